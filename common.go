@@ -24,6 +24,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/uDisguise/disguise/disguise"
+	"github.com/uDisguise/disguise/disguise/profile"
 	"github.com/uDisguise/disguise/internal/godebug"
 )
 
@@ -92,6 +94,11 @@ const (
 	extensionSignatureAlgorithms     uint16 = 13
 	extensionALPN                    uint16 = 16
 	extensionSCT                     uint16 = 18
+	extensionPadding                 uint16 = 21
+	extensionExtendedMasterSecret    uint16 = 23
+	extensionCompressCertificate     uint16 = 27
+	extensionRecordSizeLimit         uint16 = 28
+	extensionDelegatedCredentials    uint16 = 34
 	extensionSessionTicket           uint16 = 35
 	extensionPreSharedKey            uint16 = 41
 	extensionEarlyData               uint16 = 42
@@ -101,6 +108,9 @@ const (
 	extensionCertificateAuthorities  uint16 = 47
 	extensionSignatureAlgorithmsCert uint16 = 50
 	extensionKeyShare                uint16 = 51
+	extensionApplicationSettings     uint16 = 17513
+	extensionECHOuterExtensions      uint16 = 0xfd00
+	extensionEncryptedClientHello    uint16 = 0xfe0d
 	extensionRenegotiationInfo       uint16 = 0xff01
 )
 
@@ -241,6 +251,21 @@ type ConnectionState struct {
 	// the client. It's available both on the server and on the client side.
 	ServerName string
 
+	// ECHAccepted is true if the server accepted the Encrypted Client Hello
+	// of the client, so that ServerName was never sent in the clear.
+	ECHAccepted bool
+
+	// EarlyDataAccepted is true if the server accepted the 0-RTT data the
+	// client sent with Conn.WriteEarlyData. An attacker can replay such data
+	// to the server, which should only act on it in ways that are safe to
+	// repeat. On the server, Read returns it before any other data.
+	EarlyDataAccepted bool
+
+	// Disguise describes the Disguise layer of the connection. A
+	// VerifyConnection callback can refuse connections on which Disguise
+	// was not negotiated.
+	Disguise DisguiseState
+
 	// PeerCertificates are the parsed certificates sent by the peer, in the
 	// order in which they were sent. The first element is the leaf certificate
 	// that the connection is verified against.
@@ -280,6 +305,39 @@ type ConnectionState struct {
 	ekm func(label string, context []byte, length int) ([]byte, error)
 }
 
+// DisguiseState describes the Disguise layer of a connection.
+type DisguiseState struct {
+	// Version is the Disguise protocol version negotiated in the
+	// handshake, or zero if it was not negotiated.
+	Version uint8
+
+	// Enabled is true if the application data of the connection is carried
+	// in Disguise cells, which is the case once Disguise was negotiated,
+	// unless the server forwards the client to its decoy or either side
+	// switched to DisguiseProfileOff.
+	Enabled bool
+
+	// The fields below are only set once the Disguise layer started, at the
+	// end of the handshake.
+
+	// Profile is the active traffic profile, and ProfileName its name, as
+	// returned by Conn.DisguiseProfile.
+	Profile     profile.TrafficType
+	ProfileName string
+
+	// Prediction is the traffic type the classifier last found most likely
+	// for the connection, with a posterior probability of Confidence, which
+	// is zero until its first prediction.
+	Prediction profile.TrafficType
+	Confidence float64
+
+	// CoverPolicy is the name of the active cover traffic policy.
+	CoverPolicy string
+
+	// Metrics counts the cells of the connection.
+	Metrics disguise.MetricsSnapshot
+}
+
 // ExportKeyingMaterial returns length bytes of exported key material in a new
 // slice as defined in RFC 5705. If context is nil, it is not used as part of
 // the seed. If the connection was set to allow renegotiation via
@@ -288,6 +346,19 @@ func (cs *ConnectionState) ExportKeyingMaterial(label string, context []byte, le
 	return cs.ekm(label, context, length)
 }
 
+// DisguiseFailureMode selects how a connection reacts to a fatal Disguise
+// error.
+type DisguiseFailureMode int
+
+const (
+	// DisguiseFailureClose closes the underlying connection without
+	// sending anything to the peer.
+	DisguiseFailureClose DisguiseFailureMode = iota
+	// DisguiseFailureAlert sends the alert in Config.DisguiseAlert before
+	// the connection fails.
+	DisguiseFailureAlert
+)
+
 // ClientAuthType declares the policy the server will follow for
 // TLS Client Authentication.
 type ClientAuthType int
@@ -344,6 +415,11 @@ type ClientSessionState struct {
 	nonce  []byte    // Ticket nonce sent by the server, to derive PSK
 	useBy  time.Time // Expiration of the ticket lifetime as set by the server
 	ageAdd uint32    // Random obfuscation factor for sending the ticket age
+
+	maxEarlyData uint32 // Largest amount of 0-RTT data the server accepts with the ticket
+	alpn         string // Application protocol negotiated for the session
+
+	disguise disguiseSession // Disguise state of the connection that received the ticket
 }
 
 // ClientSessionCache is a cache of ClientSessionState objects that can be used
@@ -669,6 +745,26 @@ type Config struct {
 	// also disabled if ClientSessionCache is nil.
 	SessionTicketsDisabled bool
 
+	// MaxEarlyData is the largest amount of TLS 1.3 0-RTT data, in bytes, a
+	// server accepts from clients resuming a session, which its session
+	// tickets advertise. When it accepts early data, the server handshake
+	// completes without waiting for the client's Finished message, which
+	// Read checks once it has returned the early data. Zero, the default,
+	// disables 0-RTT. See Conn.WriteEarlyData.
+	MaxEarlyData uint32
+
+	// EarlyDataReplayWindow is how far the ticket age a client reports may
+	// be off from the one the server expects for its 0-RTT data to be
+	// accepted. Together with EarlyDataReplayCache, it keeps an attacker
+	// from replaying 0-RTT data. If zero, 10 seconds is used.
+	EarlyDataReplayWindow time.Duration
+
+	// EarlyDataReplayCache records the session tickets the server accepted
+	// 0-RTT data with, so that each ticket is used for 0-RTT data only once.
+	// Servers that share session ticket keys should share it. If nil, a
+	// cache private to this Config is used.
+	EarlyDataReplayCache EarlyDataReplayCache
+
 	// SessionTicketKey is used by TLS servers to provide session resumption.
 	// See RFC 5077 and the PSK mode of RFC 8446. If zero, it will be filled
 	// with random data before the first server handshake.
@@ -725,7 +821,91 @@ type Config struct {
 	// used for debugging.
 	KeyLogWriter io.Writer
 
-	// mutex protects sessionTicketKeys and autoSessionTicketKeys.
+	// ClientHelloSpec, if not nil, shapes the ClientHello sent by a client
+	// after a browser's, rather than this package's own. See
+	// ChromeClientHelloSpec, FirefoxClientHelloSpec and
+	// SafariClientHelloSpec.
+	ClientHelloSpec *ClientHelloSpec
+
+	// GREASE, if true, makes a client that has no ClientHelloSpec add
+	// GREASE values (RFC 8701) to its ClientHello, like browsers do, so
+	// that servers that choke on unknown values are noticed. A
+	// ClientHelloSpec places GREASE values with GREASEPlaceholder instead.
+	GREASE bool
+
+	// ClientHelloLengths, if not empty, are the lengths a client pads its
+	// ClientHello to with the padding extension (RFC 7685), such as the
+	// sizes browsers send. The shortest length the ClientHello fits in is
+	// used, and a ClientHello that fits in none is sent unpadded. Lengths
+	// count the handshake message and its four byte header, but not the
+	// record header. They take precedence over ClientHelloSpec.Padding.
+	ClientHelloLengths []int
+
+	// ServerHelloSpec, if not nil, shapes the handshake of a server after a
+	// common server stack's, rather than this package's own. See
+	// NginxServerHelloSpec and CloudflareServerHelloSpec.
+	ServerHelloSpec *ServerHelloSpec
+
+	// EncryptedClientHelloConfigList, if not nil, is the ECHConfigList a
+	// client encrypts its ClientHello with, so that ServerName and the other
+	// sensitive extensions are only seen by the server, behind the public
+	// name of its configuration. It requires TLS 1.3. If the server rejects
+	// it, the handshake fails with an ECHRejectionError.
+	EncryptedClientHelloConfigList []byte
+
+	// EncryptedClientHelloKeys are the keys a server decrypts Encrypted
+	// Client Hellos with. See NewEncryptedClientHelloKey.
+	EncryptedClientHelloKeys []EncryptedClientHelloKey
+
+	// Disguise optionally configures the Disguise layer of connections
+	// using this Config, such as a rate limiter shared between them. If
+	// nil, the defaults are used, which do not limit the rate of the
+	// connections; see disguise.Config.Rate.
+	Disguise *disguise.Config
+
+	// DisguiseMetrics, if not nil, is called when the Disguise layer of a
+	// connection starts, before the handshake completes, and returns the
+	// hook that receives its events, or nil. It overrides Disguise.Metrics.
+	DisguiseMetrics func(ConnectionState) disguise.Metrics
+
+	// DisguiseFailure selects how a connection reacts to a fatal Disguise
+	// error, such as a cell that cannot be decoded. The default closes the
+	// transport silently.
+	DisguiseFailure DisguiseFailureMode
+
+	// DisguiseAlert is the alert description sent when DisguiseFailure is
+	// DisguiseFailureAlert. The zero value sends close_notify, like an
+	// ordinary server shutting the connection down.
+	DisguiseAlert uint8
+
+	// DisguiseSecret is the secret shared by Disguise clients and servers.
+	// A client proves knowledge of it with a MAC over its random and the
+	// current time, carried in the legacy_session_id of the ClientHello, and
+	// a server activates Disguise only for clients that do. It rejects
+	// tokens made more than a couple of minutes off its own clock, and
+	// those it has already accepted, so Config.Time should be accurate on
+	// both ends. A server without any secret, set
+	// here or with SetDisguiseKeys, activates it for every client. Either
+	// way the server confirms activation in its random, and connections
+	// that are not confirmed carry plain TLS application data. A client
+	// with a secret only accepts a confirmation made with it, so it does
+	// not activate Disguise with a server that has none.
+	DisguiseSecret []byte
+
+	// DisguiseDecoy, if not nil, makes a server that has Disguise keys
+	// forward every client that does not present a valid token to the
+	// connection it returns, so that a prober sees an ordinary website. The
+	// decision is made right after GetConfigForClient, before any Disguise
+	// state is created, and the handshake returns ErrDecoyForwarded once
+	// the forwarded session is over.
+	DisguiseDecoy func(ctx context.Context) (net.Conn, error)
+
+	// DisguiseDecoyMode selects whether DisguiseDecoy receives the raw
+	// connection or the decrypted application data.
+	DisguiseDecoyMode DecoyMode
+
+	// mutex protects sessionTicketKeys, autoSessionTicketKeys,
+	// disguiseKeyList, earlyDataReplayCache and disguiseRandoms.
 	mutex sync.RWMutex
 	// sessionTicketKeys contains zero or more ticket keys. If set, it means the
 	// the keys were set with SessionTicketKey or SetSessionTicketKeys. The
@@ -736,6 +916,15 @@ type Config struct {
 	// autoSessionTicketKeys is like sessionTicketKeys but is owned by the
 	// auto-rotation logic. See Config.ticketKeys.
 	autoSessionTicketKeys []ticketKey
+	// disguiseKeyList contains the keys set with SetDisguiseKeys. The slice
+	// contents are not protected by the mutex and are immutable.
+	disguiseKeyList [][]byte
+	// earlyDataReplayCache is the cache used if EarlyDataReplayCache is nil,
+	// created on first use.
+	earlyDataReplayCache EarlyDataReplayCache
+	// disguiseRandoms records the client randoms of the Disguise tokens
+	// accepted in the last disguiseReplayWindow, created on first use.
+	disguiseRandoms EarlyDataReplayCache
 }
 
 const (
@@ -788,34 +977,53 @@ func (c *Config) Clone() *Config {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 	return &Config{
-		Rand:                        c.Rand,
-		Time:                        c.Time,
-		Certificates:                c.Certificates,
-		NameToCertificate:           c.NameToCertificate,
-		GetCertificate:              c.GetCertificate,
-		GetClientCertificate:        c.GetClientCertificate,
-		GetConfigForClient:          c.GetConfigForClient,
-		VerifyPeerCertificate:       c.VerifyPeerCertificate,
-		VerifyConnection:            c.VerifyConnection,
-		RootCAs:                     c.RootCAs,
-		NextProtos:                  c.NextProtos,
-		ServerName:                  c.ServerName,
-		ClientAuth:                  c.ClientAuth,
-		ClientCAs:                   c.ClientCAs,
-		InsecureSkipVerify:          c.InsecureSkipVerify,
-		CipherSuites:                c.CipherSuites,
-		PreferServerCipherSuites:    c.PreferServerCipherSuites,
-		SessionTicketsDisabled:      c.SessionTicketsDisabled,
-		SessionTicketKey:            c.SessionTicketKey,
-		ClientSessionCache:          c.ClientSessionCache,
-		MinVersion:                  c.MinVersion,
-		MaxVersion:                  c.MaxVersion,
-		CurvePreferences:            c.CurvePreferences,
-		DynamicRecordSizingDisabled: c.DynamicRecordSizingDisabled,
-		Renegotiation:               c.Renegotiation,
-		KeyLogWriter:                c.KeyLogWriter,
-		sessionTicketKeys:           c.sessionTicketKeys,
-		autoSessionTicketKeys:       c.autoSessionTicketKeys,
+		Rand:                           c.Rand,
+		Time:                           c.Time,
+		Certificates:                   c.Certificates,
+		NameToCertificate:              c.NameToCertificate,
+		GetCertificate:                 c.GetCertificate,
+		GetClientCertificate:           c.GetClientCertificate,
+		GetConfigForClient:             c.GetConfigForClient,
+		VerifyPeerCertificate:          c.VerifyPeerCertificate,
+		VerifyConnection:               c.VerifyConnection,
+		RootCAs:                        c.RootCAs,
+		NextProtos:                     c.NextProtos,
+		ServerName:                     c.ServerName,
+		ClientAuth:                     c.ClientAuth,
+		ClientCAs:                      c.ClientCAs,
+		InsecureSkipVerify:             c.InsecureSkipVerify,
+		CipherSuites:                   c.CipherSuites,
+		PreferServerCipherSuites:       c.PreferServerCipherSuites,
+		SessionTicketsDisabled:         c.SessionTicketsDisabled,
+		MaxEarlyData:                   c.MaxEarlyData,
+		EarlyDataReplayWindow:          c.EarlyDataReplayWindow,
+		EarlyDataReplayCache:           c.EarlyDataReplayCache,
+		SessionTicketKey:               c.SessionTicketKey,
+		ClientSessionCache:             c.ClientSessionCache,
+		MinVersion:                     c.MinVersion,
+		MaxVersion:                     c.MaxVersion,
+		CurvePreferences:               c.CurvePreferences,
+		DynamicRecordSizingDisabled:    c.DynamicRecordSizingDisabled,
+		Renegotiation:                  c.Renegotiation,
+		KeyLogWriter:                   c.KeyLogWriter,
+		ClientHelloSpec:                c.ClientHelloSpec,
+		GREASE:                         c.GREASE,
+		ClientHelloLengths:             c.ClientHelloLengths,
+		ServerHelloSpec:                c.ServerHelloSpec,
+		EncryptedClientHelloConfigList: c.EncryptedClientHelloConfigList,
+		EncryptedClientHelloKeys:       c.EncryptedClientHelloKeys,
+		Disguise:                       c.Disguise,
+		DisguiseMetrics:                c.DisguiseMetrics,
+		DisguiseFailure:                c.DisguiseFailure,
+		DisguiseAlert:                  c.DisguiseAlert,
+		DisguiseSecret:                 c.DisguiseSecret,
+		DisguiseDecoy:                  c.DisguiseDecoy,
+		DisguiseDecoyMode:              c.DisguiseDecoyMode,
+		sessionTicketKeys:              c.sessionTicketKeys,
+		autoSessionTicketKeys:          c.autoSessionTicketKeys,
+		disguiseKeyList:                c.disguiseKeyList,
+		earlyDataReplayCache:           c.earlyDataReplayCache,
+		disguiseRandoms:                c.disguiseRandoms,
 	}
 }
 
@@ -1323,6 +1531,7 @@ func (c *Config) BuildNameToCertificate() {
 
 const (
 	keyLogLabelTLS12           = "CLIENT_RANDOM"
+	keyLogLabelClientEarly     = "CLIENT_EARLY_TRAFFIC_SECRET"
 	keyLogLabelClientHandshake = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelServerHandshake = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
 	keyLogLabelClientTraffic   = "CLIENT_TRAFFIC_SECRET_0"
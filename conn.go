@@ -17,6 +17,7 @@ import (
 	"hash"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -57,6 +58,11 @@ type Conn struct {
 	verifiedChains [][]*x509.Certificate
 	// serverName contains the server name indicated by the client, if any.
 	serverName string
+	// echAccepted is true if the server accepted the Encrypted Client Hello.
+	echAccepted bool
+	// echPublicName is set by a client whose Encrypted Client Hello was
+	// rejected to the public name the server is authenticated against.
+	echPublicName string
 	// secureRenegotiation is true if the server echoed the secure
 	// renegotiation extension. (This is meaningless as a server because
 	// renegotiation is not supported in that case.)
@@ -64,8 +70,11 @@ type Conn struct {
 	// ekm is a closure for exporting keying material.
 	ekm func(label string, context []byte, length int) ([]byte, error)
 	// resumptionSecret is the resumption_master_secret for handling
-	// NewSessionTicket messages. nil if config.SessionTicketsDisabled.
+	// NewSessionTicket messages, or on a server, for sending them. nil if
+	// config.SessionTicketsDisabled. ticketsSent counts the tickets a TLS
+	// 1.3 server sent, which number their nonces.
 	resumptionSecret []byte
+	ticketsSent      uint64
 
 	// ticketKeys is the set of active session ticket keys for this
 	// connection. The first one is used to encrypt new tickets and
@@ -119,8 +128,55 @@ type Conn struct {
 
 	tmp [16]byte
 
-	// disguiseManager handles all the disguise protocol logic.
+	// disguiseVersion is the Disguise protocol version activated by the
+	// handshake, or zero if the connection carries plain TLS application
+	// data. disguiseKey is the key that authenticated the client, nil if
+	// the server accepts every client.
+	disguiseVersion uint8
+	disguiseKey     []byte
+	// disguiseManager handles all the disguise protocol logic. It is nil
+	// unless Disguise was activated.
 	disguiseManager *disguise.Manager
+	// disguiseResumed is the Disguise state of the session this connection
+	// resumed, restored by initDisguise.
+	disguiseResumed disguiseSession
+	// disguiseInput holds reassembled application data not yet returned
+	// by Read. Protected by in.Mutex.
+	disguiseInput bytes.Buffer
+	// disguiseOutOff and disguiseInOff are set once the last cell of this
+	// side, and of the peer, was sent after DisguiseProfileOff. The records
+	// that follow carry application data as is. Protected by out.Mutex and
+	// in.Mutex respectively.
+	disguiseOutOff bool
+	disguiseInOff  bool
+	// disguiseDeadline is the write deadline, which drainDisguise honours
+	// while the rate limiters hold cells back.
+	disguiseDeadline deadline
+
+	// earlyData is the data a client queued with WriteEarlyData, and
+	// earlyDataAccepted is whether the server accepted it as 0-RTT data.
+	// earlyDisguise is the Manager that framed accepted early data, which
+	// initDisguise adopts.
+	earlyData         []byte
+	earlyDataAccepted bool
+	earlyDisguise     *disguise.Manager
+	// earlyEKM is the early exporter of a connection that sent or accepted
+	// early data, which keys the Disguise cells of the early data only.
+	earlyEKM func(label string, context []byte, length int) ([]byte, error)
+	// earlyHandshake is set on a server that accepted early data until Read
+	// reaches the end of it, and earlyDataLeft is how much more of it the
+	// client may send. skipEarlyData is how many bytes of rejected early
+	// data the server may still skip. Protected by in.Mutex.
+	earlyHandshake *serverHandshakeStateTLS13
+	earlyDataLeft  uint32
+	skipEarlyData  uint32
+
+	// recordingHello is set while a server reads the first flight, which
+	// is then kept in helloBytes for DecoyForwardTCP. decoy is the backend
+	// connection of a client served in DecoyForwardTLS mode.
+	recordingHello bool
+	helloBytes     []byte
+	decoy          net.Conn
 }
 
 // Access to net.Conn methods.
@@ -141,6 +197,7 @@ func (c *Conn) RemoteAddr() net.Addr {
 // A zero value for t means Read and Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetDeadline(t time.Time) error {
+	c.disguiseDeadline.set(t)
 	return c.conn.SetDeadline(t)
 }
 
@@ -154,6 +211,7 @@ func (c *Conn) SetReadDeadline(t time.Time) error {
 // A zero value for t means Write will not time out.
 // After a Write has timed out, the TLS state is corrupt and all future writes will return the same error.
 func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.disguiseDeadline.set(t)
 	return c.conn.SetWriteDeadline(t)
 }
 
@@ -672,6 +730,9 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 	record := c.rawInput.Next(recordHeaderLen + n)
 	data, typ, err := c.in.decrypt(record)
 	if err != nil {
+		if c.skipEarlyDataLocked(recordType(record[0]), n) {
+			return c.readRecordOrCCS(expectChangeCipherSpec)
+		}
 		return c.in.setErrorLocked(c.sendAlert(err.(alert)))
 	}
 	if len(data) > maxPlaintext {
@@ -680,8 +741,17 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 
 	// Application Data messages are always protected.
 	if c.in.cipher == nil && typ == recordTypeApplicationData {
+		if c.skipEarlyDataLocked(typ, n) {
+			return c.readRecordOrCCS(expectChangeCipherSpec)
+		}
 		return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 	}
+	if c.in.cipher != nil && typ != recordTypeChangeCipherSpec {
+		// Rejected early data ends with the first record protected with
+		// the handshake keys. In TLS 1.3, ChangeCipherSpec records are
+		// never protected.
+		c.skipEarlyData = 0
+	}
 
 	if typ != recordTypeAlert && typ != recordTypeChangeCipherSpec && len(data) > 0 {
 		// This is a state-advancing message: reset the retry count.
@@ -744,6 +814,12 @@ func (c *Conn) readRecordOrCCS(expectChangeCipherSpec bool) error {
 		if !handshakeComplete || expectChangeCipherSpec {
 			return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
 		}
+		if c.earlyHandshake != nil {
+			if uint32(len(data)) > c.earlyDataLeft {
+				return c.in.setErrorLocked(c.sendAlert(alertUnexpectedMessage))
+			}
+			c.earlyDataLeft -= uint32(len(data))
+		}
 		// Some OpenSSL servers send empty records in order to randomize the
 		// CBC IV. Ignore a limited number of empty records.
 		if len(data) == 0 {
@@ -809,7 +885,11 @@ func (c *Conn) readFromUntil(r io.Reader, n int) error {
 	// attempt to fetch it so that it can be used in (*Conn).Read to
 	// "predict" closeNotify alerts.
 	c.rawInput.Grow(needs + bytes.MinRead)
+	before := c.rawInput.Len()
 	_, err := c.rawInput.ReadFrom(&atLeastReader{r, int64(needs)})
+	if c.recordingHello {
+		c.helloBytes = append(c.helloBytes, c.rawInput.Bytes()[before:]...)
+	}
 	return err
 }
 
@@ -1155,6 +1235,14 @@ func (c *Conn) handlePostHandshakeMessage() error {
 		return c.handleRenegotiation()
 	}
 
+	if hs := c.earlyHandshake; hs != nil {
+		c.earlyHandshake = nil
+		if err := hs.readEndOfEarlyData(); err != nil {
+			return c.in.setErrorLocked(err)
+		}
+		return nil
+	}
+
 	msg, err := c.readHandshake()
 	if err != nil {
 		return err
@@ -1190,22 +1278,98 @@ func (c *Conn) handleKeyUpdate(keyUpdate *keyUpdateMsg) error {
 		c.out.Lock()
 		defer c.out.Unlock()
 
-		msg := &keyUpdateMsg{}
-		_, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal())
-		if err != nil {
-			// Surface the error at the next write.
-			c.out.setErrorLocked(err)
-			return nil
-		}
+		// Surface any error at the next write.
+		c.sendKeyUpdateLocked(false)
+	}
+
+	return nil
+}
 
-		newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
-		c.out.setTrafficSecret(cipherSuite, newSecret)
+// UpdateKeys sends a TLS 1.3 KeyUpdate message, which switches the keys
+// protecting the records written from now on and asks the peer to switch
+// the keys it writes with as well. Discarding used keys provides forward
+// secrecy within long-lived connections. Connections using Disguise can
+// also send KeyUpdates on their own, as scheduled by the KeyUpdate policy
+// of Config.Disguise.
+//
+// UpdateKeys returns an error if the handshake is not complete or did not
+// negotiate TLS 1.3.
+func (c *Conn) UpdateKeys() error {
+	if !c.handshakeComplete() {
+		return errors.New("tls: UpdateKeys called before the handshake completed")
+	}
+	if c.vers != VersionTLS13 {
+		return errors.New("tls: UpdateKeys requires TLS 1.3")
 	}
 
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closeNotifySent {
+		return errShutdown
+	}
+	return c.sendKeyUpdateLocked(true)
+}
+
+// sendKeyUpdateLocked writes a KeyUpdate message and switches to the next
+// write key. If requestPeer is set, the peer is asked to do the same for its
+// own write key. c.out must be locked.
+func (c *Conn) sendKeyUpdateLocked(requestPeer bool) error {
+	cipherSuite := cipherSuiteTLS13ByID(c.cipherSuite)
+	if cipherSuite == nil {
+		return c.out.setErrorLocked(c.sendAlertLocked(alertInternalError))
+	}
+
+	msg := &keyUpdateMsg{updateRequested: requestPeer}
+	if _, err := c.writeRecordLocked(recordTypeHandshake, msg.marshal()); err != nil {
+		return c.out.setErrorLocked(err)
+	}
+
+	newSecret := cipherSuite.nextTrafficSecret(c.out.trafficSecret)
+	c.out.setTrafficSecret(cipherSuite, newSecret)
 	return nil
 }
 
+// SendSessionTicket sends the client a new TLS 1.3 session ticket. A ticket
+// carries the Disguise state of the connection at the time it is sent, and
+// the client stores its own alongside it, so that a connection resuming the
+// session continues that persona. The tickets sent with the handshake only
+// carry the state the connection started with; a server calls
+// SendSessionTicket once the connection has carried traffic to pass on what
+// the Disguise layer learned since.
+//
+// SendSessionTicket returns an error on a client, if the handshake is not
+// complete or did not negotiate TLS 1.3, or if the server does not send
+// tickets on this connection.
+func (c *Conn) SendSessionTicket() error {
+	if c.isClient {
+		return errors.New("tls: SendSessionTicket called on a client")
+	}
+	if !c.handshakeComplete() {
+		return errors.New("tls: SendSessionTicket called before the handshake completed")
+	}
+	if c.vers != VersionTLS13 {
+		return errors.New("tls: SendSessionTicket requires TLS 1.3")
+	}
+	if c.resumptionSecret == nil {
+		return errors.New("tls: session tickets are not sent on this connection")
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+	if c.closeNotifySent {
+		return errShutdown
+	}
+	return c.sendSessionTicketLocked()
+}
+
 // Read reads application data from the connection.
+//
+// Every application data record carries one Disguise cell. Cells are handed
+// to the Disguise Manager, and Read returns once a complete message has been
+// reassembled. Cells that are dropped by replay protection or lost to a
+// reassembly gap are skipped without any reaction visible to the peer; fatal
+// Disguise errors tear the connection down as selected by
+// Config.DisguiseFailure.
 func (c *Conn) Read(b []byte) (n int, err error) {
 	// 确保握手完成
 	if err := c.HandshakeContext(context.Background()); err != nil {
@@ -1214,85 +1378,116 @@ func (c *Conn) Read(b []byte) (n int, err error) {
 	if atomic.LoadUint32(&c.handshakeStatus) != 1 {
 		return 0, c.handshakeErr
 	}
+	if len(b) == 0 {
+		// Put this after Handshake, in case people were calling
+		// Read(nil) for the side effect of the Handshake.
+		return 0, nil
+	}
 
-	for {
-		c.in.Lock()
+	c.in.Lock()
+	defer c.in.Unlock()
+
+	if c.disguiseManager == nil {
+		return c.readPlainLocked(b)
+	}
+
+	for c.disguiseInput.Len() == 0 {
 		// 从 Disguise Manager 读取解封装后的应用层数据
-		plaintext, err := c.disguiseManager.ReadApplicationData()
-		if err == nil && len(plaintext) > 0 {
-			c.in.Unlock()
-			n = copy(b, plaintext)
-			return n, nil
+		plaintext, _ := c.disguiseManager.ReadApplicationData()
+		if len(plaintext) > 0 {
+			c.disguiseInput.Write(plaintext)
+			break
+		}
+		if c.disguiseInOff {
+			return c.readPlainLocked(b)
 		}
-		c.in.Unlock()
 
 		// 如果没有待读取的应用数据，则从网络读取新的 TLS 记录
-		record, typ, err := c.readAndDecryptRecord()
-		if err != nil {
+		if err := c.readRecord(); err != nil {
 			return 0, err
 		}
-
-		// 将解密后的 TLS 记录内容传递给 Disguise Manager 进行解封装
-		// 这里的 `record` 是 `c.in.decrypt` 返回的 `plaintext`
-		if typ == recordTypeApplicationData {
-			err = c.disguiseManager.ProcessInboundTraffic(record)
-			if err != nil {
-				// 如果处理失败，可能是一个攻击或协议错误，直接返回
-				c.sendAlert(alertBadRecordMAC)
+		for c.hand.Len() > 0 {
+			if err := c.handlePostHandshakeMessage(); err != nil {
 				return 0, err
 			}
-			// 再次尝试从 Disguise Manager 读取应用数据
+		}
+		if c.input.Len() == 0 {
 			continue
-		} else {
-			// 如果不是应用数据，按照原有逻辑处理（如握手、心跳等）
-			switch typ {
-			case recordTypeAlert:
-				var v alert
-				if len(record) == 2 {
-					v = alert(record[1])
-				}
-				if v == alertCloseNotify {
-					c.in.setErrorLocked(io.EOF)
-					return 0, io.EOF
-				}
-				c.in.setErrorLocked(&RecordHeaderError{
-					Msg: fmt.Sprintf("unexpected alert %s", v),
-				})
-				c.sendAlert(alertUnexpectedMessage)
-				return 0, c.in.err
-			case recordTypeChangeCipherSpec:
-				// As a client, we might receive a CCS record, for example,
-				// after an old-style renegotiation. TLS 1.3 does not use
-				// this record type.
-				if c.vers == VersionTLS13 {
-					c.in.setErrorLocked(&RecordHeaderError{
-						Msg: "unexpected ChangeCipherSpec record",
-					})
-					c.sendAlert(alertUnexpectedMessage)
-					return 0, c.in.err
-				}
-				// A server might receive a CCS record after a client
-				// sends one, but the client won't receive a second one.
-				// This code can be simplified in a real implementation.
-				c.in.setErrorLocked(&RecordHeaderError{
-					Msg: "unexpected ChangeCipherSpec record",
-				})
-				c.sendAlert(alertUnexpectedMessage)
-				return 0, c.in.err
+		}
+
+		// 将解密后的 TLS 记录内容传递给 Disguise Manager 进行解封装
+		record := make([]byte, c.input.Len())
+		c.input.Read(record)
+		if err := c.disguiseManager.ProcessInboundTraffic(record); err != nil {
+			switch disguise.ClassOf(err) {
+			case disguise.Recoverable, disguise.DropSilently:
+				continue
 			default:
-				// Any other record type is unexpected after the handshake.
-				c.in.setErrorLocked(&RecordHeaderError{
-					Msg: fmt.Sprintf("unexpected record type %d", typ),
-				})
-				c.sendAlert(alertUnexpectedMessage)
-				return 0, c.in.err
+				return 0, c.disguiseFailureLocked(err)
+			}
+		}
+		// After the last cell of the peer, its records carry application
+		// data as is.
+		c.disguiseInOff = c.disguiseManager.PeerOff()
+	}
+
+	n, _ = c.disguiseInput.Read(b)
+	return n, nil
+}
+
+// readPlainLocked reads application data from a connection on which
+// Disguise was not activated. c.in must be locked.
+func (c *Conn) readPlainLocked(b []byte) (int, error) {
+	for c.input.Len() == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+		for c.hand.Len() > 0 {
+			if err := c.handlePostHandshakeMessage(); err != nil {
+				return 0, err
 			}
 		}
 	}
+	n, _ := c.input.Read(b)
+	return n, nil
+}
+
+// disguiseFailureLocked tears the connection down after a fatal Disguise
+// error. Rather than a distinctive alert that an active prober could
+// trigger, it either closes the transport silently or sends the alert
+// configured in Config.DisguiseAlert. c.in must be locked.
+func (c *Conn) disguiseFailureLocked(err error) error {
+	c.disguiseManager.Close()
+	switch c.config.DisguiseFailure {
+	case DisguiseFailureAlert:
+		c.sendAlert(alert(c.config.DisguiseAlert))
+	default:
+		c.conn.Close()
+	}
+	return c.in.setErrorLocked(err)
 }
 
 // Write writes application data to the connection.
+//
+// The data is fragmented into Disguise cells and Write blocks until the
+// scheduler has released all of them it can, which may take a while if
+// disguise.Config.Rate or the active profile caps the connection's rate.
+// Under a Conversation model, Write may return with cells still queued
+// while the Conversation waits for the peer's turn to end; they are sent by
+// the connection in the background once it does.
 func (c *Conn) Write(b []byte) (n int, err error) {
+	// interlock with Close below
+	for {
+		x := atomic.LoadInt32(&c.activeCall)
+		if x&1 != 0 {
+			return 0, net.ErrClosed
+		}
+		if atomic.CompareAndSwapInt32(&c.activeCall, x, x+2) {
+			break
+		}
+	}
+	defer atomic.AddInt32(&c.activeCall, -2)
+
 	// 确保握手完成
 	if err := c.HandshakeContext(context.Background()); err != nil {
 		return 0, err
@@ -1301,95 +1496,279 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 		return 0, c.handshakeErr
 	}
 
+	c.out.Lock()
+	if err := c.out.err; err != nil {
+		c.out.Unlock()
+		return 0, err
+	}
+	if c.closeNotifySent {
+		c.out.Unlock()
+		return 0, errShutdown
+	}
+	if c.disguiseManager == nil || c.disguiseOutOff {
+		defer c.out.Unlock()
+		n, err := c.writeRecordLocked(recordTypeApplicationData, b)
+		return n, c.out.setErrorLocked(err)
+	}
+	c.out.Unlock()
+
 	// 将应用数据分块并交给 Disguise Manager 进行封装
 	err = c.disguiseManager.QueueApplicationData(b)
+	if err == disguise.ErrPassThrough {
+		// The last cell was sent, and c.disguiseOutOff set, since.
+		c.out.Lock()
+		defer c.out.Unlock()
+		n, err := c.writeRecordLocked(recordTypeApplicationData, b)
+		return n, c.out.setErrorLocked(err)
+	}
 	if err != nil {
 		return 0, err
 	}
 
-	// 持续从 Disguise Manager 获取待发送的伪装数据包
-	// 并发送到网络
-	for {
-		packet, err := c.disguiseManager.GetOutboundTraffic()
-		if err == disguise.ErrNoOutboundTraffic {
-			// 如果没有更多待发送数据，则退出循环
-			break
+	// 持续从 Disguise Manager 获取待发送的伪装数据包并发送到网络，
+	// 被限速时等待令牌桶补充
+	if err := c.drainDisguise(); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// initDisguise creates the Disguise Manager of a connection on which the
+// handshake activated Disguise, keyed with a secret exported from the
+// connection, or adopts the one that framed the accepted early data, and
+// starts flushing the cells it queues in the background. It is called just
+// before the handshake is marked complete, so that Read and Write always
+// find the Manager in place.
+func (c *Conn) initDisguise() error {
+	if c.disguiseVersion == 0 || c.disguiseManager != nil || c.decoy != nil {
+		return nil
+	}
+	if c.earlyDisguise != nil {
+		c.disguiseManager, c.earlyDisguise = c.earlyDisguise, nil
+	} else {
+		m := c.newDisguiseManager()
+		// A server that accepted Disguise early data decodes it with the
+		// early keys, until readEndOfEarlyData moves the receiving
+		// direction to the keys of the handshake, which every other cell
+		// uses. The peers agree on SharedRand from the early secret.
+		early := c.earlyDataAccepted && c.earlyEKM != nil
+		ekm := c.ekm
+		if early {
+			ekm = c.earlyEKM
+		}
+		err := c.keyDisguise(m, ekm)
+		if err == nil && early {
+			err = c.rekeyDisguise(m, true, false)
 		}
 		if err != nil {
-			return 0, err
+			m.Close()
+			c.sendAlert(alertInternalError)
+			return err
 		}
+		c.disguiseManager = m
+		c.restoreDisguise()
+	}
+	go c.disguiseFlushLoop(c.disguiseManager)
+	return nil
+}
 
-		// 使用原始的 TLS 加密逻辑对伪装数据包进行加密
-		// 这里的 `recordTypeApplicationData` 是伪装数据包的类型
-		record, err := c.out.encrypt(nil, packet, c.config.rand())
-		if err != nil {
-			return 0, err
+// disguiseStateLocked returns the DisguiseState of the connection.
+func (c *Conn) disguiseStateLocked() DisguiseState {
+	state := DisguiseState{
+		Version: c.disguiseVersion,
+		Enabled: c.disguiseVersion != 0 && c.decoy == nil,
+	}
+	if m := c.disguiseManager; m != nil {
+		state.Profile = m.State().Profile
+		state.ProfileName = c.DisguiseProfile()
+		state.Enabled = state.Enabled && state.ProfileName != DisguiseProfileOff
+		state.CoverPolicy = m.CoverPolicy()
+		state.Metrics = m.Metrics()
+		state.Prediction, state.Confidence = state.Metrics.Prediction, state.Metrics.Confidence
+	}
+	return state
+}
+
+// newDisguiseManager creates a Disguise Manager with the options of the
+// Config, and the Metrics hook DisguiseMetrics returns for the connection.
+func (c *Conn) newDisguiseManager() *disguise.Manager {
+	config := c.config.Disguise
+	if c.config.DisguiseMetrics != nil {
+		if hook := c.config.DisguiseMetrics(c.connectionStateLocked()); hook != nil {
+			withHook := new(disguise.Config)
+			if config != nil {
+				*withHook = *config
+			}
+			withHook.Metrics = hook
+			config = withHook
 		}
+	}
+	return disguise.NewManagerWithConfig(config)
+}
 
-		// 发送到网络
-		if _, err := c.conn.Write(record); err != nil {
-			return 0, err
+// disguiseFlushLoop sends the cells the Manager queues on its own, such as
+// cover traffic, while the application is not writing.
+func (c *Conn) disguiseFlushLoop(m *disguise.Manager) {
+	retry := time.NewTimer(0)
+	if !retry.Stop() {
+		<-retry.C
+	}
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-m.Done():
+			return
+		case <-m.Ready():
+		case <-retry.C:
+		}
+
+		c.out.Lock()
+		err := c.flushDisguiseLocked()
+		c.out.Unlock()
+		switch err {
+		case nil:
+		case disguise.ErrOutboundThrottled:
+			retry.Reset(m.NextSendDelay())
+		default:
+			return
 		}
 	}
+}
 
-	return len(b), nil
+// deadline is a time that may change while a goroutine waits for it.
+type deadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{}
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
 }
 
-// readAndDecryptRecord is a helper function to read a TLS record, decrypt it,
-// and handle any non-application data records.
-func (c *Conn) readAndDecryptRecord() ([]byte, recordType, error) {
+// get returns the deadline, and a channel closed when it is set again.
+func (d *deadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+// drainDisguise writes the cells queued in the Disguise Manager, waiting for
+// the rate limiters to release the ones they hold back. It gives up when the
+// write deadline passes, which leaves the connection unusable for writing
+// like any other write timeout, or when the Conn is closed.
+func (c *Conn) drainDisguise() error {
+	m := c.disguiseManager
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
 	for {
-		if err := c.readRecord(); err != nil {
-			if err == io.EOF {
-				return nil, 0, err
-			}
-			return nil, 0, c.in.setErrorLocked(c.handshakeErr)
+		c.out.Lock()
+		err := c.flushDisguiseLocked()
+		if err != disguise.ErrOutboundThrottled {
+			c.out.Unlock()
+			return err
 		}
+		t, changed := c.disguiseDeadline.get()
+		if !t.IsZero() && !time.Now().Before(t) {
+			defer c.out.Unlock()
+			return c.out.setErrorLocked(os.ErrDeadlineExceeded)
+		}
+		c.out.Unlock()
 
-		// Process one record from c.rawInput
-		record, typ, err := c.in.decrypt(c.rawInput.Next(c.rawInput.Len()))
-		if err != nil {
-			c.sendAlert(err.(alert))
-			return nil, 0, err
+		wait := m.NextSendDelay()
+		if !t.IsZero() {
+			wait = min(wait, time.Until(t))
+		}
+		if timer == nil {
+			timer = time.NewTimer(wait)
+		} else {
+			timer.Reset(wait)
+		}
+		select {
+		case <-timer.C:
+		case <-changed:
+		case <-m.Done():
+			return net.ErrClosed
 		}
+	}
+}
 
-		switch typ {
-		case recordTypeAlert:
-			var v alert
-			if len(record) == 2 {
-				v = alert(record[1])
-			}
-			if v == alertCloseNotify {
-				return nil, 0, io.EOF
-			}
-			return nil, 0, &RecordHeaderError{
-				Msg: fmt.Sprintf("unexpected alert %s", v),
-			}
-		case recordTypeChangeCipherSpec:
-			// As a client, we might receive a CCS record, for example,
-			// after an old-style renegotiation. TLS 1.3 does not use
-			// this record type.
-			if c.vers == VersionTLS13 {
-				return nil, 0, &RecordHeaderError{
-					Msg: "unexpected ChangeCipherSpec record",
-				}
-			}
-			// A server might receive a CCS record after a client
-			// sends one, but the client won't receive a second one.
-			// This code can be simplified in a real implementation.
-			return nil, 0, &RecordHeaderError{
-				Msg: "unexpected ChangeCipherSpec record",
-			}
-		case recordTypeApplicationData:
-			// This is the data we want to process.
-			return record, typ, nil
-		default:
-			// Any other record type is unexpected after the handshake.
-			return nil, 0, &RecordHeaderError{
-				Msg: fmt.Sprintf("unexpected record type %d", typ),
+// flushDisguiseLocked writes every cell the Disguise scheduler releases, one
+// TLS record per cell, and the KeyUpdates its policy calls for. It returns disguise.ErrOutboundThrottled if cells
+// remain queued behind the rate limiters. c.out must be locked.
+func (c *Conn) flushDisguiseLocked() error {
+	if c.closeNotifySent {
+		return errShutdown
+	}
+	for {
+		if c.vers == VersionTLS13 && c.disguiseManager.KeyUpdateDue() {
+			if err := c.sendKeyUpdateLocked(true); err != nil {
+				return err
 			}
 		}
+		packet, err := c.disguiseManager.GetOutboundTraffic()
+		if err == disguise.ErrNoOutboundTraffic {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.writeCellLocked(packet); err != nil {
+			return c.out.setErrorLocked(err)
+		}
+		if c.disguiseManager.Off() {
+			// That was the last cell; the records that follow carry
+			// application data as is.
+			c.disguiseOutOff = true
+			return nil
+		}
+	}
+}
+
+// writeCellLocked writes a Disguise cell as a single application data record.
+// Unlike writeRecordLocked it never splits its input, so the receiver sees
+// exactly one cell per record. c.out must be locked.
+func (c *Conn) writeCellLocked(cell []byte) error {
+	if err := c.out.err; err != nil {
+		return err
+	}
+	if len(cell) > maxPlaintext {
+		return errors.New("tls: disguise cell exceeds the maximum record size")
+	}
+
+	vers := c.vers
+	if vers == VersionTLS13 {
+		// TLS 1.3 froze the record layer version to 1.2.
+		vers = VersionTLS12
 	}
+	outBuf := make([]byte, recordHeaderLen, recordHeaderLen+len(cell)+256)
+	outBuf[0] = byte(recordTypeApplicationData)
+	outBuf[1] = byte(vers >> 8)
+	outBuf[2] = byte(vers)
+	outBuf[3] = byte(len(cell) >> 8)
+	outBuf[4] = byte(len(cell))
+
+	outBuf, err := c.out.encrypt(outBuf, cell, c.config.rand())
+	if err != nil {
+		return err
+	}
+	_, err = c.write(outBuf)
+	return err
 }
 
 // Close closes the connection.
@@ -1405,6 +1784,10 @@ func (c *Conn) Close() error {
 			break
 		}
 	}
+	if c.handshakeComplete() && c.disguiseManager != nil {
+		// Stop the Disguise background loops before tearing down.
+		c.disguiseManager.Close()
+	}
 	if x != 0 {
 		// io.Writer and io.Closer should not be used concurrently.
 		// If Close is called while a Write is currently in-flight,
@@ -1572,6 +1955,9 @@ func (c *Conn) connectionStateLocked() ConnectionState {
 	state.DidResume = c.didResume
 	state.NegotiatedProtocolIsMutual = true
 	state.ServerName = c.serverName
+	state.ECHAccepted = c.echAccepted
+	state.EarlyDataAccepted = c.earlyDataAccepted
+	state.Disguise = c.disguiseStateLocked()
 	state.CipherSuite = c.cipherSuite
 	state.PeerCertificates = c.peerCertificates
 	state.VerifiedChains = c.verifiedChains
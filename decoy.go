@@ -0,0 +1,105 @@
+package tls
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// DecoyMode selects how a server hands an unauthenticated client to its
+// decoy backend.
+type DecoyMode int
+
+const (
+	// DecoyForwardTCP forwards the raw connection, starting with the bytes
+	// of the ClientHello, so the decoy terminates TLS itself. This is the
+	// mode to use when the decoy is a real HTTPS website.
+	DecoyForwardTCP DecoyMode = iota
+	// DecoyForwardTLS completes the handshake with the server's own
+	// certificate and forwards the decrypted application data. This is the
+	// mode to use when the decoy is a plaintext backend, such as an HTTP
+	// server.
+	DecoyForwardTLS
+)
+
+// ErrDecoyForwarded is returned by the server handshake once a client that
+// did not present a valid Disguise token has been served by the decoy.
+var ErrDecoyForwarded = errors.New("tls: client was forwarded to the Disguise decoy")
+
+// serveDecoyTCP replays the first flight read from the client to the decoy
+// and then splices the two connections until either side is done.
+func (c *Conn) serveDecoyTCP(ctx context.Context) error {
+	backend, err := c.config.DisguiseDecoy(ctx)
+	if err != nil {
+		c.conn.Close()
+		return err
+	}
+	defer backend.Close()
+
+	if _, err := backend.Write(c.helloBytes); err != nil {
+		c.conn.Close()
+		return err
+	}
+	c.helloBytes = nil
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		io.Copy(c.conn, backend)
+		c.conn.Close()
+	}()
+	io.Copy(backend, c.conn)
+	backend.Close()
+	wg.Wait()
+
+	return ErrDecoyForwarded
+}
+
+// serveDecoyTLS relays application data between the client, over the TLS
+// session that was just established, and the decoy backend. c.in must be
+// locked, as it is for the duration of the handshake.
+func (c *Conn) serveDecoyTLS() error {
+	backend := c.decoy
+	defer backend.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		buf := make([]byte, maxPlaintext)
+		for {
+			n, err := backend.Read(buf)
+			if n > 0 {
+				if _, err := c.writeRecord(recordTypeApplicationData, buf[:n]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		// Hang up the way an ordinary server does once the backend is done.
+		c.closeNotify()
+		c.conn.Close()
+	}()
+
+	for {
+		if err := c.readRecord(); err != nil {
+			break
+		}
+		if c.hand.Len() > 0 {
+			if err := c.handlePostHandshakeMessage(); err != nil {
+				break
+			}
+		}
+		if _, err := io.Copy(backend, &c.input); err != nil {
+			break
+		}
+	}
+	backend.Close()
+	wg.Wait()
+
+	return ErrDecoyForwarded
+}
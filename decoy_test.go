@@ -0,0 +1,181 @@
+package tls
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// decoyServer starts a server that hands clients without the Disguise
+// secret to a decoy in the given mode. It returns the decoy's end of the
+// backend connection, and the result of the server handshake.
+func decoyServer(t *testing.T, conn net.Conn, mode DecoyMode) (backend net.Conn, result <-chan error) {
+	t.Helper()
+	decoy, serverEnd := net.Pipe()
+	t.Cleanup(func() { decoy.Close() })
+	server := Server(conn, &Config{
+		Certificates:      []Certificate{testCertificate(t)},
+		DisguiseSecret:    []byte("disguise secret"),
+		DisguiseDecoyMode: mode,
+		DisguiseDecoy: func(context.Context) (net.Conn, error) {
+			return serverEnd, nil
+		},
+	})
+	errc := make(chan error, 1)
+	go func() { errc <- server.Handshake() }()
+	return decoy, errc
+}
+
+// readRecord reads one TLS record, header included, from r.
+func readRecord(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	record := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(r, record); err != nil {
+		t.Fatal(err)
+	}
+	n := int(record[3])<<8 | int(record[4])
+	record = append(record, make([]byte, n)...)
+	if _, err := io.ReadFull(r, record[recordHeaderLen:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// expectRead fails the test unless the next bytes read from r are want.
+func expectRead(t *testing.T, r io.Reader, want []byte) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatalf("reading %q: %v", want, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+// TestDecoyTCP checks that the decoy receives the client's bytes unchanged,
+// starting with its ClientHello, and that the client receives the decoy's.
+func TestDecoyTCP(t *testing.T) {
+	// The ClientHello of a client without the secret.
+	helloClient, helloServer := net.Pipe()
+	go Client(helloClient, &Config{ServerName: "example.com"}).Handshake()
+	hello := readRecord(t, helloServer)
+	helloClient.Close()
+	helloServer.Close()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	backend, result := decoyServer(t, conn, DecoyForwardTCP)
+	go client.Write(hello)
+	expectRead(t, backend, hello)
+
+	request, response := []byte("more from the client"), []byte("\x16\x03\x03 from the decoy")
+	go client.Write(request)
+	expectRead(t, backend, request)
+	go backend.Write(response)
+	expectRead(t, client, response)
+
+	client.Close()
+	if err := <-result; !errors.Is(err, ErrDecoyForwarded) {
+		t.Errorf("server handshake = %v, want ErrDecoyForwarded", err)
+	}
+}
+
+// TestDecoyTLS checks that the decoy receives the decrypted application data
+// of the client, and that the client receives the decoy's over TLS.
+func TestDecoyTLS(t *testing.T) {
+	clientConn, conn := net.Pipe()
+	backend, result := decoyServer(t, conn, DecoyForwardTLS)
+	client := Client(clientConn, &Config{ServerName: "example.com", InsecureSkipVerify: true})
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if client.ConnectionState().Disguise.Enabled {
+		t.Error("Disguise enabled for a client of the decoy")
+	}
+
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	go client.Write(request)
+	expectRead(t, backend, request)
+	go backend.Write(response)
+	expectRead(t, client, response)
+
+	// The server hangs up once the decoy does.
+	backend.Close()
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("client Read after the decoy closed = %v, want io.EOF", err)
+	}
+	if err := <-result; !errors.Is(err, ErrDecoyForwarded) {
+		t.Errorf("server handshake = %v, want ErrDecoyForwarded", err)
+	}
+}
+
+// TestDecoyReplay checks that a recorded ClientHello of an authorised client
+// is handed to the decoy when it is replayed, and so is one made with the
+// right key but a clock too far off.
+func TestDecoyReplay(t *testing.T) {
+	recordHello := func(config *Config) []byte {
+		helloClient, helloServer := net.Pipe()
+		defer helloServer.Close()
+		go func() {
+			Client(helloClient, config).Handshake()
+			helloClient.Close()
+		}()
+		return readRecord(t, helloServer)
+	}
+	hello := recordHello(&Config{ServerName: "example.com", DisguiseSecret: []byte("disguise secret")})
+	stale := recordHello(&Config{
+		ServerName:     "example.com",
+		DisguiseSecret: []byte("disguise secret"),
+		Time:           func() time.Time { return time.Now().Add(-time.Hour) },
+	})
+
+	decoys := make(chan net.Conn, 1)
+	config := &Config{
+		Certificates:      []Certificate{testCertificate(t)},
+		DisguiseSecret:    []byte("disguise secret"),
+		DisguiseDecoyMode: DecoyForwardTCP,
+		DisguiseDecoy: func(context.Context) (net.Conn, error) {
+			backend, serverEnd := net.Pipe()
+			decoys <- backend
+			return serverEnd, nil
+		},
+	}
+	serve := func(hello []byte) (client net.Conn, result <-chan error) {
+		client, conn := net.Pipe()
+		errc := make(chan error, 1)
+		go func() {
+			errc <- Server(conn, config).Handshake()
+			conn.Close()
+		}()
+		go client.Write(hello)
+		return client, errc
+	}
+
+	// The first time, the server answers the hello itself.
+	client, result := serve(hello)
+	if record := readRecord(t, client); record[0] != byte(recordTypeHandshake) {
+		t.Fatalf("server answered the authorised hello with a record of type %d", record[0])
+	}
+	client.Close()
+	if err := <-result; errors.Is(err, ErrDecoyForwarded) {
+		t.Fatal("authorised hello forwarded to the decoy")
+	}
+
+	for name, hello := range map[string][]byte{"replayed": hello, "stale": stale} {
+		client, result := serve(hello)
+		backend := <-decoys
+		expectRead(t, backend, hello)
+		backend.Close()
+		client.Close()
+		if err := <-result; !errors.Is(err, ErrDecoyForwarded) {
+			t.Errorf("server handshake with a %s hello = %v, want ErrDecoyForwarded", name, err)
+		}
+	}
+}
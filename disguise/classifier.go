@@ -139,6 +139,44 @@ func (h *HMMClassifier) Predict(observations []int) (profile.TrafficType, error)
 	return h.States[lastState], nil
 }
 
+// Posterior runs the forward algorithm over a sequence of observations and
+// returns the probability of each hidden state at the end of the sequence.
+func (h *HMMClassifier) Posterior(observations []int) (map[profile.TrafficType]float64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(observations) == 0 {
+		return nil, errors.New("observations cannot be empty")
+	}
+
+	numStates := len(h.States)
+	alpha := make([]float64, numStates)
+	next := make([]float64, numStates)
+
+	for i, state := range h.States {
+		alpha[i] = math.Log(1.0/float64(numStates)) + math.Log(h.EmissionProbs[state][observations[0]])
+	}
+
+	for t := 1; t < len(observations); t++ {
+		obs := observations[t]
+		for i, currentState := range h.States {
+			terms := make([]float64, numStates)
+			for j, prevState := range h.States {
+				terms[j] = alpha[j] + math.Log(h.TransitionProbs[prevState][currentState])
+			}
+			next[i] = logSumExp(terms) + math.Log(h.EmissionProbs[currentState][obs])
+		}
+		alpha, next = next, alpha
+	}
+
+	norm := logSumExp(alpha)
+	posterior := make(map[profile.TrafficType]float64, numStates)
+	for i, state := range h.States {
+		posterior[state] = math.Exp(alpha[i] - norm)
+	}
+	return posterior, nil
+}
+
 // Train updates the HMM's probabilities based on a sequence of observations and the corresponding ground truth.
 func (h *HMMClassifier) Train(observations []int, groundTruth profile.TrafficType) error {
 	h.mu.Lock()
@@ -147,6 +185,11 @@ func (h *HMMClassifier) Train(observations []int, groundTruth profile.TrafficTyp
 	if len(observations) == 0 {
 		return errors.New("observations cannot be empty")
 	}
+	// Only the fixed profiles are states of the model; traffic shaped by
+	// the dynamic mixture has no single ground truth to learn from.
+	if _, ok := h.EmissionCounts[groundTruth]; !ok {
+		return errors.New("ground truth is not a state of the model")
+	}
 
 	// For a simplified online learning, we just update the counts.
 	// A more robust solution would implement Baum-Welch or Viterbi training.
@@ -170,6 +213,66 @@ func (h *HMMClassifier) Train(observations []int, groundTruth profile.TrafficTyp
 	return nil
 }
 
+// ClassifierCounts are the online learning counters of an HMMClassifier,
+// from which its probabilities are derived.
+type ClassifierCounts struct {
+	Emission   map[profile.TrafficType][]float64
+	Transition map[profile.TrafficType]map[profile.TrafficType]float64
+}
+
+// Counts returns a copy of the classifier's counters.
+func (h *HMMClassifier) Counts() ClassifierCounts {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	c := ClassifierCounts{
+		Emission:   make(map[profile.TrafficType][]float64, len(h.EmissionCounts)),
+		Transition: make(map[profile.TrafficType]map[profile.TrafficType]float64, len(h.TransitionCounts)),
+	}
+	for state, counts := range h.EmissionCounts {
+		c.Emission[state] = append([]float64(nil), counts...)
+	}
+	for state, transitions := range h.TransitionCounts {
+		c.Transition[state] = make(map[profile.TrafficType]float64, len(transitions))
+		for next, count := range transitions {
+			c.Transition[state][next] = count
+		}
+	}
+	return c
+}
+
+// SetCounts replaces the classifier's counters, such as with the ones of a
+// previous connection, and recomputes its probabilities as Train would have.
+// Counters of unknown states or observations are ignored, and counters that
+// are all zero leave the initial probabilities in place.
+func (h *HMMClassifier) SetCounts(c ClassifierCounts) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	trained := false
+	for state, counts := range h.EmissionCounts {
+		for i := range counts {
+			counts[i] = 0
+			if i < len(c.Emission[state]) && c.Emission[state][i] > 0 {
+				counts[i] = c.Emission[state][i]
+				trained = true
+			}
+		}
+	}
+	for state, transitions := range h.TransitionCounts {
+		for next := range transitions {
+			transitions[next] = 0
+			if count := c.Transition[state][next]; count > 0 {
+				transitions[next] = count
+				trained = true
+			}
+		}
+	}
+	if trained {
+		h.reNormalizeProbabilities()
+	}
+}
+
 func (h *HMMClassifier) reNormalizeProbabilities() {
 	// Re-normalize emission probabilities from counts
 	for state, counts := range h.EmissionCounts {
@@ -200,6 +303,24 @@ func (h *HMMClassifier) reNormalizeProbabilities() {
 	}
 }
 
+// logSumExp computes log(sum(exp(x))) without underflowing.
+func logSumExp(xs []float64) float64 {
+	max := math.Inf(-1)
+	for _, x := range xs {
+		if x > max {
+			max = x
+		}
+	}
+	if math.IsInf(max, -1) {
+		return max
+	}
+	sum := 0.0
+	for _, x := range xs {
+		sum += math.Exp(x - max)
+	}
+	return max + math.Log(sum)
+}
+
 // DiscretizePayloadSize maps a payload length to a discrete bucket.
 func DiscretizePayloadSize(length int) int {
 	if length < 200 {
@@ -0,0 +1,67 @@
+package disguise
+
+import (
+	"math"
+	"testing"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+func TestPosterior(t *testing.T) {
+	h := NewHMMClassifier()
+	for _, tt := range []struct {
+		payload int
+		want    profile.TrafficType
+	}{
+		{100, profile.WebBrowsing},
+		{1300, profile.FileDownload},
+	} {
+		observations := make([]int, 20)
+		for i := range observations {
+			observations[i] = DiscretizePayloadSize(tt.payload)
+		}
+		posterior, err := h.Posterior(observations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum, best := 0.0, profile.TrafficType(-1)
+		for typ, p := range posterior {
+			sum += p
+			if best < 0 || p > posterior[best] {
+				best = typ
+			}
+		}
+		if math.Abs(sum-1) > 1e-9 {
+			t.Errorf("posterior of %d byte payloads sums to %v, want 1", tt.payload, sum)
+		}
+		if best != tt.want {
+			t.Errorf("posterior of %d byte payloads favours %v, want %v: %v", tt.payload, best, tt.want, posterior)
+		}
+	}
+
+	if _, err := h.Posterior(nil); err == nil {
+		t.Error("Posterior accepted no observations")
+	}
+}
+
+// TestPosteriorBlending checks that blending the posterior of bulk traffic
+// into the dynamic profile, as the profiling loop does, moves its mixture
+// away from web browsing.
+func TestPosteriorBlending(t *testing.T) {
+	h := NewHMMClassifier()
+	p := profile.GetProfile(profile.Dynamic)
+	observations := make([]int, 50)
+	for i := range observations {
+		observations[i] = DiscretizePayloadSize(1300)
+	}
+	for range 30 {
+		posterior, err := h.Posterior(observations)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.BlendWeights(posterior)
+	}
+	if d := p.DominantType(); d == profile.WebBrowsing {
+		t.Errorf("DominantType = %v after blending bulk traffic, weights %v", d, p.Weights())
+	}
+}
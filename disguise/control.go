@@ -0,0 +1,133 @@
+package disguise
+
+import "github.com/uDisguise/disguise/disguise/profile"
+
+// Control messages are carried in the payload of control cells, which are
+// authenticated once the Manager is keyed with SetSecret. The first byte
+// selects the message.
+const (
+	// controlProfile announces the profile the sender switched to, as its
+	// TrafficType, and whether it is pinned.
+	controlProfile byte = 0x01
+	// controlOff is the last cell of its direction. The records that
+	// follow carry application data as is.
+	controlOff byte = 0x02
+)
+
+// SetPinned pins or unpins the active profile. While it is pinned, the
+// dynamic profile keeps its current mixture instead of adapting it to the
+// classifier's predictions. Fixed profiles never adapt.
+func (m *Manager) SetPinned(pinned bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pinned = pinned
+}
+
+// Pinned reports whether the active profile is pinned.
+func (m *Manager) Pinned() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pinned
+}
+
+// Announce queues a control cell telling the peer to switch to the active
+// profile and pinning state as well, so that both directions are shaped
+// alike. Control cells go ahead of queued data.
+func (m *Manager) Announce() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pinned byte
+	if m.pinned {
+		pinned = 1
+	}
+	cell, err := m.framer.CreateControlCell([]byte{controlProfile, byte(m.profile.GetProfileType()), pinned})
+	if err != nil {
+		return err
+	}
+	m.scheduler.ScheduleCell(cell)
+	m.recordQueued()
+	m.signalReady()
+	return nil
+}
+
+// TurnOff ends the cells of the connection, which then carries application
+// data as is, without any shaping. Cells already queued are sent first,
+// followed by a control cell telling the peer that the records after it
+// are not cells; QueueApplicationData returns ErrPassThrough once it was
+// sent. The peer turns off its own direction when it receives it. There is
+// no turning back on.
+func (m *Manager) TurnOff() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.turnOffLocked()
+}
+
+func (m *Manager) turnOffLocked() {
+	if m.stopping {
+		return
+	}
+	m.stopping = true
+	m.logger.Info("disguise turned off", "by_peer", m.peerOff)
+	m.signalReady()
+}
+
+// Off reports whether the Manager sent the last cell of its direction.
+func (m *Manager) Off() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.off
+}
+
+// PeerOff reports whether the peer sent the last cell of its direction, so
+// that the records after it carry application data as is.
+func (m *Manager) PeerOff() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.peerOff
+}
+
+// endCellsLocked returns the control cell that ends this direction, once
+// no data is left in the queue. Queued cover cells are dropped. The Manager
+// is closed once both directions ended. It must be called with m.mu held.
+func (m *Manager) endCellsLocked() ([]byte, error) {
+	cell, err := m.framer.CreateControlCell([]byte{controlOff})
+	if err != nil {
+		return nil, err
+	}
+	encodedCell, err := m.framer.EncodeCell(cell)
+	if err != nil {
+		return nil, err
+	}
+	m.off = true
+	m.recordSent(cell, len(encodedCell), 0)
+	if m.peerOff {
+		m.Close()
+	}
+	return encodedCell, nil
+}
+
+// handleControlLocked acts on a control message of the peer. Unknown
+// messages are ignored. It must be called with m.mu held.
+func (m *Manager) handleControlLocked(msg []byte) {
+	if len(msg) == 0 {
+		return
+	}
+	switch msg[0] {
+	case controlProfile:
+		if len(msg) < 3 || !validType(profile.TrafficType(msg[1])) {
+			return
+		}
+		t := profile.TrafficType(msg[1])
+		if t != m.profile.GetProfileType() {
+			m.setProfileLocked(profile.GetProfile(t))
+		}
+		m.pinned = msg[2] != 0
+	case controlOff:
+		m.peerOff = true
+		m.turnOffLocked()
+		if m.off {
+			m.Close()
+		}
+	}
+}
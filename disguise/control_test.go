@@ -0,0 +1,139 @@
+//go:build go1.25
+
+package disguise
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// managerPair returns a client and a server Manager keyed with the same
+// secret.
+func managerPair(t *testing.T) (client, server *Manager) {
+	t.Helper()
+	secret := bytes.Repeat([]byte{1}, SecretLen)
+	client, server = NewManager(), NewManager()
+	t.Cleanup(client.Close)
+	t.Cleanup(server.Close)
+	if err := client.SetSecret(secret, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.SetSecret(secret, false); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// pump passes every cell that from releases to to, and returns how many
+// there were.
+func pump(t *testing.T, from, to *Manager) int {
+	t.Helper()
+	n := 0
+	for {
+		b, err := from.GetOutboundTraffic()
+		switch {
+		case errors.Is(err, ErrNoOutboundTraffic):
+			return n
+		case errors.Is(err, ErrOutboundThrottled):
+			time.Sleep(from.NextSendDelay())
+			continue
+		case err != nil:
+			t.Fatal(err)
+		}
+		if err := to.ProcessInboundTraffic(b); err != nil {
+			t.Fatalf("ProcessInboundTraffic = %v", err)
+		}
+		n++
+	}
+}
+
+func TestAnnounce(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		client, server := managerPair(t)
+		client.SetProfile(profile.GetProfile(profile.VideoStreaming))
+		client.SetPinned(true)
+		if got := server.State().Profile; got != profile.Dynamic {
+			t.Fatalf("server switched to %v before the announcement", got)
+		}
+		if err := client.Announce(); err != nil {
+			t.Fatal(err)
+		}
+		if pump(t, client, server) != 1 {
+			t.Error("announcement not sent as a single cell")
+		}
+		if got := server.State().Profile; got != profile.VideoStreaming || !server.Pinned() {
+			t.Errorf("server on %v, pinned %v; want %v, pinned", got, server.Pinned(), profile.VideoStreaming)
+		}
+
+		client.SetPinned(false)
+		client.Announce()
+		pump(t, client, server)
+		if server.Pinned() {
+			t.Error("server still pinned after the announcement")
+		}
+	})
+}
+
+func TestControlIgnored(t *testing.T) {
+	m := NewManager()
+	defer m.Close()
+	for _, msg := range [][]byte{
+		nil,
+		{controlProfile},
+		{controlProfile, 0xff, 1},
+		{0xff},
+	} {
+		m.mu.Lock()
+		m.handleControlLocked(msg)
+		m.mu.Unlock()
+		if m.State().Profile != profile.Dynamic || m.Pinned() || m.Off() || m.PeerOff() {
+			t.Errorf("control message %x acted upon", msg)
+		}
+	}
+}
+
+// TestTurnOff checks that the data queued before TurnOff is sent first, and
+// that both directions end once the peer received the last cell.
+func TestTurnOff(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		client, server := managerPair(t)
+		if err := client.QueueApplicationData([]byte("queued")); err != nil {
+			t.Fatal(err)
+		}
+		client.TurnOff()
+		if client.Off() {
+			t.Error("Off before the last cell was sent")
+		}
+		pump(t, client, server)
+		if !client.Off() {
+			t.Error("not Off after the last cell was sent")
+		}
+		if err := client.QueueApplicationData([]byte("more")); err != ErrPassThrough {
+			t.Errorf("QueueApplicationData after TurnOff = %v, want ErrPassThrough", err)
+		}
+		if data, err := server.ReadApplicationData(); err != nil || string(data) != "queued" {
+			t.Errorf("server read %q, %v; want the data queued before TurnOff", data, err)
+		}
+		if !server.PeerOff() {
+			t.Fatal("server did not receive the last cell")
+		}
+
+		// The server answers with the last cell of its own direction.
+		pump(t, server, client)
+		if !server.Off() || !client.PeerOff() {
+			t.Error("server direction not turned off")
+		}
+		for _, m := range []*Manager{client, server} {
+			select {
+			case <-m.Done():
+			default:
+				t.Error("Manager not closed once both directions ended")
+			}
+		}
+	})
+}
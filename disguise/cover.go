@@ -0,0 +1,318 @@
+package disguise
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// CoverOverhead summarises the bandwidth cost of a cover traffic policy.
+type CoverOverhead struct {
+	DataBytes  int64
+	CoverBytes int64
+}
+
+// Ratio returns the cover bytes sent per byte of real data.
+func (o CoverOverhead) Ratio() float64 {
+	if o.DataBytes == 0 {
+		if o.CoverBytes == 0 {
+			return 0
+		}
+		return math.Inf(1)
+	}
+	return float64(o.CoverBytes) / float64(o.DataBytes)
+}
+
+// CoverPolicy decides when, and how much, cover traffic is emitted.
+type CoverPolicy interface {
+	// Name returns a short identifier of the policy.
+	Name() string
+	// ObserveData records a real cell of n bytes leaving the connection.
+	ObserveData(now time.Time, n int)
+	// ObserveCover records a cover cell of n bytes leaving the connection.
+	ObserveCover(n int)
+	// Next returns the number of cover bytes to emit now, and how long to
+	// wait before the policy is consulted again.
+	Next(now time.Time) (coverBytes int, wait time.Duration)
+	// Overhead reports the bandwidth spent on cover traffic so far.
+	Overhead() CoverOverhead
+}
+
+// NewCoverPolicy builds the cover traffic policy selected by a profile.
+func NewCoverPolicy(p *profile.Profile) CoverPolicy {
+	switch p.Cover.Mode {
+	case profile.CoverConstantRate:
+		return &constantRatePolicy{profile: p}
+	case profile.CoverFixedRate:
+		return &fixedRatePolicy{profile: p}
+	case profile.CoverAdaptive:
+		return newAdaptivePolicy(p)
+	case profile.CoverTailPadding:
+		return &tailPaddingPolicy{profile: p}
+	default:
+		return &probingPolicy{profile: p}
+	}
+}
+
+// overheadCounter implements the accounting shared by all policies.
+type overheadCounter struct {
+	mu       sync.Mutex
+	overhead CoverOverhead
+}
+
+func (c *overheadCounter) addData(n int) {
+	c.mu.Lock()
+	c.overhead.DataBytes += int64(n)
+	c.mu.Unlock()
+}
+
+func (c *overheadCounter) ObserveCover(n int) {
+	c.mu.Lock()
+	c.overhead.CoverBytes += int64(n)
+	c.mu.Unlock()
+}
+
+func (c *overheadCounter) Overhead() CoverOverhead {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.overhead
+}
+
+// probingPolicy emits a single randomly sized dummy cell per cover interval.
+type probingPolicy struct {
+	overheadCounter
+	profile *profile.Profile
+	started bool
+}
+
+func (p *probingPolicy) Name() string { return "probing" }
+
+func (p *probingPolicy) ObserveData(now time.Time, n int) { p.addData(n) }
+
+func (p *probingPolicy) Next(now time.Time) (int, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.started {
+		// The first cover cell goes out one interval after start-up.
+		p.started = true
+		return 0, p.profile.CoverInterval()
+	}
+	return p.profile.GetNextCellSize(), p.profile.CoverInterval()
+}
+
+// constantRatePolicy sends one full-size cell per slot. Slots that already
+// carried real data are left alone, so the wire sees a constant bitrate.
+type constantRatePolicy struct {
+	overheadCounter
+	profile  *profile.Profile
+	lastData time.Time
+}
+
+func (p *constantRatePolicy) Name() string { return "constant-rate" }
+
+func (p *constantRatePolicy) ObserveData(now time.Time, n int) {
+	p.addData(n)
+	p.mu.Lock()
+	p.lastData = now
+	p.mu.Unlock()
+}
+
+func (p *constantRatePolicy) Next(now time.Time) (int, time.Duration) {
+	slot := p.profile.Cover.Interval
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if now.Sub(p.lastData) < slot {
+		return 0, slot
+	}
+	return p.profile.MaxCellSize, slot
+}
+
+// fixedRatePolicy is a BuFLO/Tamaraw style shaper. While a burst is active
+// every empty slot is filled, and once the real data stops the burst keeps
+// being padded until its cell count reaches a multiple of BurstCells.
+type fixedRatePolicy struct {
+	overheadCounter
+	profile    *profile.Profile
+	lastData   time.Time
+	burstCells int
+	active     bool
+}
+
+func (p *fixedRatePolicy) Name() string { return "fixed-rate" }
+
+func (p *fixedRatePolicy) ObserveData(now time.Time, n int) {
+	p.addData(n)
+	p.mu.Lock()
+	p.lastData = now
+	p.burstCells++
+	p.active = true
+	p.mu.Unlock()
+}
+
+func (p *fixedRatePolicy) Next(now time.Time) (int, time.Duration) {
+	cfg := p.profile.Cover
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.active {
+		return 0, cfg.Interval
+	}
+	if now.Sub(p.lastData) < cfg.Interval {
+		return 0, cfg.Interval
+	}
+	if now.Sub(p.lastData) >= cfg.BurstGap && (cfg.BurstCells <= 0 || p.burstCells%cfg.BurstCells == 0) {
+		p.active = false
+		p.burstCells = 0
+		return 0, cfg.Interval
+	}
+	p.burstCells++
+	return p.profile.MaxCellSize, cfg.Interval
+}
+
+// adaptiveBins are the upper bounds of the inter-cell gap histogram used by
+// adaptivePolicy. They are spaced logarithmically, as in WTF-PAD.
+var adaptiveBins = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	4 * time.Millisecond,
+	8 * time.Millisecond,
+	16 * time.Millisecond,
+	32 * time.Millisecond,
+	64 * time.Millisecond,
+	128 * time.Millisecond,
+	256 * time.Millisecond,
+	512 * time.Millisecond,
+}
+
+// adaptivePolicy implements WTF-PAD style adaptive padding. It learns a
+// histogram of the gaps between real cells and, after each cell, samples an
+// expected gap from it. If no real cell shows up before the sampled gap
+// elapses, the gap is statistically unlikely and a cover cell fills it.
+// Gaps longer than BurstGap end the burst and are never filled.
+type adaptivePolicy struct {
+	overheadCounter
+	profile  *profile.Profile
+	hist     []float64
+	lastData time.Time
+	deadline time.Time
+}
+
+func newAdaptivePolicy(p *profile.Profile) *adaptivePolicy {
+	hist := make([]float64, len(adaptiveBins))
+	for i := range hist {
+		hist[i] = 1
+	}
+	return &adaptivePolicy{profile: p, hist: hist}
+}
+
+func (p *adaptivePolicy) Name() string { return "adaptive" }
+
+func (p *adaptivePolicy) ObserveData(now time.Time, n int) {
+	p.addData(n)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.lastData.IsZero() {
+		if gap := now.Sub(p.lastData); gap < p.profile.Cover.BurstGap {
+			p.hist[adaptiveBin(gap)]++
+		}
+	}
+	p.lastData = now
+	p.deadline = now.Add(p.sampleGap())
+}
+
+func (p *adaptivePolicy) Next(now time.Time) (int, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	idle := p.profile.Cover.Interval
+	if p.deadline.IsZero() || now.Sub(p.lastData) >= p.profile.Cover.BurstGap {
+		return 0, idle
+	}
+	if now.Before(p.deadline) {
+		return 0, p.deadline.Sub(now)
+	}
+	// The expected cell did not arrive: fill the gap and arm the next one
+	// as if the cover cell had been real.
+	gap := p.sampleGap()
+	p.deadline = now.Add(gap)
+	return p.profile.GetNextCellSize(), gap
+}
+
+// sampleGap draws a gap from the learned histogram, uniformly within the
+// selected bin. It must be called with p.mu held.
+func (p *adaptivePolicy) sampleGap() time.Duration {
+	total := 0.0
+	for _, c := range p.hist {
+		total += c
+	}
+	r := rand.Float64() * total
+	for i, c := range p.hist {
+		r -= c
+		if r <= 0 {
+			lo := time.Duration(0)
+			if i > 0 {
+				lo = adaptiveBins[i-1]
+			}
+			return lo + time.Duration(rand.Int63n(int64(adaptiveBins[i]-lo)+1))
+		}
+	}
+	return adaptiveBins[len(adaptiveBins)-1]
+}
+
+func adaptiveBin(gap time.Duration) int {
+	for i, upper := range adaptiveBins {
+		if gap <= upper {
+			return i
+		}
+	}
+	return len(adaptiveBins) - 1
+}
+
+// tailPaddingPolicy rounds the byte volume of every burst up to a multiple
+// of BurstBytes once the burst has gone quiet.
+type tailPaddingPolicy struct {
+	overheadCounter
+	profile     *profile.Profile
+	lastData    time.Time
+	burstVolume int
+}
+
+func (p *tailPaddingPolicy) Name() string { return "tail-padding" }
+
+func (p *tailPaddingPolicy) ObserveData(now time.Time, n int) {
+	p.addData(n)
+	p.mu.Lock()
+	p.lastData = now
+	p.burstVolume += n
+	p.mu.Unlock()
+}
+
+func (p *tailPaddingPolicy) Next(now time.Time) (int, time.Duration) {
+	cfg := p.profile.Cover
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.burstVolume == 0 {
+		return 0, cfg.BurstGap
+	}
+	if wait := cfg.BurstGap - now.Sub(p.lastData); wait > 0 {
+		return 0, wait
+	}
+	pad := 0
+	if cfg.BurstBytes > 0 {
+		if rem := p.burstVolume % cfg.BurstBytes; rem != 0 {
+			pad = cfg.BurstBytes - rem
+			// Cover cells are at least MinCellSize bytes, so a shorter
+			// pad would overshoot the multiple: round up to the next.
+			for pad < p.profile.MinCellSize {
+				pad += cfg.BurstBytes
+			}
+		}
+	}
+	p.burstVolume = 0
+	return pad, cfg.BurstGap
+}
@@ -0,0 +1,185 @@
+package disguise
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// coverProfile returns the web browsing profile with the given cover mode,
+// and short slots for the tests.
+func coverProfile(mode profile.CoverMode) *profile.Profile {
+	p := profile.GetProfile(profile.WebBrowsing)
+	p.Cover = profile.CoverConfig{
+		Mode:       mode,
+		Interval:   10 * time.Millisecond,
+		BurstGap:   50 * time.Millisecond,
+		BurstCells: 5,
+		BurstBytes: 4096,
+	}
+	return p
+}
+
+func TestNewCoverPolicy(t *testing.T) {
+	for mode, name := range map[profile.CoverMode]string{
+		profile.CoverProbing:      "probing",
+		profile.CoverConstantRate: "constant-rate",
+		profile.CoverFixedRate:    "fixed-rate",
+		profile.CoverAdaptive:     "adaptive",
+		profile.CoverTailPadding:  "tail-padding",
+	} {
+		if got := NewCoverPolicy(coverProfile(mode)).Name(); got != name {
+			t.Errorf("policy of mode %d is %q, want %q", mode, got, name)
+		}
+	}
+}
+
+func TestProbingPolicy(t *testing.T) {
+	p := coverProfile(profile.CoverProbing)
+	c := NewCoverPolicy(p)
+	now := time.Now()
+	if n, wait := c.Next(now); n != 0 || wait != p.CoverInterval() {
+		t.Errorf("first Next = %d, %v; want 0, %v", n, wait, p.CoverInterval())
+	}
+	for range 100 {
+		n, _ := c.Next(now)
+		if n < p.MinCellSize || n >= p.MaxCellSize {
+			t.Fatalf("probing cell of %d bytes, want [%d, %d)", n, p.MinCellSize, p.MaxCellSize)
+		}
+	}
+}
+
+func TestConstantRatePolicy(t *testing.T) {
+	p := coverProfile(profile.CoverConstantRate)
+	c := NewCoverPolicy(p)
+	now := time.Now()
+	if n, _ := c.Next(now); n != p.MaxCellSize {
+		t.Errorf("idle slot filled with %d bytes, want %d", n, p.MaxCellSize)
+	}
+	c.ObserveData(now, 500)
+	if n, _ := c.Next(now.Add(5 * time.Millisecond)); n != 0 {
+		t.Errorf("slot that carried data filled with %d bytes", n)
+	}
+	if n, _ := c.Next(now.Add(10 * time.Millisecond)); n != p.MaxCellSize {
+		t.Errorf("next slot filled with %d bytes, want %d", n, p.MaxCellSize)
+	}
+}
+
+func TestFixedRatePolicy(t *testing.T) {
+	p := coverProfile(profile.CoverFixedRate)
+	c := NewCoverPolicy(p)
+	now := time.Now()
+	if n, _ := c.Next(now); n != 0 {
+		t.Errorf("cover of %d bytes before any burst", n)
+	}
+	for range 3 {
+		c.ObserveData(now, 1000)
+	}
+	cells := 3
+	for i := 1; i <= 20; i++ {
+		if n, _ := c.Next(now.Add(time.Duration(i) * p.Cover.Interval)); n > 0 {
+			if n != p.MaxCellSize {
+				t.Errorf("cover cell of %d bytes, want %d", n, p.MaxCellSize)
+			}
+			cells++
+		}
+	}
+	// Four slots before the burst gap, then padding up to a multiple.
+	if cells != 10 {
+		t.Errorf("burst of %d cells, want 10", cells)
+	}
+}
+
+func TestAdaptivePolicy(t *testing.T) {
+	p := coverProfile(profile.CoverAdaptive)
+	// Longer than any sampled gap, so that none ends the burst.
+	p.Cover.BurstGap = time.Second
+	c := NewCoverPolicy(p)
+	now := time.Now()
+	if n, wait := c.Next(now); n != 0 || wait != p.Cover.Interval {
+		t.Errorf("Next before any data = %d, %v; want 0, %v", n, wait, p.Cover.Interval)
+	}
+	c.ObserveData(now, 1000)
+	n, wait := c.Next(now)
+	if n != 0 || wait <= 0 || wait > adaptiveBins[len(adaptiveBins)-1] {
+		t.Fatalf("Next right after data = %d, %v; want 0 and a sampled gap", n, wait)
+	}
+	if n, _ := c.Next(now.Add(wait)); n < p.MinCellSize {
+		t.Errorf("unlikely gap filled with %d bytes", n)
+	}
+	if n, _ := c.Next(now.Add(p.Cover.BurstGap)); n != 0 {
+		t.Errorf("gap past the end of the burst filled with %d bytes", n)
+	}
+}
+
+func TestTailPaddingPolicy(t *testing.T) {
+	p := coverProfile(profile.CoverTailPadding)
+	for _, tt := range []struct {
+		burst, pad int
+	}{
+		{1000, 3096},
+		{4096, 0},
+		// A pad below MinCellSize goes on to the next multiple.
+		{4096 - 30, 30 + 4096},
+	} {
+		c := NewCoverPolicy(p)
+		now := time.Now()
+		c.ObserveData(now, tt.burst)
+		if n, _ := c.Next(now.Add(p.Cover.BurstGap / 2)); n != 0 {
+			t.Errorf("burst of %d bytes padded before it ended", tt.burst)
+		}
+		if n, _ := c.Next(now.Add(p.Cover.BurstGap)); n != tt.pad {
+			t.Errorf("burst of %d bytes padded with %d, want %d", tt.burst, n, tt.pad)
+		}
+		if n, _ := c.Next(now.Add(2 * p.Cover.BurstGap)); n != 0 {
+			t.Errorf("burst of %d bytes padded twice", tt.burst)
+		}
+	}
+}
+
+func TestCoverOverhead(t *testing.T) {
+	c := NewCoverPolicy(coverProfile(profile.CoverProbing))
+	if r := c.Overhead().Ratio(); r != 0 {
+		t.Errorf("Ratio of an unused policy = %v, want 0", r)
+	}
+	c.ObserveCover(300)
+	if r := c.Overhead().Ratio(); !math.IsInf(r, 1) {
+		t.Errorf("Ratio without data = %v, want +Inf", r)
+	}
+	c.ObserveData(time.Now(), 1000)
+	c.ObserveData(time.Now(), 500)
+	c.ObserveCover(450)
+	if o := c.Overhead(); o.DataBytes != 1500 || o.CoverBytes != 750 || o.Ratio() != 0.5 {
+		t.Errorf("Overhead = %+v, ratio %v; want 1500 data and 750 cover bytes", o, o.Ratio())
+	}
+}
+
+// TestScheduleCover checks that cover bytes are split into cells within the
+// bounds of the profile which add up to the requested volume.
+func TestScheduleCover(t *testing.T) {
+	m := NewManager()
+	defer m.Close()
+	p := coverProfile(profile.CoverTailPadding)
+	p.Rate = profile.Rate{}
+	m.SetProfile(p)
+
+	for _, coverBytes := range []int{64, 1400, 1410, 3000, 4126} {
+		m.mu.Lock()
+		m.scheduleCover(coverBytes)
+		total := 0
+		for cell := m.scheduler.GetNextCell(); cell != nil; cell = m.scheduler.GetNextCell() {
+			size := framing.CellHeaderLen + int(cell.PayloadLen) + int(cell.PaddingLen)
+			if size < m.profile.MinCellSize || size > m.profile.MaxCellSize {
+				t.Errorf("cover cell of %d bytes", size)
+			}
+			total += size
+		}
+		m.mu.Unlock()
+		if total != coverBytes {
+			t.Errorf("%d cover bytes scheduled as %d", coverBytes, total)
+		}
+	}
+}
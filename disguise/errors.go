@@ -0,0 +1,57 @@
+package disguise
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorClass tells the owner of a connection how to react to an error
+// returned by the Manager.
+type ErrorClass int
+
+const (
+	// Fatal errors leave the Disguise state unusable; the connection must
+	// be torn down.
+	Fatal ErrorClass = iota
+	// Recoverable errors cost the current cell or stream, such as a
+	// reassembly gap, but the connection can keep going.
+	Recoverable
+	// DropSilently errors concern cells that must be discarded without any
+	// reaction visible to the peer, such as replays (SPEC §8).
+	DropSilently
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case Recoverable:
+		return "recoverable"
+	case DropSilently:
+		return "drop-silently"
+	default:
+		return "fatal"
+	}
+}
+
+// Error is a classified error returned by the Manager.
+type Error struct {
+	Class ErrorClass
+	// Op describes the operation that failed, such as "decode".
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("disguise: %s: %v", e.Op, e.Err)
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// ClassOf returns the class of err. Errors that were not produced by the
+// Manager are considered fatal.
+func ClassOf(err error) ErrorClass {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Class
+	}
+	return Fatal
+}
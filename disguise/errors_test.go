@@ -0,0 +1,63 @@
+package disguise
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+func TestClassOf(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want ErrorClass
+	}{
+		{&Error{Class: Recoverable, Op: "op", Err: errors.New("gap")}, Recoverable},
+		{fmt.Errorf("wrapped: %w", &Error{Class: DropSilently, Op: "op", Err: errors.New("replay")}), DropSilently},
+		{&Error{Class: Fatal, Op: "op", Err: errors.New("decode")}, Fatal},
+		{errors.New("foreign"), Fatal},
+	} {
+		if got := ClassOf(tt.err); got != tt.want {
+			t.Errorf("ClassOf(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestInboundErrorClass checks the class of the errors ProcessInboundTraffic
+// returns for cells that cannot be decoded, replays and reassembly gaps.
+func TestInboundErrorClass(t *testing.T) {
+	m := NewManager()
+	defer m.Close()
+
+	f := framing.NewFramer(profile.GetProfile(profile.WebBrowsing))
+	cells, err := f.Fragment(make([]byte, 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cells) < 3 {
+		t.Fatalf("message fragmented into %d cells, want at least 3", len(cells))
+	}
+	encoded := make([][]byte, len(cells))
+	for i, cell := range cells {
+		if encoded[i], err = f.EncodeCell(cell); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(what string, data []byte, want ErrorClass) {
+		t.Helper()
+		err := m.ProcessInboundTraffic(data)
+		var e *Error
+		if !errors.As(err, &e) || e.Class != want {
+			t.Errorf("ProcessInboundTraffic(%s) = %v, want a %v error", what, err, want)
+		}
+	}
+	if err := m.ProcessInboundTraffic(encoded[0]); err != nil {
+		t.Fatalf("ProcessInboundTraffic(first cell) = %v", err)
+	}
+	check("a replay", encoded[0], DropSilently)
+	check("a cell after a gap", encoded[2], Recoverable)
+	check("a truncated cell", encoded[1][:framing.CellHeaderLen-1], Fatal)
+}
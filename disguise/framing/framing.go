@@ -2,11 +2,10 @@ package framing
 
 import (
 	"bytes"
+	"crypto/hmac"
 	crypto_rand "crypto/rand"
-	"encoding/base64"
 	"encoding/binary"
 	"errors"
-	"math/rand"
 	"sync"
 	"time"
 
@@ -15,7 +14,7 @@ import (
 
 // Cell structure definitions based on the specification.
 const (
-	CellHeaderLen = 20
+	CellHeaderLen = 22 // sum of the SPEC §4 header fields
 	TypeData      = 0x01
 	TypeHandshake = 0x02
 	TypeControl   = 0x03
@@ -41,6 +40,14 @@ type Framer struct {
 	profile *profile.Profile
 	mu      sync.Mutex
 	seq     uint32
+	// controlSeq numbers the control cells, which form a stream of their
+	// own with CellID zero, so that replay protection tells them apart.
+	controlSeq uint32
+	// padding, if set, overrides the generator selected by the profile.
+	padding PaddingGenerator
+	// send and receive are set by SetKeys.
+	send    *keyedDirection
+	receive *keyedDirection
 }
 
 // NewFramer creates a new Framer instance.
@@ -58,6 +65,14 @@ func (f *Framer) SetProfile(p *profile.Profile) {
 	f.profile = p
 }
 
+// SetPaddingGenerator overrides the padding generator selected by the active
+// profile. A nil generator restores the profile's choice.
+func (f *Framer) SetPaddingGenerator(g PaddingGenerator) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.padding = g
+}
+
 // Fragment takes a byte slice of application data and fragments it into a slice of Cells.
 func (f *Framer) Fragment(data []byte) ([]*Cell, error) {
 	f.mu.Lock()
@@ -95,20 +110,9 @@ func (f *Framer) Fragment(data []byte) ([]*Cell, error) {
 		
 		cell.PaddingLen = uint16(paddingLen)
 		
-		// Infer profile type without calling a non-existent method
-		var currentProfileType profile.TrafficType
-		if len(f.profile.TrafficWeights) == 1 {
-			for t := range f.profile.TrafficWeights {
-				currentProfileType = t
-			}
-		} else {
-			// For dynamic profile, we assume WebBrowsing as a heuristic
-			currentProfileType = profile.WebBrowsing
-		}
-
-		cell.Padding = f.generatePadding(paddingLen, currentProfileType)
+		cell.Padding = f.generatePadding(paddingLen)
 
-		cell.RandOffset = f.generateRandomOffset(uint16(totalCellSize))
+		cell.RandOffset = f.generateRandomOffset(paddingLen)
 
 		cells = append(cells, cell)
 		payloadOffset += payloadLen
@@ -117,21 +121,50 @@ func (f *Framer) Fragment(data []byte) ([]*Cell, error) {
 	return cells, nil
 }
 
+// CreateControlCell creates a control cell carrying payload. If the Framer
+// has Keys, EncodeCell appends a tag authenticating it to the payload, and
+// DecodeCell checks and removes it. Control cells are numbered in a stream
+// of their own, with CellID zero.
+func (f *Framer) CreateControlCell(payload []byte) (*Cell, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := len(payload)
+	if f.send != nil {
+		n += ControlTagLen
+	}
+	if n > 0xffff {
+		return nil, errors.New("control cell payload too long")
+	}
+	seq := f.controlSeq
+	f.controlSeq++
+	return &Cell{
+		Type:       TypeControl,
+		Seq:        seq,
+		Timestamp:  time.Now().UnixNano() / 1e6,
+		PayloadLen: uint16(len(payload)),
+		Payload:    payload,
+		Padding:    []byte{},
+	}, nil
+}
+
 // CreateDummyCell creates a dummy cell for cover traffic.
 func (f *Framer) CreateDummyCell() (*Cell, error) {
-	totalCellSize := f.profile.GetNextCellSize()
-	paddingLen := totalCellSize - CellHeaderLen
+	return f.CreateDummyCellOfSize(f.profile.GetNextCellSize())
+}
 
-	var currentProfileType profile.TrafficType
-	if len(f.profile.TrafficWeights) == 1 {
-		for t := range f.profile.TrafficWeights {
-			currentProfileType = t
-		}
-	} else {
-		currentProfileType = profile.WebBrowsing
+// CreateDummyCellOfSize creates a dummy cell whose encoded length is
+// totalCellSize, as requested by a cover traffic policy.
+func (f *Framer) CreateDummyCellOfSize(totalCellSize int) (*Cell, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	paddingLen := totalCellSize - CellHeaderLen
+	if paddingLen < 0 {
+		paddingLen = 0
 	}
 
-	padding := f.generatePadding(paddingLen, currentProfileType)
+	padding := f.generatePadding(paddingLen)
 
 	cell := &Cell{
 		CellID:     0x0000,
@@ -141,50 +174,51 @@ func (f *Framer) CreateDummyCell() (*Cell, error) {
 		Timestamp:  time.Now().UnixNano() / 1e6,
 		PayloadLen: 0,
 		PaddingLen: uint16(paddingLen),
-		RandOffset: f.generateRandomOffset(uint16(totalCellSize)),
+		RandOffset: f.generateRandomOffset(paddingLen),
 		Payload:    []byte{},
 		Padding:    padding,
 	}
 	return cell, nil
 }
 
-// generatePadding creates content-aware or random padding.
-func (f *Framer) generatePadding(length int, profileType profile.TrafficType) []byte {
+// generatePadding creates content-aware padding using the overriding
+// generator, or else the one selected by the active profile. Mixture profiles
+// pad like their currently dominant traffic type.
+func (f *Framer) generatePadding(length int) []byte {
 	if length <= 0 {
 		return []byte{}
 	}
 
-	if profileType == profile.WebBrowsing {
-		switch rand.Intn(2) {
-		case 0:
-			data := make([]byte, (length/4)*3)
-			crypto_rand.Read(data)
-			encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
-			base64.StdEncoding.Encode(encoded, data)
-			if len(encoded) > length {
-				return encoded[:length]
-			}
-			padding := make([]byte, length)
-			copy(padding, encoded)
-			crypto_rand.Read(padding[len(encoded):])
-			return padding
-		case 1:
-			padding := make([]byte, length)
-			crypto_rand.Read(padding)
-			for i := 0; i < len(padding); i += 10 {
-				padding[i] = 0x00
-			}
-			return padding
-		}
+	g := f.padding
+	if g == nil {
+		g = newPaddingGenerator(f.profile.Padding, f.profile.DominantType(), f.source())
 	}
+	return g.Generate(length)
+}
 
-	padding := make([]byte, length)
-	crypto_rand.Read(padding)
-	return padding
+// source returns the keyed padding PRNG, or the global generators if the
+// Framer has no Keys.
+func (f *Framer) source() source {
+	if f.send == nil {
+		return source{}
+	}
+	return f.send.rand
 }
 
-// EncodeCell serializes a Cell struct into a byte slice.
+// EncodeCell serializes a Cell struct into a byte slice. With Keys, the
+// header is masked and control cells are authenticated.
 func (f *Framer) EncodeCell(cell *Cell) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cell.Type == TypeControl && f.send != nil {
+		tag := f.send.controlTag(cell.Seq, cell.Payload)
+		c := *cell
+		c.Payload = append(cell.Payload[:len(cell.Payload):len(cell.Payload)], tag...)
+		c.PayloadLen = uint16(len(c.Payload))
+		cell = &c
+	}
+
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, cell.CellID); err != nil { return nil, err }
 	if err := binary.Write(buf, binary.BigEndian, cell.Type); err != nil { return nil, err }
@@ -203,17 +237,32 @@ func (f *Framer) EncodeCell(cell *Cell) ([]byte, error) {
 
 	buf.Write(totalContent)
 
-	return buf.Bytes(), nil
+	encoded := buf.Bytes()
+	if f.send != nil {
+		f.send.mask(encoded[:CellHeaderLen], encoded[CellHeaderLen:])
+	}
+	return encoded, nil
 }
 
-// DecodeCell deserializes a byte slice back into a Cell struct.
+// DecodeCell deserializes a byte slice back into a Cell struct. With Keys,
+// the header is unmasked and control cells are checked.
 func (f *Framer) DecodeCell(data []byte) (*Cell, error) {
 	if len(data) < CellHeaderLen {
 		return nil, errors.New("cell data too short")
 	}
 
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	header := data[:CellHeaderLen]
+	d := f.receive
+	if d != nil {
+		header = bytes.Clone(header)
+		d.mask(header, data[CellHeaderLen:])
+	}
+
 	cell := &Cell{}
-	reader := bytes.NewReader(data)
+	reader := bytes.NewReader(header)
 	if err := binary.Read(reader, binary.BigEndian, &cell.CellID); err != nil { return nil, err }
 	if err := binary.Read(reader, binary.BigEndian, &cell.Type); err != nil { return nil, err }
 	if err := binary.Read(reader, binary.BigEndian, &cell.Flags); err != nil { return nil, err }
@@ -224,34 +273,55 @@ func (f *Framer) DecodeCell(data []byte) (*Cell, error) {
 	if err := binary.Read(reader, binary.BigEndian, &cell.RandOffset); err != nil { return nil, err }
 
 	payloadAndPadding := data[CellHeaderLen:]
-	if len(payloadAndPadding) != int(cell.PayloadLen + cell.PaddingLen) {
+	if len(payloadAndPadding) != int(cell.PayloadLen)+int(cell.PaddingLen) {
 		return nil, errors.New("cell content length mismatch")
 	}
+	if cell.RandOffset > cell.PaddingLen {
+		return nil, errors.New("cell payload offset out of range")
+	}
 	
 	cell.Payload = make([]byte, cell.PayloadLen)
 	cell.Padding = make([]byte, cell.PaddingLen)
 	
-	copy(cell.Payload, payloadAndPadding[cell.RandOffset:int(cell.RandOffset+cell.PayloadLen)])
+	copy(cell.Payload, payloadAndPadding[cell.RandOffset:int(cell.RandOffset)+int(cell.PayloadLen)])
 	copy(cell.Padding, payloadAndPadding[:cell.RandOffset])
-	copy(cell.Padding[cell.RandOffset:], payloadAndPadding[int(cell.RandOffset+cell.PayloadLen):])
+	copy(cell.Padding[cell.RandOffset:], payloadAndPadding[int(cell.RandOffset)+int(cell.PayloadLen):])
+
+	if cell.Type == TypeControl && d != nil {
+		n := len(cell.Payload) - ControlTagLen
+		if n < 0 || !hmac.Equal(cell.Payload[n:], d.controlTag(cell.Seq, cell.Payload[:n])) {
+			return nil, ErrControlAuth
+		}
+		cell.Payload = cell.Payload[:n]
+		cell.PayloadLen = uint16(n)
+	}
 
 	return cell, nil
 }
 
-// generateCellID creates a cryptographically secure random CellID.
+// generateCellID creates a cryptographically secure random CellID, or one
+// derived from the Keys of the Framer. It never returns zero, the CellID of
+// control and dummy cells.
 func (f *Framer) generateCellID() uint16 {
-	var id [2]byte
-	_, err := crypto_rand.Read(id[:])
-	if err != nil {
-		return 0
+	if f.send != nil {
+		return f.send.nextCellID()
+	}
+	var b [2]byte
+	for {
+		// crypto/rand.Read never fails.
+		crypto_rand.Read(b[:])
+		if id := binary.BigEndian.Uint16(b[:]); id != 0 {
+			return id
+		}
 	}
-	return binary.BigEndian.Uint16(id[:])
 }
 
 // generateRandomOffset creates a random offset for payload within the cell.
-func (f *Framer) generateRandomOffset(max uint16) uint16 {
-	if max <= 1 {
+// The payload may start anywhere from before the first padding byte to after
+// the last one, so the offset is drawn from [0, paddingLen].
+func (f *Framer) generateRandomOffset(paddingLen int) uint16 {
+	if paddingLen <= 0 {
 		return 0
 	}
-	return uint16(rand.Intn(int(max - 1)))
+	return uint16(f.source().Intn(paddingLen + 1))
 }
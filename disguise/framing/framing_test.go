@@ -0,0 +1,39 @@
+package framing
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// TestCellIDReserved checks that no data stream gets CellID zero, which
+// control and dummy cells use.
+func TestCellIDReserved(t *testing.T) {
+	f := NewFramer(profile.GetProfile(profile.WebBrowsing))
+	for range 1 << 17 {
+		if f.generateCellID() == 0 {
+			t.Fatal("random CellID zero")
+		}
+	}
+
+	keys, err := DeriveKeys(make([]byte, 32), "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The 7263rd stream of these Keys draws zero.
+	const streams = 8000
+	zero := false
+	for i := range uint64(streams) {
+		zero = zero || binary.BigEndian.Uint16(prf(keys.cellID, i)) == 0
+	}
+	if !zero {
+		t.Fatalf("none of the first %d streams draws zero", streams)
+	}
+	f.SetKeys(keys, keys)
+	for range streams {
+		if f.generateCellID() == 0 {
+			t.Fatal("keyed CellID zero")
+		}
+	}
+}
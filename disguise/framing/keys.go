@@ -0,0 +1,144 @@
+package framing
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ControlTagLen is the length of the authentication tag that ends the
+// payload of a control cell sent with Keys.
+const ControlTagLen = 16
+
+// ErrControlAuth is returned by DecodeCell for a control cell whose tag does
+// not verify.
+var ErrControlAuth = errors.New("control cell authentication failed")
+
+// Keys are the secrets a Framer keys the cells of one direction of a
+// connection with. The sender and the receiver derive the same Keys from the
+// secret of the connection, so that the receiver can undo the header masking
+// and check control cells.
+type Keys struct {
+	cellID  []byte // keys the generation of CellIDs
+	header  []byte // masks the cell headers
+	padding []byte // seeds the padding PRNG
+	control []byte // authenticates control cells
+}
+
+// DeriveKeys expands secret, which must be uniformly random and unique to
+// the connection, into the Keys of the direction named by label.
+func DeriveKeys(secret []byte, label string) (*Keys, error) {
+	k := new(Keys)
+	for _, key := range []struct {
+		dst  *[]byte
+		name string
+	}{
+		{&k.cellID, "cell id"},
+		{&k.header, "header"},
+		{&k.padding, "padding"},
+		{&k.control, "control"},
+	} {
+		b := make([]byte, 32)
+		if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, []byte("disguise "+label+" "+key.name)), b); err != nil {
+			return nil, err
+		}
+		*key.dst = b
+	}
+	return k, nil
+}
+
+// keyedDirection is the state of one direction of a Framer that has Keys.
+type keyedDirection struct {
+	keys *Keys
+	// streams counts the CellIDs generated.
+	streams uint64
+	// rand is the padding PRNG.
+	rand source
+}
+
+func newKeyedDirection(keys *Keys) *keyedDirection {
+	if keys == nil {
+		return nil
+	}
+	var seed [32]byte
+	copy(seed[:], keys.padding)
+	return &keyedDirection{keys: keys, rand: newSource(rand.NewChaCha8(seed))}
+}
+
+// prf returns HMAC-SHA256 of a counter under key.
+func prf(key []byte, counter uint64) []byte {
+	h := hmac.New(sha256.New, key)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], counter)
+	h.Write(b[:])
+	return h.Sum(nil)
+}
+
+// nextCellID returns the CellID of the next stream. Zero, the CellID of
+// control and dummy cells, is skipped.
+func (d *keyedDirection) nextCellID() uint16 {
+	for {
+		id := binary.BigEndian.Uint16(prf(d.keys.cellID, d.streams))
+		d.streams++
+		if id != 0 {
+			return id
+		}
+	}
+}
+
+// mask XORs the header of a cell with its mask, which is derived from the
+// rest of the cell, so that the receiver can unmask any cell on its own,
+// whichever cells were encoded but never sent before it.
+func (d *keyedDirection) mask(header, body []byte) {
+	h := hmac.New(sha256.New, d.keys.header)
+	h.Write(body)
+	m := h.Sum(nil)
+	for i := range header[:CellHeaderLen] {
+		header[i] ^= m[i]
+	}
+}
+
+// controlTag returns the tag of a control cell with payload, bound to its
+// sequence number in the stream of control cells.
+func (d *keyedDirection) controlTag(seq uint32, payload []byte) []byte {
+	h := hmac.New(sha256.New, d.keys.control)
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], seq)
+	h.Write(b[:])
+	h.Write(payload)
+	return h.Sum(nil)[:ControlTagLen]
+}
+
+// SetKeys keys the cells the Framer encodes with send, and the ones it
+// decodes with receive, which must match the Keys the peer sends with. It
+// must be called before any cell is encoded or decoded. Keyed Framers derive
+// CellIDs and padding from the Keys, mask cell headers, and authenticate
+// control cells.
+func (f *Framer) SetKeys(send, receive *Keys) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.send = newKeyedDirection(send)
+	f.receive = newKeyedDirection(receive)
+}
+
+// SetSendKeys replaces the Keys the Framer encodes cells with, leaving the
+// receiving direction as it is. Cells encoded afterwards, including those
+// fragmented before, are masked and authenticated with send.
+func (f *Framer) SetSendKeys(send *Keys) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.send = newKeyedDirection(send)
+}
+
+// SetReceiveKeys replaces the Keys the Framer decodes cells with, leaving
+// the sending direction as it is.
+func (f *Framer) SetReceiveKeys(receive *Keys) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.receive = newKeyedDirection(receive)
+}
@@ -0,0 +1,164 @@
+package framing
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// keyedFramers returns a sender and a receiver keyed for the same direction.
+func keyedFramers(t *testing.T) (send, receive *Framer) {
+	t.Helper()
+	secret := bytes.Repeat([]byte{1}, 32)
+	client, err := DeriveKeys(secret, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := DeriveKeys(secret, "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := profile.GetProfile(profile.WebBrowsing)
+	send, receive = NewFramer(p), NewFramer(p)
+	send.SetKeys(client, server)
+	receive.SetKeys(server, client)
+	return send, receive
+}
+
+func TestDeriveKeys(t *testing.T) {
+	secret := bytes.Repeat([]byte{1}, 32)
+	k, err := DeriveKeys(secret, "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := DeriveKeys(secret, "client")
+	server, _ := DeriveKeys(secret, "server")
+	other, _ := DeriveKeys(bytes.Repeat([]byte{2}, 32), "client")
+
+	keys := [][]byte{k.cellID, k.header, k.padding, k.control}
+	for i, key := range keys {
+		if len(key) != 32 {
+			t.Errorf("key %d of %d bytes, want 32", i, len(key))
+		}
+		for _, prev := range keys[:i] {
+			if bytes.Equal(key, prev) {
+				t.Errorf("key %d repeats an earlier one", i)
+			}
+		}
+	}
+	for _, tt := range []struct {
+		name string
+		k    *Keys
+		same bool
+	}{
+		{"same secret and label", again, true},
+		{"other label", server, false},
+		{"other secret", other, false},
+	} {
+		for i, key := range [][]byte{tt.k.cellID, tt.k.header, tt.k.padding, tt.k.control} {
+			if bytes.Equal(key, keys[i]) != tt.same {
+				t.Errorf("key %d with the %s: equal %v, want %v", i, tt.name, !tt.same, tt.same)
+			}
+		}
+	}
+}
+
+func TestHeaderMask(t *testing.T) {
+	send, receive := keyedFramers(t)
+	plain := NewFramer(profile.GetProfile(profile.WebBrowsing))
+
+	cells, err := send.Fragment(make([]byte, 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := make([][]byte, len(cells))
+	for i, cell := range cells {
+		if encoded[i], err = send.EncodeCell(cell); err != nil {
+			t.Fatal(err)
+		}
+		unmasked, _ := plain.EncodeCell(cell)
+		if bytes.Equal(encoded[i][:CellHeaderLen], unmasked[:CellHeaderLen]) {
+			t.Errorf("header of cell %d not masked", i)
+		}
+		if !bytes.Equal(encoded[i][CellHeaderLen:], unmasked[CellHeaderLen:]) {
+			t.Errorf("content of cell %d masked", i)
+		}
+	}
+
+	// A cell encoded but never sent does not affect the masks of the
+	// ones that are, and the receiver unmasks cells in any order.
+	if _, err := send.EncodeCell(cells[0]); err != nil {
+		t.Fatal(err)
+	}
+	for i := len(encoded) - 1; i >= 0; i-- {
+		cell, err := receive.DecodeCell(encoded[i])
+		if err != nil {
+			t.Fatalf("DecodeCell(cell %d) = %v", i, err)
+		}
+		if cell.CellID != cells[i].CellID || cell.Seq != cells[i].Seq || !bytes.Equal(cell.Payload, cells[i].Payload) {
+			t.Errorf("cell %d decoded as %+v, want %+v", i, cell, cells[i])
+		}
+	}
+
+	// A Framer with other Keys reads garbage.
+	other, _ := keyedFramers(t)
+	if cell, err := other.DecodeCell(encoded[0]); err == nil && cell.CellID == cells[0].CellID && cell.Seq == cells[0].Seq {
+		t.Error("cell unmasked by the sender's own Keys")
+	}
+}
+
+func TestControlTag(t *testing.T) {
+	send, receive := keyedFramers(t)
+	var encoded [][]byte
+	for _, payload := range []string{"first", "second"} {
+		cell, err := send.CreateControlCell([]byte(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := send.EncodeCell(cell)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded = append(encoded, b)
+	}
+	for i, want := range []string{"first", "second"} {
+		cell, err := receive.DecodeCell(encoded[i])
+		if err != nil {
+			t.Fatalf("DecodeCell(control cell %d) = %v", i, err)
+		}
+		if string(cell.Payload) != want || int(cell.PayloadLen) != len(want) {
+			t.Errorf("control cell %d carries %q, want %q", i, cell.Payload, want)
+		}
+	}
+
+	// A cell tagged with another control key is rejected, even though
+	// its header unmasks.
+	forged := *send.send.keys
+	forged.control = bytes.Repeat([]byte{3}, 32)
+	forger := NewFramer(profile.GetProfile(profile.WebBrowsing))
+	forger.SetKeys(&forged, &forged)
+	cell, _ := forger.CreateControlCell([]byte("first"))
+	b, _ := forger.EncodeCell(cell)
+	if _, err := receive.DecodeCell(b); err != ErrControlAuth {
+		t.Errorf("DecodeCell(forged control cell) = %v, want ErrControlAuth", err)
+	}
+
+	// The tag covers the payload, and the position of the cell in the
+	// stream of control cells.
+	d := send.send
+	if bytes.Equal(d.controlTag(0, []byte("first")), d.controlTag(1, []byte("first"))) {
+		t.Error("control tag not bound to the sequence number")
+	}
+	if bytes.Equal(d.controlTag(0, []byte("first")), d.controlTag(0, []byte("second"))) {
+		t.Error("control tag not bound to the payload")
+	}
+
+	// Control cells of an unkeyed Framer are not accepted.
+	plain := NewFramer(profile.GetProfile(profile.WebBrowsing))
+	cell, _ = plain.CreateControlCell([]byte("first"))
+	b, _ = plain.EncodeCell(cell)
+	if _, err := receive.DecodeCell(b); err == nil {
+		t.Error("DecodeCell accepted an unauthenticated control cell")
+	}
+}
@@ -0,0 +1,235 @@
+package framing
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"math/rand/v2"
+	"strconv"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// PaddingGenerator produces the bytes that fill the padding of a cell.
+type PaddingGenerator interface {
+	// Generate returns exactly length bytes of padding.
+	Generate(length int) []byte
+}
+
+// PaddingGeneratorFunc adapts an ordinary function to a PaddingGenerator.
+type PaddingGeneratorFunc func(length int) []byte
+
+// Generate calls f(length).
+func (f PaddingGeneratorFunc) Generate(length int) []byte { return f(length) }
+
+// NewPaddingGenerator returns the generator for a padding style. PaddingAuto
+// is resolved using the traffic type the cell belongs to.
+func NewPaddingGenerator(style profile.PaddingStyle, t profile.TrafficType) PaddingGenerator {
+	return newPaddingGenerator(style, t, source{})
+}
+
+// source is the randomness padding is drawn from: the keyed PRNG of a
+// Framer, or the global generators if it is the zero value.
+type source struct {
+	chacha *rand.ChaCha8
+	rand   *rand.Rand
+}
+
+func newSource(c *rand.ChaCha8) source {
+	return source{chacha: c, rand: rand.New(c)}
+}
+
+func (s source) Intn(n int) int {
+	if s.rand == nil {
+		return rand.IntN(n)
+	}
+	return s.rand.IntN(n)
+}
+
+func (s source) Int63n(n int64) int64 {
+	if s.rand == nil {
+		return rand.Int64N(n)
+	}
+	return s.rand.Int64N(n)
+}
+
+func (s source) Uint32() uint32 {
+	if s.rand == nil {
+		return rand.Uint32()
+	}
+	return s.rand.Uint32()
+}
+
+// Read fills b with cryptographically random bytes.
+func (s source) Read(b []byte) {
+	if s.chacha == nil {
+		crypto_rand.Read(b)
+		return
+	}
+	s.chacha.Read(b)
+}
+
+func newPaddingGenerator(style profile.PaddingStyle, t profile.TrafficType, src source) PaddingGenerator {
+	if style == profile.PaddingAuto {
+		switch t {
+		case profile.WebBrowsing:
+			return webGenerator{src}
+		case profile.VideoStreaming:
+			style = profile.PaddingVideo
+		case profile.FileDownload:
+			style = profile.PaddingCompressed
+		default:
+			style = profile.PaddingRandom
+		}
+	}
+
+	switch style {
+	case profile.PaddingHPACK:
+		return hpackGenerator{src}
+	case profile.PaddingText:
+		return textGenerator{src}
+	case profile.PaddingVideo:
+		return videoGenerator{src}
+	case profile.PaddingCompressed:
+		return compressedGenerator{src}
+	default:
+		return randomGenerator{src}
+	}
+}
+
+// randomGenerator fills padding with cryptographically random bytes.
+type randomGenerator struct{ src source }
+
+func (g randomGenerator) Generate(length int) []byte {
+	padding := make([]byte, length)
+	g.src.Read(padding)
+	return padding
+}
+
+// webGenerator mixes header blocks and text bodies, like a page load.
+type webGenerator struct{ src source }
+
+func (g webGenerator) Generate(length int) []byte {
+	if g.src.Intn(2) == 0 {
+		return hpackGenerator(g).Generate(length)
+	}
+	return textGenerator(g).Generate(length)
+}
+
+// hpackStaticFields are static table indices (RFC 7541, Appendix A) of
+// header fields browsers commonly send fully indexed.
+var hpackStaticFields = []byte{2, 3, 4, 5, 6, 7, 8, 16, 19, 31, 32, 33}
+
+// hpackLiteralNames are static table indices of header names browsers
+// commonly send with a literal value.
+var hpackLiteralNames = []byte{1, 4, 15, 16, 19, 23, 28, 31, 32, 33, 51, 58}
+
+// hpackGenerator emits a sequence of HPACK header field representations:
+// indexed fields, dynamic table references and literals with incremental
+// indexing whose Huffman coded values are random bytes.
+type hpackGenerator struct{ src source }
+
+func (g hpackGenerator) Generate(length int) []byte {
+	buf := make([]byte, 0, length+64)
+	for len(buf) < length {
+		switch g.src.Intn(3) {
+		case 0:
+			buf = append(buf, 0x80|hpackStaticFields[g.src.Intn(len(hpackStaticFields))])
+		case 1:
+			// Dynamic table entries start at index 62.
+			buf = append(buf, 0x80|byte(62+g.src.Intn(64)))
+		default:
+			valueLen := 4 + g.src.Intn(48)
+			buf = append(buf, 0x40|hpackLiteralNames[g.src.Intn(len(hpackLiteralNames))])
+			buf = append(buf, 0x80|byte(valueLen))
+			value := make([]byte, valueLen)
+			g.src.Read(value)
+			buf = append(buf, value...)
+		}
+	}
+	return buf[:length]
+}
+
+var textKeys = []string{"id", "name", "type", "data", "items", "url", "status", "value", "token", "updated_at", "count", "meta"}
+
+// textGenerator emits JSON fragments and base64 encoded text.
+type textGenerator struct{ src source }
+
+func (g textGenerator) Generate(length int) []byte {
+	if g.src.Intn(3) == 0 {
+		data := make([]byte, (length/4)*3+3)
+		g.src.Read(data)
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(data)))
+		base64.StdEncoding.Encode(encoded, data)
+		return encoded[:length]
+	}
+
+	buf := make([]byte, 0, length+64)
+	buf = append(buf, '{')
+	for len(buf) < length {
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		buf = strconv.AppendQuote(buf, textKeys[g.src.Intn(len(textKeys))])
+		buf = append(buf, ':')
+		switch g.src.Intn(3) {
+		case 0:
+			buf = strconv.AppendInt(buf, g.src.Int63n(1<<32), 10)
+		case 1:
+			buf = append(buf, '"')
+			buf = append(buf, randomToken(g.src, 4+g.src.Intn(28))...)
+			buf = append(buf, '"')
+		default:
+			buf = append(buf, "true"...)
+		}
+	}
+	return buf[:length]
+}
+
+// randomToken returns n base64url characters.
+func randomToken(src source, n int) []byte {
+	raw := make([]byte, base64.RawURLEncoding.DecodedLen(n)+1)
+	src.Read(raw)
+	token := make([]byte, base64.RawURLEncoding.EncodedLen(len(raw)))
+	base64.RawURLEncoding.Encode(token, raw)
+	return token[:n]
+}
+
+// videoGenerator emits fragmented MP4 chunks: a moof box announcing the
+// fragment followed by an mdat box holding random sample data.
+type videoGenerator struct{ src source }
+
+func (g videoGenerator) Generate(length int) []byte {
+	buf := make([]byte, 0, length+32)
+	if length >= 48 && g.src.Intn(4) == 0 {
+		var moof [24]byte
+		binary.BigEndian.PutUint32(moof[0:], 24)
+		copy(moof[4:], "moof")
+		binary.BigEndian.PutUint32(moof[8:], 16)
+		copy(moof[12:], "mfhd")
+		binary.BigEndian.PutUint32(moof[20:], g.src.Uint32())
+		buf = append(buf, moof[:]...)
+	}
+	var mdat [8]byte
+	binary.BigEndian.PutUint32(mdat[0:], uint32(length-len(buf)))
+	copy(mdat[4:], "mdat")
+	buf = append(buf, mdat[:]...)
+	if len(buf) < length {
+		samples := make([]byte, length-len(buf))
+		g.src.Read(samples)
+		buf = append(buf, samples...)
+	}
+	return buf[:length]
+}
+
+// compressedGenerator emits gzip members: a valid header followed by
+// incompressible bytes, which is what a deflate stream looks like.
+type compressedGenerator struct{ src source }
+
+func (g compressedGenerator) Generate(length int) []byte {
+	buf := make([]byte, length)
+	g.src.Read(buf)
+	header := []byte{0x1f, 0x8b, 0x08, 0x00, 0, 0, 0, 0, 0x00, 0x03}
+	copy(buf, header)
+	return buf
+}
@@ -0,0 +1,94 @@
+package framing
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+var paddingStyles = map[profile.PaddingStyle]string{
+	profile.PaddingRandom:     "random",
+	profile.PaddingHPACK:      "hpack",
+	profile.PaddingText:       "text",
+	profile.PaddingVideo:      "video",
+	profile.PaddingCompressed: "compressed",
+}
+
+func TestPaddingLength(t *testing.T) {
+	for style, name := range paddingStyles {
+		g := NewPaddingGenerator(style, profile.WebBrowsing)
+		for _, length := range []int{0, 1, 7, 10, 48, 100, 1378} {
+			for range 20 {
+				if got := len(g.Generate(length)); got != length {
+					t.Fatalf("%s padding of %d bytes has %d", name, length, got)
+				}
+			}
+		}
+	}
+}
+
+func TestPaddingContent(t *testing.T) {
+	const length = 500
+	for range 20 {
+		if p := NewPaddingGenerator(profile.PaddingCompressed, profile.WebBrowsing).Generate(length); !bytes.HasPrefix(p, []byte{0x1f, 0x8b, 0x08}) {
+			t.Errorf("compressed padding does not start with a gzip header: %x", p[:10])
+		}
+
+		p := NewPaddingGenerator(profile.PaddingVideo, profile.WebBrowsing).Generate(length)
+		if box := string(p[4:8]); box != "mdat" && box != "moof" {
+			t.Errorf("video padding starts with a %q box", box)
+		}
+
+		p = NewPaddingGenerator(profile.PaddingText, profile.WebBrowsing).Generate(length)
+		if p[0] != '{' {
+			if _, err := base64.StdEncoding.DecodeString(string(p[:length/4*4])); err != nil {
+				t.Errorf("text padding is neither JSON nor base64: %q", p[:32])
+			}
+		}
+
+		p = NewPaddingGenerator(profile.PaddingHPACK, profile.WebBrowsing).Generate(length)
+		if p[0]&0xc0 == 0 {
+			t.Errorf("HPACK padding starts with %#x, not an indexed field or a literal", p[0])
+		}
+	}
+}
+
+func TestPaddingAuto(t *testing.T) {
+	for typ, want := range map[profile.TrafficType]PaddingGenerator{
+		profile.WebBrowsing:    webGenerator{},
+		profile.VideoStreaming: videoGenerator{},
+		profile.FileDownload:   compressedGenerator{},
+		profile.Dynamic:        randomGenerator{},
+	} {
+		if got := NewPaddingGenerator(profile.PaddingAuto, typ); got != want {
+			t.Errorf("automatic padding of %v is %T, want %T", typ, got, want)
+		}
+	}
+}
+
+func TestSetPaddingGenerator(t *testing.T) {
+	f := NewFramer(profile.GetProfile(profile.WebBrowsing))
+	f.SetPaddingGenerator(PaddingGeneratorFunc(func(length int) []byte {
+		return bytes.Repeat([]byte{'p'}, length)
+	}))
+	cells, err := f.Fragment(make([]byte, 5000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cell := range cells {
+		if len(cell.Padding) != int(cell.PaddingLen) || bytes.Count(cell.Padding, []byte{'p'}) != len(cell.Padding) {
+			t.Fatalf("cell padded with %q, not by the generator", cell.Padding)
+		}
+	}
+
+	f.SetPaddingGenerator(nil)
+	cell, err := f.CreateDummyCellOfSize(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Count(cell.Padding, []byte{'p'}) == len(cell.Padding) {
+		t.Error("the generator was still used after it was cleared")
+	}
+}
@@ -0,0 +1,155 @@
+package framing
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Replay protection errors returned by ReplayWindow.Check.
+var (
+	ErrClockSkew     = errors.New("cell timestamp outside the allowed clock skew")
+	ErrDuplicateCell = errors.New("duplicate cell sequence number")
+	ErrStaleCell     = errors.New("cell sequence number behind the replay window")
+	ErrSeqWrapped    = errors.New("cell sequence number wrapped around")
+)
+
+const (
+	// replayWindowSize is the number of sequence numbers behind the highest
+	// one seen that are still accepted once.
+	replayWindowSize = 64
+	// maxReplayStreams bounds the number of data streams whose windows are
+	// kept. The oldest stream is forgotten first.
+	maxReplayStreams = 1024
+	// DefaultMaxClockSkew is the clock skew tolerated by a ReplayWindow
+	// when none is configured.
+	DefaultMaxClockSkew = 2 * time.Minute
+)
+
+// ReplayStats counts the cells rejected by a ReplayWindow.
+type ReplayStats struct {
+	ClockSkew uint64
+	Duplicate uint64
+	Stale     uint64
+	Wrapped   uint64
+}
+
+// seqWindow is a sliding bitmap over the sequence numbers of one stream.
+// Bit i of seen is set if highest-i has been accepted.
+type seqWindow struct {
+	highest uint32
+	seen    uint64
+}
+
+// ReplayWindow validates the timestamps and sequence numbers of inbound
+// cells. Streams are keyed by CellID and each keeps a sliding window of
+// recently accepted sequence numbers, so a replayed cell is detected even
+// after its stream has been reassembled.
+//
+// The data cells of all streams share the sequence numbers of the Framer
+// that sent them, which only grow. When a stream is forgotten, the highest
+// sequence number it reached becomes a low-water mark: a cell of a stream
+// that is not tracked must be above it, or it may replay a forgotten stream.
+type ReplayWindow struct {
+	mu      sync.Mutex
+	maxSkew time.Duration
+	streams map[uint16]*seqWindow
+	order   []uint16
+	// evicted is the low-water mark, valid if forgotten is set.
+	evicted   uint32
+	forgotten bool
+	stats     ReplayStats
+}
+
+// NewReplayWindow returns a ReplayWindow accepting timestamps up to maxSkew
+// away from the local clock. A zero maxSkew selects DefaultMaxClockSkew.
+func NewReplayWindow(maxSkew time.Duration) *ReplayWindow {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxClockSkew
+	}
+	return &ReplayWindow{
+		maxSkew: maxSkew,
+		streams: make(map[uint16]*seqWindow),
+	}
+}
+
+// Check validates cell at time now and records it as seen. Dummy cells
+// carry no sequence number and are only subject to the clock skew check.
+func (w *ReplayWindow) Check(cell *Cell, now time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	skew := now.Sub(time.UnixMilli(cell.Timestamp))
+	if skew > w.maxSkew || -skew > w.maxSkew {
+		w.stats.ClockSkew++
+		return ErrClockSkew
+	}
+	if cell.Type == TypeDummy {
+		return nil
+	}
+
+	win, ok := w.streams[cell.CellID]
+	if !ok {
+		if w.forgotten && cell.Seq <= w.evicted {
+			w.stats.Stale++
+			return ErrStaleCell
+		}
+		w.track(cell.CellID, &seqWindow{highest: cell.Seq, seen: 1})
+		return nil
+	}
+
+	switch {
+	case cell.Seq > win.highest:
+		shift := cell.Seq - win.highest
+		if shift >= replayWindowSize {
+			win.seen = 1
+		} else {
+			win.seen = win.seen<<shift | 1
+		}
+		win.highest = cell.Seq
+		return nil
+	case win.highest-cell.Seq >= 1<<31:
+		// The sender's counter ran past 2^32 and started over. Cells after
+		// the wrap are indistinguishable from replays of the earliest
+		// ones, so they are rejected.
+		w.stats.Wrapped++
+		return ErrSeqWrapped
+	case win.highest-cell.Seq >= replayWindowSize:
+		w.stats.Stale++
+		return ErrStaleCell
+	}
+
+	bit := uint64(1) << (win.highest - cell.Seq)
+	if win.seen&bit != 0 {
+		w.stats.Duplicate++
+		return ErrDuplicateCell
+	}
+	win.seen |= bit
+	return nil
+}
+
+// track starts the window of a stream, forgetting the oldest data stream if
+// there are too many. The control stream, CellID zero, numbers its cells on
+// its own and is never forgotten. track must be called with w.mu held.
+func (w *ReplayWindow) track(id uint16, win *seqWindow) {
+	w.streams[id] = win
+	if id == 0 {
+		return
+	}
+	if len(w.order) >= maxReplayStreams {
+		old := w.streams[w.order[0]]
+		if !w.forgotten || old.highest > w.evicted {
+			w.evicted, w.forgotten = old.highest, true
+		}
+		delete(w.streams, w.order[0])
+		w.order = w.order[1:]
+	}
+	w.order = append(w.order, id)
+}
+
+// Stats returns the number of cells rejected so far, by reason.
+func (w *ReplayWindow) Stats() ReplayStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.stats
+}
@@ -0,0 +1,151 @@
+package framing
+
+import (
+	"testing"
+	"time"
+)
+
+func replayCell(id uint16, seq uint32, ts time.Time) *Cell {
+	return &Cell{CellID: id, Type: TypeData, Seq: seq, Timestamp: ts.UnixMilli()}
+}
+
+func TestReplayWindow(t *testing.T) {
+	w := NewReplayWindow(0)
+	now := time.Now()
+	for _, tt := range []struct {
+		seq  uint32
+		want error
+	}{
+		{10, nil},
+		{10, ErrDuplicateCell},
+		{12, nil},
+		// Out of order, within the window.
+		{11, nil},
+		{11, ErrDuplicateCell},
+		{100, nil},
+		{100 - replayWindowSize + 1, nil},
+		{100 - replayWindowSize, ErrStaleCell},
+		{12, ErrStaleCell},
+		// A jump past the window forgets it.
+		{1000, nil},
+		{999, nil},
+		{100, ErrStaleCell},
+	} {
+		if err := w.Check(replayCell(1, tt.seq, now), now); err != tt.want {
+			t.Errorf("Check(seq %d) = %v, want %v", tt.seq, err, tt.want)
+		}
+	}
+	// Streams are independent.
+	if err := w.Check(replayCell(2, 10, now), now); err != nil {
+		t.Errorf("Check(seq 10 of another stream) = %v", err)
+	}
+	if s := w.Stats(); s != (ReplayStats{Duplicate: 2, Stale: 3}) {
+		t.Errorf("Stats = %+v", s)
+	}
+}
+
+func TestReplayWindowWrap(t *testing.T) {
+	w := NewReplayWindow(0)
+	now := time.Now()
+	for _, tt := range []struct {
+		seq  uint32
+		want error
+	}{
+		{1<<32 - 2, nil},
+		{1<<32 - 1, nil},
+		// Past 2^32, the sender's counter started over.
+		{0, ErrSeqWrapped},
+		{5, ErrSeqWrapped},
+		// A cell 2^31 back is the first to count as wrapped.
+		{1<<32 - 1 - (1<<31 - 1), ErrStaleCell},
+		{1<<32 - 1 - 1<<31, ErrSeqWrapped},
+	} {
+		if err := w.Check(replayCell(1, tt.seq, now), now); err != tt.want {
+			t.Errorf("Check(seq %d) = %v, want %v", tt.seq, err, tt.want)
+		}
+	}
+	if s := w.Stats(); s.Wrapped != 3 || s.Stale != 1 {
+		t.Errorf("Stats = %+v", s)
+	}
+}
+
+func TestReplayClockSkew(t *testing.T) {
+	const skew = time.Minute
+	w := NewReplayWindow(skew)
+	now := time.Now()
+	for i, tt := range []struct {
+		offset time.Duration
+		want   error
+	}{
+		{0, nil},
+		{skew, nil},
+		{-skew, nil},
+		{skew + time.Millisecond, ErrClockSkew},
+		{-skew - time.Millisecond, ErrClockSkew},
+	} {
+		cell := replayCell(1, uint32(i), now.Add(tt.offset).Truncate(time.Millisecond))
+		if err := w.Check(cell, now.Truncate(time.Millisecond)); err != tt.want {
+			t.Errorf("Check(timestamp %v away) = %v, want %v", tt.offset, err, tt.want)
+		}
+	}
+
+	// Dummy cells are only checked for skew.
+	dummy := &Cell{Type: TypeDummy, Timestamp: now.UnixMilli()}
+	for range 2 {
+		if err := w.Check(dummy, now); err != nil {
+			t.Errorf("Check(dummy) = %v", err)
+		}
+	}
+	dummy.Timestamp = now.Add(-2 * skew).UnixMilli()
+	if err := w.Check(dummy, now); err != ErrClockSkew {
+		t.Errorf("Check(late dummy) = %v, want %v", err, ErrClockSkew)
+	}
+	if s := w.Stats(); s.ClockSkew != 3 {
+		t.Errorf("Stats = %+v, want 3 skewed cells", s)
+	}
+}
+
+// TestReplayStreamLimit checks that the cells of a stream forgotten to make
+// room for newer ones, down to its final cell, are not accepted again.
+func TestReplayStreamLimit(t *testing.T) {
+	w := NewReplayWindow(0)
+	now := time.Now()
+	// The first stream ends with a final cell, after which the
+	// Reassembler forgets it too.
+	final := replayCell(1, 2, now)
+	final.Flags = 0x01
+	for seq := range uint32(2) {
+		w.Check(replayCell(1, seq, now), now)
+	}
+	w.Check(final, now)
+	// A control cell, numbered in a stream of its own.
+	if err := w.Check(replayCell(0, 0, now), now); err != nil {
+		t.Fatalf("Check(control cell) = %v", err)
+	}
+	seq := uint32(3)
+	for id := range uint16(maxReplayStreams) {
+		if err := w.Check(replayCell(id+2, seq, now), now); err != nil {
+			t.Fatalf("Check(stream %d) = %v", id+2, err)
+		}
+		seq++
+	}
+
+	for _, cell := range []*Cell{final, replayCell(1, 0, now)} {
+		if err := w.Check(cell, now); err != ErrStaleCell {
+			t.Errorf("Check(seq %d of a forgotten stream) = %v, want %v", cell.Seq, err, ErrStaleCell)
+		}
+	}
+	if err := w.Check(replayCell(maxReplayStreams+1, seq-1, now), now); err != ErrDuplicateCell {
+		t.Errorf("Check(replay of a recent stream) = %v, want %v", err, ErrDuplicateCell)
+	}
+	// New streams and control cells still go through.
+	if err := w.Check(replayCell(1, seq, now), now); err != nil {
+		t.Errorf("Check(new stream) = %v", err)
+	}
+	if err := w.Check(replayCell(0, 1, now), now); err != nil {
+		t.Errorf("Check(next control cell) = %v", err)
+	}
+	if err := w.Check(replayCell(0, 0, now), now); err != ErrDuplicateCell {
+		t.Errorf("Check(replayed control cell) = %v, want %v", err, ErrDuplicateCell)
+	}
+}
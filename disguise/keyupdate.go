@@ -0,0 +1,132 @@
+package disguise
+
+import (
+	"math/rand"
+	"time"
+)
+
+// KeyUpdatePolicy schedules the TLS 1.3 KeyUpdate messages a connection
+// sends on its own, for forward secrecy within long-lived connections and
+// to match the update frequency of the traffic it imitates. A KeyUpdate is
+// due as soon as any of the enabled limits is reached, and all of them start
+// over once it is sent. The zero value never sends one.
+type KeyUpdatePolicy struct {
+	// Bytes, if not zero, is how many bytes of cells are sent under one
+	// key.
+	Bytes int64
+
+	// Records, if not zero, is how many cells, each a TLS record, are sent
+	// under one key.
+	Records int64
+
+	// MinInterval and MaxInterval, if MaxInterval is not zero, bound the
+	// time a key is used for. Each interval is drawn uniformly between
+	// them.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+}
+
+// keyUpdateSchedule tracks how long the current key has been in use under a
+// KeyUpdatePolicy. It is protected by the mutex of its Manager.
+type keyUpdateSchedule struct {
+	policy   KeyUpdatePolicy
+	bytes    int64
+	records  int64
+	deadline time.Time
+	expired  bool
+}
+
+func newKeyUpdateSchedule(policy KeyUpdatePolicy, now time.Time) *keyUpdateSchedule {
+	s := &keyUpdateSchedule{policy: policy}
+	s.reset(now)
+	return s
+}
+
+// timed reports whether the policy bounds the lifetime of a key.
+func (s *keyUpdateSchedule) timed() bool {
+	return s.policy.MaxInterval > 0
+}
+
+func (s *keyUpdateSchedule) reset(now time.Time) {
+	s.bytes, s.records, s.expired = 0, 0, false
+	if s.timed() {
+		s.schedule(now)
+	}
+}
+
+// schedule draws the time the current key expires at.
+func (s *keyUpdateSchedule) schedule(now time.Time) {
+	interval := s.policy.MaxInterval
+	if spread := s.policy.MaxInterval - s.policy.MinInterval; spread > 0 {
+		interval = s.policy.MinInterval + time.Duration(rand.Int63n(int64(spread)+1))
+	}
+	s.deadline = now.Add(interval)
+}
+
+// observe records a cell of n bytes sent under the current key.
+func (s *keyUpdateSchedule) observe(n int) {
+	s.bytes += int64(n)
+	s.records++
+}
+
+// expire marks the current key as expired if its interval has elapsed, and
+// returns how long until the next check. An expired key stays expired until
+// the next reset, but the interval is drawn again, so that a connection
+// that cannot update its keys is not woken continuously.
+func (s *keyUpdateSchedule) expire(now time.Time) (expired bool, wait time.Duration) {
+	if wait := s.deadline.Sub(now); wait > 0 {
+		return false, wait
+	}
+	s.expired = true
+	s.schedule(now)
+	return true, s.deadline.Sub(now)
+}
+
+func (s *keyUpdateSchedule) due() bool {
+	p := s.policy
+	return s.expired ||
+		p.Bytes > 0 && s.bytes >= p.Bytes ||
+		p.Records > 0 && s.records >= p.Records
+}
+
+// KeyUpdateDue reports whether the KeyUpdate policy calls for new keys, and
+// if so starts its limits over. The caller is expected to send a KeyUpdate
+// when it returns true.
+func (m *Manager) KeyUpdateDue() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.keyUpdate.due() {
+		return false
+	}
+	m.keyUpdate.reset(time.Now())
+	return true
+}
+
+// startKeyUpdateLoop wakes the connection when the current key outlives its
+// interval, so that idle connections update their keys too. Since KeyUpdateDue
+// restarts the interval, the loop may wake up before the current deadline,
+// and then just waits for it again.
+func (m *Manager) startKeyUpdateLoop() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-m.done:
+			return
+		}
+		m.mu.Lock()
+		expired, wait := m.keyUpdate.expire(time.Now())
+		if expired {
+			m.signalReady()
+		}
+		m.mu.Unlock()
+
+		if wait < minCoverWait {
+			wait = minCoverWait
+		}
+		timer.Reset(wait)
+	}
+}
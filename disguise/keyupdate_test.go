@@ -0,0 +1,113 @@
+//go:build go1.25
+
+package disguise
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestKeyUpdateLimits(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		policy KeyUpdatePolicy
+		// cells is how many cells of 100 bytes are sent under a key.
+		cells int
+	}{
+		{"Bytes", KeyUpdatePolicy{Bytes: 250}, 3},
+		{"Records", KeyUpdatePolicy{Records: 4}, 4},
+		{"Both", KeyUpdatePolicy{Bytes: 1000, Records: 2}, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Now()
+			s := newKeyUpdateSchedule(tt.policy, now)
+			// The limits start over with each key.
+			for range 2 {
+				for i := range tt.cells {
+					if s.due() {
+						t.Fatalf("KeyUpdate due after %d cells, want %d", i, tt.cells)
+					}
+					s.observe(100)
+				}
+				if !s.due() {
+					t.Fatalf("KeyUpdate not due after %d cells", tt.cells)
+				}
+				s.reset(now)
+			}
+		})
+	}
+}
+
+func TestKeyUpdateDisabled(t *testing.T) {
+	now := time.Now()
+	s := newKeyUpdateSchedule(KeyUpdatePolicy{}, now)
+	if s.timed() {
+		t.Error("zero policy bounds the lifetime of keys")
+	}
+	for range 1000 {
+		s.observe(16384)
+	}
+	if s.due() {
+		t.Error("zero policy called for a KeyUpdate")
+	}
+}
+
+func TestKeyUpdateInterval(t *testing.T) {
+	policy := KeyUpdatePolicy{MinInterval: time.Minute, MaxInterval: 2 * time.Minute}
+	now := time.Now()
+	s := newKeyUpdateSchedule(policy, now)
+	for range 100 {
+		s.reset(now)
+		if d := s.deadline.Sub(now); d < policy.MinInterval || d > policy.MaxInterval {
+			t.Fatalf("key used for %v, want between %v and %v", d, policy.MinInterval, policy.MaxInterval)
+		}
+	}
+
+	deadline := s.deadline
+	if expired, wait := s.expire(deadline.Add(-time.Second)); expired || wait != time.Second {
+		t.Errorf("expire a second early = %v, %v; want false, 1s", expired, wait)
+	}
+	expired, wait := s.expire(deadline)
+	if !expired || wait < policy.MinInterval || wait > policy.MaxInterval {
+		t.Errorf("expire at the deadline = %v, %v; want true and the next interval", expired, wait)
+	}
+	if !s.due() {
+		t.Error("expired key not due for an update")
+	}
+}
+
+// TestKeyUpdateIdle checks that a Manager signals an idle connection once
+// its key expires, and that KeyUpdateDue starts the interval over.
+func TestKeyUpdateIdle(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		m := NewManagerWithConfig(&Config{
+			KeyUpdate: KeyUpdatePolicy{MinInterval: time.Minute, MaxInterval: time.Minute},
+		})
+		defer m.Close()
+
+		time.Sleep(time.Minute - time.Second)
+		synctest.Wait()
+		if m.KeyUpdateDue() {
+			t.Fatal("KeyUpdate due before the interval elapsed")
+		}
+		time.Sleep(time.Second)
+		synctest.Wait()
+		select {
+		case <-m.Ready():
+		default:
+			t.Error("connection not signalled once its key expired")
+		}
+		if !m.KeyUpdateDue() {
+			t.Fatal("KeyUpdate not due once the interval elapsed")
+		}
+		if m.KeyUpdateDue() {
+			t.Error("KeyUpdate due again right after the last one")
+		}
+		time.Sleep(time.Minute)
+		synctest.Wait()
+		if !m.KeyUpdateDue() {
+			t.Error("KeyUpdate not due once the next interval elapsed")
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -12,15 +13,75 @@ import (
 	"github.com/uDisguise/disguise/disguise/scheduler"
 )
 
+// Version is the Disguise protocol version confirmed during the TLS
+// handshake.
+const Version uint8 = 1
+
 // ErrNoOutboundTraffic indicates there's no more traffic to send.
 var ErrNoOutboundTraffic = errors.New("no outbound traffic available")
 
+// ErrPassThrough is returned by QueueApplicationData once the Manager
+// ended its cells after TurnOff: the application data is to be written as
+// is.
+var ErrPassThrough = errors.New("disguise: turned off, data passes through")
+
+// ErrOutboundThrottled indicates cells are queued but the rate limiters hold
+// them back. NextSendDelay reports how long to wait.
+var ErrOutboundThrottled = errors.New("outbound traffic throttled")
+
+// discardLogger is the Logger of a Manager configured without one.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// Config carries the per-connection options of a Manager.
+type Config struct {
+	// SharedLimiter, if not nil, is consulted in addition to the profile's
+	// own rate limits. Sharing one limiter, such as one returned by
+	// scheduler.NewSharedLimiter, between connections holds all of them
+	// under an aggregate budget.
+	SharedLimiter scheduler.Limiter
+
+	// Rate, if its Average is not zero, holds the cells the connection
+	// sends to that rate whichever profile is active. The zero value leaves
+	// the connection as fast as the profile's own Rate, which for the
+	// presets is unlimited.
+	Rate profile.Rate
+
+	// MaxClockSkew is the largest difference tolerated between the
+	// timestamp of an inbound cell and the local clock. Zero selects
+	// framing.DefaultMaxClockSkew.
+	MaxClockSkew time.Duration
+
+	// KeyUpdate schedules the KeyUpdate messages of TLS 1.3 connections.
+	// The zero value leaves them to the application, see Conn.UpdateKeys.
+	KeyUpdate KeyUpdatePolicy
+
+	// Conversation, if not nil, synchronises the schedules of the two
+	// peers, which take turns sending bursts as the model describes, such
+	// as the one of a profile preset. Both peers must set the same model.
+	// The schedule is drawn from the secret set with SetSecret, and starts
+	// then; tls.Conn sets it after the handshake. A side only learns that
+	// its turn has come from the cells it processes, so an application
+	// that waits for its own data to be sent must keep reading.
+	Conversation *profile.ConversationModel
+
+	// Metrics, if not nil, receives the events of the Manager. Manager.Metrics
+	// reports them in summary either way.
+	Metrics Metrics
+
+	// Logger, if not nil, receives structured events: profile switches,
+	// cover policy changes, dropped and replayed cells, and, from tls.Conn,
+	// the outcome of the Disguise negotiation. Its handler selects the
+	// levels that are kept. If nil, nothing is logged.
+	Logger *slog.Logger
+}
+
 // Manager handles the full lifecycle of Disguise protocol.
 type Manager struct {
 	mu           sync.Mutex
 	profile      *profile.Profile
 	framer       *framing.Framer
 	reassembler  *framing.Reassembler
+	replay       *framing.ReplayWindow
 	scheduler    *scheduler.Scheduler
 	inboundQueue *bytes.Buffer
 	
@@ -28,52 +89,245 @@ type Manager struct {
 	observationQueue []int
 	
 	lastProfileSwitch time.Time
+	// pinned stops the dynamic profiling loop from adapting the active
+	// profile.
+	pinned bool
+
+	// stopping is set by TurnOff, and off once the cell that ends this
+	// direction was sent. peerOff is set once the peer's was received.
+	stopping bool
+	off      bool
+	peerOff  bool
+
+	// cover is the cover traffic policy selected by the active profile.
+	// coverBase accumulates the overhead of policies replaced by
+	// SetProfile, so CoverOverhead spans the whole connection.
+	cover     CoverPolicy
+	coverBase CoverOverhead
+
+	// shared is the secret SharedRand derives its seeds from, set by
+	// SetSecret.
+	shared []byte
+
+	// conversation is the synchronised schedule started by SetSecret if
+	// conversationModel is set.
+	conversationModel *profile.ConversationModel
+	conversation      *scheduler.Conversation
+	// conversationWait is how long the conversation held back the last
+	// GetOutboundTraffic call.
+	conversationWait time.Duration
+
+	// pending holds the writes QueueApplicationData received while cells
+	// of earlier ones were still queued, in order.
+	pending [][]byte
+
+	// metrics summarises the events reported to hook, which is never nil.
+	metrics MetricsSnapshot
+	hook    Metrics
+
+	logger *slog.Logger
+
+	// keyUpdate tracks the use of the current key under the KeyUpdate
+	// policy.
+	keyUpdate *keyUpdateSchedule
+
+	// ready is signalled when cells are queued outside of a Write, such as
+	// cover traffic, or when a KeyUpdate is due. done is closed by Close to stop the background loops.
+	ready     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewManager initializes a new Disguise Manager.
 func NewManager() *Manager {
+	return NewManagerWithConfig(nil)
+}
+
+// NewManagerWithConfig initializes a new Disguise Manager with the given
+// options. A nil config is equivalent to an empty one.
+func NewManagerWithConfig(config *Config) *Manager {
+	if config == nil {
+		config = &Config{}
+	}
+	hook := config.Metrics
+	if hook == nil {
+		hook = NopMetrics{}
+	}
+	logger := config.Logger
+	if logger == nil {
+		logger = discardLogger
+	}
 	p := profile.GetProfile(profile.Dynamic)
 	s := scheduler.NewScheduler()
+	s.SetProfile(p)
+	s.SetRate(config.Rate)
+	s.SetSharedLimiter(config.SharedLimiter)
 	
 	m := &Manager{
 		profile:          p,
 		framer:           framing.NewFramer(p),
 		reassembler:      framing.NewReassembler(),
+		replay:           framing.NewReplayWindow(config.MaxClockSkew),
 		scheduler:        s,
 		inboundQueue:     new(bytes.Buffer),
 		classifier:       NewHMMClassifier(),
 		observationQueue: make([]int, 0, 100),
 		lastProfileSwitch: time.Now(),
+		cover:            NewCoverPolicy(p),
+		keyUpdate:        newKeyUpdateSchedule(config.KeyUpdate, time.Now()),
+		conversationModel: config.Conversation,
+		hook:             hook,
+		logger:           logger,
+		ready:            make(chan struct{}, 1),
+		done:             make(chan struct{}),
 	}
 
 	go m.startCoverTrafficLoop()
 	go m.startDynamicProfilingLoop()
+	if m.keyUpdate.timed() {
+		go m.startKeyUpdateLoop()
+	}
 
 	return m
 }
 
+// Close stops the Manager's background loops. It is safe to call more than
+// once.
+func (m *Manager) Close() {
+	m.closeOnce.Do(func() { close(m.done) })
+}
+
+// Done returns a channel that is closed once the Manager is closed.
+func (m *Manager) Done() <-chan struct{} {
+	return m.done
+}
+
+// Ready returns a channel that receives a value whenever cells are queued
+// in the background and should be flushed by the owner of the connection.
+func (m *Manager) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// signalReady must be called with m.mu held.
+func (m *Manager) signalReady() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
 // SetProfile dynamically changes the active traffic profile.
 func (m *Manager) SetProfile(p *profile.Profile) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	
+	m.setProfileLocked(p)
+}
+
+// setProfileLocked is SetProfile with m.mu held.
+func (m *Manager) setProfileLocked(p *profile.Profile) {
 	// 在切换配置文件前，使用之前的观察数据训练模型
 	if len(m.observationQueue) > 0 {
 		m.classifier.Train(m.observationQueue, m.profile.GetProfileType())
 		m.observationQueue = m.observationQueue[:0]
 	}
 
+	if from, to := m.profile.GetProfileType(), p.GetProfileType(); from != to {
+		m.recordProfileSwitch(from, to)
+		m.logger.Info("disguise profile switch", "from", from, "to", to)
+	}
 	m.profile = p
 	m.framer.SetProfile(p)
 	m.scheduler.SetProfile(p)
 	m.lastProfileSwitch = time.Now()
+
+	prev := m.cover.Overhead()
+	m.coverBase.DataBytes += prev.DataBytes
+	m.coverBase.CoverBytes += prev.CoverBytes
+	previous := m.cover.Name()
+	m.cover = NewCoverPolicy(p)
+	if name := m.cover.Name(); name != previous {
+		m.logger.Info("disguise cover policy change", "from", previous, "to", name)
+	}
+}
+
+// CoverPolicy returns the name of the active cover traffic policy.
+func (m *Manager) CoverPolicy() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.cover.Name()
 }
 
+// CoverOverhead reports the bandwidth spent on cover traffic over the
+// lifetime of the connection.
+func (m *Manager) CoverOverhead() CoverOverhead {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.cover.Overhead()
+	return CoverOverhead{
+		DataBytes:  m.coverBase.DataBytes + cur.DataBytes,
+		CoverBytes: m.coverBase.CoverBytes + cur.CoverBytes,
+	}
+}
+
+// interactiveMessageSize is the largest write QueueApplicationData treats as
+// interactive. Larger writes are queued as bulk data, so a download cannot
+// starve short request/response exchanges.
+const interactiveMessageSize = 1024
+
 // QueueApplicationData takes application data and fragments it into cells.
+// The peer reassembles each write once its last cell arrives, so a write is
+// only fragmented once the cells of the earlier ones have been sent; until
+// then it waits in a queue of its own. data is not retained.
 func (m *Manager) QueueApplicationData(data []byte) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.off {
+		return ErrPassThrough
+	}
+	data = bytes.Clone(data)
+	if len(m.pending) > 0 || m.scheduler.QueuedData() > 0 {
+		m.pending = append(m.pending, data)
+		return nil
+	}
+	return m.queueStreamLocked(data, applicationOptions(data))
+}
+
+// applicationOptions returns the scheduling options of a write.
+func applicationOptions(data []byte) scheduler.Options {
+	opts := scheduler.Options{Class: scheduler.ClassBulk}
+	if len(data) <= interactiveMessageSize {
+		opts.Class = scheduler.ClassInteractive
+	}
+	return opts
+}
+
+// queuePendingLocked fragments the next write held back by
+// QueueApplicationData once no earlier cells are queued. It must be called
+// with m.mu held.
+func (m *Manager) queuePendingLocked() error {
+	if len(m.pending) == 0 || m.scheduler.QueuedData() > 0 {
+		return nil
+	}
+	data := m.pending[0]
+	m.pending[0] = nil
+	m.pending = m.pending[1:]
+	return m.queueStreamLocked(data, applicationOptions(data))
+}
+
+// QueueStream fragments application data into the cells of a single stream
+// and queues them with the given scheduling options.
+func (m *Manager) QueueStream(data []byte, opts scheduler.Options) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.off {
+		return ErrPassThrough
+	}
+	return m.queueStreamLocked(data, opts)
+}
+
+func (m *Manager) queueStreamLocked(data []byte, opts scheduler.Options) error {
 	cells, err := m.framer.Fragment(data)
 	if err != nil {
 		return err
@@ -81,8 +335,9 @@ func (m *Manager) QueueApplicationData(data []byte) error {
 
 	for _, cell := range cells {
 		m.observationQueue = append(m.observationQueue, DiscretizePayloadSize(len(cell.Payload)))
-		m.scheduler.ScheduleCell(cell)
+		m.scheduler.Schedule(cell, opts)
 	}
+	m.recordQueued()
 
 	return nil
 }
@@ -92,8 +347,25 @@ func (m *Manager) GetOutboundTraffic() ([]byte, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if m.off {
+		return nil, ErrNoOutboundTraffic
+	}
+	if err := m.queuePendingLocked(); err != nil {
+		return nil, err
+	}
+	if m.stopping && m.scheduler.QueuedData() == 0 {
+		return m.endCellsLocked()
+	}
+
 	cell := m.scheduler.GetNextCell()
+	m.conversationWait = 0
+	if cell == nil && m.conversation != nil && m.scheduler.Wait() == 0 {
+		cell, m.conversationWait = m.conversationCover()
+	}
 	if cell == nil {
+		if m.scheduler.Wait() > 0 || m.conversationWait > 0 {
+			return nil, ErrOutboundThrottled
+		}
 		return nil, ErrNoOutboundTraffic
 	}
 
@@ -102,17 +374,77 @@ func (m *Manager) GetOutboundTraffic() ([]byte, error) {
 		return nil, fmt.Errorf("failed to encode cell: %w", err)
 	}
 
+	if cell.Type == framing.TypeDummy {
+		m.cover.ObserveCover(len(encodedCell))
+	} else {
+		m.cover.ObserveData(time.Now(), len(encodedCell))
+	}
+	m.keyUpdate.observe(len(encodedCell))
+	m.recordSent(cell, len(encodedCell), m.scheduler.Delay())
+	if m.conversation != nil {
+		m.conversation.Sent(len(encodedCell))
+	}
+
 	return encodedCell, nil
 }
 
-// ProcessInboundTraffic takes an inbound cell and reassembles it.
+// conversationCover returns a dummy cell filling the current burst of the
+// conversation if it is this side's turn, or else how long until it is. It
+// must be called with m.mu held.
+func (m *Manager) conversationCover() (*framing.Cell, time.Duration) {
+	budget, wait := m.conversation.Turn(time.Now(), false)
+	if budget <= 0 {
+		return nil, wait
+	}
+	size := min(max(budget, m.profile.MinCellSize), m.profile.MaxCellSize)
+	cell, err := m.framer.CreateDummyCellOfSize(size)
+	if err != nil {
+		return nil, 0
+	}
+	return cell, 0
+}
+
+// NextSendDelay returns how long the rate limiters or the conversation hold
+// back the next cell, as of the last GetOutboundTraffic call.
+func (m *Manager) NextSendDelay() time.Duration {
+	m.mu.Lock()
+	wait := m.conversationWait
+	m.mu.Unlock()
+	return max(m.scheduler.Wait(), wait)
+}
+
+// ProcessInboundTraffic takes an inbound cell and reassembles it. Errors are
+// of type *Error; callers should use ClassOf to decide whether the
+// connection can continue.
 func (m *Manager) ProcessInboundTraffic(data []byte) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	// Every cell of the peer counts towards its burst, whatever becomes
+	// of it.
+	if m.conversation != nil && m.conversation.Received(len(data)) {
+		m.signalReady()
+	}
+
+	// Errors are logged, as required by SPEC §8, before the caller
+	// decides what becomes of the connection.
 	cell, err := m.framer.DecodeCell(data)
 	if err != nil {
-		return fmt.Errorf("failed to decode cell: %w", err)
+		m.logger.Warn("disguise cell dropped", "op", "decode cell", "len", len(data), "err", err)
+		return &Error{Class: Fatal, Op: "decode cell", Err: err}
+	}
+
+	// Replayed, stale and out-of-window cells are dropped silently, as
+	// required by SPEC §8, and counted in ReplayStats.
+	if err := m.replay.Check(cell, time.Now()); err != nil {
+		m.logger.Info("disguise replay rejected", "cell_id", cell.CellID, "seq", cell.Seq, "err", err)
+		return &Error{Class: DropSilently, Op: "replay check", Err: err}
+	}
+	m.recordReceived(cell, len(data))
+
+	if cell.Type == framing.TypeControl {
+		m.handleControlLocked(cell.Payload)
+		return nil
 	}
 
 	if cell.Type == framing.TypeData {
@@ -120,18 +452,24 @@ func (m *Manager) ProcessInboundTraffic(data []byte) error {
 		
 		reassembled, err := m.reassembler.ProcessCell(cell)
 		if err != nil {
-			return fmt.Errorf("failed to reassemble cell: %w", err)
+			m.recordReassemblyError(err)
+			m.logger.Warn("disguise cell dropped", "op", "reassemble cell", "cell_id", cell.CellID, "seq", cell.Seq, "err", err)
+			return &Error{Class: Recoverable, Op: "reassemble cell", Err: err}
 		}
 		if reassembled != nil {
 			m.inboundQueue.Write(reassembled)
 		}
-	} else {
-		return nil
 	}
 
 	return nil
 }
 
+// ReplayStats returns the number of inbound cells dropped by replay
+// protection, by reason.
+func (m *Manager) ReplayStats() framing.ReplayStats {
+	return m.replay.Stats()
+}
+
 // ReadApplicationData reads reassembled application data from the internal buffer.
 func (m *Manager) ReadApplicationData() ([]byte, error) {
 	m.mu.Lock()
@@ -146,47 +484,99 @@ func (m *Manager) ReadApplicationData() ([]byte, error) {
 	return data, nil
 }
 
-// startCoverTrafficLoop periodically generates and schedules dummy traffic
+// minCoverWait bounds how often the cover loop consults its policy, so a
+// misconfigured zero interval cannot spin.
+const minCoverWait = time.Millisecond
+
+// startCoverTrafficLoop asks the active cover policy how much dummy traffic
+// to emit, schedules it as dummy cells and sleeps for as long as the policy
+// asks.
 func (m *Manager) startCoverTrafficLoop() {
-	ticker := time.NewTicker(m.profile.ProbingInterval)
-	defer ticker.Stop()
+	timer := time.NewTimer(minCoverWait)
+	defer timer.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-timer.C:
+		case <-m.done:
+			return
+		}
 		m.mu.Lock()
-		dummyCell, err := m.framer.CreateDummyCell()
-		if err == nil {
-			m.scheduler.ScheduleCell(dummyCell)
+		coverBytes, wait := m.cover.Next(time.Now())
+		if coverBytes > 0 && !m.stopping {
+			m.scheduleCover(coverBytes)
+			m.recordQueued()
+			m.signalReady()
 		}
 		m.mu.Unlock()
+
+		if wait < minCoverWait {
+			wait = minCoverWait
+		}
+		timer.Reset(wait)
+	}
+}
+
+// scheduleCover splits coverBytes into dummy cells that respect the active
+// profile's cell size bounds. The cells add up to coverBytes exactly, unless
+// it is less than MinCellSize. It must be called with m.mu held.
+func (m *Manager) scheduleCover(coverBytes int) {
+	for coverBytes > 0 {
+		size := coverBytes
+		if size > m.profile.MaxCellSize {
+			size = m.profile.MaxCellSize
+			// Leave enough for a last cell of MinCellSize.
+			if rest := coverBytes - size; rest < m.profile.MinCellSize {
+				size = coverBytes - m.profile.MinCellSize
+			}
+		}
+		if size < m.profile.MinCellSize {
+			size = m.profile.MinCellSize
+		}
+		dummyCell, err := m.framer.CreateDummyCellOfSize(size)
+		if err != nil {
+			return
+		}
+		m.scheduler.ScheduleCell(dummyCell)
+		coverBytes -= size
 	}
 }
 
-// startDynamicProfilingLoop analyzes traffic load and switches profiles accordingly.
+// startDynamicProfilingLoop analyzes traffic and, while the dynamic mixture
+// profile is active, shifts its weights towards the classifier's posterior.
+// Fixed profiles are left untouched, and so is a pinned one.
 func (m *Manager) startDynamicProfilingLoop() {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+		case <-m.done:
+			return
+		}
 		m.mu.Lock()
-		
-		if len(m.observationQueue) < 10 {
+
+		if len(m.observationQueue) < 10 || m.pinned || m.profile.GetProfileType() != profile.Dynamic {
 			m.mu.Unlock()
 			continue
 		}
-		
-		predictedType, err := m.classifier.Predict(m.observationQueue)
+
+		posterior, err := m.classifier.Posterior(m.observationQueue)
 		if err != nil {
 			m.mu.Unlock()
 			continue
 		}
-		
-		if predictedType != m.profile.GetProfileType() {
-			m.SetProfile(profile.GetProfile(predictedType))
-			fmt.Printf("动态剖析: 切换到 %v 配置文件。\n", predictedType)
+
+		m.recordPrediction(posterior)
+		previous := m.profile.DominantType()
+		m.profile.BlendWeights(posterior)
+		if dominant := m.profile.DominantType(); dominant != previous {
+			m.lastProfileSwitch = time.Now()
+			m.recordProfileSwitch(previous, dominant)
+			m.logger.Info("disguise profile switch", "from", previous, "to", dominant, "dynamic", true)
 		}
-		
+
 		m.observationQueue = m.observationQueue[:0]
 		m.mu.Unlock()
 	}
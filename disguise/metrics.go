@@ -0,0 +1,152 @@
+package disguise
+
+import (
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// Metrics receives the events of a Manager, to export them to a monitoring
+// system. Its methods are called synchronously with the lock of the Manager
+// held, so they must be fast, must not block and must not call back into the
+// Manager. Embed NopMetrics to implement only some of them.
+type Metrics interface {
+	// CellSent records a cell of the given framing type leaving the
+	// connection, of n bytes once encoded, of which padding are padding.
+	CellSent(cellType uint8, n, padding int)
+	// CellReceived records a cell of the peer, of n bytes as received, of
+	// which padding are padding.
+	CellReceived(cellType uint8, n, padding int)
+	// QueueDepth records the number of cells queued for sending.
+	QueueDepth(cells int)
+	// SchedulerDelay records how long a sent cell waited in the queue.
+	SchedulerDelay(d time.Duration)
+	// ReassemblyError records a data cell of the peer that could not be
+	// reassembled.
+	ReassemblyError(err error)
+	// ClassifierPrediction records the traffic type the classifier finds
+	// most likely for the observed traffic, with its posterior probability.
+	ClassifierPrediction(t profile.TrafficType, confidence float64)
+	// ProfileSwitch records a change of the active profile, or of the
+	// dominant traffic type of the dynamic one.
+	ProfileSwitch(from, to profile.TrafficType)
+}
+
+// NopMetrics is a Metrics that ignores all events.
+type NopMetrics struct{}
+
+func (NopMetrics) CellSent(uint8, int, int)                               {}
+func (NopMetrics) CellReceived(uint8, int, int)                           {}
+func (NopMetrics) QueueDepth(int)                                         {}
+func (NopMetrics) SchedulerDelay(time.Duration)                           {}
+func (NopMetrics) ReassemblyError(error)                                  {}
+func (NopMetrics) ClassifierPrediction(profile.TrafficType, float64)      {}
+func (NopMetrics) ProfileSwitch(profile.TrafficType, profile.TrafficType) {}
+
+// CellCounts counts cells and their encoded bytes.
+type CellCounts struct {
+	Cells uint64
+	Bytes uint64
+}
+
+// DirectionMetrics counts the cells of one direction of a connection by
+// type. Handshake cells count as control cells.
+type DirectionMetrics struct {
+	Data    CellCounts
+	Dummy   CellCounts
+	Control CellCounts
+	// PaddingBytes is the number of padding bytes of all cells.
+	PaddingBytes uint64
+}
+
+func (d *DirectionMetrics) add(cellType uint8, n, padding int) {
+	c := &d.Control
+	switch cellType {
+	case framing.TypeData:
+		c = &d.Data
+	case framing.TypeDummy:
+		c = &d.Dummy
+	}
+	c.Cells++
+	c.Bytes += uint64(n)
+	d.PaddingBytes += uint64(padding)
+}
+
+// MetricsSnapshot summarises the events of a Manager over the lifetime of
+// the connection.
+type MetricsSnapshot struct {
+	Sent     DirectionMetrics
+	Received DirectionMetrics
+
+	// QueueDepth is the number of cells currently queued for sending.
+	QueueDepth int
+	// SchedulerDelay is the time the sent cells waited in the queue, in
+	// total, and MaxSchedulerDelay the longest a single one did.
+	SchedulerDelay    time.Duration
+	MaxSchedulerDelay time.Duration
+
+	ReassemblyErrors uint64
+
+	// Prediction and Confidence are the last prediction of the classifier.
+	// Confidence is zero if it made none yet.
+	Prediction profile.TrafficType
+	Confidence float64
+
+	ProfileSwitches uint64
+}
+
+// Metrics returns a snapshot of the events of the Manager.
+func (m *Manager) Metrics() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.metrics
+	s.QueueDepth = m.scheduler.Len()
+	return s
+}
+
+// The record methods update the snapshot and forward the event to the hook
+// of the Manager. They must be called with m.mu held.
+
+func (m *Manager) recordSent(cell *framing.Cell, n int, delay time.Duration) {
+	m.metrics.Sent.add(cell.Type, n, int(cell.PaddingLen))
+	m.metrics.SchedulerDelay += delay
+	m.metrics.MaxSchedulerDelay = max(m.metrics.MaxSchedulerDelay, delay)
+	m.hook.CellSent(cell.Type, n, int(cell.PaddingLen))
+	m.hook.SchedulerDelay(delay)
+	m.hook.QueueDepth(m.scheduler.Len())
+}
+
+func (m *Manager) recordReceived(cell *framing.Cell, n int) {
+	m.metrics.Received.add(cell.Type, n, int(cell.PaddingLen))
+	m.hook.CellReceived(cell.Type, n, int(cell.PaddingLen))
+}
+
+func (m *Manager) recordQueued() {
+	m.hook.QueueDepth(m.scheduler.Len())
+}
+
+func (m *Manager) recordReassemblyError(err error) {
+	m.metrics.ReassemblyErrors++
+	m.hook.ReassemblyError(err)
+}
+
+func (m *Manager) recordPrediction(posterior map[profile.TrafficType]float64) {
+	var best profile.TrafficType
+	confidence := -1.0
+	for t, p := range posterior {
+		if p > confidence || p == confidence && t < best {
+			best, confidence = t, p
+		}
+	}
+	if confidence < 0 {
+		return
+	}
+	m.metrics.Prediction, m.metrics.Confidence = best, confidence
+	m.hook.ClassifierPrediction(best, confidence)
+}
+
+func (m *Manager) recordProfileSwitch(from, to profile.TrafficType) {
+	m.metrics.ProfileSwitches++
+	m.hook.ProfileSwitch(from, to)
+}
@@ -0,0 +1,177 @@
+//go:build go1.25
+
+package disguise
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"testing/synctest"
+
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// recordingMetrics counts the events a Manager reports to its hook.
+type recordingMetrics struct {
+	NopMetrics
+	sent, received   map[uint8]CellCounts
+	sentPadding      uint64
+	receivedPadding  uint64
+	reassemblyErrors int
+	switches         [][2]profile.TrafficType
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{sent: make(map[uint8]CellCounts), received: make(map[uint8]CellCounts)}
+}
+
+func (r *recordingMetrics) CellSent(cellType uint8, n, padding int) {
+	c := r.sent[cellType]
+	c.Cells++
+	c.Bytes += uint64(n)
+	r.sent[cellType] = c
+	r.sentPadding += uint64(padding)
+}
+
+func (r *recordingMetrics) CellReceived(cellType uint8, n, padding int) {
+	c := r.received[cellType]
+	c.Cells++
+	c.Bytes += uint64(n)
+	r.received[cellType] = c
+	r.receivedPadding += uint64(padding)
+}
+
+func (r *recordingMetrics) ReassemblyError(error) { r.reassemblyErrors++ }
+
+func (r *recordingMetrics) ProfileSwitch(from, to profile.TrafficType) {
+	r.switches = append(r.switches, [2]profile.TrafficType{from, to})
+}
+
+// checkDirection fails the test unless the snapshot of one direction
+// matches what the hook received, with framing types selecting the counts.
+func checkDirection(t *testing.T, name string, got DirectionMetrics, hook map[uint8]CellCounts, padding uint64) {
+	t.Helper()
+	for _, c := range []struct {
+		typ  uint8
+		name string
+		got  CellCounts
+	}{
+		{framing.TypeData, "data", got.Data},
+		{framing.TypeDummy, "dummy", got.Dummy},
+		{framing.TypeControl, "control", got.Control},
+	} {
+		if c.got != hook[c.typ] {
+			t.Errorf("%s %s cells = %+v, hook saw %+v", name, c.name, c.got, hook[c.typ])
+		}
+	}
+	if got.PaddingBytes != padding {
+		t.Errorf("%s padding bytes = %d, hook saw %d", name, got.PaddingBytes, padding)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		secret := bytes.Repeat([]byte{1}, SecretLen)
+		clientHook, serverHook := newRecordingMetrics(), newRecordingMetrics()
+		client := NewManagerWithConfig(&Config{Metrics: clientHook})
+		server := NewManagerWithConfig(&Config{Metrics: serverHook})
+		defer client.Close()
+		defer server.Close()
+		client.SetSecret(secret, true)
+		server.SetSecret(secret, false)
+
+		// Data, dummy and control cells.
+		client.QueueApplicationData(bytes.Repeat([]byte("a"), 3000))
+		client.mu.Lock()
+		client.scheduleCover(2 * client.profile.MaxCellSize)
+		client.mu.Unlock()
+		client.SetPinned(true)
+		if err := client.Announce(); err != nil {
+			t.Fatal(err)
+		}
+		pump(t, client, server)
+
+		sent, received := client.Metrics().Sent, server.Metrics().Received
+		if sent.Data.Cells < 2 || sent.Dummy.Cells != 2 || sent.Control.Cells != 1 {
+			t.Errorf("sent %d data, %d dummy and %d control cells; want several, 2 and 1",
+				sent.Data.Cells, sent.Dummy.Cells, sent.Control.Cells)
+		}
+		if sent.PaddingBytes == 0 {
+			t.Error("no padding bytes counted")
+		}
+		if sent != received {
+			t.Errorf("client sent %+v, server received %+v", sent, received)
+		}
+		checkDirection(t, "sent", sent, clientHook.sent, clientHook.sentPadding)
+		checkDirection(t, "received", received, serverHook.received, serverHook.receivedPadding)
+		if got, _ := server.ReadApplicationData(); len(got) != 3000 {
+			t.Errorf("server read %d bytes, want 3000", len(got))
+		}
+	})
+}
+
+func TestMetricsErrors(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		hook := newRecordingMetrics()
+		client, _ := managerPair(t)
+		server := NewManagerWithConfig(&Config{Metrics: hook})
+		defer server.Close()
+		server.SetSecret(bytes.Repeat([]byte{1}, SecretLen), false)
+
+		client.QueueApplicationData(bytes.Repeat([]byte("a"), 5000))
+		var cells [][]byte
+		for {
+			b, err := client.GetOutboundTraffic()
+			if errors.Is(err, ErrNoOutboundTraffic) {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			cells = append(cells, b)
+		}
+		if len(cells) < 3 {
+			t.Fatalf("5000 bytes sent in %d cells, want at least 3", len(cells))
+		}
+
+		// A replayed cell is dropped and counted in ReplayStats.
+		server.ProcessInboundTraffic(cells[0])
+		if err := server.ProcessInboundTraffic(cells[0]); !errors.Is(err, framing.ErrDuplicateCell) {
+			t.Errorf("replayed cell: ProcessInboundTraffic = %v, want ErrDuplicateCell", err)
+		}
+		if got := server.ReplayStats(); got != (framing.ReplayStats{Duplicate: 1}) {
+			t.Errorf("ReplayStats = %+v, want one duplicate", got)
+		}
+
+		// A cell whose predecessor was lost cannot be reassembled.
+		if err := server.ProcessInboundTraffic(cells[2]); err == nil {
+			t.Error("cell after a gap reassembled")
+		}
+		if got := server.Metrics().ReassemblyErrors; got != 1 || hook.reassemblyErrors != 1 {
+			t.Errorf("ReassemblyErrors = %d, hook saw %d; want 1", got, hook.reassemblyErrors)
+		}
+	})
+}
+
+func TestMetricsProfileSwitch(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		hook := newRecordingMetrics()
+		m := NewManagerWithConfig(&Config{Metrics: hook})
+		defer m.Close()
+
+		m.SetProfile(profile.GetProfile(profile.VideoStreaming))
+		m.SetProfile(profile.GetProfile(profile.VideoStreaming))
+		m.SetProfile(profile.GetProfile(profile.FileDownload))
+		want := [][2]profile.TrafficType{
+			{profile.Dynamic, profile.VideoStreaming},
+			{profile.VideoStreaming, profile.FileDownload},
+		}
+		if len(hook.switches) != len(want) || hook.switches[0] != want[0] || hook.switches[1] != want[1] {
+			t.Errorf("hook saw switches %v, want %v", hook.switches, want)
+		}
+		if got := m.Metrics().ProfileSwitches; got != 2 {
+			t.Errorf("ProfileSwitches = %d, want 2", got)
+		}
+	})
+}
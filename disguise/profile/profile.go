@@ -16,9 +16,116 @@ const (
 	FileDownload
 	// New dynamic profile mode
 	Dynamic
-	CellHeaderLen = 20
+	CellHeaderLen = 22 // sum of the SPEC §4 header fields
 )
 
+func (t TrafficType) String() string {
+	switch t {
+	case WebBrowsing:
+		return "web-browsing"
+	case VideoStreaming:
+		return "video-streaming"
+	case FileDownload:
+		return "file-download"
+	case Dynamic:
+		return "dynamic"
+	default:
+		return "unknown"
+	}
+}
+
+// PaddingStyle selects the content that fills the padding of a cell.
+type PaddingStyle int
+
+const (
+	// PaddingAuto derives the padding content from the traffic type that
+	// produced the cell.
+	PaddingAuto PaddingStyle = iota
+	// PaddingRandom fills padding with uniformly random bytes.
+	PaddingRandom
+	// PaddingHPACK mimics compressed HTTP/2 header blocks.
+	PaddingHPACK
+	// PaddingText mimics JSON documents and base64 encoded text.
+	PaddingText
+	// PaddingVideo mimics fragmented MP4 container chunks.
+	PaddingVideo
+	// PaddingCompressed mimics gzip compressed blobs.
+	PaddingCompressed
+)
+
+// CoverMode selects the cover traffic policy used with a profile.
+type CoverMode int
+
+const (
+	// CoverProbing sends a single dummy cell every ProbingInterval,
+	// stretched by the current load.
+	CoverProbing CoverMode = iota
+	// CoverConstantRate fills every idle slot with a full-size dummy cell,
+	// producing a constant bitrate regardless of the real traffic.
+	CoverConstantRate
+	// CoverFixedRate follows BuFLO/Tamaraw: idle slots are filled while a
+	// burst is in progress, and each burst is padded to a multiple of
+	// BurstCells cells before the connection goes quiet.
+	CoverFixedRate
+	// CoverAdaptive follows WTF-PAD: inter-cell gaps are learned from the
+	// real traffic and gaps that are statistically unlikely are filled.
+	CoverAdaptive
+	// CoverTailPadding rounds the volume of every burst up to a multiple of
+	// BurstBytes bytes once the burst has ended.
+	CoverTailPadding
+)
+
+// CoverConfig parameterises the cover traffic policy of a profile.
+type CoverConfig struct {
+	Mode CoverMode
+	// Interval is the slot length of the constant and fixed rate modes.
+	Interval time.Duration
+	// BurstGap is the idle time after which a burst is considered over.
+	BurstGap time.Duration
+	// BurstCells is the number of cells a CoverFixedRate burst is padded
+	// to a multiple of.
+	BurstCells int
+	// BurstBytes is the volume a CoverTailPadding burst is rounded up to a
+	// multiple of.
+	BurstBytes int
+}
+
+// Rate is the target sending rate of a profile, in bytes per second. A
+// zero Average leaves the connection unshaped, as the presets returned by
+// GetProfile do.
+type Rate struct {
+	// Average is the long-term rate the connection is held to.
+	Average float64
+	// Peak caps the instantaneous rate while a burst is drained.
+	Peak float64
+	// Burst is the number of bytes that may be sent at Peak after an idle
+	// period.
+	Burst int
+}
+
+// SizeRange is a range of byte counts.
+type SizeRange struct {
+	Min, Max int
+}
+
+// DurationRange is a range of durations.
+type DurationRange struct {
+	Min, Max time.Duration
+}
+
+// ConversationModel describes the request/response structure of the traffic
+// a profile imitates. A conversation is a sequence of exchanges: the client
+// sends a request burst, and once the server received it, the server waits
+// for a think time and answers with a response burst. The client starts the
+// next exchange after an idle time. Burst sizes are drawn log-uniformly from
+// their ranges, and times uniformly.
+type ConversationModel struct {
+	Request  SizeRange
+	Response SizeRange
+	Think    DurationRange
+	Idle     DurationRange
+}
+
 // Profile defines the parameters for a traffic simulation profile.
 type Profile struct {
 	MinCellSize       int
@@ -28,10 +135,16 @@ type Profile struct {
 	EWMAAlpha         float64
 	TrafficWeights    map[TrafficType]float64
 	PayloadDistributions map[TrafficType]distribution
+	Cover             CoverConfig
+	Padding           PaddingStyle
+	Rate              Rate
+	// Conversation is the request/response model of the traffic, used by
+	// peers that synchronise their schedules. See disguise.Config.
+	Conversation      ConversationModel
 
 	mu sync.Mutex
 	// State for the adaptive model.
-	CurrentLoad float64 // 修复: 将 'currentLoad' 改为 'CurrentLoad'
+	CurrentLoad float64
 }
 
 // distribution is an interface for a statistical distribution.
@@ -66,6 +179,43 @@ func (d *paretoDistribution) Sample() int {
 	return int(math.Max(1, d.xm/math.Pow(rand.Float64(), 1/d.alpha)))
 }
 
+// defaultCoverConfig returns the cover parameters shared by the presets. The
+// mode keeps the historical one-dummy-per-ProbingInterval behaviour; the other
+// fields only take effect once a deployment selects a different mode.
+func defaultCoverConfig() CoverConfig {
+	return CoverConfig{
+		Mode:       CoverProbing,
+		Interval:   20 * time.Millisecond,
+		BurstGap:   500 * time.Millisecond,
+		BurstCells: 100,
+		BurstBytes: 16 * 1024,
+	}
+}
+
+// The conversation models of the presets: page loads with small requests
+// answered by resources of all sizes, video segments fetched every few
+// seconds, and large files fetched one after the other.
+var (
+	webConversation = ConversationModel{
+		Request:  SizeRange{Min: 300, Max: 2000},
+		Response: SizeRange{Min: 1000, Max: 200 * 1024},
+		Think:    DurationRange{Min: 20 * time.Millisecond, Max: 150 * time.Millisecond},
+		Idle:     DurationRange{Min: 200 * time.Millisecond, Max: 5 * time.Second},
+	}
+	videoConversation = ConversationModel{
+		Request:  SizeRange{Min: 300, Max: 800},
+		Response: SizeRange{Min: 200 * 1024, Max: 2 * 1024 * 1024},
+		Think:    DurationRange{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond},
+		Idle:     DurationRange{Min: 1 * time.Second, Max: 4 * time.Second},
+	}
+	downloadConversation = ConversationModel{
+		Request:  SizeRange{Min: 300, Max: 1000},
+		Response: SizeRange{Min: 1024 * 1024, Max: 16 * 1024 * 1024},
+		Think:    DurationRange{Min: 10 * time.Millisecond, Max: 30 * time.Millisecond},
+		Idle:     DurationRange{Min: 1 * time.Second, Max: 10 * time.Second},
+	}
+)
+
 // GetProfile returns a pre-configured profile instance.
 func GetProfile(t TrafficType) *Profile {
 	switch t {
@@ -76,6 +226,8 @@ func GetProfile(t TrafficType) *Profile {
 			ProbingInterval: 15 * time.Second,
 			LatencyJitter:   20 * time.Millisecond,
 			EWMAAlpha:       0.1,
+			Cover:           defaultCoverConfig(),
+			Conversation:    webConversation,
 			TrafficWeights: map[TrafficType]float64{WebBrowsing: 1.0},
 			PayloadDistributions: map[TrafficType]distribution{
 				WebBrowsing: &bimodalDistribution{
@@ -94,6 +246,8 @@ func GetProfile(t TrafficType) *Profile {
 			ProbingInterval: 10 * time.Second,
 			LatencyJitter:   10 * time.Millisecond,
 			EWMAAlpha:       0.2,
+			Cover:           defaultCoverConfig(),
+			Conversation:    videoConversation,
 			TrafficWeights: map[TrafficType]float64{VideoStreaming: 1.0},
 			PayloadDistributions: map[TrafficType]distribution{
 				VideoStreaming: &bimodalDistribution{
@@ -112,6 +266,8 @@ func GetProfile(t TrafficType) *Profile {
 			ProbingInterval: 30 * time.Second,
 			LatencyJitter:   50 * time.Millisecond,
 			EWMAAlpha:       0.05,
+			Cover:           defaultCoverConfig(),
+			Conversation:    downloadConversation,
 			TrafficWeights: map[TrafficType]float64{FileDownload: 1.0},
 			PayloadDistributions: map[TrafficType]distribution{
 				FileDownload: &paretoDistribution{
@@ -128,6 +284,8 @@ func GetProfile(t TrafficType) *Profile {
 			ProbingInterval: 15 * time.Second,
 			LatencyJitter:   20 * time.Millisecond,
 			EWMAAlpha:       0.1,
+			Cover:           defaultCoverConfig(),
+			Conversation:    webConversation,
 			TrafficWeights: map[TrafficType]float64{
 				WebBrowsing:    0.7,
 				VideoStreaming: 0.2,
@@ -185,6 +343,9 @@ func (p *Profile) GetNextCellSize() int {
 
 // GetProfileType returns the current active profile type based on weights.
 func (p *Profile) GetProfileType() TrafficType {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if len(p.TrafficWeights) == 1 {
 		for t := range p.TrafficWeights {
 			return t
@@ -213,6 +374,106 @@ func (p *Profile) selectTrafficType() TrafficType {
 	return WebBrowsing // Fallback
 }
 
+// DominantType returns the traffic type with the highest mixture weight.
+func (p *Profile) DominantType() TrafficType {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	best := WebBrowsing
+	bestWeight := -1.0
+	for _, t := range []TrafficType{WebBrowsing, VideoStreaming, FileDownload} {
+		if w, ok := p.TrafficWeights[t]; ok && w > bestWeight {
+			best, bestWeight = t, w
+		}
+	}
+	return best
+}
+
+// BlendWeights shifts the mixture weights towards the given posterior
+// distribution using the profile's EWMAAlpha as the smoothing factor. Types
+// without a payload distribution are ignored, and the result is renormalised
+// so that the weights always sum to one.
+func (p *Profile) BlendWeights(posterior map[TrafficType]float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0.0
+	for t, w := range p.TrafficWeights {
+		if _, ok := p.PayloadDistributions[t]; !ok {
+			continue
+		}
+		w = (1-p.EWMAAlpha)*w + p.EWMAAlpha*posterior[t]
+		p.TrafficWeights[t] = w
+		total += w
+	}
+	if total == 0 {
+		return
+	}
+	for t := range p.TrafficWeights {
+		p.TrafficWeights[t] /= total
+	}
+}
+
+// Weights returns a copy of the mixture weights.
+func (p *Profile) Weights() map[TrafficType]float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	weights := make(map[TrafficType]float64, len(p.TrafficWeights))
+	for t, w := range p.TrafficWeights {
+		weights[t] = w
+	}
+	return weights
+}
+
+// SetWeights replaces the mixture weights, such as with the ones saved from
+// another instance of the same profile. Like in BlendWeights, the profile
+// keeps its set of types, so a type missing from weights or weighing zero
+// stays in the mixture with a zero weight, and the result is renormalised.
+// Weights that sum to zero leave the profile unchanged.
+func (p *Profile) SetWeights(weights map[TrafficType]float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0.0
+	for t := range p.TrafficWeights {
+		if _, ok := p.PayloadDistributions[t]; ok && weights[t] > 0 {
+			total += weights[t]
+		}
+	}
+	if total == 0 {
+		return
+	}
+	for t := range p.TrafficWeights {
+		if _, ok := p.PayloadDistributions[t]; ok {
+			p.TrafficWeights[t] = max(weights[t], 0) / total
+		}
+	}
+}
+
+// SetLoad replaces the EWMA of the normalised payload load.
+func (p *Profile) SetLoad(load float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.CurrentLoad = load
+}
+
+// Load returns the current EWMA of the normalised payload load.
+func (p *Profile) Load() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.CurrentLoad
+}
+
+// CoverInterval returns the delay until the next cover cell. An idle
+// connection emits cover at ProbingInterval; as the observed load rises the
+// real cells provide most of the cover, and the interval stretches up to
+// twice ProbingInterval.
+func (p *Profile) CoverInterval() time.Duration {
+	load := math.Min(math.Max(p.Load(), 0), 1)
+	return time.Duration(float64(p.ProbingInterval) * (1 + load))
+}
+
 // updateLoad simulates an adaptive mechanism by updating the current load
 // using an Exponentially Weighted Moving Average (EWMA).
 func (p *Profile) updateLoad(latest int) {
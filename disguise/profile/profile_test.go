@@ -0,0 +1,97 @@
+package profile
+
+import (
+	"math"
+	"testing"
+)
+
+func weightSum(w map[TrafficType]float64) float64 {
+	sum := 0.0
+	for _, v := range w {
+		sum += v
+	}
+	return sum
+}
+
+func TestBlendWeights(t *testing.T) {
+	p := GetProfile(Dynamic)
+	p.BlendWeights(map[TrafficType]float64{VideoStreaming: 1})
+
+	// With EWMAAlpha 0.1, a tenth of the weight moves to the posterior.
+	want := map[TrafficType]float64{WebBrowsing: 0.63, VideoStreaming: 0.28, FileDownload: 0.09}
+	got := p.Weights()
+	for typ, w := range want {
+		if math.Abs(got[typ]-w) > 1e-9 {
+			t.Errorf("weight of %v = %v, want %v", typ, got[typ], w)
+		}
+	}
+	if sum := weightSum(got); math.Abs(sum-1) > 1e-9 {
+		t.Errorf("weights sum to %v, want 1", sum)
+	}
+
+	for range 20 {
+		p.BlendWeights(map[TrafficType]float64{VideoStreaming: 1})
+	}
+	if d := p.DominantType(); d != VideoStreaming {
+		t.Errorf("DominantType = %v after blending towards video, want %v", d, VideoStreaming)
+	}
+	if typ := p.GetProfileType(); typ != Dynamic {
+		t.Errorf("GetProfileType = %v, want %v", typ, Dynamic)
+	}
+}
+
+func TestBlendWeightsFixedProfile(t *testing.T) {
+	p := GetProfile(WebBrowsing)
+	p.BlendWeights(map[TrafficType]float64{FileDownload: 1})
+
+	got := p.Weights()
+	if len(got) != 1 || got[WebBrowsing] != 1 {
+		t.Errorf("weights = %v, want only %v at 1", got, WebBrowsing)
+	}
+}
+
+func TestBlendWeightsZeroPosterior(t *testing.T) {
+	p := GetProfile(Dynamic)
+	p.BlendWeights(map[TrafficType]float64{})
+
+	got := p.Weights()
+	if sum := weightSum(got); math.Abs(sum-1) > 1e-9 {
+		t.Errorf("weights sum to %v, want 1", sum)
+	}
+	if math.Abs(got[WebBrowsing]-0.7) > 1e-9 {
+		t.Errorf("weight of %v = %v, want it unchanged at 0.7", WebBrowsing, got[WebBrowsing])
+	}
+}
+
+func TestSetWeights(t *testing.T) {
+	p := GetProfile(Dynamic)
+	p.SetWeights(map[TrafficType]float64{WebBrowsing: 2, VideoStreaming: 0})
+
+	// The types left at zero stay in the mixture, so the profile stays
+	// dynamic.
+	want := map[TrafficType]float64{WebBrowsing: 1, VideoStreaming: 0, FileDownload: 0}
+	got := p.Weights()
+	if len(got) != len(want) {
+		t.Fatalf("weights = %v, want %v", got, want)
+	}
+	for typ, w := range want {
+		if w2, ok := got[typ]; !ok || w2 != w {
+			t.Errorf("weight of %v = %v, want %v", typ, got[typ], w)
+		}
+	}
+	if typ := p.GetProfileType(); typ != Dynamic {
+		t.Errorf("GetProfileType = %v, want %v", typ, Dynamic)
+	}
+
+	// Weights that sum to zero, or only name types the profile does not
+	// mix, are ignored.
+	p.SetWeights(map[TrafficType]float64{VideoStreaming: 0})
+	fixed := GetProfile(VideoStreaming)
+	fixed.SetWeights(map[TrafficType]float64{WebBrowsing: 1})
+	if got := p.Weights(); got[WebBrowsing] != 1 {
+		t.Errorf("weights = %v after zero weights", got)
+	}
+	if got := fixed.Weights(); len(got) != 1 || got[VideoStreaming] != 1 {
+		t.Errorf("weights of a fixed profile = %v", got)
+	}
+}
@@ -0,0 +1,146 @@
+package scheduler
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// Exchange is one request/response exchange of a Conversation.
+type Exchange struct {
+	Request  int
+	Response int
+	Think    time.Duration
+	Idle     time.Duration
+}
+
+// Conversation is the schedule of a connection whose peers take turns as
+// described by a profile.ConversationModel. Both peers draw the same
+// exchanges from a PRNG seeded with a secret they share, and follow them
+// by counting the bytes of the cells each side sends: a side only sends
+// during its own burst, and its burst ends once it sent the bytes the
+// exchange calls for, which is also when the peer, counting the bytes it
+// receives, knows that its turn has come.
+type Conversation struct {
+	mu     sync.Mutex
+	model  profile.ConversationModel
+	rand   *rand.Rand
+	client bool
+
+	exchange Exchange
+	// ours is whether the current burst is sent by this side, and left is
+	// how many bytes of it remain.
+	ours bool
+	left int
+	// notBefore is when this side's burst may start. A client may start
+	// its request early if it has data to send, skipping the idle time.
+	notBefore time.Time
+	idle      bool
+}
+
+// NewConversation starts a conversation following model with exchanges drawn
+// from r. Both peers must use the same model, and PRNGs that produce the same
+// sequence. client selects the side of the conversation. The first request
+// is sent right away.
+func NewConversation(model profile.ConversationModel, r *rand.Rand, client bool) *Conversation {
+	c := &Conversation{model: model, rand: r, client: client}
+	c.next()
+	c.ours, c.left = client, c.exchange.Request
+	return c
+}
+
+// next draws the next exchange.
+func (c *Conversation) next() {
+	m := c.model
+	c.exchange = Exchange{
+		Request:  logUniform(c.rand, m.Request),
+		Response: logUniform(c.rand, m.Response),
+		Think:    uniform(c.rand, m.Think),
+		Idle:     uniform(c.rand, m.Idle),
+	}
+}
+
+func logUniform(r *rand.Rand, s profile.SizeRange) int {
+	lo, hi := max(s.Min, 1), max(s.Max, s.Min, 1)
+	n := math.Exp(math.Log(float64(lo)) + r.Float64()*(math.Log(float64(hi))-math.Log(float64(lo))))
+	return int(math.Round(n))
+}
+
+func uniform(r *rand.Rand, d profile.DurationRange) time.Duration {
+	if d.Max <= d.Min {
+		return d.Min
+	}
+	return d.Min + time.Duration(r.Int64N(int64(d.Max-d.Min)+1))
+}
+
+// Turn reports how many more bytes this side may send in its current burst.
+// If it may not send now, Turn returns zero, and how long until its burst
+// starts, or zero if it waits for the peer's burst. pending tells whether
+// data is queued.
+func (c *Conversation) Turn(now time.Time, pending bool) (budget int, wait time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.ours {
+		return 0, 0
+	}
+	if now.Before(c.notBefore) && !(c.idle && pending) {
+		return 0, c.notBefore.Sub(now)
+	}
+	return c.left, 0
+}
+
+// Sent records a cell of n bytes sent by this side.
+func (c *Conversation) Sent(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.ours {
+		return
+	}
+	c.left -= n
+	if c.left > 0 {
+		return
+	}
+	if c.client {
+		c.ours, c.left = false, c.exchange.Response
+	} else {
+		c.next()
+		c.ours, c.left = false, c.exchange.Request
+	}
+}
+
+// Received records a cell of n bytes sent by the peer, and reports whether
+// it ended the peer's burst, so that this side's turn has come.
+func (c *Conversation) Received(n int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ours {
+		return false
+	}
+	c.left -= n
+	if c.left > 0 {
+		return false
+	}
+	now := time.Now()
+	if c.client {
+		c.next()
+		c.ours, c.left = true, c.exchange.Request
+		c.notBefore, c.idle = now.Add(c.exchange.Idle), true
+	} else {
+		c.ours, c.left = true, c.exchange.Response
+		c.notBefore, c.idle = now.Add(c.exchange.Think), false
+	}
+	return true
+}
+
+// Exchange returns the current exchange.
+func (c *Conversation) Exchange() Exchange {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exchange
+}
@@ -0,0 +1,144 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// Limiter caps the rate at which cells leave a Scheduler.
+type Limiter interface {
+	// Delay returns how long to wait before n bytes may be sent. It does
+	// not consume any budget.
+	Delay(now time.Time, n int) time.Duration
+	// Take consumes n bytes of budget.
+	Take(now time.Time, n int)
+}
+
+// TokenBucket is a Limiter refilled at a constant rate up to a maximum
+// burst. It is safe for concurrent use, so a single TokenBucket can be shared
+// by many connections to hold them under an aggregate budget.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket refilled at rate bytes per second and
+// holding at most burst bytes.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// NewSharedLimiter returns a TokenBucket meant to be shared by every
+// connection that should count against one process-wide budget.
+func NewSharedLimiter(rate float64, burst int) *TokenBucket {
+	return NewTokenBucket(rate, burst)
+}
+
+// refill must be called with b.mu held.
+func (b *TokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// Delay implements Limiter. A request larger than the bucket is allowed
+// once the bucket is full, and drives the balance negative.
+func (b *TokenBucket) Delay(now time.Time, n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	need := float64(n)
+	if need > b.burst {
+		need = b.burst
+	}
+	if b.tokens >= need || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Take implements Limiter.
+func (b *TokenBucket) Take(now time.Time, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+// limiters combines several limiters; a send must satisfy all of them.
+type limiters []Limiter
+
+func (ls limiters) Delay(now time.Time, n int) time.Duration {
+	var wait time.Duration
+	for _, l := range ls {
+		if d := l.Delay(now, n); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+func (ls limiters) Take(now time.Time, n int) {
+	for _, l := range ls {
+		l.Take(now, n)
+	}
+}
+
+// newRateLimiter builds the average and peak token buckets of rate, for cells
+// of up to cellSize bytes. It returns nil for a zero rate, which leaves the
+// connection unshaped.
+func newRateLimiter(rate profile.Rate, cellSize int) Limiter {
+	if rate.Average <= 0 {
+		return nil
+	}
+	burst := rate.Burst
+	if burst < cellSize {
+		burst = cellSize
+	}
+	ls := limiters{NewTokenBucket(rate.Average, burst)}
+	if rate.Peak > rate.Average {
+		// The peak bucket only holds a single cell, so a full average
+		// bucket drains at no more than the peak rate.
+		ls = append(ls, NewTokenBucket(rate.Peak, cellSize))
+	}
+	return ls
+}
+
+// carryTokens starts the buckets of l with the tokens left in the matching
+// buckets of prev, the limiter it replaces, up to their own burst, so that
+// switching profiles does not grant a fresh burst allowance.
+func carryTokens(l, prev Limiter, now time.Time) {
+	ls, ok := l.(limiters)
+	if !ok {
+		return
+	}
+	prevs, _ := prev.(limiters)
+	for i := range min(len(ls), len(prevs)) {
+		b, ok := ls[i].(*TokenBucket)
+		p, ok2 := prevs[i].(*TokenBucket)
+		if !ok || !ok2 {
+			continue
+		}
+		p.mu.Lock()
+		p.refill(now)
+		b.tokens = min(p.tokens, b.burst)
+		p.mu.Unlock()
+		b.last = now
+	}
+}
@@ -0,0 +1,150 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// checkDelay fails the test unless l waits want, within rounding, before n
+// bytes at now.
+func checkDelay(t *testing.T, l Limiter, now time.Time, n int, want time.Duration) {
+	t.Helper()
+	if got := l.Delay(now, n); got < want-time.Microsecond || got > want+time.Microsecond {
+		t.Errorf("Delay(%d bytes) = %v, want %v", n, got, want)
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := NewTokenBucket(1000, 500)
+	now := time.Now()
+	checkDelay(t, b, now, 500, 0)
+	b.Take(now, 500)
+	checkDelay(t, b, now, 100, 100*time.Millisecond)
+	checkDelay(t, b, now.Add(50*time.Millisecond), 100, 50*time.Millisecond)
+	checkDelay(t, b, now.Add(100*time.Millisecond), 100, 0)
+	// Delay does not consume the tokens.
+	checkDelay(t, b, now.Add(100*time.Millisecond), 100, 0)
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	b := NewTokenBucket(1000, 500)
+	now := time.Now()
+	b.Take(now, 500)
+	// An idle bucket fills up to its burst and no further.
+	now = now.Add(time.Hour)
+	checkDelay(t, b, now, 500, 0)
+	b.Take(now, 500)
+	checkDelay(t, b, now, 1, time.Millisecond)
+
+	// A request larger than the burst waits for a full bucket, then
+	// overdraws it.
+	now = now.Add(time.Second)
+	checkDelay(t, b, now, 2000, 0)
+	b.Take(now, 2000)
+	checkDelay(t, b, now, 100, 1600*time.Millisecond)
+}
+
+func TestSharedLimiter(t *testing.T) {
+	shared := NewSharedLimiter(1000, 1000)
+	s1, s2 := unshapedScheduler(), unshapedScheduler()
+	s1.SetSharedLimiter(shared)
+	s2.SetSharedLimiter(shared)
+	for i := range 2 {
+		s1.Schedule(testCell(1, uint32(i), 500), Options{Class: ClassBulk})
+		s2.Schedule(testCell(2, uint32(i), 500), Options{Class: ClassBulk})
+	}
+	if s1.GetNextCell() == nil || s2.GetNextCell() == nil {
+		t.Fatal("the shared budget did not let a cell through each Scheduler")
+	}
+	for _, s := range []*Scheduler{s1, s2} {
+		if cell := s.GetNextCell(); cell != nil {
+			t.Errorf("cell of stream %d sent past the shared budget", cell.CellID)
+		}
+		if wait := s.Wait(); wait <= 0 || wait > 500*time.Millisecond {
+			t.Errorf("Wait = %v, want up to 500ms", wait)
+		}
+	}
+
+	// Control cells are never held back.
+	control := testCell(3, 0, 500)
+	s1.Schedule(control, Options{Class: ClassControl})
+	if cell := s1.GetNextCell(); cell != control {
+		t.Errorf("GetNextCell = %+v, want the control cell", cell)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	const cell = 1400
+	if l := newRateLimiter(profile.Rate{}, cell); l != nil {
+		t.Errorf("zero rate limited by %v", l)
+	}
+
+	l := newRateLimiter(profile.Rate{Average: 1000, Peak: 4000, Burst: 100000}, cell)
+	now := time.Now()
+	checkDelay(t, l, now, cell, 0)
+	l.Take(now, cell)
+	// The average bucket holds plenty, so the peak rate paces the burst.
+	checkDelay(t, l, now, cell, time.Duration(cell)*time.Second/4000)
+
+	// Without a peak above the average, the average bucket alone applies,
+	// and holds at least a cell.
+	l = newRateLimiter(profile.Rate{Average: 1000, Burst: 10}, cell)
+	checkDelay(t, l, now, cell, 0)
+	l.Take(now, cell)
+	checkDelay(t, l, now, 100, 100*time.Millisecond)
+}
+
+func TestCarryTokens(t *testing.T) {
+	const cell = 1000
+	now := time.Now()
+	prev := newRateLimiter(profile.Rate{Average: 1000, Burst: 5000}, cell)
+	prev.Take(now, 4500)
+
+	// The spent budget carries over to a new limiter.
+	l := newRateLimiter(profile.Rate{Average: 1000, Burst: 8000}, cell)
+	carryTokens(l, prev, now)
+	checkDelay(t, l, now, 500, 0)
+	checkDelay(t, l, now, 1000, 500*time.Millisecond)
+
+	// A limiter with a smaller burst holds no more than it.
+	prev = newRateLimiter(profile.Rate{Average: 1000, Burst: 5000}, cell)
+	l = newRateLimiter(profile.Rate{Average: 1000, Burst: 2000}, cell)
+	carryTokens(l, prev, now)
+	l.Take(now, 2000)
+	checkDelay(t, l, now, 1000, time.Second)
+
+	// An overdrawn budget stays overdrawn, in the peak bucket too.
+	prev = newRateLimiter(profile.Rate{Average: 1000, Peak: 2000, Burst: 5000}, cell)
+	prev.Take(now, 6000)
+	l = newRateLimiter(profile.Rate{Average: 1000, Peak: 4000, Burst: 5000}, cell)
+	carryTokens(l, prev, now)
+	checkDelay(t, l, now, 1000, 2*time.Second)
+	prev = newRateLimiter(profile.Rate{Average: 1000, Burst: 5000}, cell)
+	prev.Take(now, 6000)
+	l = newRateLimiter(profile.Rate{Average: 1000, Burst: 5000}, cell)
+	carryTokens(l, prev, now)
+	checkDelay(t, l, now, 1000, 2*time.Second)
+}
+
+// TestSetProfileBudget checks that switching profiles back and forth does
+// not let more cells through than the rate allows.
+func TestSetProfileBudget(t *testing.T) {
+	rate := profile.Rate{Average: 1000, Burst: 2000}
+	s := NewScheduler()
+	s.SetRate(rate)
+	for i := range 10 {
+		s.Schedule(testCell(1, uint32(i), 1000), Options{Class: ClassBulk})
+	}
+	sent := 0
+	for _, typ := range []profile.TrafficType{profile.VideoStreaming, profile.FileDownload, profile.WebBrowsing} {
+		for s.GetNextCell() != nil {
+			sent++
+		}
+		s.SetProfile(profile.GetProfile(typ))
+	}
+	if sent != 2 {
+		t.Errorf("%d cells of 1000 bytes sent within a burst of 2000", sent)
+	}
+}
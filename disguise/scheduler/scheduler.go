@@ -9,12 +9,42 @@ import (
 	"github.com/uDisguise/disguise/disguise/profile"
 )
 
+// Class is the priority class of a queued cell. Lower classes are always
+// served before higher ones.
+type Class int
+
+const (
+	ClassControl Class = iota
+	ClassInteractive
+	ClassBulk
+	ClassCover
+)
+
+// Options controls how a single cell is queued.
+type Options struct {
+	Class Class
+	// Weight is the share of its class the cell's stream receives. Streams
+	// are identified by CellID. Zero means a weight of one.
+	Weight float64
+	// Deadline is the latest time the cell should leave the queue. Cover
+	// cells that miss their deadline are dropped; data cells are served
+	// earliest-deadline-first within their class. The zero value means no
+	// deadline.
+	Deadline time.Time
+}
+
 // cellItem is a wrapper for a Cell with a priority and index.
 type cellItem struct {
-	cell *framing.Cell
-	// The priority determines the order of the item in the queue.
-	// A lower value means higher priority.
-	priority int64
+	cell     *framing.Cell
+	class    Class
+	deadline time.Time
+	// queued is when the cell was queued.
+	queued time.Time
+	// finish is the virtual finish time of the cell under weighted fair
+	// queueing. It orders cells of the same class across streams.
+	finish float64
+	// seq breaks ties in arrival order.
+	seq uint64
 	// The index is needed by update and is maintained by the heap.Interface methods.
 	index int
 }
@@ -25,7 +55,20 @@ type cellPriorityQueue []*cellItem
 func (pq cellPriorityQueue) Len() int { return len(pq) }
 
 func (pq cellPriorityQueue) Less(i, j int) bool {
-	return pq[i].priority < pq[j].priority
+	a, b := pq[i], pq[j]
+	if a.class != b.class {
+		return a.class < b.class
+	}
+	if !a.deadline.IsZero() && !b.deadline.IsZero() && !a.deadline.Equal(b.deadline) {
+		return a.deadline.Before(b.deadline)
+	}
+	if a.deadline.IsZero() != b.deadline.IsZero() {
+		return !a.deadline.IsZero()
+	}
+	if a.finish != b.finish {
+		return a.finish < b.finish
+	}
+	return a.seq < b.seq
 }
 
 func (pq cellPriorityQueue) Swap(i, j int) {
@@ -50,64 +93,271 @@ func (pq *cellPriorityQueue) Pop() interface{} {
 	return item
 }
 
+// streamState tracks the weighted fair queueing state of one stream.
+type streamState struct {
+	lastFinish float64
+	queued     int
+}
+
 // Scheduler manages the transmission order and timing of cells.
 type Scheduler struct {
 	mu           sync.Mutex
 	profile      *profile.Profile
 	queue        cellPriorityQueue // Use the priority queue
 	lastSendTime time.Time
+
+	// virtualTime is the finish time of the last dequeued cell.
+	virtualTime float64
+	streams     map[uint16]*streamState
+	nextSeq     uint64
+	dropped     uint64
+
+	// limiter shapes the connection to the profile's target rate, or to
+	// rate if set with SetRate, and shared, if set, holds it under an
+	// aggregate budget. wait is the delay reported by the last throttled
+	// GetNextCell.
+	rate    profile.Rate
+	limiter Limiter
+	shared  Limiter
+	wait    time.Duration
+	// delay is how long the cell returned by the last GetNextCell waited
+	// in the queue.
+	delay time.Duration
+
+	// conversation, if set, holds cells back until it is this side's turn.
+	// queuedData counts the queued cells that are not cover traffic.
+	conversation *Conversation
+	queuedData   int
 }
 
 // NewScheduler creates a new Scheduler instance.
 func NewScheduler() *Scheduler {
+	p := profile.GetProfile(profile.WebBrowsing)
 	s := &Scheduler{
-		profile:      profile.GetProfile(profile.WebBrowsing),
+		profile:      p,
 		queue:        make(cellPriorityQueue, 0),
 		lastSendTime: time.Now(),
+		streams:      make(map[uint16]*streamState),
+		limiter:      newRateLimiter(p.Rate, p.MaxCellSize),
 	}
 	heap.Init(&s.queue)
 	return s
 }
 
-// SetProfile updates the active traffic profile.
+// SetProfile updates the active traffic profile and its rate limits. The
+// budget left under the previous limits carries over.
 func (s *Scheduler) SetProfile(p *profile.Profile) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.profile = p
+	s.setLimiterLocked()
 }
 
-// ScheduleCell adds a cell to the transmission queue with a randomized delay.
+// SetRate shapes the Scheduler to rate whichever profile is active, in place
+// of the Rate of the profiles. The zero Rate restores theirs.
+func (s *Scheduler) SetRate(rate profile.Rate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rate = rate
+	s.setLimiterLocked()
+}
+
+// setLimiterLocked rebuilds the limiter of the active rate. It must be called
+// with s.mu held.
+func (s *Scheduler) setLimiterLocked() {
+	rate := s.profile.Rate
+	if s.rate.Average > 0 {
+		rate = s.rate
+	}
+	l := newRateLimiter(rate, s.profile.MaxCellSize)
+	carryTokens(l, s.limiter, time.Now())
+	s.limiter = l
+}
+
+// SetSharedLimiter attaches a limiter shared with other connections. Cells
+// must fit both the profile's budget and the shared one.
+func (s *Scheduler) SetSharedLimiter(l Limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shared = l
+}
+
+// SetConversation makes the Scheduler follow c, only releasing cells during
+// the bursts of this side. The owner of the Scheduler reports the cells sent
+// and received to c, and fills the bursts with cover traffic when the queue
+// runs dry.
+func (s *Scheduler) SetConversation(c *Conversation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversation = c
+}
+
+// ScheduleCell adds a cell to the transmission queue using the default
+// options for its type: control cells first, then data as bulk traffic, and
+// cover cells last with a deadline one cover slot away.
 func (s *Scheduler) ScheduleCell(cell *framing.Cell) {
+	opts := Options{Class: ClassBulk}
+	switch cell.Type {
+	case framing.TypeControl, framing.TypeHandshake:
+		opts.Class = ClassControl
+	case framing.TypeDummy:
+		s.mu.Lock()
+		grace := s.profile.Cover.Interval
+		if s.profile.LatencyJitter > grace {
+			grace = s.profile.LatencyJitter
+		}
+		s.mu.Unlock()
+		opts.Class = ClassCover
+		opts.Deadline = time.Now().Add(grace)
+	}
+	s.Schedule(cell, opts)
+}
+
+// Schedule adds a cell to the transmission queue with explicit options.
+func (s *Scheduler) Schedule(cell *framing.Cell, opts Options) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	priority := time.Now().UnixNano()
-	if cell.Type == framing.TypeDummy {
-		// Dummy cells have lower priority to prioritize real data.
-		// We add a large offset to their timestamp.
-		priority = time.Now().Add(s.profile.ProbingInterval).UnixNano()
+	weight := opts.Weight
+	if weight <= 0 {
+		weight = 1
 	}
 
+	stream, ok := s.streams[cell.CellID]
+	if !ok {
+		stream = &streamState{}
+		s.streams[cell.CellID] = stream
+	}
+	start := s.virtualTime
+	if stream.lastFinish > start {
+		start = stream.lastFinish
+	}
+	size := float64(framing.CellHeaderLen + int(cell.PayloadLen) + int(cell.PaddingLen))
+	stream.lastFinish = start + size/weight
+	stream.queued++
+
+	if opts.Class != ClassCover {
+		s.queuedData++
+	}
 	heap.Push(&s.queue, &cellItem{
 		cell:     cell,
-		priority: priority,
+		class:    opts.Class,
+		deadline: opts.Deadline,
+		queued:   time.Now(),
+		finish:   stream.lastFinish,
+		seq:      s.nextSeq,
 	})
+	s.nextSeq++
 }
 
-// GetNextCell returns the next cell to be sent from the queue.
+// GetNextCell returns the next cell to be sent from the queue. Cover cells
+// whose deadline has passed are dropped rather than sent late. It returns nil
+// when the queue is empty, the rate limiters hold the next cell back or the
+// Conversation, if any, says it is not this side's turn; in the latter cases
+// Wait reports how long to back off, if waiting is not on the peer.
 func (s *Scheduler) GetNextCell() *framing.Cell {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if s.queue.Len() == 0 {
-		return nil
+	now := time.Now()
+	s.wait = 0
+	if c := s.conversation; c != nil && s.queue.Len() > 0 {
+		if budget, wait := c.Turn(now, s.queuedData > 0); budget <= 0 {
+			s.wait = wait
+			return nil
+		}
+	}
+	for s.queue.Len() > 0 {
+		item := s.queue[0]
+		if item.class == ClassCover && !item.deadline.IsZero() && now.After(item.deadline) {
+			heap.Pop(&s.queue)
+			s.release(item)
+			s.dropped++
+			continue
+		}
+
+		size := framing.CellHeaderLen + int(item.cell.PayloadLen) + int(item.cell.PaddingLen)
+		if item.class != ClassControl {
+			ls := s.limiters()
+			if wait := ls.Delay(now, size); wait > 0 {
+				s.wait = wait
+				return nil
+			}
+			ls.Take(now, size)
+		}
+
+		heap.Pop(&s.queue)
+		s.release(item)
+		s.lastSendTime = now
+		s.delay = now.Sub(item.queued)
+		return item.cell
+	}
+	return nil
+}
+
+// Wait returns how long the last GetNextCell call was throttled for, or
+// zero if it was not throttled.
+func (s *Scheduler) Wait() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wait
+}
+
+// Delay returns how long the cell returned by the last GetNextCell call
+// waited in the queue.
+func (s *Scheduler) Delay() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delay
+}
+
+// limiters returns the limiters that apply to non-control cells. It must be
+// called with s.mu held.
+func (s *Scheduler) limiters() limiters {
+	var ls limiters
+	for _, l := range []Limiter{s.limiter, s.shared} {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+// release updates the fair queueing state once item leaves the queue. It
+// must be called with s.mu held.
+func (s *Scheduler) release(item *cellItem) {
+	if item.finish > s.virtualTime {
+		s.virtualTime = item.finish
 	}
-	
-	item := s.queue[0]
-	if time.Now().UnixNano() < item.priority {
-		return nil // Not yet time to send the highest-priority cell.
+	if item.class != ClassCover {
+		s.queuedData--
 	}
+	if stream, ok := s.streams[item.cell.CellID]; ok {
+		stream.queued--
+		if stream.queued <= 0 {
+			delete(s.streams, item.cell.CellID)
+		}
+	}
+}
+
+// Len returns the number of queued cells.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue.Len()
+}
+
+// QueuedData returns the number of queued cells that are not cover traffic.
+func (s *Scheduler) QueuedData() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queuedData
+}
 
-	heap.Pop(&s.queue)
-	return item.cell
+// Dropped returns the number of cover cells dropped for missing their
+// deadline.
+func (s *Scheduler) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
 }
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// unshapedScheduler returns a Scheduler without rate limits.
+func unshapedScheduler() *Scheduler {
+	p := profile.GetProfile(profile.WebBrowsing)
+	p.Rate = profile.Rate{}
+	s := NewScheduler()
+	s.SetProfile(p)
+	return s
+}
+
+func testCell(id uint16, seq uint32, size int) *framing.Cell {
+	return &framing.Cell{
+		CellID:     id,
+		Type:       framing.TypeData,
+		Seq:        seq,
+		PaddingLen: uint16(size - framing.CellHeaderLen),
+	}
+}
+
+func TestClassOrder(t *testing.T) {
+	s := unshapedScheduler()
+	for i, class := range []Class{ClassBulk, ClassCover, ClassInteractive, ClassControl} {
+		s.Schedule(testCell(uint16(i+1), 0, 100), Options{Class: class})
+	}
+	for _, want := range []uint16{4, 3, 1, 2} {
+		if cell := s.GetNextCell(); cell == nil || cell.CellID != want {
+			t.Fatalf("GetNextCell = %+v, want the cell of stream %d", cell, want)
+		}
+	}
+	if cell := s.GetNextCell(); cell != nil {
+		t.Errorf("GetNextCell = %+v from an empty queue", cell)
+	}
+}
+
+func TestDeadlineOrder(t *testing.T) {
+	s := unshapedScheduler()
+	now := time.Now()
+	s.Schedule(testCell(1, 0, 100), Options{Class: ClassInteractive})
+	s.Schedule(testCell(2, 0, 100), Options{Class: ClassInteractive, Deadline: now.Add(time.Hour)})
+	s.Schedule(testCell(3, 0, 100), Options{Class: ClassInteractive, Deadline: now.Add(time.Minute)})
+	for _, want := range []uint16{3, 2, 1} {
+		if cell := s.GetNextCell(); cell == nil || cell.CellID != want {
+			t.Fatalf("GetNextCell = %+v, want the cell of stream %d", cell, want)
+		}
+	}
+}
+
+func TestWeightedFairQueueing(t *testing.T) {
+	s := unshapedScheduler()
+	for i := range 40 {
+		s.Schedule(testCell(1, uint32(i), 1000), Options{Class: ClassBulk, Weight: 3})
+		s.Schedule(testCell(2, uint32(i), 1000), Options{Class: ClassBulk})
+	}
+	served := map[uint16]int{}
+	next := map[uint16]uint32{}
+	for range 40 {
+		cell := s.GetNextCell()
+		if cell.Seq != next[cell.CellID] {
+			t.Fatalf("stream %d served cell %d before %d", cell.CellID, cell.Seq, next[cell.CellID])
+		}
+		next[cell.CellID]++
+		served[cell.CellID]++
+	}
+	if served[1] != 30 || served[2] != 10 {
+		t.Errorf("served %d cells of the stream of weight 3 and %d of the other, want 30 and 10", served[1], served[2])
+	}
+}
+
+func TestCoverDeadline(t *testing.T) {
+	s := unshapedScheduler()
+	cover := testCell(0, 0, 100)
+	cover.Type = framing.TypeDummy
+	s.Schedule(cover, Options{Class: ClassCover, Deadline: time.Now().Add(-time.Millisecond)})
+	if cell := s.GetNextCell(); cell != nil {
+		t.Errorf("GetNextCell = %+v, want the late cover cell dropped", cell)
+	}
+	if d := s.Dropped(); d != 1 {
+		t.Errorf("Dropped = %d, want 1", d)
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("Len = %d after the drop, want 0", n)
+	}
+}
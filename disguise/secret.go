@@ -0,0 +1,106 @@
+package disguise
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	mathrand "math/rand/v2"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/scheduler"
+)
+
+// SecretLen is the length of the secrets accepted by SetSecret.
+const SecretLen = 32
+
+// SetSecret keys the Manager with secret, which both peers share and which
+// must be uniformly random and unique to the connection, such as one
+// exported from its TLS session. Each direction gets its own framing.Keys,
+// from which CellIDs and padding are derived and which mask cell headers and
+// authenticate control cells; client selects the direction the Manager sends
+// in. SetSecret must be called before any cell is encoded or decoded.
+func (m *Manager) SetSecret(secret []byte, client bool) error {
+	clientKeys, err := framing.DeriveKeys(secret, "client")
+	if err != nil {
+		return err
+	}
+	serverKeys, err := framing.DeriveKeys(secret, "server")
+	if err != nil {
+		return err
+	}
+	shared := make([]byte, SecretLen)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, []byte("disguise shared")), shared); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client {
+		m.framer.SetKeys(clientKeys, serverKeys)
+	} else {
+		m.framer.SetKeys(serverKeys, clientKeys)
+	}
+	m.shared = shared
+	if m.conversationModel != nil {
+		m.conversation = scheduler.NewConversation(*m.conversationModel, sharedRand(shared, "conversation"), client)
+		m.scheduler.SetConversation(m.conversation)
+	}
+	return nil
+}
+
+// RekeySend replaces the Keys the Manager sends cells with by those SetSecret
+// would derive from secret, leaving the receiving direction and SharedRand
+// as they are. It moves a Manager keyed from a secret without forward
+// secrecy, such as the early exporter of a 0-RTT connection, to one that has
+// it; the peer calls RekeyReceive with the same secret before it decodes the
+// first cell sent afterwards.
+func (m *Manager) RekeySend(secret []byte, client bool) error {
+	keys, err := framing.DeriveKeys(secret, directionLabel(client))
+	if err != nil {
+		return err
+	}
+	m.framer.SetSendKeys(keys)
+	return nil
+}
+
+// RekeyReceive is the counterpart of RekeySend for the cells the Manager
+// receives.
+func (m *Manager) RekeyReceive(secret []byte, client bool) error {
+	keys, err := framing.DeriveKeys(secret, directionLabel(!client))
+	if err != nil {
+		return err
+	}
+	m.framer.SetReceiveKeys(keys)
+	return nil
+}
+
+// directionLabel names the direction the client or the server sends in.
+func directionLabel(client bool) string {
+	if client {
+		return "client"
+	}
+	return "server"
+}
+
+// SharedRand returns a PRNG that produces the same sequence at both peers
+// for the same label, once SetSecret keyed them with the same secret. It
+// lets them agree on random decisions, such as a padding schedule, without
+// exchanging them. Without a secret, the PRNG is seeded randomly.
+func (m *Manager) SharedRand(label string) *mathrand.Rand {
+	m.mu.Lock()
+	shared := m.shared
+	m.mu.Unlock()
+	return sharedRand(shared, label)
+}
+
+func sharedRand(shared []byte, label string) *mathrand.Rand {
+	var seed [32]byte
+	if shared == nil {
+		rand.Read(seed[:])
+	} else {
+		io.ReadFull(hkdf.Expand(sha256.New, shared, []byte(label)), seed[:])
+	}
+	return mathrand.New(mathrand.NewChaCha8(seed))
+}
@@ -0,0 +1,46 @@
+//go:build go1.25
+
+package disguise
+
+import (
+	"bytes"
+	"testing"
+	"testing/synctest"
+)
+
+func TestRekey(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		client, server := managerPair(t)
+		secret := bytes.Repeat([]byte{2}, SecretLen)
+
+		// The client moves to the new keys first: the server cannot
+		// decode its cells until it does too.
+		if err := client.RekeySend(secret, true); err != nil {
+			t.Fatal(err)
+		}
+		client.Announce()
+		cell, err := client.GetOutboundTraffic()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := server.ProcessInboundTraffic(cell); err == nil {
+			t.Error("cell sent with the new keys decoded with the old ones")
+		}
+
+		if err := server.RekeyReceive(secret, false); err != nil {
+			t.Fatal(err)
+		}
+		client.QueueApplicationData([]byte("rekeyed"))
+		pump(t, client, server)
+		if got, _ := server.ReadApplicationData(); string(got) != "rekeyed" {
+			t.Errorf("server read %q after rekeying, want %q", got, "rekeyed")
+		}
+
+		// The other direction keeps its keys.
+		server.QueueApplicationData([]byte("unchanged"))
+		pump(t, server, client)
+		if got, _ := client.ReadApplicationData(); string(got) != "unchanged" {
+			t.Errorf("client read %q, want %q", got, "unchanged")
+		}
+	})
+}
@@ -0,0 +1,321 @@
+// Package simnet simulates the network between two endpoints in memory, for
+// testing the Disguise layer without real sockets.
+//
+// Pipe returns the two ends of a connection whose directions each follow a
+// Link: the bytes written are cut into segments, which are serialised at the
+// bandwidth of the link, propagated with its latency and jitter, and may be
+// overtaken by later ones. Like TCP, the receiver sees the bytes in order,
+// and none are lost, so reordering shows as head-of-line blocking.
+//
+// All timing uses the time package, and the randomness of each link is drawn
+// from its seed. Run inside testing/synctest.Test, where time is virtual and
+// only advances once every goroutine of the test is blocked, connections are
+// deterministic up to the order of simultaneous events, and delays cost no
+// real time. This includes the timers of the Disguise layer, and the default
+// Config.Time of the tls package. synctest.Test needs Go 1.25, so the tests
+// that use it are built only with go1.25 and later, while the module itself
+// keeps supporting Go 1.24.
+package simnet
+
+import (
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultMSS is the segment size of a Link that does not set one.
+const DefaultMSS = 1460
+
+// Link describes one direction of a simulated connection. The zero value
+// delivers every segment instantly.
+type Link struct {
+	// Latency is the one-way propagation delay of every segment.
+	Latency time.Duration
+
+	// Jitter, if not zero, adds a delay drawn uniformly from [0, Jitter) to
+	// every segment.
+	Jitter time.Duration
+
+	// Bandwidth, if not zero, is the rate of the link in bytes per second.
+	// Segments are serialised one after the other at this rate.
+	Bandwidth int64
+
+	// MSS is the largest segment, in bytes. Zero selects DefaultMSS.
+	MSS int
+
+	// Reorder is the probability that a segment is held back for an extra
+	// ReorderDelay, so that the segments after it arrive first.
+	Reorder      float64
+	ReorderDelay time.Duration
+
+	// Seed seeds the PRNG that draws the jitter and the reordering.
+	Seed uint64
+}
+
+// Segment describes a segment delivered by a Link, as reported to the
+// function registered with Conn.Observe.
+type Segment struct {
+	// Len is the number of bytes of the segment, zero for the end of the
+	// stream.
+	Len int
+	// Sent is when the segment was written, and Arrived when it reached
+	// the receiver. Delivered is when it could be read, once the segments
+	// before it arrived as well.
+	Sent      time.Time
+	Arrived   time.Time
+	Delivered time.Time
+}
+
+// Pipe returns the two ends of a simulated connection. The bytes written to
+// a are sent over ab, and the ones written to b over ba.
+func Pipe(ab, ba Link) (a, b *Conn) {
+	toB := newDirection(ab)
+	toA := newDirection(ba)
+	a = &Conn{local: Addr("a"), remote: Addr("b"), in: toA, out: toB}
+	b = &Conn{local: Addr("b"), remote: Addr("a"), in: toB, out: toA}
+	return a, b
+}
+
+// Addr is the address of an end of a simulated connection.
+type Addr string
+
+func (a Addr) Network() string { return "simnet" }
+func (a Addr) String() string  { return string(a) }
+
+// segment is a segment in flight.
+type segment struct {
+	data    []byte
+	fin     bool
+	sent    time.Time
+	arrived time.Time
+}
+
+// direction is the state of one direction of a connection. Its methods
+// must be called with mu held, except where noted.
+type direction struct {
+	link Link
+
+	mu   sync.Mutex
+	rand *rand.Rand
+	// linkFree is when the link is done serialising the segments written
+	// so far.
+	linkFree time.Time
+	// inFlight are the segments not delivered yet, in the order they were
+	// written, and readable the bytes delivered but not read.
+	inFlight []*segment
+	readable []byte
+	// eof is set once the end of the stream was delivered, writeClosed once
+	// the writer closed, and readClosed once the reader did.
+	eof         bool
+	writeClosed bool
+	readClosed  bool
+	// notify is closed, and replaced, whenever the state changes.
+	notify chan struct{}
+
+	observer func(Segment)
+}
+
+func newDirection(link Link) *direction {
+	if link.MSS <= 0 {
+		link.MSS = DefaultMSS
+	}
+	return &direction{
+		link:   link,
+		rand:   rand.New(rand.NewPCG(link.Seed, link.Seed^0x9e3779b97f4a7c15)),
+		notify: make(chan struct{}),
+	}
+}
+
+func (d *direction) broadcast() {
+	close(d.notify)
+	d.notify = make(chan struct{})
+}
+
+// send puts a segment on the link at time now.
+func (d *direction) send(data []byte, fin bool, now time.Time) {
+	l := d.link
+	start := now
+	if d.linkFree.After(start) {
+		start = d.linkFree
+	}
+	if l.Bandwidth > 0 {
+		d.linkFree = start.Add(time.Duration(int64(len(data)) * int64(time.Second) / l.Bandwidth))
+	} else {
+		d.linkFree = start
+	}
+	delay := d.linkFree.Sub(now) + l.Latency
+	if l.Jitter > 0 {
+		delay += time.Duration(d.rand.Int64N(int64(l.Jitter)))
+	}
+	if l.Reorder > 0 && d.rand.Float64() < l.Reorder {
+		delay += l.ReorderDelay
+	}
+
+	s := &segment{data: data, fin: fin, sent: now}
+	d.inFlight = append(d.inFlight, s)
+	time.AfterFunc(delay, func() { d.arrive(s) })
+}
+
+// arrive marks s as arrived, and delivers the segments that are no longer
+// held back by one before them. It is called without d.mu held.
+func (d *direction) arrive(s *segment) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	s.arrived = now
+	for len(d.inFlight) > 0 && !d.inFlight[0].arrived.IsZero() {
+		s := d.inFlight[0]
+		d.inFlight = d.inFlight[1:]
+		if s.fin {
+			d.eof = true
+		} else if !d.readClosed {
+			d.readable = append(d.readable, s.data...)
+		}
+		if d.observer != nil {
+			d.observer(Segment{Len: len(s.data), Sent: s.sent, Arrived: s.arrived, Delivered: now})
+		}
+	}
+	d.broadcast()
+}
+
+// Conn is an end of a simulated connection. It implements net.Conn. Writes
+// never block: the data is buffered until the link delivers it.
+type Conn struct {
+	local, remote Addr
+	in, out       *direction
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ net.Conn = (*Conn)(nil)
+
+// Observe registers f to be called for every segment of the stream the
+// Conn reads, as it is delivered. f is called with the lock of the stream
+// held, and must not call back into the Conn.
+func (c *Conn) Observe(f func(Segment)) {
+	c.in.mu.Lock()
+	defer c.in.mu.Unlock()
+	c.in.observer = f
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	d := c.in
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		d.mu.Lock()
+		switch {
+		case d.readClosed:
+			d.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(d.readable) > 0:
+			n := copy(b, d.readable)
+			d.readable = d.readable[n:]
+			d.mu.Unlock()
+			return n, nil
+		case d.eof:
+			d.mu.Unlock()
+			return 0, io.EOF
+		}
+		notify := d.notify
+		d.mu.Unlock()
+
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-notify:
+			case <-t.C:
+			}
+			t.Stop()
+		} else {
+			<-notify
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+
+	d := c.out
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.writeClosed {
+		return 0, net.ErrClosed
+	}
+	if d.readClosed {
+		return 0, io.ErrClosedPipe
+	}
+	now := time.Now()
+	if !deadline.IsZero() && !now.Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	for p := b; len(p) > 0; {
+		n := min(len(p), d.link.MSS)
+		d.send(append([]byte(nil), p[:n]...), false, now)
+		p = p[n:]
+	}
+	return len(b), nil
+}
+
+// Close closes both directions of the Conn. The peer reads the bytes in
+// flight, and then io.EOF.
+func (c *Conn) Close() error {
+	out := c.out
+	out.mu.Lock()
+	if out.writeClosed {
+		out.mu.Unlock()
+		return net.ErrClosed
+	}
+	out.writeClosed = true
+	out.send(nil, true, time.Now())
+	out.mu.Unlock()
+
+	in := c.in
+	in.mu.Lock()
+	in.readClosed = true
+	in.readable = nil
+	in.broadcast()
+	in.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr  { return c.local }
+func (c *Conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	// Wake a blocked Read, so that it honours the new deadline.
+	c.in.mu.Lock()
+	c.in.broadcast()
+	c.in.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
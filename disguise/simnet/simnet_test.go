@@ -0,0 +1,161 @@
+//go:build go1.25
+
+package simnet_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	tls "github.com/uDisguise/disguise"
+	"github.com/uDisguise/disguise/disguise/simnet"
+)
+
+func TestLinkTiming(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		link := simnet.Link{Latency: 10 * time.Millisecond, Bandwidth: 100 * simnet.DefaultMSS}
+		a, b := simnet.Pipe(link, link)
+		defer a.Close()
+		defer b.Close()
+
+		start := time.Now()
+		msg := bytes.Repeat([]byte("x"), 10*simnet.DefaultMSS)
+		if _, err := a.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(b, buf); err != nil {
+			t.Fatal(err)
+		}
+		// Ten segments of 10ms each, and the latency of the last one.
+		if got, want := time.Since(start), 110*time.Millisecond; got != want {
+			t.Errorf("transfer took %v, want %v", got, want)
+		}
+	})
+}
+
+func TestLinkReorder(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		link := simnet.Link{
+			Latency:      5 * time.Millisecond,
+			Jitter:       5 * time.Millisecond,
+			MSS:          100,
+			Reorder:      0.3,
+			ReorderDelay: 20 * time.Millisecond,
+			Seed:         1,
+		}
+		a, b := simnet.Pipe(link, link)
+		defer b.Close()
+
+		var overtaken int
+		b.Observe(func(s simnet.Segment) {
+			if s.Delivered.After(s.Arrived) {
+				overtaken++
+			}
+		})
+		msg := make([]byte, 100000)
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+		go func() {
+			for p := msg; len(p) > 0; p = p[min(len(p), 777):] {
+				a.Write(p[:min(len(p), 777)])
+				time.Sleep(time.Millisecond)
+			}
+			a.Close()
+		}()
+		got, err := io.ReadAll(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("the stream was not delivered in order")
+		}
+		if overtaken == 0 {
+			t.Error("no segment was held back by an earlier one")
+		}
+	})
+}
+
+func TestDeadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+		defer a.Close()
+		defer b.Close()
+
+		b.SetReadDeadline(time.Now().Add(time.Second))
+		start := time.Now()
+		if _, err := b.Read(make([]byte, 1)); err == nil || time.Since(start) != time.Second {
+			t.Errorf("Read returned %v after %v, want a timeout after 1s", err, time.Since(start))
+		}
+	})
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestDisguiseTransfer runs a handshake and a shaped transfer over a
+// simulated link, in virtual time.
+func TestDisguiseTransfer(t *testing.T) {
+	cert := testCertificate(t)
+	synctest.Test(t, func(t *testing.T) {
+		link := simnet.Link{Latency: 40 * time.Millisecond, Jitter: 5 * time.Millisecond, Bandwidth: 1 << 20, Seed: 7}
+		a, b := simnet.Pipe(link, link)
+		client := tls.Client(a, &tls.Config{ServerName: "example.com", InsecureSkipVerify: true})
+		server := tls.Server(b, &tls.Config{Certificates: []tls.Certificate{cert}})
+		defer client.Close()
+		defer server.Close()
+
+		msg := bytes.Repeat([]byte("disguise "), 20000)
+		go func() {
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(server, buf); err == nil {
+				server.Write(buf[:1000])
+			}
+		}()
+
+		start := time.Now()
+		if _, err := client.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		reply := make([]byte, 1000)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, msg[:1000]) {
+			t.Error("server echoed the wrong data")
+		}
+		if !client.ConnectionState().Disguise.Enabled {
+			t.Error("Disguise was not enabled")
+		}
+		// A round trip for the handshake, and one for the exchange.
+		if elapsed := time.Since(start); elapsed < 160*time.Millisecond {
+			t.Errorf("transfer took %v of virtual time, less than two round trips", elapsed)
+		}
+	})
+}
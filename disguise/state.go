@@ -0,0 +1,196 @@
+package disguise
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// State summarises the traffic persona of a Manager: the active profile, its
+// mixture weights and load, and what the classifier learned. Session tickets
+// carry it, so that a resumed connection looks like the one it resumes
+// rather than starting over from the defaults.
+type State struct {
+	Profile    profile.TrafficType
+	Weights    map[profile.TrafficType]float64
+	Load       float64
+	Classifier ClassifierCounts
+}
+
+// stateFormat is the version of the encoding of State.
+const stateFormat = 1
+
+// ErrInvalidState is returned by State.UnmarshalBinary for data it did not
+// produce.
+var ErrInvalidState = errors.New("disguise: invalid state encoding")
+
+// State returns the current traffic persona of the Manager.
+func (m *Manager) State() State {
+	m.mu.Lock()
+	p := m.profile
+	m.mu.Unlock()
+
+	return State{
+		Profile:    p.GetProfileType(),
+		Weights:    p.Weights(),
+		Load:       p.Load(),
+		Classifier: m.classifier.Counts(),
+	}
+}
+
+// Restore continues the traffic persona saved by State, replacing the active
+// profile with a new one of the saved type.
+func (m *Manager) Restore(s State) {
+	p := profile.GetProfile(s.Profile)
+	p.SetWeights(s.Weights)
+	p.SetLoad(s.Load)
+	m.classifier.SetCounts(s.Classifier)
+	m.SetProfile(p)
+}
+
+// MarshalBinary encodes s compactly, with maps in a deterministic order.
+func (s State) MarshalBinary() ([]byte, error) {
+	if !validType(s.Profile) {
+		return nil, errors.New("disguise: invalid profile type in state")
+	}
+	b := []byte{stateFormat, byte(s.Profile)}
+	b = appendFloat(b, s.Load)
+
+	weights := sortedTypes(s.Weights)
+	b = append(b, byte(len(weights)))
+	for _, t := range weights {
+		b = append(b, byte(t))
+		b = appendFloat(b, s.Weights[t])
+	}
+
+	emission := sortedTypes(s.Classifier.Emission)
+	b = append(b, byte(len(emission)))
+	for _, t := range emission {
+		counts := s.Classifier.Emission[t]
+		if len(counts) > math.MaxUint8 {
+			return nil, errors.New("disguise: too many observation symbols in state")
+		}
+		b = append(b, byte(t), byte(len(counts)))
+		for _, c := range counts {
+			b = appendFloat(b, c)
+		}
+	}
+
+	transition := sortedTypes(s.Classifier.Transition)
+	b = append(b, byte(len(transition)))
+	for _, from := range transition {
+		row := s.Classifier.Transition[from]
+		to := sortedTypes(row)
+		b = append(b, byte(from), byte(len(to)))
+		for _, t := range to {
+			b = append(b, byte(t))
+			b = appendFloat(b, row[t])
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a State encoded by MarshalBinary.
+func (s *State) UnmarshalBinary(data []byte) error {
+	d := stateDecoder{data: data, ok: true}
+	if d.byte() != stateFormat {
+		return ErrInvalidState
+	}
+	st := State{
+		Profile: profile.TrafficType(d.byte()),
+		Load:    d.float(),
+		Weights: make(map[profile.TrafficType]float64),
+		Classifier: ClassifierCounts{
+			Emission:   make(map[profile.TrafficType][]float64),
+			Transition: make(map[profile.TrafficType]map[profile.TrafficType]float64),
+		},
+	}
+	for n := d.byte(); n > 0 && d.ok; n-- {
+		t := d.trafficType()
+		st.Weights[t] = d.float()
+	}
+	for n := d.byte(); n > 0 && d.ok; n-- {
+		t := d.trafficType()
+		counts := make([]float64, d.byte())
+		for i := range counts {
+			counts[i] = d.float()
+		}
+		st.Classifier.Emission[t] = counts
+	}
+	for n := d.byte(); n > 0 && d.ok; n-- {
+		from := d.trafficType()
+		row := make(map[profile.TrafficType]float64)
+		for m := d.byte(); m > 0 && d.ok; m-- {
+			to := d.trafficType()
+			row[to] = d.float()
+		}
+		st.Classifier.Transition[from] = row
+	}
+	if !d.ok || len(d.data) != 0 || !validType(st.Profile) {
+		return ErrInvalidState
+	}
+	*s = st
+	return nil
+}
+
+func validType(t profile.TrafficType) bool {
+	return t >= profile.WebBrowsing && t <= profile.Dynamic
+}
+
+func sortedTypes[V any](m map[profile.TrafficType]V) []profile.TrafficType {
+	types := make([]profile.TrafficType, 0, len(m))
+	for t := range m {
+		if validType(t) {
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+}
+
+// stateDecoder reads the encoding of a State. The first short or invalid
+// read clears ok.
+type stateDecoder struct {
+	data []byte
+	ok   bool
+}
+
+func (d *stateDecoder) byte() byte {
+	if len(d.data) < 1 {
+		d.data, d.ok = nil, false
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *stateDecoder) trafficType() profile.TrafficType {
+	t := profile.TrafficType(d.byte())
+	if !validType(t) {
+		d.ok = false
+	}
+	return t
+}
+
+// float reads a float64, which must be finite and not negative, as all the
+// quantities of a State are.
+func (d *stateDecoder) float() float64 {
+	if len(d.data) < 8 {
+		d.data, d.ok = nil, false
+		return 0
+	}
+	f := math.Float64frombits(binary.BigEndian.Uint64(d.data))
+	d.data = d.data[8:]
+	if math.IsNaN(f) || math.IsInf(f, 0) || f < 0 {
+		d.ok = false
+	}
+	return f
+}
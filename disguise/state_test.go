@@ -0,0 +1,97 @@
+package disguise
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// learnedState returns the State of a dynamic persona that learned to prefer
+// video and dropped downloads.
+func learnedState() State {
+	counts := NewHMMClassifier().Counts()
+	counts.Emission[profile.VideoStreaming][2] += 10
+	counts.Transition[profile.WebBrowsing][profile.VideoStreaming] += 4
+	return State{
+		Profile: profile.Dynamic,
+		Weights: map[profile.TrafficType]float64{
+			profile.WebBrowsing:    0.25,
+			profile.VideoStreaming: 0.75,
+			profile.FileDownload:   0,
+		},
+		Load:       0.3,
+		Classifier: counts,
+	}
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	s := learnedState()
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b2, _ := learnedState().MarshalBinary(); string(b2) != string(b) {
+		t.Error("encoding of the same State differs")
+	}
+	var got State
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("UnmarshalBinary = %+v, want %+v", got, s)
+	}
+}
+
+func TestStateInvalid(t *testing.T) {
+	s := learnedState()
+	b, err := s.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range len(b) {
+		if err := new(State).UnmarshalBinary(b[:n]); !errors.Is(err, ErrInvalidState) {
+			t.Fatalf("UnmarshalBinary of %d of %d bytes = %v", n, len(b), err)
+		}
+	}
+	for name, data := range map[string][]byte{
+		"trailing data": append(b[:len(b):len(b)], 0),
+		"format":        append([]byte{stateFormat + 1}, b[1:]...),
+		"profile":       append([]byte{stateFormat, 0xff}, b[2:]...),
+	} {
+		if err := new(State).UnmarshalBinary(data); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("UnmarshalBinary with a bad %s = %v", name, err)
+		}
+	}
+	for _, load := range []float64{math.NaN(), math.Inf(1), -1} {
+		bad := learnedState()
+		bad.Load = load
+		data, err := bad.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := new(State).UnmarshalBinary(data); !errors.Is(err, ErrInvalidState) {
+			t.Errorf("UnmarshalBinary with a load of %v = %v", load, err)
+		}
+	}
+
+	bad := learnedState()
+	bad.Profile = 0xff
+	if _, err := bad.MarshalBinary(); err == nil {
+		t.Error("MarshalBinary accepted an invalid profile type")
+	}
+}
+
+// TestManagerRestore checks that a Manager continues a saved persona, down
+// to the types of a dynamic mixture that dropped to zero.
+func TestManagerRestore(t *testing.T) {
+	m := NewManager()
+	defer m.Close()
+	s := learnedState()
+	m.Restore(s)
+	if got := m.State(); !reflect.DeepEqual(got, s) {
+		t.Errorf("State after Restore = %+v, want %+v", got, s)
+	}
+}
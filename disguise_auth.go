@@ -0,0 +1,253 @@
+package tls
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"log/slog"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise"
+)
+
+const (
+	// disguiseTokenLabel domain-separates the ClientHello token MAC.
+	disguiseTokenLabel = "disguise client hello token"
+	// disguiseConfirmLabel domain-separates the ServerHello confirmation.
+	disguiseConfirmLabel = "disguise server hello confirmation"
+	// disguiseConfirmLen is the number of leading bytes of the server random
+	// replaced by the confirmation.
+	disguiseConfirmLen = 16
+	// disguiseExporterLabel is the exporter label of the secret that keys
+	// the Disguise Manager of a connection.
+	disguiseExporterLabel = "EXPORTER-disguise manager secret"
+	// disguiseTokenPeriod is the granularity of the time a token is bound to.
+	disguiseTokenPeriod = time.Minute
+	// disguiseTokenSkew is the number of periods the time of a token may be
+	// off from the server clock, either way.
+	disguiseTokenSkew = 2
+)
+
+// discardLogger is the Logger of connections whose Config has no Disguise
+// Logger.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// disguiseLogger returns the Logger of the Disguise options of the
+// connection, which receives the outcome of the negotiation, or
+// discardLogger.
+func (c *Conn) disguiseLogger() *slog.Logger {
+	if d := c.config.Disguise; d != nil && d.Logger != nil {
+		return d.Logger
+	}
+	return discardLogger
+}
+
+// disguiseToken computes the token a client carries in the legacy_session_id
+// of its ClientHello at time now. It is a MAC over the client random and the
+// current period, so it looks like the random session ID every other client
+// sends, cannot be replayed with a different random, and goes stale after a
+// few minutes. The period is not sent: the server tries those around its own
+// clock.
+func disguiseToken(key, random []byte, now time.Time) []byte {
+	return disguisePeriodToken(key, random, disguisePeriod(now))
+}
+
+// disguisePeriod returns the period of the token made at time t.
+func disguisePeriod(t time.Time) int64 {
+	return t.Unix() / int64(disguiseTokenPeriod/time.Second)
+}
+
+func disguisePeriodToken(key, random []byte, period int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(disguiseTokenLabel))
+	mac.Write(binary.BigEndian.AppendUint64(nil, uint64(period)))
+	mac.Write(random)
+	return mac.Sum(nil)
+}
+
+// checkDisguiseToken returns the key among keys that token was made with at
+// a time within disguiseTokenSkew periods of now, or nil.
+func checkDisguiseToken(keys [][]byte, random, token []byte, now time.Time) []byte {
+	if len(token) != sha256.Size {
+		return nil
+	}
+	period := disguisePeriod(now)
+	for _, key := range keys {
+		for p := period - disguiseTokenSkew; p <= period+disguiseTokenSkew; p++ {
+			if hmac.Equal(token, disguisePeriodToken(key, random, p)) {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// disguiseReplayWindow is how long a token is accepted for at most: a token
+// made disguiseTokenSkew periods ahead of the server clock stays valid until
+// the server is as many periods ahead of it.
+const disguiseReplayWindow = (2*disguiseTokenSkew + 1) * disguiseTokenPeriod
+
+// disguiseReplayCache returns the cache of the client randoms of the tokens
+// c accepted, created on first use. Like the 0-RTT replay cache, once it is
+// full it rejects every token instead of forgetting one that could be
+// replayed.
+func (c *Config) disguiseReplayCache() EarlyDataReplayCache {
+	c.mutex.RLock()
+	cache := c.disguiseRandoms
+	c.mutex.RUnlock()
+	if cache != nil {
+		return cache
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.disguiseRandoms == nil {
+		c.disguiseRandoms = NewEarlyDataReplayCache(0)
+	}
+	return c.disguiseRandoms
+}
+
+// disguiseConfirmation computes the value a server that activated Disguise
+// places at the start of its random. It covers the protocol version, the
+// client random and the rest of the server random, including any downgrade
+// canary.
+func disguiseConfirmation(key, clientRandom, serverRandom []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(disguiseConfirmLabel))
+	mac.Write([]byte{disguise.Version})
+	mac.Write(clientRandom)
+	mac.Write(serverRandom[disguiseConfirmLen:])
+	return mac.Sum(nil)[:disguiseConfirmLen]
+}
+
+// confirmDisguise marks serverRandom, which must already be filled in, as
+// coming from a server that activated Disguise.
+func confirmDisguise(key, clientRandom, serverRandom []byte) {
+	copy(serverRandom, disguiseConfirmation(key, clientRandom, serverRandom))
+}
+
+// disguiseConfirmed reports whether serverRandom was marked by
+// confirmDisguise with key, the key of the client. A client with a key does
+// not accept the confirmation of a server that accepts every client, which
+// anyone could make.
+func disguiseConfirmed(key, clientRandom, serverRandom []byte) bool {
+	if len(serverRandom) != 32 {
+		return false
+	}
+	return hmac.Equal(serverRandom[:disguiseConfirmLen], disguiseConfirmation(key, clientRandom, serverRandom))
+}
+
+// disguiseKeys returns the keys that authenticate Disguise clients: those
+// set with SetDisguiseKeys, or else DisguiseSecret. The first key is the one
+// clients use.
+func (c *Config) disguiseKeys() [][]byte {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if len(c.disguiseKeyList) > 0 {
+		return c.disguiseKeyList
+	}
+	if len(c.DisguiseSecret) > 0 {
+		return [][]byte{c.DisguiseSecret}
+	}
+	return nil
+}
+
+// SetDisguiseKeys updates the keys that authenticate Disguise clients.
+//
+// Clients prove knowledge of the first key, while servers accept any of them.
+// It is safe to call this function while the server is running in order to
+// rotate the keys: add the new key at the end, then move it to the front once
+// every client has it, and finally drop the old one. The function will panic
+// if keys is empty.
+//
+// Keys set with this function take precedence over DisguiseSecret.
+func (c *Config) SetDisguiseKeys(keys [][]byte) {
+	if len(keys) == 0 {
+		panic("tls: keys must have at least one key")
+	}
+
+	newKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		newKeys[i] = append([]byte(nil), key...)
+	}
+
+	c.mutex.Lock()
+	c.disguiseKeyList = newKeys
+	c.mutex.Unlock()
+}
+
+// authorizeDisguise checks the token in a ClientHello and activates Disguise
+// on the server connection if it was made recently with one of the keys, and
+// its client random was not seen before. A server without any key activates
+// it for every client.
+func (c *Conn) authorizeDisguise(hello *clientHelloMsg) bool {
+	log := c.disguiseLogger()
+	keys := c.config.disguiseKeys()
+	if len(keys) == 0 {
+		c.disguiseVersion = disguise.Version
+		log.Info("disguise negotiated", "role", "server", "version", c.disguiseVersion, "remote", c.conn.RemoteAddr(), "authenticated", false)
+		return true
+	}
+	key := checkDisguiseToken(keys, hello.random, hello.sessionId, c.config.time())
+	if key == nil {
+		log.Info("disguise not negotiated", "role", "server", "remote", c.conn.RemoteAddr(), "reason", "no valid token")
+		return false
+	}
+	// A ClientHello recorded from an authorised client must not get the
+	// answer of the real server when it is replayed within the window.
+	if c.config.disguiseReplayCache().Seen(hello.random, time.Now().Add(disguiseReplayWindow)) {
+		log.Info("disguise not negotiated", "role", "server", "remote", c.conn.RemoteAddr(), "reason", "replayed token")
+		return false
+	}
+	c.disguiseVersion = disguise.Version
+	c.disguiseKey = key
+	log.Info("disguise negotiated", "role", "server", "version", c.disguiseVersion, "remote", c.conn.RemoteAddr(), "authenticated", true)
+	return true
+}
+
+// checkDisguiseConfirmation activates Disguise on the client connection if
+// the server confirmed it in its random.
+func (c *Conn) checkDisguiseConfirmation(clientRandom, serverRandom []byte) {
+	if c.echAccepted {
+		// The server confirmed Disguise before overwriting the end of its
+		// random with the ECH confirmation.
+		n := len(serverRandom) - echConfirmationLen
+		serverRandom = append(serverRandom[:n:n], make([]byte, echConfirmationLen)...)
+	}
+	log := c.disguiseLogger()
+	if disguiseConfirmed(c.disguiseKey, clientRandom, serverRandom) {
+		c.disguiseVersion = disguise.Version
+		log.Info("disguise negotiated", "role", "client", "version", c.disguiseVersion, "server_name", c.serverName)
+		return
+	}
+	log.Info("disguise not negotiated", "role", "client", "server_name", c.serverName, "reason", "no server confirmation")
+}
+
+// keyDisguise keys m with a secret exported from the connection by ekm,
+// which binds the Disguise state to the TLS session.
+func (c *Conn) keyDisguise(m *disguise.Manager, ekm func(string, []byte, int) ([]byte, error)) error {
+	secret, err := ekm(disguiseExporterLabel, nil, disguise.SecretLen)
+	if err != nil {
+		return err
+	}
+	return m.SetSecret(secret, c.isClient)
+}
+
+// rekeyDisguise moves the directions of m selected by send and receive from
+// the keys of the early exporter to ones exported from the completed
+// handshake, which unlike the early secret has forward secrecy. Only the
+// cells of the early data itself are framed with the early keys.
+func (c *Conn) rekeyDisguise(m *disguise.Manager, send, receive bool) error {
+	secret, err := c.ekm(disguiseExporterLabel, nil, disguise.SecretLen)
+	if err != nil {
+		return err
+	}
+	if send {
+		if err := m.RekeySend(secret, c.isClient); err != nil {
+			return err
+		}
+	}
+	if receive {
+		return m.RekeyReceive(secret, c.isClient)
+	}
+	return nil
+}
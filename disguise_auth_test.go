@@ -0,0 +1,496 @@
+//go:build go1.25
+
+package tls
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise"
+	"github.com/uDisguise/disguise/disguise/profile"
+	"github.com/uDisguise/disguise/disguise/simnet"
+)
+
+func TestDisguiseToken(t *testing.T) {
+	key, otherKey := []byte("key"), []byte("other key")
+	random, otherRandom := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	now := time.Unix(1700000000, 0)
+
+	token := disguiseToken(key, random, now)
+	if len(token) != sha256.Size {
+		t.Fatalf("token of %d bytes, want a session ID of %d", len(token), sha256.Size)
+	}
+	if bytes.Equal(token, disguiseToken(otherKey, random, now)) || bytes.Equal(token, disguiseToken(key, otherRandom, now)) {
+		t.Error("token does not depend on both the key and the random")
+	}
+	if bytes.Equal(token, disguiseToken(key, random, now.Add(disguiseTokenPeriod))) {
+		t.Error("token does not depend on the time")
+	}
+
+	keys := [][]byte{otherKey, key}
+	skew := disguiseTokenSkew * disguiseTokenPeriod
+	for _, d := range []time.Duration{0, skew, -skew} {
+		if got := checkDisguiseToken(keys, random, token, now.Add(d)); !bytes.Equal(got, key) {
+			t.Errorf("token checked %v later returned key %q, want %q", d, got, key)
+		}
+	}
+	for _, d := range []time.Duration{skew + disguiseTokenPeriod, -skew - disguiseTokenPeriod} {
+		if got := checkDisguiseToken(keys, random, token, now.Add(d)); got != nil {
+			t.Errorf("stale token checked %v later accepted with key %q", d, got)
+		}
+	}
+	if got := checkDisguiseToken(keys, otherRandom, token, now); got != nil {
+		t.Errorf("token accepted for another random with key %q", got)
+	}
+}
+
+func TestDisguiseConfirmation(t *testing.T) {
+	key := []byte("key")
+	clientRandom := bytes.Repeat([]byte{1}, 32)
+	serverRandom := func() []byte { return bytes.Repeat([]byte{2}, 32) }
+
+	confirmed := serverRandom()
+	confirmDisguise(key, clientRandom, confirmed)
+	if !disguiseConfirmed(key, clientRandom, confirmed) {
+		t.Error("confirmation rejected")
+	}
+	if disguiseConfirmed([]byte("other key"), clientRandom, confirmed) {
+		t.Error("confirmation accepted with another key")
+	}
+	if disguiseConfirmed(key, bytes.Repeat([]byte{3}, 32), confirmed) {
+		t.Error("confirmation accepted for another client random")
+	}
+	tampered := bytes.Clone(confirmed)
+	tampered[31] ^= 1
+	if disguiseConfirmed(key, clientRandom, tampered) {
+		t.Error("confirmation accepted with the end of the random changed")
+	}
+	if disguiseConfirmed(key, clientRandom, confirmed[:31]) {
+		t.Error("confirmation accepted from a short random")
+	}
+	if disguiseConfirmed(key, clientRandom, serverRandom()) {
+		t.Error("unmarked random accepted")
+	}
+
+	// A server without keys confirms with a nil key, which only clients
+	// without keys accept.
+	anyone := serverRandom()
+	confirmDisguise(nil, clientRandom, anyone)
+	if !disguiseConfirmed(nil, clientRandom, anyone) {
+		t.Error("confirmation of a server without keys rejected by a client without keys")
+	}
+	if disguiseConfirmed(key, clientRandom, anyone) {
+		t.Error("confirmation of a server without keys accepted by a client with a key")
+	}
+}
+
+// disguiseHandshake runs a handshake between a client and a server with the
+// given configs, and returns whether each activated Disguise.
+func disguiseHandshake(t *testing.T, clientConfig, serverConfig *Config) (client, server bool) {
+	t.Helper()
+	synctest.Test(t, func(t *testing.T) {
+		a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+		c, s := Client(a, clientConfig), Server(b, serverConfig)
+		handshake := make(chan error, 1)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer s.Close()
+			handshake <- s.Handshake()
+			io.Copy(io.Discard, s)
+		}()
+		defer func() {
+			c.Close()
+			<-done
+		}()
+		if err := c.Handshake(); err != nil {
+			t.Fatalf("client handshake: %v", err)
+		}
+		if err := <-handshake; err != nil {
+			t.Fatalf("server handshake: %v", err)
+		}
+		client = c.ConnectionState().Disguise.Enabled
+		server = s.ConnectionState().Disguise.Enabled
+	})
+	return client, server
+}
+
+func TestDisguiseAuthentication(t *testing.T) {
+	cert := testCertificate(t)
+	oldKey, newKey, otherKey := []byte("old key"), []byte("new key"), []byte("other key")
+	serverConfig := func(keys ...[]byte) *Config {
+		c := &Config{Certificates: []Certificate{cert}}
+		if len(keys) > 0 {
+			c.SetDisguiseKeys(keys)
+		}
+		return c
+	}
+	clientConfig := func(secret []byte) *Config {
+		return &Config{ServerName: "example.com", InsecureSkipVerify: true, DisguiseSecret: secret}
+	}
+
+	for _, tt := range []struct {
+		name           string
+		client, server *Config
+		// want is whether the client and the server activate Disguise.
+		wantClient, wantServer bool
+	}{
+		{"NoKeys", clientConfig(nil), serverConfig(), true, true},
+		{"Secret", clientConfig(oldKey), &Config{Certificates: []Certificate{cert}, DisguiseSecret: oldKey}, true, true},
+		{"Key", clientConfig(oldKey), serverConfig(oldKey), true, true},
+		{"WrongKey", clientConfig(otherKey), serverConfig(oldKey), false, false},
+		{"NoClientKey", clientConfig(nil), serverConfig(oldKey), false, false},
+		// The server accepts every client, but the client does not
+		// accept a confirmation anyone could make.
+		{"NoServerKey", clientConfig(oldKey), serverConfig(), false, true},
+		// While the keys rotate, the server accepts either key.
+		{"RotationOld", clientConfig(oldKey), serverConfig(oldKey, newKey), true, true},
+		{"RotationNew", clientConfig(newKey), serverConfig(oldKey, newKey), true, true},
+		{"Rotated", clientConfig(oldKey), serverConfig(newKey), false, false},
+		// A client proves knowledge of its first key only.
+		{"ClientFirstKey", func() *Config {
+			c := clientConfig(nil)
+			c.SetDisguiseKeys([][]byte{otherKey, oldKey})
+			return c
+		}(), serverConfig(oldKey), false, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := disguiseHandshake(t, tt.client, tt.server)
+			if client != tt.wantClient || server != tt.wantServer {
+				t.Errorf("Disguise enabled on the client: %v, on the server: %v; want %v and %v", client, server, tt.wantClient, tt.wantServer)
+			}
+		})
+	}
+}
+
+// TestDisguiseKeyRotation rotates the keys of a server between handshakes,
+// the way SetDisguiseKeys describes.
+func TestDisguiseKeyRotation(t *testing.T) {
+	oldKey, newKey := []byte("old key"), []byte("new key")
+	server := &Config{Certificates: []Certificate{testCertificate(t)}}
+	client := func(key []byte) *Config {
+		return &Config{ServerName: "example.com", InsecureSkipVerify: true, DisguiseSecret: key}
+	}
+	for i, step := range []struct {
+		keys [][]byte
+		// old and new are whether clients with each key are accepted.
+		old, new bool
+	}{
+		{[][]byte{oldKey}, true, false},
+		{[][]byte{oldKey, newKey}, true, true},
+		{[][]byte{newKey, oldKey}, true, true},
+		{[][]byte{newKey}, false, true},
+	} {
+		server.SetDisguiseKeys(step.keys)
+		if c, s := disguiseHandshake(t, client(oldKey), server); c != step.old || s != step.old {
+			t.Errorf("step %d: client with the old key accepted by the client: %v, by the server: %v; want %v", i, c, s, step.old)
+		}
+		if c, s := disguiseHandshake(t, client(newKey), server); c != step.new || s != step.new {
+			t.Errorf("step %d: client with the new key accepted by the client: %v, by the server: %v; want %v", i, c, s, step.new)
+		}
+	}
+}
+
+// TestDisguiseExporterSecret checks that both ends of a connection key their
+// Manager with the secret exported under the Disguise label, and that
+// connections do not share it.
+func TestDisguiseExporterSecret(t *testing.T) {
+	clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true}
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t)}}
+	// draws returns the first values of the shared PRNG of m.
+	draws := func(m *disguise.Manager) [4]uint64 {
+		r := m.SharedRand("test")
+		return [4]uint64{r.Uint64(), r.Uint64(), r.Uint64(), r.Uint64()}
+	}
+	var previous [4]uint64
+	for i := range 2 {
+		synctest.Test(t, func(t *testing.T) {
+			a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+			client, server := Client(a, clientConfig), Server(b, serverConfig)
+			handshake := make(chan error, 1)
+			go func() { handshake <- server.Handshake() }()
+			if err := client.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-handshake; err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			defer client.Close()
+
+			cs := client.ConnectionState()
+			secret, err := cs.ExportKeyingMaterial(disguiseExporterLabel, nil, disguise.SecretLen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := disguise.NewManager()
+			defer want.Close()
+			if err := want.SetSecret(secret, true); err != nil {
+				t.Fatal(err)
+			}
+
+			got := draws(client.disguiseManager)
+			if got != draws(want) {
+				t.Error("client not keyed with the exported secret")
+			}
+			if draws(server.disguiseManager) != got {
+				t.Error("server keyed with another secret than the client")
+			}
+			if i > 0 && got == previous {
+				t.Error("two connections keyed with the same secret")
+			}
+			previous = got
+		})
+	}
+}
+
+// logRecorder is an slog.Handler that keeps the level and message of every
+// record, with the attributes as strings.
+type logRecorder struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+type logRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]string
+}
+
+func (r *logRecorder) Enabled(context.Context, slog.Level) bool { return true }
+func (r *logRecorder) WithAttrs([]slog.Attr) slog.Handler       { return r }
+func (r *logRecorder) WithGroup(string) slog.Handler            { return r }
+
+func (r *logRecorder) Handle(_ context.Context, record slog.Record) error {
+	attrs := make(map[string]string)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs[a.Key] = a.Value.String()
+		return true
+	})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, logRecord{record.Level, record.Message, attrs})
+	return nil
+}
+
+// expect fails the test unless a record with msg was logged at level, with
+// the given attributes among its own.
+func (r *logRecorder) expect(t *testing.T, level slog.Level, msg string, attrs ...string) {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+next:
+	for _, rec := range r.records {
+		if rec.msg != msg || rec.level != level {
+			continue
+		}
+		for i := 0; i < len(attrs); i += 2 {
+			if rec.attrs[attrs[i]] != attrs[i+1] {
+				continue next
+			}
+		}
+		return
+	}
+	t.Errorf("no %v record %q with %v among %v", level, msg, attrs, r.records)
+}
+
+func TestDisguiseLogger(t *testing.T) {
+	cert := testCertificate(t)
+	key := []byte("key")
+	clientLog, serverLog := new(logRecorder), new(logRecorder)
+	clientConfig := func(key []byte) *Config {
+		return &Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+			MinVersion:         VersionTLS13,
+			DisguiseSecret:     key,
+			Disguise:           &disguise.Config{Logger: slog.New(clientLog)},
+		}
+	}
+	serverConfig := &Config{
+		Certificates:   []Certificate{cert},
+		DisguiseSecret: key,
+		Disguise:       &disguise.Config{Logger: slog.New(serverLog)},
+	}
+
+	synctest.Test(t, func(t *testing.T) {
+		a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+		client, server := Client(a, clientConfig(key)), Server(b, serverConfig)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		clientLog.expect(t, slog.LevelInfo, "disguise negotiated", "role", "client")
+		serverLog.expect(t, slog.LevelInfo, "disguise negotiated", "role", "server", "authenticated", "true")
+
+		if err := client.SetDisguiseProfile(DisguiseProfileVideo, false); err != nil {
+			t.Fatal(err)
+		}
+		clientLog.expect(t, slog.LevelInfo, "disguise profile switch", "from", profile.Dynamic.String(), "to", profile.VideoStreaming.String())
+		// The presets share a cover policy.
+		tail := profile.GetProfile(profile.WebBrowsing)
+		tail.Cover.Mode = profile.CoverTailPadding
+		client.disguiseManager.SetProfile(tail)
+		clientLog.expect(t, slog.LevelInfo, "disguise cover policy change", "from", "probing", "to", "tail-padding")
+		echo(t, client, "message")
+
+		// A cell that cannot be decoded, and one the server sent twice.
+		m := client.disguiseManager
+		m.ProcessInboundTraffic([]byte("short"))
+		clientLog.expect(t, slog.LevelWarn, "disguise cell dropped", "op", "decode cell")
+		state := client.ConnectionState()
+		secret, err := state.ExportKeyingMaterial(disguiseExporterLabel, nil, disguise.SecretLen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := disguise.NewManager()
+		defer peer.Close()
+		peer.SetSecret(secret, false)
+		peer.QueueApplicationData([]byte("replayed"))
+		cell, err := peer.GetOutboundTraffic()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.ProcessInboundTraffic(cell)
+		m.ProcessInboundTraffic(cell)
+		clientLog.expect(t, slog.LevelInfo, "disguise replay rejected")
+	})
+
+	// A client with another key is not confirmed, and the server hands it
+	// no Disguise.
+	disguiseHandshake(t, clientConfig([]byte("other key")), serverConfig)
+	clientLog.expect(t, slog.LevelInfo, "disguise not negotiated", "role", "client", "reason", "no server confirmation")
+	serverLog.expect(t, slog.LevelInfo, "disguise not negotiated", "role", "server", "reason", "no valid token")
+}
+
+// TestDisguiseLoggerDefault checks that nothing is logged without a Logger,
+// neither to the default slog Logger nor to the standard output.
+func TestDisguiseLoggerDefault(t *testing.T) {
+	defaultLog := new(logRecorder)
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(defaultLog))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	cert := testCertificate(t)
+	client := &Config{ServerName: "example.com", InsecureSkipVerify: true, DisguiseSecret: []byte("key")}
+	// The server rejects the client, and the client is not confirmed.
+	disguiseHandshake(t, client, &Config{Certificates: []Certificate{cert}, DisguiseSecret: []byte("other key")})
+	// Both activate Disguise.
+	disguiseHandshake(t, &Config{ServerName: "example.com", InsecureSkipVerify: true}, &Config{Certificates: []Certificate{cert}})
+
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) > 0 {
+		t.Errorf("wrote %q to the standard output", out)
+	}
+	if len(defaultLog.records) > 0 {
+		t.Errorf("logged %v to the default Logger", defaultLog.records)
+	}
+}
+
+// TestDisguiseVerifyConnection checks that a VerifyConnection callback sees
+// whether Disguise was negotiated, and can refuse a peer without it.
+func TestDisguiseVerifyConnection(t *testing.T) {
+	errNoDisguise := errors.New("Disguise not negotiated")
+	requireDisguise := func(cs ConnectionState) error {
+		if !cs.Disguise.Enabled || cs.Disguise.Version != disguise.Version {
+			return errNoDisguise
+		}
+		return nil
+	}
+	cert := testCertificate(t)
+	key, otherKey := []byte("key"), []byte("other key")
+
+	for _, tt := range []struct {
+		name                       string
+		clientKey, serverKey       []byte
+		verifyClient, verifyServer bool
+		// wantClient and wantServer are the errors of the handshakes.
+		wantClient, wantServer error
+	}{
+		{"Client", key, key, true, false, nil, nil},
+		{"Server", key, key, false, true, nil, nil},
+		{"ClientRejects", key, otherKey, true, false, errNoDisguise, nil},
+		{"ServerRejects", nil, key, false, true, nil, errNoDisguise},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true, DisguiseSecret: tt.clientKey}
+			serverConfig := &Config{Certificates: []Certificate{cert}, DisguiseSecret: tt.serverKey}
+			if tt.verifyClient {
+				clientConfig.VerifyConnection = requireDisguise
+			}
+			if tt.verifyServer {
+				serverConfig.VerifyConnection = requireDisguise
+			}
+			synctest.Test(t, func(t *testing.T) {
+				a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+				c, s := Client(a, clientConfig), Server(b, serverConfig)
+				defer c.Close()
+				handshake := make(chan error, 1)
+				go func() {
+					defer s.Close()
+					err := s.Handshake()
+					handshake <- err
+					if err == nil {
+						io.Copy(io.Discard, s)
+					}
+				}()
+				clientErr := c.Handshake()
+				if clientErr == nil && tt.wantServer != nil {
+					// The client only learns that the server refused it
+					// when it reads.
+					_, clientErr = c.Read(make([]byte, 1))
+				}
+				c.Close()
+				serverErr := <-handshake
+
+				if tt.wantClient != nil && !errors.Is(clientErr, tt.wantClient) {
+					t.Errorf("client handshake = %v, want %v", clientErr, tt.wantClient)
+				}
+				if tt.wantServer != nil {
+					if !errors.Is(serverErr, tt.wantServer) {
+						t.Errorf("server handshake = %v, want %v", serverErr, tt.wantServer)
+					}
+					if clientErr == nil {
+						t.Error("client connected to a server that refused it")
+					}
+				}
+				if tt.wantClient == nil && tt.wantServer == nil && (clientErr != nil || serverErr != nil) {
+					t.Errorf("handshake failed: client %v, server %v", clientErr, serverErr)
+				}
+				if tt.wantClient != nil && serverErr == nil {
+					t.Error("server handshake succeeded with a client that refused it")
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,430 @@
+//go:build go1.25
+
+package tls
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise"
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+	"github.com/uDisguise/disguise/disguise/simnet"
+)
+
+// testRate is the rate the tests that need a shaped connection opt in to.
+var testRate = profile.Rate{Average: 1.5e6, Peak: 6e6, Burst: 256 * 1024}
+
+// disguiseTest runs f in virtual time with a client connected to a server
+// that discards what it reads, both with the Disguise layer active. The
+// client is held to testRate.
+func disguiseTest(t *testing.T, f func(t *testing.T, client *Conn)) {
+	cert := testCertificate(t)
+	synctest.Test(t, func(t *testing.T) {
+		link := simnet.Link{Latency: 10 * time.Millisecond, Bandwidth: 1 << 30}
+		a, b := simnet.Pipe(link, link)
+		client := Client(a, &Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: VersionTLS13, Disguise: &disguise.Config{Rate: testRate}})
+		server := Server(b, &Config{Certificates: []Certificate{cert}})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			io.Copy(io.Discard, server)
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		f(t, client)
+	})
+}
+
+// TestDisguiseWriteDeadline checks that a Write held back by the rate limit
+// of the connection returns once the write deadline passes.
+func TestDisguiseWriteDeadline(t *testing.T) {
+	disguiseTest(t, func(t *testing.T, client *Conn) {
+		start := time.Now()
+		client.SetWriteDeadline(start.Add(time.Second))
+		// Several seconds' worth of data at testRate.
+		_, err := client.Write(make([]byte, 8<<20))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Write = %v, want a deadline error", err)
+		}
+		if d := time.Since(start); d != time.Second {
+			t.Errorf("Write returned after %v, want 1s", d)
+		}
+		if _, err := client.Write([]byte("more")); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Write after the timeout = %v, want the same error", err)
+		}
+	})
+}
+
+// TestDisguiseWriteClose checks that closing a Conn unblocks a Write held
+// back by the rate limit of the connection.
+func TestDisguiseWriteClose(t *testing.T) {
+	disguiseTest(t, func(t *testing.T, client *Conn) {
+		time.AfterFunc(time.Second, func() { client.Close() })
+		_, err := client.Write(make([]byte, 8<<20))
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Write = %v, want net.ErrClosed", err)
+		}
+	})
+}
+
+// TestDisguiseDecodeFailure checks how a server reacts to a record that does
+// not hold a cell: the connection fails, without the bad_record_mac alert
+// that would tell an active prober apart from an ordinary server.
+func TestDisguiseDecodeFailure(t *testing.T) {
+	cert := testCertificate(t)
+	for _, tt := range []struct {
+		name string
+		mode DisguiseFailureMode
+		// alert is what the client should receive, or zero for none.
+		alert alert
+	}{
+		{"Close", DisguiseFailureClose, 0},
+		{"Alert", DisguiseFailureAlert, alertHandshakeFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+				client := Client(a, &Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: VersionTLS13})
+				defer client.Close()
+				server := Server(b, &Config{
+					Certificates:    []Certificate{cert},
+					DisguiseFailure: tt.mode,
+					DisguiseAlert:   uint8(tt.alert),
+				})
+				defer server.Close()
+				serverErr := make(chan error, 1)
+				go func() {
+					_, err := server.Read(make([]byte, 1))
+					serverErr <- err
+				}()
+
+				if err := client.Handshake(); err != nil {
+					t.Fatal(err)
+				}
+				client.out.Lock()
+				_, err := client.writeRecordLocked(recordTypeApplicationData, []byte{1, 2, 3})
+				client.out.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				var failure *disguise.Error
+				if err := <-serverErr; !errors.As(err, &failure) || failure.Class != disguise.Fatal {
+					t.Errorf("server Read = %v, want a fatal Disguise error", err)
+				}
+				_, err = client.Read(make([]byte, 1))
+				var remote *net.OpError
+				switch {
+				case err == nil:
+					t.Fatal("client Read succeeded")
+				case !errors.As(err, &remote) || remote.Op != "remote error":
+					if tt.alert != 0 {
+						t.Errorf("client Read = %v, want the %v alert", err, tt.alert)
+					}
+				case remote.Err != tt.alert:
+					t.Errorf("client received the %v alert, want %v", remote.Err, tt.alert)
+				}
+			})
+		})
+	}
+}
+
+// trafficSecret returns the current traffic secret of hc.
+func trafficSecret(hc *halfConn) []byte {
+	hc.Lock()
+	defer hc.Unlock()
+	return hc.trafficSecret
+}
+
+// keyUpdates returns how many times the traffic secret of hc was updated
+// since it was initial.
+func keyUpdates(t *testing.T, c *Conn, hc *halfConn, initial []byte) int {
+	t.Helper()
+	hc.Lock()
+	defer hc.Unlock()
+	suite := cipherSuiteTLS13ByID(c.cipherSuite)
+	secret := initial
+	for n := range 100 {
+		if bytes.Equal(secret, hc.trafficSecret) {
+			return n
+		}
+		secret = suite.nextTrafficSecret(secret)
+	}
+	t.Fatal("traffic secret not derived from the initial one")
+	return 0
+}
+
+// sentCells returns how many cells of any type c sent.
+func sentCells(c *Conn) int {
+	sent := c.disguiseManager.Metrics().Sent
+	return int(sent.Data.Cells + sent.Control.Cells + sent.Dummy.Cells)
+}
+
+// echoTest runs f in virtual time with a client connected to a server that
+// echoes what it reads. The client uses the given Disguise options.
+func echoTest(t *testing.T, config *disguise.Config, f func(t *testing.T, client *Conn)) {
+	cert := testCertificate(t)
+	synctest.Test(t, func(t *testing.T) {
+		a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+		client := Client(a, &Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: VersionTLS13, Disguise: config})
+		server := Server(b, &Config{Certificates: []Certificate{cert}})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		f(t, client)
+	})
+}
+
+// echo writes each message to an echoing server and reads it back.
+func echo(t *testing.T, c *Conn, messages ...string) {
+	t.Helper()
+	for _, msg := range messages {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		expectRead(t, c, []byte(msg))
+	}
+}
+
+func TestUpdateKeys(t *testing.T) {
+	echoTest(t, nil, func(t *testing.T, client *Conn) {
+		out, in := trafficSecret(&client.out), trafficSecret(&client.in)
+		echo(t, client, "before")
+		for range 3 {
+			if err := client.UpdateKeys(); err != nil {
+				t.Fatal(err)
+			}
+			echo(t, client, "after")
+		}
+		if n := keyUpdates(t, client, &client.out, out); n != 3 {
+			t.Errorf("client updated its keys %d times, want 3", n)
+		}
+		// The server updated its own keys as asked.
+		if n := keyUpdates(t, client, &client.in, in); n != 3 {
+			t.Errorf("server updated its keys %d times, want 3", n)
+		}
+	})
+
+	c := Client(nil, &Config{})
+	if err := c.UpdateKeys(); err == nil {
+		t.Error("UpdateKeys succeeded before the handshake")
+	}
+}
+
+// TestDisguiseKeyUpdatePolicy checks that a connection updates its keys as
+// often as its KeyUpdate policy calls for.
+func TestDisguiseKeyUpdatePolicy(t *testing.T) {
+	t.Run("Records", func(t *testing.T) {
+		echoTest(t, &disguise.Config{KeyUpdate: disguise.KeyUpdatePolicy{Records: 3}}, func(t *testing.T, client *Conn) {
+			out, in := trafficSecret(&client.out), trafficSecret(&client.in)
+			for range 10 {
+				echo(t, client, "message")
+			}
+			// Three cells are sent under each key, which is updated as
+			// soon as the last of them is.
+			want := sentCells(client) / 3
+			if want < 3 {
+				t.Fatalf("%d cells sent, want at least one per message", sentCells(client))
+			}
+			if n := keyUpdates(t, client, &client.out, out); n != want {
+				t.Errorf("client updated its keys %d times, want %d", n, want)
+			}
+			if n := keyUpdates(t, client, &client.in, in); n != want {
+				t.Errorf("server updated its keys %d times, want %d", n, want)
+			}
+		})
+	})
+	t.Run("Bytes", func(t *testing.T) {
+		echoTest(t, &disguise.Config{KeyUpdate: disguise.KeyUpdatePolicy{Bytes: 1}}, func(t *testing.T, client *Conn) {
+			out := trafficSecret(&client.out)
+			for range 5 {
+				echo(t, client, "message")
+			}
+			// Every cell reaches the limit, so each is followed by a
+			// KeyUpdate.
+			if n, want := keyUpdates(t, client, &client.out, out), sentCells(client); n != want {
+				t.Errorf("client updated its keys %d times, want %d", n, want)
+			}
+		})
+	})
+	t.Run("Interval", func(t *testing.T) {
+		echoTest(t, &disguise.Config{KeyUpdate: disguise.KeyUpdatePolicy{MinInterval: time.Minute, MaxInterval: time.Minute}}, func(t *testing.T, client *Conn) {
+			out := trafficSecret(&client.out)
+			// An idle connection updates its keys as well.
+			time.Sleep(3*time.Minute + time.Second)
+			synctest.Wait()
+			if n := keyUpdates(t, client, &client.out, out); n != 3 {
+				t.Errorf("client updated its keys %d times in 3 minutes, want 3", n)
+			}
+			echo(t, client, "message")
+		})
+	})
+}
+
+// TestDisguiseConversationOrder checks that writes arrive in order when the
+// peers follow a conversation, in which a Write may return before its cells
+// are sent, even when a small write follows a large one.
+func TestDisguiseConversationOrder(t *testing.T) {
+	cert := testCertificate(t)
+	model := profile.GetProfile(profile.WebBrowsing).Conversation
+	config := &disguise.Config{Conversation: &model}
+	synctest.Test(t, func(t *testing.T) {
+		link := simnet.Link{Latency: 10 * time.Millisecond, Bandwidth: 1 << 30}
+		a, b := simnet.Pipe(link, link)
+		client := Client(a, &Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: VersionTLS13, Disguise: config})
+		server := Server(b, &Config{Certificates: []Certificate{cert}, Disguise: config})
+		defer server.Close()
+		defer client.Close()
+		handshake := make(chan error, 1)
+		go func() { handshake <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-handshake; err != nil {
+			t.Fatal(err)
+		}
+		// The client learns that its turns have come by reading.
+		go io.Copy(io.Discard, client)
+
+		large := bytes.Repeat([]byte("large "), 10000)
+		small := []byte("small")
+		go func() {
+			for _, b := range [][]byte{large, small} {
+				if _, err := client.Write(b); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		got := make([]byte, len(large)+len(small))
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, append(large, small...)) {
+			t.Errorf("server read %q..., want the large write first", got[:10])
+		}
+	})
+}
+
+// metricsRecorder is a disguise.Metrics hook that counts the cells sent and
+// records profile switches.
+type metricsRecorder struct {
+	disguise.NopMetrics
+	mu       sync.Mutex
+	sent     map[uint8]disguise.CellCounts
+	padding  uint64
+	switches [][2]profile.TrafficType
+}
+
+func (r *metricsRecorder) CellSent(cellType uint8, n, padding int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	c := r.sent[cellType]
+	c.Cells++
+	c.Bytes += uint64(n)
+	r.sent[cellType] = c
+	r.padding += uint64(padding)
+}
+
+func (r *metricsRecorder) ProfileSwitch(from, to profile.TrafficType) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.switches = append(r.switches, [2]profile.TrafficType{from, to})
+}
+
+// TestDisguiseMetrics checks that the hook returned by DisguiseMetrics
+// receives the events of the connection, and that ConnectionState reports
+// the same counts.
+func TestDisguiseMetrics(t *testing.T) {
+	cert := testCertificate(t)
+	synctest.Test(t, func(t *testing.T) {
+		hook := &metricsRecorder{sent: make(map[uint8]disguise.CellCounts)}
+		calls := 0
+		a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+		client := Client(a, &Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+			MinVersion:         VersionTLS13,
+			DisguiseMetrics: func(cs ConnectionState) disguise.Metrics {
+				calls++
+				if cs.ServerName != "example.com" {
+					t.Errorf("DisguiseMetrics called for server name %q", cs.ServerName)
+				}
+				return hook
+			},
+		})
+		server := Server(b, &Config{Certificates: []Certificate{cert}})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetDisguiseProfile(DisguiseProfileVideo, false); err != nil {
+			t.Fatal(err)
+		}
+		echo(t, client, "message", strings.Repeat("a", 5000))
+		synctest.Wait()
+
+		if calls != 1 {
+			t.Errorf("DisguiseMetrics called %d times, want once", calls)
+		}
+		metrics := client.ConnectionState().Disguise.Metrics
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		want := [][2]profile.TrafficType{{profile.Dynamic, profile.VideoStreaming}}
+		if len(hook.switches) != 1 || hook.switches[0] != want[0] || metrics.ProfileSwitches != 1 {
+			t.Errorf("hook saw switches %v, ProfileSwitches = %d; want %v", hook.switches, metrics.ProfileSwitches, want)
+		}
+		if metrics.Sent.Data.Cells < 3 || metrics.Received.Data.Cells < 3 {
+			t.Errorf("sent %d and received %d data cells, want several each", metrics.Sent.Data.Cells, metrics.Received.Data.Cells)
+		}
+		for typ, got := range map[uint8]disguise.CellCounts{
+			framing.TypeData:    metrics.Sent.Data,
+			framing.TypeDummy:   metrics.Sent.Dummy,
+			framing.TypeControl: metrics.Sent.Control,
+		} {
+			if got != hook.sent[typ] {
+				t.Errorf("ConnectionState reports %+v cells of type %d sent, hook saw %+v", got, typ, hook.sent[typ])
+			}
+		}
+		if metrics.Sent.PaddingBytes != hook.padding {
+			t.Errorf("ConnectionState reports %d padding bytes sent, hook saw %d", metrics.Sent.PaddingBytes, hook.padding)
+		}
+	})
+}
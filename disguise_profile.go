@@ -0,0 +1,105 @@
+package tls
+
+import (
+	"errors"
+
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// The names of the Disguise traffic profiles, as accepted by
+// Conn.SetDisguiseProfile.
+const (
+	// DisguiseProfileOff turns Disguise off: application data is written
+	// as is, without cells, padding or cover traffic.
+	DisguiseProfileOff = "off"
+	// DisguiseProfileWeb mimics general web browsing.
+	DisguiseProfileWeb = "web-browsing"
+	// DisguiseProfileVideo mimics the bursts of video streaming.
+	DisguiseProfileVideo = "video-streaming"
+	// DisguiseProfileDownload mimics bulk file downloads.
+	DisguiseProfileDownload = "file-download"
+	// DisguiseProfileDynamic, the default, adapts a mixture of the others
+	// to the traffic of the application.
+	DisguiseProfileDynamic = "dynamic"
+)
+
+// disguiseProfileTypes maps the names of the profiles other than
+// DisguiseProfileOff to their types.
+var disguiseProfileTypes = map[string]profile.TrafficType{
+	DisguiseProfileWeb:      profile.WebBrowsing,
+	DisguiseProfileVideo:    profile.VideoStreaming,
+	DisguiseProfileDownload: profile.FileDownload,
+	DisguiseProfileDynamic:  profile.Dynamic,
+}
+
+// checkDisguiseControl returns an error naming the operation op unless
+// Disguise is active on the connection.
+func (c *Conn) checkDisguiseControl(op string) error {
+	if !c.handshakeComplete() {
+		return errors.New("tls: " + op + " called before the handshake completed")
+	}
+	if c.disguiseManager == nil {
+		return errors.New("tls: " + op + " called on a connection without Disguise")
+	}
+	return nil
+}
+
+// SetDisguiseProfile switches the connection to the named traffic profile,
+// one of the DisguiseProfile constants, for the cells sent from now on. If
+// announce is set, the peer is asked to switch too, so that both directions
+// are shaped alike.
+//
+// DisguiseProfileOff is always announced, and turns off both directions
+// once the cells already queued are sent: the connection then carries
+// application data as is, like one on which Disguise was not negotiated.
+// It cannot be turned back on.
+func (c *Conn) SetDisguiseProfile(name string, announce bool) error {
+	if err := c.checkDisguiseControl("SetDisguiseProfile"); err != nil {
+		return err
+	}
+	m := c.disguiseManager
+	if name == DisguiseProfileOff {
+		m.TurnOff()
+		return nil
+	}
+	t, ok := disguiseProfileTypes[name]
+	if !ok {
+		return errors.New("tls: unknown Disguise profile " + name)
+	}
+	if m.Off() || m.PeerOff() {
+		return errors.New("tls: Disguise was turned off")
+	}
+	m.SetProfile(profile.GetProfile(t))
+	if announce {
+		return m.Announce()
+	}
+	return nil
+}
+
+// DisguiseProfile returns the name of the active traffic profile, or the
+// empty string if Disguise is not active on the connection.
+func (c *Conn) DisguiseProfile() string {
+	if !c.handshakeComplete() || c.disguiseManager == nil {
+		return ""
+	}
+	m := c.disguiseManager
+	if m.Off() || m.PeerOff() {
+		return DisguiseProfileOff
+	}
+	return m.State().Profile.String()
+}
+
+// SetDisguiseProfilePinned pins or unpins the active profile. A pinned
+// DisguiseProfileDynamic keeps its current mixture instead of adapting it
+// to the traffic; the other profiles never adapt. If announce is set, the
+// peer pins or unpins its profile too.
+func (c *Conn) SetDisguiseProfilePinned(pinned, announce bool) error {
+	if err := c.checkDisguiseControl("SetDisguiseProfilePinned"); err != nil {
+		return err
+	}
+	c.disguiseManager.SetPinned(pinned)
+	if announce {
+		return c.disguiseManager.Announce()
+	}
+	return nil
+}
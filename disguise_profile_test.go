@@ -0,0 +1,473 @@
+//go:build go1.25
+
+package tls
+
+import (
+	"io"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise"
+	"github.com/uDisguise/disguise/disguise/framing"
+	"github.com/uDisguise/disguise/disguise/profile"
+	"github.com/uDisguise/disguise/disguise/simnet"
+)
+
+// The traffic tests compare what a shaped connection sends with samples drawn
+// from its profile, and fail if the tests find them different at this level
+// of significance. It is low enough for the tests not to fail by chance, and
+// still far above the p-values of a profile that is not followed.
+const (
+	trafficSignificance = 1e-6
+
+	// referenceSamples is the size of the samples drawn from a profile.
+	referenceSamples = 50000
+
+	// steadyBytes is the volume of cells sent once a connection's burst
+	// allowance is spent.
+	steadyBytes = 1 << 20
+
+	// recordOverhead is what TLS 1.3 adds to the length of a record: the
+	// inner content type, and the tag of the AEAD.
+	recordOverhead = 1 + 16
+)
+
+// wireRecord is a record as written to the network.
+type wireRecord struct {
+	length int
+	sent   time.Time
+}
+
+// recordLogConn notes the length and the time of every record written to it.
+type recordLogConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	header  []byte
+	body    int
+	records []wireRecord
+}
+
+func (c *recordLogConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	for p := b; len(p) > 0; {
+		if c.body > 0 {
+			n := min(c.body, len(p))
+			c.body -= n
+			p = p[n:]
+			continue
+		}
+		n := min(recordHeaderLen-len(c.header), len(p))
+		c.header = append(c.header, p[:n]...)
+		p = p[n:]
+		if len(c.header) == recordHeaderLen {
+			c.body = int(c.header[3])<<8 | int(c.header[4])
+			c.records = append(c.records, wireRecord{length: c.body, sent: time.Now()})
+			c.header = c.header[:0]
+		}
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordLogConn) log() []wireRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.records)
+}
+
+// shapedTraffic sends n bytes from a client to a server over a simulated
+// link, in virtual time, with the client shaped by the named profile and held
+// to rate. It returns the records the client sent with that profile, all of
+// which carry a cell.
+func shapedTraffic(t *testing.T, cert Certificate, name string, rate profile.Rate, n int) []wireRecord {
+	var records []wireRecord
+	synctest.Test(t, func(t *testing.T) {
+		// The link is fast enough for the rate limit alone to pace the
+		// records.
+		link := simnet.Link{Latency: 10 * time.Millisecond, Bandwidth: 1 << 30}
+		a, b := simnet.Pipe(link, link)
+		wire := &recordLogConn{Conn: a}
+		client := Client(wire, &Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: VersionTLS13, Disguise: &disguise.Config{Rate: rate}})
+		server := Server(b, &Config{Certificates: []Certificate{cert}})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			io.Copy(io.Discard, server)
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		// Pinned, the dynamic profile keeps its initial mixture.
+		if err := client.SetDisguiseProfile(name, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetDisguiseProfilePinned(true, false); err != nil {
+			t.Fatal(err)
+		}
+		start := len(wire.log())
+		if _, err := client.Write(make([]byte, n)); err != nil {
+			t.Fatal(err)
+		}
+		records = wire.log()[start:]
+	})
+	return records
+}
+
+// referenceCellSizes draws n cell sizes from the profile the way the Framer
+// sizes data cells: a payload, padded up to a cell size if it falls short.
+func referenceCellSizes(p *profile.Profile, n int) []float64 {
+	sizes := make([]float64, n)
+	for i := range sizes {
+		sizes[i] = float64(max(p.GetNextCellSize(), framing.CellHeaderLen+p.GetNextPayloadLength()))
+	}
+	return sizes
+}
+
+// ksTest returns the two-sample Kolmogorov-Smirnov statistic of a and b, the
+// largest distance between their empirical distribution functions, and the
+// asymptotic p-value of the hypothesis that they follow the same
+// distribution.
+func ksTest(a, b []float64) (d, p float64) {
+	a, b = slices.Sorted(slices.Values(a)), slices.Sorted(slices.Values(b))
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		x := min(a[i], b[j])
+		for i < len(a) && a[i] == x {
+			i++
+		}
+		for j < len(b) && b[j] == x {
+			j++
+		}
+		d = max(d, math.Abs(float64(i)/float64(len(a))-float64(j)/float64(len(b))))
+	}
+	n := math.Sqrt(float64(len(a)) * float64(len(b)) / float64(len(a)+len(b)))
+	lambda := (n + 0.12 + 0.11/n) * d
+	for k := 1; k <= 100; k++ {
+		term := 2 * math.Exp(-2*float64(k*k)*lambda*lambda)
+		if k%2 == 0 {
+			term = -term
+		}
+		p += term
+		if math.Abs(term) < 1e-12 {
+			break
+		}
+	}
+	return d, min(max(p, 0), 1)
+}
+
+// chiSquaredTest returns the chi-squared statistic of the hypothesis that a
+// and b follow the same distribution over bins equal parts of [lo, hi], and
+// its p-value. Values outside the range count in the nearest bin. Bins are
+// merged with the next ones until b, the reference, expects at least five
+// values of a in each.
+func chiSquaredTest(a, b []float64, lo, hi float64, bins int) (chi2, p float64) {
+	count := func(values []float64) []float64 {
+		counts := make([]float64, bins)
+		for _, v := range values {
+			i := int((v - lo) / (hi - lo) * float64(bins))
+			counts[min(max(i, 0), bins-1)]++
+		}
+		return counts
+	}
+	ca, cb := count(a), count(b)
+	na, nb := float64(len(a)), float64(len(b))
+
+	var ra, rb []float64
+	var sa, sb float64
+	for i := range bins {
+		sa, sb = sa+ca[i], sb+cb[i]
+		if sb*na/nb >= 5 {
+			ra, rb = append(ra, sa), append(rb, sb)
+			sa, sb = 0, 0
+		}
+	}
+	if len(ra) == 0 {
+		return 0, 1
+	}
+	ra[len(ra)-1] += sa
+	rb[len(rb)-1] += sb
+
+	ka, kb := math.Sqrt(nb/na), math.Sqrt(na/nb)
+	for i := range ra {
+		diff := ka*ra[i] - kb*rb[i]
+		chi2 += diff * diff / (ra[i] + rb[i])
+	}
+	df := float64(len(ra) - 1)
+	if df < 1 {
+		return chi2, 1
+	}
+	// The Wilson-Hilferty approximation: the cube root of chi2/df is
+	// nearly normal.
+	v := 2 / (9 * df)
+	z := (math.Cbrt(chi2/df) - (1 - v)) / math.Sqrt(v)
+	return chi2, math.Erfc(z/math.Sqrt2) / 2
+}
+
+// TestDisguiseProfileTraffic checks that the records of a shaped transfer
+// follow the distributions of the profile: their sizes, and the time each
+// waits for the rate limit of the connection once the burst allowance is
+// spent.
+func TestDisguiseProfileTraffic(t *testing.T) {
+	cert := testCertificate(t)
+	for _, tt := range []struct {
+		name string
+		typ  profile.TrafficType
+		rate profile.Rate
+		// other is a profile the sizes must not pass for.
+		other profile.TrafficType
+	}{
+		{DisguiseProfileWeb, profile.WebBrowsing, testRate, profile.VideoStreaming},
+		{DisguiseProfileVideo, profile.VideoStreaming, profile.Rate{Average: 1e6, Peak: 2.5e6, Burst: 512 * 1024}, profile.FileDownload},
+		{DisguiseProfileDownload, profile.FileDownload, profile.Rate{Average: 4e6, Peak: 8e6, Burst: 1024 * 1024}, profile.WebBrowsing},
+		{DisguiseProfileDynamic, profile.Dynamic, testRate, profile.WebBrowsing},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := profile.GetProfile(tt.typ)
+			rate := tt.rate
+			// The volume sent at the peak rate while the average bucket
+			// drains.
+			burst := int(float64(rate.Burst) * rate.Peak / (rate.Peak - rate.Average))
+
+			records := shapedTraffic(t, cert, tt.name, rate, burst+steadyBytes)
+			if len(records) == 0 {
+				t.Fatal("no records were sent")
+			}
+
+			var sizes, gaps []float64
+			sent := 0
+			for i, r := range records {
+				size := r.length - recordOverhead
+				sizes = append(sizes, float64(size))
+				if sent > burst+p.MaxCellSize {
+					gaps = append(gaps, r.sent.Sub(records[i-1].sent).Seconds())
+				}
+				sent += size
+			}
+			if len(gaps) < 100 {
+				t.Fatalf("only %d of %d records were sent after the burst", len(gaps), len(records))
+			}
+
+			reference := referenceCellSizes(p, referenceSamples)
+			if d, pv := ksTest(sizes, reference); pv < trafficSignificance {
+				t.Errorf("sizes of %d records: KS D = %.4f, p = %.3g", len(sizes), d, pv)
+			}
+			lo, hi := float64(p.MinCellSize), float64(p.MaxCellSize)
+			if chi2, pv := chiSquaredTest(sizes, reference, lo, hi, 20); pv < trafficSignificance {
+				t.Errorf("sizes of %d records: chi-squared = %.1f, p = %.3g", len(sizes), chi2, pv)
+			}
+
+			// A cell waits for the average bucket to refill its size.
+			waits := make([]float64, len(reference))
+			for i, size := range reference {
+				waits[i] = size / rate.Average
+			}
+			if d, pv := ksTest(gaps, waits); pv < trafficSignificance {
+				t.Errorf("gaps between %d records: KS D = %.4f, p = %.3g", len(gaps), d, pv)
+			}
+
+			// The tests must tell the profile apart from another one.
+			other := referenceCellSizes(profile.GetProfile(tt.other), referenceSamples)
+			if d, pv := ksTest(sizes, other); pv >= trafficSignificance {
+				t.Errorf("sizes pass for %v: KS D = %.4f, p = %.3g", tt.other, d, pv)
+			}
+		})
+	}
+}
+
+// profileTest runs f in virtual time with a client connected to a server
+// that echoes what it reads. wire logs the records the client writes, and
+// serverWire the ones the server does.
+func profileTest(t *testing.T, f func(t *testing.T, client, server *Conn, wire, serverWire *recordLogConn)) {
+	cert := testCertificate(t)
+	synctest.Test(t, func(t *testing.T) {
+		a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+		wire, serverWire := &recordLogConn{Conn: a}, &recordLogConn{Conn: b}
+		client := Client(wire, &Config{ServerName: "example.com", InsecureSkipVerify: true, MinVersion: VersionTLS13})
+		server := Server(serverWire, &Config{Certificates: []Certificate{cert}})
+		handshake := make(chan error, 1)
+		go func() { handshake <- server.Handshake() }()
+		if err := client.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-handshake; err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer server.Close()
+			io.Copy(server, server)
+		}()
+		defer func() {
+			client.Close()
+			<-done
+		}()
+		f(t, client, server, wire, serverWire)
+	})
+}
+
+func TestSetDisguiseProfile(t *testing.T) {
+	profileTest(t, func(t *testing.T, client, server *Conn, _, _ *recordLogConn) {
+		check := func(what, wantClient, wantServer string) {
+			t.Helper()
+			if p, sp := client.DisguiseProfile(), server.DisguiseProfile(); p != wantClient || sp != wantServer {
+				t.Errorf("%s: client on %q, server on %q; want %q and %q", what, p, sp, wantClient, wantServer)
+			}
+		}
+		check("initially", DisguiseProfileDynamic, DisguiseProfileDynamic)
+
+		if err := client.SetDisguiseProfile(DisguiseProfileVideo, false); err != nil {
+			t.Fatal(err)
+		}
+		echo(t, client, "message")
+		check("unannounced", DisguiseProfileVideo, DisguiseProfileDynamic)
+
+		// The announcement reaches the server ahead of the message.
+		if err := client.SetDisguiseProfile(DisguiseProfileDownload, true); err != nil {
+			t.Fatal(err)
+		}
+		echo(t, client, "message")
+		check("announced", DisguiseProfileDownload, DisguiseProfileDownload)
+
+		if err := client.SetDisguiseProfile(DisguiseProfileDynamic, false); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetDisguiseProfilePinned(true, true); err != nil {
+			t.Fatal(err)
+		}
+		echo(t, client, "message")
+		check("pinned", DisguiseProfileDynamic, DisguiseProfileDynamic)
+		if !server.disguiseManager.Pinned() {
+			t.Error("server not pinned by the announcement")
+		}
+
+		if err := client.SetDisguiseProfile("carrier-pigeon", false); err == nil {
+			t.Error("SetDisguiseProfile accepted an unknown profile")
+		}
+	})
+
+	c := Client(nil, &Config{})
+	if err := c.SetDisguiseProfile(DisguiseProfileWeb, false); err == nil {
+		t.Error("SetDisguiseProfile succeeded before the handshake")
+	}
+	if p := c.DisguiseProfile(); p != "" {
+		t.Errorf("DisguiseProfile before the handshake = %q, want none", p)
+	}
+}
+
+// TestDisguiseProfileOff checks that DisguiseProfileOff turns off both
+// directions, which then carry application data as is.
+func TestDisguiseProfileOff(t *testing.T) {
+	profileTest(t, func(t *testing.T, client, server *Conn, wire, serverWire *recordLogConn) {
+		// plain returns whether the records written to w since start
+		// are the single record of msg, without a cell around it.
+		plain := func(w *recordLogConn, start int, msg string) bool {
+			records := w.log()[start:]
+			return len(records) == 1 && records[0].length == len(msg)+recordOverhead
+		}
+
+		start, serverStart := len(wire.log()), len(serverWire.log())
+		echo(t, client, "shaped")
+		if plain(wire, start, "shaped") || plain(serverWire, serverStart, "shaped") {
+			t.Fatal("message sent as is before Disguise was turned off")
+		}
+
+		if err := client.SetDisguiseProfile(DisguiseProfileOff, false); err != nil {
+			t.Fatal(err)
+		}
+		// The data queued before the last cell still arrives. The server
+		// sends its own last cell once it read the client's.
+		echo(t, client, "last")
+		synctest.Wait()
+		if p, sp := client.DisguiseProfile(), server.DisguiseProfile(); p != DisguiseProfileOff || sp != DisguiseProfileOff {
+			t.Errorf("client on %q, server on %q; want both off", p, sp)
+		}
+
+		start, serverStart = len(wire.log()), len(serverWire.log())
+		echo(t, client, "pass-through")
+		if !plain(wire, start, "pass-through") {
+			t.Errorf("client wrote %+v, want the message as is", wire.log()[start:])
+		}
+		if !plain(serverWire, serverStart, "pass-through") {
+			t.Errorf("server wrote %+v, want the message as is", serverWire.log()[serverStart:])
+		}
+
+		if err := client.SetDisguiseProfile(DisguiseProfileWeb, false); err == nil {
+			t.Error("Disguise turned back on")
+		}
+		if p := client.DisguiseProfile(); p != DisguiseProfileOff {
+			t.Errorf("client on %q after turning back on failed, want off", p)
+		}
+	})
+}
+
+// TestDisguiseConnectionState checks every field of the DisguiseState that
+// ConnectionState reports on both ends.
+func TestDisguiseConnectionState(t *testing.T) {
+	if got := Client(nil, &Config{}).ConnectionState().Disguise; got != (DisguiseState{}) {
+		t.Errorf("DisguiseState before the handshake = %+v, want the zero value", got)
+	}
+	profileTest(t, func(t *testing.T, client, server *Conn, _, _ *recordLogConn) {
+		for range 12 {
+			echo(t, client, "message")
+		}
+		// Let the dynamic profile classify what the client received.
+		time.Sleep(6 * time.Second)
+		state := client.ConnectionState().Disguise
+		if state.Version != disguise.Version || !state.Enabled {
+			t.Errorf("client Disguise version %d, enabled %v; want %d, enabled", state.Version, state.Enabled, disguise.Version)
+		}
+		if state.ProfileName != DisguiseProfileDynamic {
+			t.Errorf("client ProfileName = %q, want %q", state.ProfileName, DisguiseProfileDynamic)
+		}
+		if state.Confidence <= 0 || state.Confidence > 1 {
+			t.Errorf("client Confidence = %v, want a probability after a prediction", state.Confidence)
+		}
+		if state.Prediction != state.Metrics.Prediction || state.Confidence != state.Metrics.Confidence {
+			t.Errorf("client predicts %v at %v, its Metrics %v at %v", state.Prediction, state.Confidence, state.Metrics.Prediction, state.Metrics.Confidence)
+		}
+
+		if err := client.SetDisguiseProfile(DisguiseProfileVideo, false); err != nil {
+			t.Fatal(err)
+		}
+		echo(t, client, "message")
+		synctest.Wait()
+		state = client.ConnectionState().Disguise
+		if state.ProfileName != DisguiseProfileVideo || state.Profile != profile.VideoStreaming {
+			t.Errorf("client on %q (%v), want %q (%v)", state.ProfileName, state.Profile, DisguiseProfileVideo, profile.VideoStreaming)
+		}
+		if m := client.disguiseManager; state.CoverPolicy == "" || state.CoverPolicy != m.CoverPolicy() {
+			t.Errorf("client CoverPolicy = %q, want %q", state.CoverPolicy, m.CoverPolicy())
+		}
+		metrics := state.Metrics
+		if metrics.Sent.Data.Cells < 13 || metrics.Received.Data.Cells < 13 {
+			t.Errorf("client sent %d and received %d data cells, want 13 each", metrics.Sent.Data.Cells, metrics.Received.Data.Cells)
+		}
+		if metrics.ProfileSwitches == 0 {
+			t.Error("switching to video streaming not counted")
+		}
+		if want := client.disguiseManager.Metrics(); metrics != want {
+			t.Errorf("client Metrics = %+v, Manager reports %+v", metrics, want)
+		}
+
+		state = server.ConnectionState().Disguise
+		if state.Version != disguise.Version || !state.Enabled || state.ProfileName != DisguiseProfileDynamic {
+			t.Errorf("server Disguise version %d, enabled %v, on %q; want %d, enabled, on %q",
+				state.Version, state.Enabled, state.ProfileName, disguise.Version, DisguiseProfileDynamic)
+		}
+		if state.Metrics.Received.Data.Cells < 13 {
+			t.Errorf("server received %d data cells, want 13", state.Metrics.Received.Data.Cells)
+		}
+	})
+}
@@ -0,0 +1,434 @@
+package tls
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/uDisguise/disguise/disguise"
+	"github.com/uDisguise/disguise/disguise/profile"
+)
+
+// TLS 1.3 0-RTT data, as specified in RFC 8446, sections 2.3, 4.2.10 and 8.
+
+const (
+	// defaultEarlyDataReplayWindow is used if Config.EarlyDataReplayWindow
+	// is zero.
+	defaultEarlyDataReplayWindow = 10 * time.Second
+
+	// minEarlyDataSkip is how many bytes of rejected 0-RTT data a server
+	// skips at least, even with 0-RTT disabled, so that clients holding
+	// tickets from when it was enabled still connect.
+	minEarlyDataSkip = 1 << 16
+)
+
+// EarlyDataReplayCache records the session tickets a server accepted 0-RTT
+// data with. Implementations should expect to be called concurrently from
+// different goroutines.
+type EarlyDataReplayCache interface {
+	// Seen records ticket until expiry, and reports whether it was already
+	// recorded and has not expired yet. A cache that can't record ticket
+	// must report true, so that the 0-RTT data is rejected.
+	Seen(ticket []byte, expiry time.Time) bool
+}
+
+// replayCache is the EarlyDataReplayCache returned by
+// NewEarlyDataReplayCache. Tickets are recorded with expiry times that
+// increase with the time they are recorded at, so the oldest entry is the
+// first to expire.
+type replayCache struct {
+	sync.Mutex
+
+	m        map[string]*list.Element
+	q        *list.List
+	capacity int
+}
+
+type replayCacheEntry struct {
+	ticket string
+	expiry time.Time
+}
+
+// NewEarlyDataReplayCache returns an EarlyDataReplayCache that holds up to
+// capacity tickets. Once it is full of tickets that have not expired, it
+// reports every other ticket as seen, which rejects its 0-RTT data rather
+// than forgetting a ticket that could be replayed. If capacity is < 1, a
+// default capacity is used instead.
+func NewEarlyDataReplayCache(capacity int) EarlyDataReplayCache {
+	const defaultReplayCacheCapacity = 1 << 16
+
+	if capacity < 1 {
+		capacity = defaultReplayCacheCapacity
+	}
+	return &replayCache{
+		m:        make(map[string]*list.Element),
+		q:        list.New(),
+		capacity: capacity,
+	}
+}
+
+// Seen implements EarlyDataReplayCache.
+func (c *replayCache) Seen(ticket []byte, expiry time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	for elem := c.q.Front(); elem != nil; elem = c.q.Front() {
+		entry := elem.Value.(*replayCacheEntry)
+		if entry.expiry.After(now) {
+			break
+		}
+		c.q.Remove(elem)
+		delete(c.m, entry.ticket)
+	}
+
+	if _, ok := c.m[string(ticket)]; ok {
+		return true
+	}
+	if c.q.Len() >= c.capacity {
+		return true
+	}
+	entry := &replayCacheEntry{ticket: string(ticket), expiry: expiry}
+	c.m[entry.ticket] = c.q.PushBack(entry)
+	return false
+}
+
+func (c *Config) earlyDataReplayWindow() time.Duration {
+	if c.EarlyDataReplayWindow > 0 {
+		return c.EarlyDataReplayWindow
+	}
+	return defaultEarlyDataReplayWindow
+}
+
+// replayCache returns EarlyDataReplayCache, or the cache private to c.
+func (c *Config) replayCache() EarlyDataReplayCache {
+	if c.EarlyDataReplayCache != nil {
+		return c.EarlyDataReplayCache
+	}
+	c.mutex.RLock()
+	cache := c.earlyDataReplayCache
+	c.mutex.RUnlock()
+	if cache != nil {
+		return cache
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.earlyDataReplayCache == nil {
+		c.earlyDataReplayCache = NewEarlyDataReplayCache(0)
+	}
+	return c.earlyDataReplayCache
+}
+
+// earlyDataSkip is how many bytes of 0-RTT data a server skips when it
+// rejects it.
+func (c *Config) earlyDataSkip() uint32 {
+	if c.MaxEarlyData > minEarlyDataSkip {
+		return c.MaxEarlyData
+	}
+	return minEarlyDataSkip
+}
+
+// WriteEarlyData queues b to be sent by a client as TLS 1.3 0-RTT data, in
+// the first flight of the handshake, and must be called before the
+// handshake. The data is only sent early when the client resumes a session
+// whose server advertised 0-RTT support, and up to the amount the server
+// accepts; on connections using Disguise, it is framed into Disguise cells
+// with the persona of the resumed session. Whatever the server did not
+// receive as 0-RTT data, either because there was too much of it or because
+// the server rejected it, is written as ordinary application data once the
+// handshake completes, so b is delivered either way. ConnectionState
+// reports which happened in EarlyDataAccepted.
+//
+// An attacker can replay 0-RTT data to the server, which has no way to
+// tell. By writing data with WriteEarlyData rather than Write, an
+// application marks it as safe to replay, such as an idempotent request.
+// 0-RTT data is not sent with an Encrypted Client Hello.
+func (c *Conn) WriteEarlyData(b []byte) (int, error) {
+	if !c.isClient {
+		return 0, errors.New("tls: WriteEarlyData called on a server connection")
+	}
+
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if c.handshakeErr != nil || c.handshakeComplete() || c.handshakes > 0 {
+		return 0, errors.New("tls: WriteEarlyData called after the handshake")
+	}
+	c.earlyData = append(c.earlyData, b...)
+	return len(b), nil
+}
+
+// offerEarlyData reports whether a client resuming session sends its early
+// data as 0-RTT data.
+func (c *Conn) offerEarlyData(session *ClientSessionState) bool {
+	if len(c.earlyData) == 0 || session.maxEarlyData == 0 ||
+		c.config.EncryptedClientHelloConfigList != nil {
+		return false
+	}
+	// The server only accepts early data for the application protocol
+	// that was negotiated for the session.
+	if session.alpn == "" {
+		return true
+	}
+	for _, proto := range c.config.NextProtos {
+		if proto == session.alpn {
+			return true
+		}
+	}
+	return false
+}
+
+// clientEarlyData is the state of the 0-RTT data a client sent after its
+// ClientHello.
+type clientEarlyData struct {
+	session *ClientSessionState
+	// cipher and seq are the record protection with the
+	// client_early_traffic_secret, kept to send EndOfEarlyData.
+	cipher any
+	seq    [8]byte
+	// sent is how much of the early data was sent, if it was not framed by
+	// Disguise.
+	sent int
+	// manager framed the early data into Disguise cells, with the ones
+	// that did not fit in what the server accepts left queued.
+	manager *disguise.Manager
+}
+
+// sendEarlyData writes the early data of a client that offered it in hello
+// as 0-RTT data, together with the dummy ChangeCipherSpec that follows the
+// ClientHello. The record layer is left unprotected, as the server did not
+// choose a version yet.
+func (c *Conn) sendEarlyData(hello *clientHelloMsg, session *ClientSessionState, earlySecret []byte) (*clientEarlyData, error) {
+	suite := cipherSuiteTLS13ByID(session.cipherSuite)
+	if suite == nil {
+		return nil, c.sendAlert(alertInternalError)
+	}
+	transcript := suite.hash.New()
+	transcript.Write(hello.marshal())
+	secret := suite.deriveSecret(earlySecret, clientEarlyTrafficLabel, transcript)
+	if err := c.config.writeKeyLog(keyLogLabelClientEarly, hello.random, secret); err != nil {
+		c.sendAlert(alertInternalError)
+		return nil, err
+	}
+	c.earlyEKM = suite.earlyExportKeyingMaterial(earlySecret, transcript)
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	// The early data uses TLS 1.3 records, whatever the server selects.
+	c.vers, c.out.version = VersionTLS13, VersionTLS13
+	defer func() {
+		c.vers, c.out.version = 0, 0
+		c.out.cipher, c.out.trafficSecret, c.out.seq = nil, nil, [8]byte{}
+	}()
+
+	// See RFC 8446, Appendix D.4.
+	if _, err := c.writeRecordLocked(recordTypeChangeCipherSpec, []byte{1}); err != nil {
+		return nil, err
+	}
+	c.out.setTrafficSecret(suite, secret)
+
+	early := &clientEarlyData{session: session}
+	if session.disguise.version != 0 {
+		if err := c.sendEarlyCellsLocked(early); err != nil {
+			return nil, err
+		}
+	} else {
+		early.sent = len(c.earlyData)
+		if early.sent > int(session.maxEarlyData) {
+			early.sent = int(session.maxEarlyData)
+		}
+		if _, err := c.writeRecordLocked(recordTypeApplicationData, c.earlyData[:early.sent]); err != nil {
+			return nil, err
+		}
+	}
+	early.cipher, early.seq = c.out.cipher, c.out.seq
+	return early, nil
+}
+
+// sendEarlyCellsLocked frames the early data into Disguise cells with the
+// persona of the resumed session and keys from the early exporter, and
+// writes as many of them as surely fit in what the server accepts. c.out must be locked.
+func (c *Conn) sendEarlyCellsLocked(early *clientEarlyData) (err error) {
+	early.manager = c.newDisguiseManager()
+	defer func() {
+		if err != nil {
+			early.manager.Close()
+		}
+	}()
+	if err := c.keyDisguise(early.manager, c.earlyEKM); err != nil {
+		return err
+	}
+	early.session.disguise.restore(early.manager)
+	if err := early.manager.QueueApplicationData(c.earlyData); err != nil {
+		return err
+	}
+	// A cell is encoded as it is taken from the Manager, so only as many
+	// are taken as surely fit: the rest stay queued, to be encoded with the
+	// keys of the handshake once it is complete.
+	maxCell := profile.GetProfile(early.manager.State().Profile).MaxCellSize
+	left := int(early.session.maxEarlyData)
+	for left >= maxCell {
+		cell, err := early.manager.GetOutboundTraffic()
+		if err == disguise.ErrNoOutboundTraffic || err == disguise.ErrOutboundThrottled {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := c.writeCellLocked(cell); err != nil {
+			return err
+		}
+		left -= len(cell)
+	}
+	return nil
+}
+
+// sendEndOfEarlyData tells a server that accepted the early data that it is
+// over, with the last record protected with the client_early_traffic_secret.
+func (hs *clientHandshakeStateTLS13) sendEndOfEarlyData() error {
+	c := hs.c
+
+	if !c.earlyDataAccepted {
+		return nil
+	}
+
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	clientSecret := c.out.trafficSecret
+	c.out.cipher, c.out.seq = hs.earlyData.cipher, hs.earlyData.seq
+
+	endOfEarlyData := new(endOfEarlyDataMsg)
+	hs.transcript.Write(endOfEarlyData.marshal())
+	if _, err := c.writeRecordLocked(recordTypeHandshake, endOfEarlyData.marshal()); err != nil {
+		return err
+	}
+
+	c.out.setTrafficSecret(hs.suite, clientSecret)
+	return nil
+}
+
+// finishEarlyData is called once the client knows whether Disguise is
+// active. If the server accepted early data framed by Disguise, the Manager
+// that framed it carries on with the keys of the handshake.
+func (hs *clientHandshakeStateTLS13) finishEarlyData() error {
+	c := hs.c
+	early := hs.earlyData
+
+	if early == nil {
+		return nil
+	}
+	if !c.earlyDataAccepted {
+		if early.manager != nil {
+			early.manager.Close()
+		}
+		return nil
+	}
+	if c.disguiseVersion != early.session.disguise.version {
+		c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: server accepted early data with a different Disguise version")
+	}
+	if early.manager == nil {
+		return nil
+	}
+	if err := c.rekeyDisguise(early.manager, true, true); err != nil {
+		c.sendAlert(alertInternalError)
+		return err
+	}
+	c.earlyDisguise = early.manager
+	return nil
+}
+
+// sendLeftoverEarlyData writes, as ordinary application data, the early
+// data a client did not send as 0-RTT data or the server rejected. It is
+// called once the handshake is complete, and errors surface at the next
+// Write. After accepted early data framed by Disguise, it is what remains
+// queued in the Manager.
+func (c *Conn) sendLeftoverEarlyData(early *clientEarlyData) {
+	data := c.earlyData
+	c.earlyData = nil
+	if early != nil && c.earlyDataAccepted {
+		if early.manager != nil {
+			c.drainDisguise()
+			return
+		}
+		data = data[early.sent:]
+	}
+	if len(data) > 0 {
+		c.Write(data)
+	}
+}
+
+// acceptEarlyData reports whether a server accepts the 0-RTT data of a
+// client resuming session with identity, the first PSK identity of its
+// ClientHello, whose binder was verified.
+func (hs *serverHandshakeStateTLS13) acceptEarlyData(session *sessionStateTLS13, identity pskIdentity) bool {
+	c := hs.c
+
+	if !hs.clientHello.earlyData || c.config.MaxEarlyData == 0 || session.maxEarlyData == 0 {
+		return false
+	}
+	// The early data was protected with the cipher suite of the session,
+	// framed for its Disguise version, and is meant for its application
+	// protocol.
+	if session.cipherSuite != hs.suite.id || session.disguise.version != c.disguiseVersion {
+		return false
+	}
+	alpn, err := negotiateALPN(c.config.NextProtos, hs.clientHello.alpnProtocols)
+	if err != nil || alpn != session.alpn {
+		return false
+	}
+
+	// The age of the ticket the client reports must match its actual age,
+	// so that a ClientHello is only accepted within the replay window after
+	// it was sent, and the ticket must not have been used for 0-RTT data
+	// during that time. See RFC 8446, Section 8.
+	window := c.config.earlyDataReplayWindow()
+	now := c.config.time()
+	clientAge := time.Duration(identity.obfuscatedTicketAge-session.ageAdd) * time.Millisecond
+	serverAge := now.Sub(time.Unix(int64(session.createdAt), 0))
+	if skew := serverAge - clientAge; skew < -window || skew > window {
+		return false
+	}
+	return !c.config.replayCache().Seen(identity.label, now.Add(2*window))
+}
+
+// readEndOfEarlyData reads the EndOfEarlyData message and the Finished of a
+// client whose early data the server accepted. The handshake completes
+// without them, and Read calls it once the early data was returned.
+func (hs *serverHandshakeStateTLS13) readEndOfEarlyData() error {
+	c := hs.c
+
+	msg, err := c.readHandshake()
+	if err != nil {
+		return err
+	}
+
+	// EndOfEarlyData was added to the transcript by sendServerFinished.
+	if _, ok := msg.(*endOfEarlyDataMsg); !ok {
+		c.sendAlert(alertUnexpectedMessage)
+		return unexpectedMessageError(new(endOfEarlyDataMsg), msg)
+	}
+	c.in.setTrafficSecret(hs.suite, hs.clientHandshakeSecret)
+	if m := c.disguiseManager; m != nil {
+		if err := c.rekeyDisguise(m, false, true); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+	}
+
+	return hs.readClientFinished()
+}
+
+// skipEarlyDataLocked reports whether a server drops a record of n bytes,
+// which it could not decrypt or which arrived unprotected, as 0-RTT data it
+// rejected. See RFC 8446, Section 4.2.10. c.in must be locked.
+func (c *Conn) skipEarlyDataLocked(typ recordType, n int) bool {
+	if typ != recordTypeApplicationData || uint32(n) > c.skipEarlyData {
+		return false
+	}
+	c.skipEarlyData -= uint32(n)
+	return true
+}
@@ -0,0 +1,123 @@
+package tls
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// replayingSessionCache holds the last session it was given, and can be
+// rewound to an earlier one to resume with a ticket already used.
+type replayingSessionCache struct {
+	session *ClientSessionState
+}
+
+func (c *replayingSessionCache) Get(string) (*ClientSessionState, bool) {
+	return c.session, c.session != nil
+}
+
+func (c *replayingSessionCache) Put(_ string, session *ClientSessionState) {
+	if session != nil {
+		c.session = session
+	}
+}
+
+// earlyDataExchange writes early as early data from a client, and returns
+// what the server read and the state of both connections.
+func earlyDataExchange(t *testing.T, clientConfig, serverConfig *Config, early []byte) (read []byte, client, server ConnectionState) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	type result struct {
+		read  []byte
+		state ConnectionState
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer s.Close()
+		srv := Server(s, serverConfig)
+		buf := make([]byte, len(early))
+		if _, err := io.ReadFull(srv, buf); err != nil {
+			results <- result{err: err}
+			return
+		}
+		_, err = srv.Write([]byte{0})
+		results <- result{buf, srv.ConnectionState(), err}
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	cli := Client(c, clientConfig)
+	if _, err := cli.WriteEarlyData(early); err != nil {
+		t.Fatal(err)
+	}
+	// Reading the server's reply also reads its session ticket.
+	if _, err := io.ReadFull(cli, make([]byte, 1)); err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	r := <-results
+	if r.err != nil {
+		t.Fatalf("server: %v", r.err)
+	}
+	return r.read, cli.ConnectionState(), r.state
+}
+
+func TestEarlyData(t *testing.T) {
+	for _, disguised := range []bool{false, true} {
+		serverConfig := &Config{
+			Certificates:   []Certificate{testCertificate(t)},
+			MaxEarlyData:   16384,
+			DisguiseSecret: []byte("early data secret"),
+		}
+		cache := new(replayingSessionCache)
+		clientConfig := &Config{
+			ServerName:         "example.com",
+			InsecureSkipVerify: true,
+			ClientSessionCache: cache,
+		}
+		if disguised {
+			clientConfig.DisguiseSecret = serverConfig.DisguiseSecret
+		}
+
+		// Without a session, the data is sent after the handshake.
+		msg := []byte("GET / HTTP/1.1\r\n\r\n")
+		if read, client, _ := earlyDataExchange(t, clientConfig, serverConfig, msg); client.EarlyDataAccepted || !bytes.Equal(read, msg) {
+			t.Fatalf("disguised=%v: first connection read %q, early data accepted: %v", disguised, read, client.EarlyDataAccepted)
+		}
+		ticket := cache.session
+
+		// Resuming, it is accepted up to MaxEarlyData, and the rest follows.
+		for _, msg := range [][]byte{msg, bytes.Repeat([]byte("a"), 50000)} {
+			read, client, server := earlyDataExchange(t, clientConfig, serverConfig, msg)
+			if !client.EarlyDataAccepted || !server.EarlyDataAccepted || !client.DidResume {
+				t.Errorf("disguised=%v: early data of %d bytes was not accepted", disguised, len(msg))
+			}
+			if !bytes.Equal(read, msg) {
+				t.Errorf("disguised=%v: server read %d bytes of early data, want %d", disguised, len(read), len(msg))
+			}
+		}
+
+		// A ticket is only used once for early data. The replayed data is
+		// rejected, and the client sends it again after the handshake.
+		cache.session = ticket
+		read, client, server := earlyDataExchange(t, clientConfig, serverConfig, msg)
+		if client.EarlyDataAccepted || server.EarlyDataAccepted {
+			t.Errorf("disguised=%v: replayed early data was accepted", disguised)
+		}
+		if !client.DidResume || !bytes.Equal(read, msg) {
+			t.Errorf("disguised=%v: after rejecting early data, server read %q, resumed: %v", disguised, read, client.DidResume)
+		}
+	}
+}
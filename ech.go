@@ -0,0 +1,746 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"hash"
+	"io"
+
+	"github.com/uDisguise/disguise/internal/hpke"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// Encrypted Client Hello, as specified in draft-ietf-tls-esni-18.
+
+const (
+	// echConfigVersion is the version of the ECHConfig structures this
+	// package understands. Configurations of other versions are skipped.
+	echConfigVersion = extensionEncryptedClientHello
+
+	echClientHelloOuter uint8 = 0
+	echClientHelloInner uint8 = 1
+
+	// echConfirmationLen is the length of the signal with which a server
+	// accepts the ClientHelloInner, in the ServerHello random or in the
+	// encrypted_client_hello extension of a HelloRetryRequest.
+	echConfirmationLen = 8
+
+	echAcceptConfirmationLabel    = "ech accept confirmation"
+	echHRRAcceptConfirmationLabel = "hrr ech accept confirmation"
+)
+
+// echCipherSuites are the HPKE cipher suites of the configurations made by
+// NewEncryptedClientHelloKey, in order of preference.
+var echCipherSuites = []echCipherSuite{
+	{hpke.KDF_HKDF_SHA256, hpke.AEAD_AES_128_GCM},
+	{hpke.KDF_HKDF_SHA256, hpke.AEAD_AES_256_GCM},
+	{hpke.KDF_HKDF_SHA256, hpke.AEAD_ChaCha20Poly1305},
+}
+
+// EncryptedClientHelloKey is a key with which a server decrypts Encrypted
+// Client Hellos.
+type EncryptedClientHelloKey struct {
+	// Config is the marshaled ECHConfig that clients encrypt to.
+	Config []byte
+	// PrivateKey is the private key matching the public key of Config.
+	PrivateKey []byte
+	// SendAsRetry selects Config for the retry configurations sent to the
+	// clients whose Encrypted Client Hello the server could not decrypt,
+	// for example because they used a retired key.
+	SendAsRetry bool
+}
+
+// ECHRejectionError is returned by the handshake of a client whose Encrypted
+// Client Hello was rejected by the server. The server was authenticated
+// against the public name of the configuration instead, but the connection
+// can't be used.
+type ECHRejectionError struct {
+	// RetryConfigList is the ECHConfigList the server sent for the client
+	// to retry with, if any.
+	RetryConfigList []byte
+}
+
+func (e *ECHRejectionError) Error() string {
+	return "tls: server rejected ECH"
+}
+
+// NewEncryptedClientHelloKey generates a key for a server to decrypt
+// Encrypted Client Hellos with. configID tells it apart from the other keys
+// of the server, and publicName is the name clients send in the clear, which
+// the certificates of the server must also be valid for.
+func NewEncryptedClientHelloKey(rand io.Reader, configID uint8, publicName string) (EncryptedClientHelloKey, error) {
+	if len(publicName) == 0 || len(publicName) > 255 {
+		return EncryptedClientHelloKey{}, errors.New("tls: invalid ECH public name")
+	}
+	privateKey, publicKey, err := hpke.GenerateKey(rand)
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+
+	var b cryptobyte.Builder
+	b.AddUint16(echConfigVersion)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(configID)
+		b.AddUint16(hpke.DHKEM_X25519_HKDF_SHA256)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(publicKey)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			for _, suite := range echCipherSuites {
+				b.AddUint16(suite.kdfID)
+				b.AddUint16(suite.aeadID)
+			}
+		})
+		b.AddUint8(0) // maximum_name_length
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(publicName))
+		})
+		b.AddUint16(0) // extensions
+	})
+	config, err := b.Bytes()
+	if err != nil {
+		return EncryptedClientHelloKey{}, err
+	}
+	return EncryptedClientHelloKey{Config: config, PrivateKey: privateKey, SendAsRetry: true}, nil
+}
+
+// ECHConfigList returns the ECHConfigList of the configurations of keys,
+// for the clients of a server to set as Config.EncryptedClientHelloConfigList.
+func ECHConfigList(keys []EncryptedClientHelloKey) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, key := range keys {
+			b.AddBytes(key.Config)
+		}
+	})
+	return b.BytesOrPanic()
+}
+
+type echCipherSuite struct {
+	kdfID, aeadID uint16
+}
+
+// echConfig is a parsed ECHConfig.
+type echConfig struct {
+	raw           []byte
+	configID      uint8
+	kemID         uint16
+	publicKey     []byte
+	cipherSuites  []echCipherSuite
+	maxNameLength uint8
+	publicName    string
+	// unsupportedMandatory is set if the configuration has an extension
+	// that clients must understand to use it, none of which are supported.
+	unsupportedMandatory bool
+}
+
+// parseECHConfig parses one ECHConfig of the supported version.
+func parseECHConfig(raw []byte) (*echConfig, error) {
+	config := &echConfig{raw: raw}
+	s := cryptobyte.String(raw)
+	var version uint16
+	var contents, publicKey, cipherSuites, publicName, extensions cryptobyte.String
+	if !s.ReadUint16(&version) || !s.ReadUint16LengthPrefixed(&contents) || !s.Empty() {
+		return nil, errors.New("tls: malformed ECHConfig")
+	}
+	if version != echConfigVersion {
+		return nil, errors.New("tls: unsupported ECHConfig version")
+	}
+	if !contents.ReadUint8(&config.configID) ||
+		!contents.ReadUint16(&config.kemID) ||
+		!contents.ReadUint16LengthPrefixed(&publicKey) ||
+		!contents.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!contents.ReadUint8(&config.maxNameLength) ||
+		!contents.ReadUint8LengthPrefixed(&publicName) ||
+		!contents.ReadUint16LengthPrefixed(&extensions) ||
+		!contents.Empty() || publicName.Empty() {
+		return nil, errors.New("tls: malformed ECHConfig")
+	}
+	config.publicKey = publicKey
+	config.publicName = string(publicName)
+	for !cipherSuites.Empty() {
+		var suite echCipherSuite
+		if !cipherSuites.ReadUint16(&suite.kdfID) || !cipherSuites.ReadUint16(&suite.aeadID) {
+			return nil, errors.New("tls: malformed ECHConfig")
+		}
+		config.cipherSuites = append(config.cipherSuites, suite)
+	}
+	for !extensions.Empty() {
+		var extension uint16
+		var extData cryptobyte.String
+		if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+			return nil, errors.New("tls: malformed ECHConfig")
+		}
+		if extension&0x8000 != 0 {
+			config.unsupportedMandatory = true
+		}
+	}
+	return config, nil
+}
+
+// parseECHConfigList returns the configurations of an ECHConfigList that are
+// of the supported version.
+func parseECHConfigList(data []byte) ([]*echConfig, error) {
+	s := cryptobyte.String(data)
+	var list cryptobyte.String
+	if !s.ReadUint16LengthPrefixed(&list) || !s.Empty() || list.Empty() {
+		return nil, errors.New("tls: malformed ECHConfigList")
+	}
+	var configs []*echConfig
+	for !list.Empty() {
+		var version uint16
+		var contents cryptobyte.String
+		raw := list
+		if !list.ReadUint16(&version) || !list.ReadUint16LengthPrefixed(&contents) {
+			return nil, errors.New("tls: malformed ECHConfigList")
+		}
+		if version != echConfigVersion {
+			continue
+		}
+		config, err := parseECHConfig(raw[:4+len(contents)])
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// supports reports whether this package can encrypt to config with suite.
+func (config *echConfig) supports(suite echCipherSuite) bool {
+	if !hpke.SupportedKDF(suite.kdfID) || !hpke.SupportedAEAD(suite.aeadID) {
+		return false
+	}
+	for _, s := range config.cipherSuites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// pickECHConfig returns the first configuration of list a client can use,
+// and the first of its cipher suites that is supported.
+func pickECHConfig(list []*echConfig) (*echConfig, echCipherSuite, bool) {
+	for _, config := range list {
+		if !hpke.SupportedKEM(config.kemID) || config.unsupportedMandatory {
+			continue
+		}
+		for _, suite := range config.cipherSuites {
+			if config.supports(suite) {
+				return config, suite, true
+			}
+		}
+	}
+	return nil, echCipherSuite{}, false
+}
+
+// echInfo is the HPKE info of the encryption to config.
+func echInfo(config *echConfig) []byte {
+	info := append([]byte("tls ech\x00"), config.raw...)
+	return info
+}
+
+// marshalECHOuter returns the encrypted_client_hello extension of a
+// ClientHelloOuter.
+func marshalECHOuter(suite echCipherSuite, configID uint8, enc, payload []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(echClientHelloOuter)
+	b.AddUint16(suite.kdfID)
+	b.AddUint16(suite.aeadID)
+	b.AddUint8(configID)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(enc)
+	})
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(payload)
+	})
+	return b.BytesOrPanic()
+}
+
+// parseECHOuter parses the encrypted_client_hello extension of a
+// ClientHelloOuter. It reports the type of the extension, and only parses
+// the rest if it is an outer one.
+func parseECHOuter(data []byte) (echType uint8, suite echCipherSuite, configID uint8, enc, payload []byte, ok bool) {
+	s := cryptobyte.String(data)
+	if !s.ReadUint8(&echType) {
+		return 0, suite, 0, nil, nil, false
+	}
+	if echType != echClientHelloOuter {
+		return echType, suite, 0, nil, nil, true
+	}
+	var encData, payloadData cryptobyte.String
+	if !s.ReadUint16(&suite.kdfID) || !s.ReadUint16(&suite.aeadID) ||
+		!s.ReadUint8(&configID) ||
+		!s.ReadUint16LengthPrefixed(&encData) ||
+		!s.ReadUint16LengthPrefixed(&payloadData) ||
+		!s.Empty() || payloadData.Empty() {
+		return 0, suite, 0, nil, nil, false
+	}
+	return echType, suite, configID, encData, payloadData, true
+}
+
+// helloExtension is an extension of a marshaled ClientHello or ServerHello,
+// with the offset of its data in the message.
+type helloExtension struct {
+	typ    uint16
+	data   []byte
+	offset int
+}
+
+// helloExtensions returns the extensions of a marshaled ClientHello or
+// ServerHello, in order.
+func helloExtensions(msg []byte) ([]helloExtension, bool) {
+	s := cryptobyte.String(msg)
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.Skip(4) || !s.Skip(2+32) || !s.ReadUint8LengthPrefixed(&sessionID) {
+		return nil, false
+	}
+	if msg[0] == typeClientHello {
+		if !s.ReadUint16LengthPrefixed(&cipherSuites) || !s.ReadUint8LengthPrefixed(&compressionMethods) {
+			return nil, false
+		}
+	} else if !s.Skip(2 + 1) {
+		return nil, false
+	}
+	if s.Empty() {
+		return nil, true
+	}
+	if !s.ReadUint16LengthPrefixed(&extensions) || !s.Empty() {
+		return nil, false
+	}
+	var exts []helloExtension
+	for !extensions.Empty() {
+		var ext helloExtension
+		var data cryptobyte.String
+		if !extensions.ReadUint16(&ext.typ) || !extensions.ReadUint16LengthPrefixed(&data) {
+			return nil, false
+		}
+		ext.data = data
+		ext.offset = len(msg) - len(extensions) - len(data)
+		exts = append(exts, ext)
+	}
+	return exts, true
+}
+
+// zeroExtension returns a copy of the marshaled hello msg with the data of
+// the extension ext, or its last n bytes if n is positive, zeroed.
+func zeroExtension(msg []byte, ext uint16, n int) []byte {
+	out := append([]byte{}, msg...)
+	exts, _ := helloExtensions(msg)
+	for _, e := range exts {
+		if e.typ != ext {
+			continue
+		}
+		data := out[e.offset : e.offset+len(e.data)]
+		if n > 0 && n <= len(data) {
+			data = data[len(data)-n:]
+		}
+		for i := range data {
+			data[i] = 0
+		}
+	}
+	return out
+}
+
+// echConfirmation returns the signal with which a server accepts the
+// ClientHelloInner, computed over transcript, which must end with the
+// ServerHello or HelloRetryRequest with the signal zeroed.
+func echConfirmation(suite *cipherSuiteTLS13, innerRandom []byte, label string, transcript hash.Hash) []byte {
+	return suite.expandLabel(suite.extract(innerRandom, nil), label, transcript.Sum(nil), echConfirmationLen)
+}
+
+// echClientContext is the state of a client that offered an Encrypted
+// Client Hello.
+type echClientContext struct {
+	config *echConfig
+	suite  echCipherSuite
+	enc    []byte
+	sender *hpke.Sender
+	// outer is the last ClientHelloOuter sent, or before the first one, the
+	// template of the next.
+	outer *clientHelloMsg
+	// sealed is set once the first ClientHelloOuter is sent, after which
+	// the encapsulated key is no longer repeated.
+	sealed bool
+}
+
+// prepareECH turns hello into a ClientHelloInner for the configuration list
+// of the client, and prepares the ClientHelloOuter it is carried in.
+func (c *Conn) prepareECH(hello *clientHelloMsg) (*echClientContext, error) {
+	configs, err := parseECHConfigList(c.config.EncryptedClientHelloConfigList)
+	if err != nil {
+		return nil, err
+	}
+	config, suite, ok := pickECHConfig(configs)
+	if !ok {
+		return nil, errors.New("tls: no supported configuration in EncryptedClientHelloConfigList")
+	}
+	if !hello.offersVersion(VersionTLS13) {
+		return nil, errors.New("tls: EncryptedClientHelloConfigList requires TLS 1.3")
+	}
+
+	outer := *hello
+	outer.raw = nil
+	outer.serverName = config.publicName
+	outer.random = make([]byte, 32)
+	if _, err := io.ReadFull(c.config.rand(), outer.random); err != nil {
+		return nil, errors.New("tls: short read from Rand: " + err.Error())
+	}
+
+	// The ClientHelloInner may only negotiate TLS 1.3, and is padded by
+	// the encryption rather than by the padding extension.
+	var versions []uint16
+	for _, v := range hello.supportedVersions {
+		if isGREASE(v) || v >= VersionTLS13 {
+			versions = append(versions, v)
+		}
+	}
+	hello.supportedVersions = versions
+	hello.encryptedClientHello = []byte{echClientHelloInner}
+	hello.padding = false
+	hello.paddingLengths = nil
+
+	enc, sender, err := hpke.SetupSender(config.kemID, suite.kdfID, suite.aeadID,
+		config.publicKey, echInfo(config), c.config.rand())
+	if err != nil {
+		return nil, err
+	}
+	return &echClientContext{config: config, suite: suite, enc: enc, sender: sender, outer: &outer}, nil
+}
+
+// sealOuter encrypts inner into a new ClientHelloOuter, stored in
+// ech.outer. Besides the ticket support loadSession advertises, only the
+// key shares and cookie of inner change between the ClientHelloOuters of a
+// handshake.
+func (ech *echClientContext) sealOuter(inner *clientHelloMsg) error {
+	outer := *ech.outer
+	outer.raw = nil
+	outer.ticketSupported = inner.ticketSupported
+	outer.pskModes = inner.pskModes
+	outer.keyShares = inner.keyShares
+	outer.cookie = inner.cookie
+
+	enc := ech.enc
+	if ech.sealed {
+		enc = nil
+	}
+	encoded := encodeInnerClientHello(inner.marshal(), ech.config.maxNameLength, inner.serverName)
+	placeholder := make([]byte, len(encoded)+ech.sender.Overhead())
+	outer.encryptedClientHello = marshalECHOuter(ech.suite, ech.config.configID, enc, placeholder)
+	aad := outer.marshal()[4:]
+	payload, err := ech.sender.Seal(aad, encoded)
+	if err != nil {
+		return err
+	}
+	outer.raw = nil
+	outer.encryptedClientHello = marshalECHOuter(ech.suite, ech.config.configID, enc, payload)
+	outer.marshal()
+
+	ech.outer = &outer
+	ech.sealed = true
+	return nil
+}
+
+// encodeInnerClientHello returns the EncodedClientHelloInner of a marshaled
+// ClientHelloInner: its body without the session ID, which the server takes
+// from the ClientHelloOuter, padded to hide the length of serverName.
+func encodeInnerClientHello(inner []byte, maxNameLength uint8, serverName string) []byte {
+	body := inner[4:]
+	sessionIDLen := int(body[2+32])
+	encoded := make([]byte, 0, len(body)+255+32)
+	encoded = append(encoded, body[:2+32]...)
+	encoded = append(encoded, 0)
+	encoded = append(encoded, body[2+32+1+sessionIDLen:]...)
+
+	var padding int
+	if serverName != "" {
+		if n := int(maxNameLength) - len(serverName); n > 0 {
+			padding = n
+		}
+	} else {
+		padding = int(maxNameLength) + 9
+	}
+	padding += 31 - (len(encoded)+padding+31)%32
+	return append(encoded, make([]byte, padding)...)
+}
+
+// checkECHAcceptance checks whether the server accepted the ClientHelloInner
+// in hs.hello, as signaled in the ServerHello or HelloRetryRequest in
+// hs.serverHello, and otherwise continues the handshake with the
+// ClientHelloOuter.
+func (hs *clientHandshakeStateTLS13) checkECHAcceptance() {
+	c := hs.c
+
+	transcript := hs.suite.hash.New()
+	transcript.Write(hs.hello.marshal())
+	var accepted bool
+	if bytes.Equal(hs.serverHello.random, helloRetryRequestRandom) {
+		if len(hs.serverHello.echConfirmation) == echConfirmationLen {
+			chHash := transcript.Sum(nil)
+			transcript.Reset()
+			transcript.Write([]byte{typeMessageHash, 0, 0, uint8(len(chHash))})
+			transcript.Write(chHash)
+			transcript.Write(zeroExtension(hs.serverHello.marshal(), extensionEncryptedClientHello, 0))
+			confirmation := echConfirmation(hs.suite, hs.hello.random, echHRRAcceptConfirmationLabel, transcript)
+			accepted = hmac.Equal(hs.serverHello.echConfirmation, confirmation)
+		}
+	} else {
+		transcript.Write(zeroServerHelloConfirmation(hs.serverHello.marshal()))
+		confirmation := echConfirmation(hs.suite, hs.hello.random, echAcceptConfirmationLabel, transcript)
+		accepted = hmac.Equal(hs.serverHello.random[32-echConfirmationLen:], confirmation)
+	}
+
+	if accepted {
+		c.echAccepted = true
+		return
+	}
+	hs.hello = hs.echContext.outer
+	hs.session, hs.earlySecret, hs.binderKey = nil, nil, nil
+	c.echPublicName = hs.echContext.config.publicName
+}
+
+// checkECHConfirmation checks that the ServerHello that follows a
+// HelloRetryRequest accepting the ClientHelloInner accepts it too.
+func (hs *clientHandshakeStateTLS13) checkECHConfirmation() error {
+	transcript := cloneHash(hs.transcript, hs.suite.hash)
+	transcript.Write(zeroServerHelloConfirmation(hs.serverHello.marshal()))
+	confirmation := echConfirmation(hs.suite, hs.hello.random, echAcceptConfirmationLabel, transcript)
+	if !hmac.Equal(hs.serverHello.random[32-echConfirmationLen:], confirmation) {
+		hs.c.sendAlert(alertIllegalParameter)
+		return errors.New("tls: server rejected ECH after accepting it in a HelloRetryRequest")
+	}
+	return nil
+}
+
+// zeroServerHelloConfirmation returns a copy of a marshaled ServerHello with
+// the confirmation in its random zeroed.
+func zeroServerHelloConfirmation(serverHello []byte) []byte {
+	out := append([]byte{}, serverHello...)
+	confirmation := out[4+2+32-echConfirmationLen : 4+2+32]
+	for i := range confirmation {
+		confirmation[i] = 0
+	}
+	return out
+}
+
+// echRejectionError aborts the handshake of a client whose Encrypted Client
+// Hello was rejected, once the server is authenticated against the public
+// name of the configuration.
+func (c *Conn) echRejectionError(retryConfigList []byte) error {
+	c.sendAlert(alertECHRequired)
+	return &ECHRejectionError{RetryConfigList: retryConfigList}
+}
+
+// echServerContext is the state of a server that received an Encrypted
+// Client Hello, accepted if recipient is set.
+type echServerContext struct {
+	recipient *hpke.Recipient
+	configID  uint8
+	suite     echCipherSuite
+}
+
+// processECHClientHello decrypts the ClientHelloInner carried in outer, if
+// any. It returns the ClientHello to continue the handshake with, and a
+// context if the client offered ECH.
+func (c *Conn) processECHClientHello(outer *clientHelloMsg) (*clientHelloMsg, *echServerContext, error) {
+	if len(outer.encryptedClientHello) == 0 || len(c.config.EncryptedClientHelloKeys) == 0 {
+		return outer, nil, nil
+	}
+	echType, suite, configID, enc, payload, ok := parseECHOuter(outer.encryptedClientHello)
+	if !ok {
+		c.sendAlert(alertDecodeError)
+		return nil, nil, errors.New("tls: malformed encrypted_client_hello extension")
+	}
+	if echType != echClientHelloOuter {
+		c.sendAlert(alertIllegalParameter)
+		return nil, nil, errors.New("tls: client sent an inner encrypted_client_hello extension in the clear")
+	}
+
+	for _, key := range c.config.EncryptedClientHelloKeys {
+		config, err := parseECHConfig(key.Config)
+		if err != nil || config.configID != configID || !config.supports(suite) {
+			continue
+		}
+		recipient, err := hpke.SetupRecipient(config.kemID, suite.kdfID, suite.aeadID,
+			key.PrivateKey, echInfo(config), enc)
+		if err != nil {
+			continue
+		}
+		aad := zeroExtension(outer.raw, extensionEncryptedClientHello, len(payload))[4:]
+		encoded, err := recipient.Open(aad, payload)
+		if err != nil {
+			continue
+		}
+		inner, err := decodeInnerClientHello(outer, encoded)
+		if err != nil {
+			c.sendAlert(alertIllegalParameter)
+			return nil, nil, err
+		}
+		c.echAccepted = true
+		return inner, &echServerContext{recipient: recipient, configID: configID, suite: suite}, nil
+	}
+	return outer, &echServerContext{}, nil
+}
+
+// openRetry decrypts the ClientHelloInner of the second ClientHelloOuter,
+// after a HelloRetryRequest accepted the first.
+func (ech *echServerContext) openRetry(c *Conn, outer *clientHelloMsg) (*clientHelloMsg, error) {
+	if len(outer.encryptedClientHello) == 0 {
+		c.sendAlert(alertMissingExtension)
+		return nil, errors.New("tls: client dropped ECH after a HelloRetryRequest")
+	}
+	echType, suite, configID, enc, payload, ok := parseECHOuter(outer.encryptedClientHello)
+	if !ok {
+		c.sendAlert(alertDecodeError)
+		return nil, errors.New("tls: malformed encrypted_client_hello extension")
+	}
+	if echType != echClientHelloOuter || suite != ech.suite || configID != ech.configID || len(enc) != 0 {
+		c.sendAlert(alertIllegalParameter)
+		return nil, errors.New("tls: client changed ECH parameters after a HelloRetryRequest")
+	}
+	aad := zeroExtension(outer.raw, extensionEncryptedClientHello, len(payload))[4:]
+	encoded, err := ech.recipient.Open(aad, payload)
+	if err != nil {
+		c.sendAlert(alertDecryptError)
+		return nil, errors.New("tls: invalid ECH payload after a HelloRetryRequest")
+	}
+	inner, err := decodeInnerClientHello(outer, encoded)
+	if err != nil {
+		c.sendAlert(alertIllegalParameter)
+		return nil, err
+	}
+	return inner, nil
+}
+
+// decodeInnerClientHello reconstructs the ClientHelloInner from its
+// EncodedClientHelloInner, taking the session ID and the extensions listed
+// in ech_outer_extensions from outer.
+func decodeInnerClientHello(outer *clientHelloMsg, encoded []byte) (*clientHelloMsg, error) {
+	errMalformed := errors.New("tls: malformed ClientHelloInner")
+
+	s := cryptobyte.String(encoded)
+	var vers uint16
+	var random []byte
+	var sessionID, cipherSuites, compressionMethods, extensions cryptobyte.String
+	if !s.ReadUint16(&vers) || !s.ReadBytes(&random, 32) ||
+		!s.ReadUint8LengthPrefixed(&sessionID) || !sessionID.Empty() ||
+		!s.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!s.ReadUint8LengthPrefixed(&compressionMethods) ||
+		!s.ReadUint16LengthPrefixed(&extensions) {
+		return nil, errMalformed
+	}
+	for _, b := range s {
+		if b != 0 {
+			return nil, errors.New("tls: invalid ClientHelloInner padding")
+		}
+	}
+
+	outerExtensions, ok := helloExtensions(outer.raw)
+	if !ok {
+		return nil, errMalformed
+	}
+
+	var err error
+	var b cryptobyte.Builder
+	b.AddUint8(typeClientHello)
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(vers)
+		b.AddBytes(random)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(outer.sessionId)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(cipherSuites)
+		})
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(compressionMethods)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			usedOuter := false
+			for !extensions.Empty() {
+				var extension uint16
+				var extData cryptobyte.String
+				if !extensions.ReadUint16(&extension) || !extensions.ReadUint16LengthPrefixed(&extData) {
+					err = errMalformed
+					return
+				}
+				if extension != extensionECHOuterExtensions {
+					b.AddUint16(extension)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(extData)
+					})
+					continue
+				}
+
+				// The referenced extensions are copied from the
+				// ClientHelloOuter, where they must appear in the same order.
+				var types cryptobyte.String
+				if usedOuter || !extData.ReadUint8LengthPrefixed(&types) || !extData.Empty() || types.Empty() {
+					err = errMalformed
+					return
+				}
+				usedOuter = true
+				for !types.Empty() {
+					var typ uint16
+					if !types.ReadUint16(&typ) || typ == extensionEncryptedClientHello {
+						err = errMalformed
+						return
+					}
+					for len(outerExtensions) > 0 && outerExtensions[0].typ != typ {
+						outerExtensions = outerExtensions[1:]
+					}
+					if len(outerExtensions) == 0 {
+						err = errors.New("tls: ClientHelloInner references a missing outer extension")
+						return
+					}
+					b.AddUint16(typ)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes(outerExtensions[0].data)
+					})
+					outerExtensions = outerExtensions[1:]
+				}
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	raw, err := b.Bytes()
+	if err != nil {
+		return nil, errMalformed
+	}
+
+	inner := new(clientHelloMsg)
+	if !inner.unmarshal(raw) {
+		return nil, errMalformed
+	}
+	if !bytes.Equal(inner.encryptedClientHello, []byte{echClientHelloInner}) {
+		return nil, errors.New("tls: ClientHelloInner lacks the inner encrypted_client_hello extension")
+	}
+	if !inner.offersVersion(VersionTLS13) {
+		return nil, errors.New("tls: ClientHelloInner does not offer TLS 1.3")
+	}
+	for _, v := range inner.supportedVersions {
+		if !isGREASE(v) && v < VersionTLS13 {
+			return nil, errors.New("tls: ClientHelloInner offers a version older than TLS 1.3")
+		}
+	}
+	return inner, nil
+}
+
+// echRetryConfigList returns the ECHConfigList of the keys sent as retry
+// configurations, or nil if there are none.
+func echRetryConfigList(keys []EncryptedClientHelloKey) []byte {
+	var retry []EncryptedClientHelloKey
+	for _, key := range keys {
+		if key.SendAsRetry {
+			retry = append(retry, key)
+		}
+	}
+	if len(retry) == 0 {
+		return nil
+	}
+	return ECHConfigList(retry)
+}
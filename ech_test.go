@@ -0,0 +1,185 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// echTestSetup returns a server with an ECH key for public.example, and a
+// client that encrypts its ClientHello for example.com to it. The server
+// certificate is trusted by the client and valid for both names.
+func echTestSetup(t *testing.T) (clientConfig, serverConfig *Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "example.com"},
+		DNSNames:              []string{"example.com", "public.example"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	echKey, err := NewEncryptedClientHelloKey(rand.Reader, 1, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig = &Config{
+		Certificates:             []Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		EncryptedClientHelloKeys: []EncryptedClientHelloKey{echKey},
+	}
+	clientConfig = &Config{
+		ServerName:                     "example.com",
+		RootCAs:                        roots,
+		EncryptedClientHelloConfigList: ECHConfigList(serverConfig.EncryptedClientHelloKeys),
+	}
+	return clientConfig, serverConfig
+}
+
+func TestECHAccepted(t *testing.T) {
+	for _, hrr := range []bool{false, true} {
+		clientConfig, serverConfig := echTestSetup(t)
+		if hrr {
+			serverConfig.CurvePreferences = []CurveID{CurveP256}
+		}
+		clientConfig.ClientHelloLengths = []int{1024}
+		hello, serverHello, state := handshakeRecorded(t, clientConfig, serverConfig)
+
+		if !state.ECHAccepted {
+			t.Fatalf("hrr=%v: ECH was not accepted", hrr)
+		}
+		if state.ServerName != "example.com" {
+			t.Errorf("hrr=%v: server name is %q", hrr, state.ServerName)
+		}
+		var outer clientHelloMsg
+		if !outer.unmarshal(hello) {
+			t.Fatalf("hrr=%v: failed to parse the ClientHelloOuter", hrr)
+		}
+		if outer.serverName != "public.example" {
+			t.Errorf("hrr=%v: ClientHelloOuter was sent for %q", hrr, outer.serverName)
+		}
+		if len(outer.encryptedClientHello) == 0 || outer.encryptedClientHello[0] != echClientHelloOuter {
+			t.Errorf("hrr=%v: ClientHelloOuter lacks the outer encrypted_client_hello extension", hrr)
+		}
+		if bytes.Contains(hello, []byte("example.com")) {
+			t.Errorf("hrr=%v: ClientHelloOuter leaks the inner server name", hrr)
+		}
+		if len(hello) != 1024 {
+			t.Errorf("hrr=%v: ClientHelloOuter is %d bytes long, want it padded to 1024", hrr, len(hello))
+		}
+		var sh serverHelloMsg
+		if !sh.unmarshal(serverHello) {
+			t.Fatalf("hrr=%v: failed to parse the ServerHello", hrr)
+		}
+		if isHRR := bytes.Equal(sh.random, helloRetryRequestRandom); isHRR != hrr {
+			t.Errorf("hrr=%v: server sent a HelloRetryRequest: %v", hrr, isHRR)
+		}
+	}
+}
+
+// echHandshakeErrors runs a handshake between client and server configs,
+// and returns the errors both sides saw.
+func echHandshakeErrors(t *testing.T, clientConfig, serverConfig *Config) (clientErr, serverErr error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	serverErrc := make(chan error, 1)
+	go func() {
+		s, err := ln.Accept()
+		if err != nil {
+			serverErrc <- err
+			return
+		}
+		defer s.Close()
+		server := Server(s, serverConfig)
+		if err := server.Handshake(); err != nil {
+			serverErrc <- err
+			return
+		}
+		_, err = server.Read(make([]byte, 1))
+		serverErrc <- err
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	clientErr = Client(c, clientConfig).Handshake()
+	c.Close()
+	return clientErr, <-serverErrc
+}
+
+func TestECHRejected(t *testing.T) {
+	clientConfig, serverConfig := echTestSetup(t)
+
+	// The server rotated its key, and sends the new one as a retry
+	// configuration to the client still using the old one.
+	rotated, err := NewEncryptedClientHelloKey(rand.Reader, 2, "public.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig.EncryptedClientHelloKeys = []EncryptedClientHelloKey{rotated}
+	clientErr, serverErr := echHandshakeErrors(t, clientConfig, serverConfig)
+	var rejection *ECHRejectionError
+	if !errors.As(clientErr, &rejection) {
+		t.Fatalf("client error is %v, want an ECHRejectionError", clientErr)
+	}
+	if want := ECHConfigList(serverConfig.EncryptedClientHelloKeys); !bytes.Equal(rejection.RetryConfigList, want) {
+		t.Errorf("retry configurations are %x, want %x", rejection.RetryConfigList, want)
+	}
+	if serverErr == nil {
+		t.Error("server read data after the client rejected the connection")
+	}
+
+	// Retrying with the new configuration succeeds.
+	clientConfig.EncryptedClientHelloConfigList = rejection.RetryConfigList
+	if _, _, state := handshakeRecorded(t, clientConfig, serverConfig); !state.ECHAccepted {
+		t.Error("ECH was not accepted with the retry configuration")
+	}
+
+	// A TLS 1.2 server can't accept ECH, and sends no retry configurations.
+	tls12Config := serverConfig.Clone()
+	tls12Config.MaxVersion = VersionTLS12
+	tls12Config.EncryptedClientHelloKeys = nil
+	clientErr, _ = echHandshakeErrors(t, clientConfig, tls12Config)
+	if !errors.As(clientErr, &rejection) {
+		t.Fatalf("TLS 1.2: client error is %v, want an ECHRejectionError", clientErr)
+	}
+	if rejection.RetryConfigList != nil {
+		t.Errorf("TLS 1.2: retry configurations are %x", rejection.RetryConfigList)
+	}
+
+	// The server is authenticated against the public name on rejection.
+	serverConfig.EncryptedClientHelloKeys = nil
+	clientConfig.ServerName = "other.example"
+	clientErr, _ = echHandshakeErrors(t, clientConfig, serverConfig)
+	if !errors.As(clientErr, &rejection) {
+		t.Fatalf("client error is %v, want an ECHRejectionError after checking the public name", clientErr)
+	}
+}
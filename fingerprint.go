@@ -0,0 +1,700 @@
+package tls
+
+import (
+	"errors"
+	"io"
+	mathrand "math/rand"
+	"time"
+)
+
+// GREASEPlaceholder stands for a GREASE value (RFC 8701) in the lists of a
+// ClientHelloSpec. Every ClientHello replaces it with a random GREASE value,
+// the same one wherever it stands for a group in supported_groups and
+// key_share. It may be used in the cipher suite, extension, group, key share,
+// signature algorithm and version lists.
+const GREASEPlaceholder uint16 = 0x0a0a
+
+// isGREASE reports whether v is one of the values reserved by RFC 8701.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// CertCompressionAlgorithm is a certificate compression algorithm, as
+// advertised in the compress_certificate extension (RFC 8879).
+type CertCompressionAlgorithm uint16
+
+const (
+	CertCompressionZlib   CertCompressionAlgorithm = 1
+	CertCompressionBrotli CertCompressionAlgorithm = 2
+	CertCompressionZstd   CertCompressionAlgorithm = 3
+)
+
+// ClientHelloSpec describes the shape of a ClientHello, so that a client can
+// send the fingerprint of a browser rather than the one of this package.
+// Start from one of the presets, such as ChromeClientHelloSpec, rather than
+// building one from scratch.
+//
+// The spec only changes what is advertised. Cipher suites, groups and
+// signature algorithms that this package does not implement may be listed,
+// but the handshake fails if the server selects one of them. In particular,
+// compress_certificate is advertised without being supported, and
+// extended_master_secret is not honoured in TLS 1.2, so a TLS 1.2 server
+// that negotiates it cannot be reached.
+type ClientHelloSpec struct {
+	// CipherSuites is the cipher suite list, in order. It replaces both
+	// Config.CipherSuites and the TLS 1.3 defaults.
+	CipherSuites []uint16
+
+	// Extensions is the list of extension code points, in the order they go
+	// on the wire. Optional extensions, such as status_request or
+	// extended_master_secret, are sent only if they are listed. Extensions
+	// the handshake needs but that are not listed, such as cookie after a
+	// HelloRetryRequest, are sent after the listed ones. padding and
+	// pre_shared_key always come last.
+	Extensions []uint16
+
+	// ShuffleExtensions randomizes the order of Extensions for every
+	// ClientHello, except for GREASE, padding and pre_shared_key, like
+	// Chrome does.
+	ShuffleExtensions bool
+
+	// SupportedCurves is the supported_groups list and KeyShareCurves the
+	// groups a key share is sent for. At least one of the latter must be a
+	// group this package implements.
+	SupportedCurves []CurveID
+	KeyShareCurves  []CurveID
+
+	// SupportedPoints is the ec_point_formats list.
+	SupportedPoints []uint8
+
+	// SignatureAlgorithms is the signature_algorithms list.
+	SignatureAlgorithms []SignatureScheme
+
+	// SupportedVersions is the supported_versions list. Versions disabled
+	// by Config.MinVersion and Config.MaxVersion are left out.
+	SupportedVersions []uint16
+
+	// NextProtos is the ALPN list sent when Config.NextProtos is empty.
+	NextProtos []string
+
+	// ApplicationSettings lists the protocols sent in the
+	// application_settings extension.
+	ApplicationSettings []string
+
+	// CertCompressionAlgorithms lists the algorithms sent in the
+	// compress_certificate extension.
+	CertCompressionAlgorithms []CertCompressionAlgorithm
+
+	// DelegatedCredentials lists the signature algorithms sent in the
+	// delegated_credentials extension.
+	DelegatedCredentials []SignatureScheme
+
+	// RecordSizeLimit is the value of the record_size_limit extension.
+	RecordSizeLimit uint16
+
+	// Padding pads ClientHellos between 256 and 511 bytes long to 512
+	// bytes, like BoringSSL and NSS do.
+	Padding bool
+}
+
+// ffdhe2048 and ffdhe3072 are the finite field groups of RFC 7919. They are
+// advertised by Firefox but not implemented by this package.
+const (
+	ffdhe2048 CurveID = 0x0100
+	ffdhe3072 CurveID = 0x0101
+)
+
+// ChromeClientHelloSpec returns a ClientHelloSpec mimicking Chrome 120.
+func ChromeClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			GREASEPlaceholder,
+			TLS_AES_128_GCM_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		Extensions: []uint16{
+			GREASEPlaceholder,
+			extensionServerName,
+			extensionExtendedMasterSecret,
+			extensionRenegotiationInfo,
+			extensionSupportedCurves,
+			extensionSupportedPoints,
+			extensionSessionTicket,
+			extensionALPN,
+			extensionStatusRequest,
+			extensionSignatureAlgorithms,
+			extensionSCT,
+			extensionKeyShare,
+			extensionPSKModes,
+			extensionSupportedVersions,
+			extensionCompressCertificate,
+			extensionApplicationSettings,
+			GREASEPlaceholder,
+			extensionPadding,
+			extensionPreSharedKey,
+		},
+		ShuffleExtensions: true,
+		SupportedCurves:   []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256, CurveP384},
+		KeyShareCurves:    []CurveID{CurveID(GREASEPlaceholder), X25519},
+		SupportedPoints:   []uint8{pointFormatUncompressed},
+		SignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			PSSWithSHA256,
+			PKCS1WithSHA256,
+			ECDSAWithP384AndSHA384,
+			PSSWithSHA384,
+			PKCS1WithSHA384,
+			PSSWithSHA512,
+			PKCS1WithSHA512,
+		},
+		SupportedVersions:         []uint16{GREASEPlaceholder, VersionTLS13, VersionTLS12},
+		NextProtos:                []string{"h2", "http/1.1"},
+		ApplicationSettings:       []string{"h2"},
+		CertCompressionAlgorithms: []CertCompressionAlgorithm{CertCompressionBrotli},
+		Padding:                   true,
+	}
+}
+
+// FirefoxClientHelloSpec returns a ClientHelloSpec mimicking Firefox 120.
+func FirefoxClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			TLS_AES_128_GCM_SHA256,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+		},
+		Extensions: []uint16{
+			extensionServerName,
+			extensionExtendedMasterSecret,
+			extensionRenegotiationInfo,
+			extensionSupportedCurves,
+			extensionSupportedPoints,
+			extensionSessionTicket,
+			extensionALPN,
+			extensionStatusRequest,
+			extensionDelegatedCredentials,
+			extensionKeyShare,
+			extensionSupportedVersions,
+			extensionSignatureAlgorithms,
+			extensionPSKModes,
+			extensionRecordSizeLimit,
+			extensionPadding,
+			extensionPreSharedKey,
+		},
+		SupportedCurves: []CurveID{X25519, CurveP256, CurveP384, CurveP521, ffdhe2048, ffdhe3072},
+		KeyShareCurves:  []CurveID{X25519, CurveP256},
+		SupportedPoints: []uint8{pointFormatUncompressed},
+		SignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			ECDSAWithP384AndSHA384,
+			ECDSAWithP521AndSHA512,
+			PSSWithSHA256,
+			PSSWithSHA384,
+			PSSWithSHA512,
+			PKCS1WithSHA256,
+			PKCS1WithSHA384,
+			PKCS1WithSHA512,
+			ECDSAWithSHA1,
+			PKCS1WithSHA1,
+		},
+		SupportedVersions: []uint16{VersionTLS13, VersionTLS12},
+		NextProtos:        []string{"h2", "http/1.1"},
+		DelegatedCredentials: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			ECDSAWithP384AndSHA384,
+			ECDSAWithP521AndSHA512,
+			ECDSAWithSHA1,
+		},
+		RecordSizeLimit: 0x4001,
+		Padding:         true,
+	}
+}
+
+// SafariClientHelloSpec returns a ClientHelloSpec mimicking Safari 17.
+func SafariClientHelloSpec() *ClientHelloSpec {
+	return &ClientHelloSpec{
+		CipherSuites: []uint16{
+			GREASEPlaceholder,
+			TLS_AES_128_GCM_SHA256,
+			TLS_AES_256_GCM_SHA384,
+			TLS_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			TLS_RSA_WITH_AES_256_GCM_SHA384,
+			TLS_RSA_WITH_AES_128_GCM_SHA256,
+			TLS_RSA_WITH_AES_256_CBC_SHA,
+			TLS_RSA_WITH_AES_128_CBC_SHA,
+			0xc008, // TLS_ECDHE_ECDSA_WITH_3DES_EDE_CBC_SHA
+			TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+			TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+		Extensions: []uint16{
+			GREASEPlaceholder,
+			extensionServerName,
+			extensionExtendedMasterSecret,
+			extensionRenegotiationInfo,
+			extensionSupportedCurves,
+			extensionSupportedPoints,
+			extensionALPN,
+			extensionStatusRequest,
+			extensionSignatureAlgorithms,
+			extensionSCT,
+			extensionKeyShare,
+			extensionPSKModes,
+			extensionSupportedVersions,
+			extensionCompressCertificate,
+			GREASEPlaceholder,
+			extensionPadding,
+		},
+		SupportedCurves: []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256, CurveP384, CurveP521},
+		KeyShareCurves:  []CurveID{CurveID(GREASEPlaceholder), X25519},
+		SupportedPoints: []uint8{pointFormatUncompressed},
+		SignatureAlgorithms: []SignatureScheme{
+			ECDSAWithP256AndSHA256,
+			PSSWithSHA256,
+			PKCS1WithSHA256,
+			ECDSAWithP384AndSHA384,
+			ECDSAWithSHA1,
+			PSSWithSHA384,
+			PKCS1WithSHA384,
+			PSSWithSHA512,
+			PKCS1WithSHA512,
+			PKCS1WithSHA1,
+		},
+		SupportedVersions: []uint16{
+			GREASEPlaceholder, VersionTLS13, VersionTLS12, VersionTLS11, VersionTLS10,
+		},
+		NextProtos:                []string{"h2", "http/1.1"},
+		CertCompressionAlgorithms: []CertCompressionAlgorithm{CertCompressionZlib},
+		Padding:                   true,
+	}
+}
+
+// clientHelloPaddingLen returns the length of the padding extension data
+// for a ClientHello of length n, or zero if it needs no padding. Like
+// BoringSSL, it pads messages between 256 and 511 bytes long to 512 bytes,
+// to work around servers that hang on them.
+func clientHelloPaddingLen(n int) int {
+	if n <= 0xff || n >= 0x200 {
+		return 0
+	}
+	padding := 0x200 - n
+	if padding >= 4+1 {
+		return padding - 4 // extension header
+	}
+	return 1
+}
+
+// clientHelloPaddingTo returns the length of the padding extension data
+// that pads a ClientHello of length n to the shortest of lengths it fits in,
+// or zero if it fits in none. The extension is never empty, as some servers
+// reject an empty extension at the end of the list.
+func clientHelloPaddingTo(n int, lengths []int) int {
+	best := 0
+	for _, l := range lengths {
+		if padding := l - n - 4; padding >= 1 && padding <= 0xffff && (best == 0 || padding < best) {
+			best = padding
+		}
+	}
+	return best
+}
+
+// greaseValues holds the GREASE values of one ClientHello.
+type greaseValues struct {
+	cipherSuite        uint16
+	group              uint16
+	version            uint16
+	signatureAlgorithm uint16
+	extensions         [2]uint16
+}
+
+// newGREASEValues draws the GREASE values of a ClientHello from rand. The
+// two extension values are distinct, since an extension may only appear
+// once.
+func newGREASEValues(rand io.Reader) (greaseValues, error) {
+	var b [6]byte
+	if _, err := io.ReadFull(rand, b[:]); err != nil {
+		return greaseValues{}, err
+	}
+	value := func(b byte) uint16 { return 0x0a0a | uint16(b&0xf0)<<8 | uint16(b&0xf0) }
+	g := greaseValues{
+		cipherSuite:        value(b[0]),
+		group:              value(b[1]),
+		version:            value(b[2]),
+		signatureAlgorithm: value(b[3]),
+		extensions:         [2]uint16{value(b[4]), value(b[5])},
+	}
+	if g.extensions[1] == g.extensions[0] {
+		g.extensions[1] ^= 0x1010
+	}
+	return g, nil
+}
+
+// applyClientHelloSpec shapes hello after spec. supportedVersions are the
+// versions enabled by the Config. Key shares are left to the caller.
+func (c *Conn) applyClientHelloSpec(hello *clientHelloMsg, spec *ClientHelloSpec, supportedVersions []uint16) (greaseValues, error) {
+	config := c.config
+	grease, err := newGREASEValues(config.rand())
+	if err != nil {
+		return greaseValues{}, errors.New("tls: short read from Rand: " + err.Error())
+	}
+
+	hello.cipherSuites = make([]uint16, 0, len(spec.CipherSuites))
+	for _, suite := range spec.CipherSuites {
+		if suite == GREASEPlaceholder {
+			suite = grease.cipherSuite
+		}
+		hello.cipherSuites = append(hello.cipherSuites, suite)
+	}
+
+	hello.supportedCurves = make([]CurveID, 0, len(spec.SupportedCurves))
+	for _, curve := range spec.SupportedCurves {
+		if curve == CurveID(GREASEPlaceholder) {
+			curve = CurveID(grease.group)
+		}
+		hello.supportedCurves = append(hello.supportedCurves, curve)
+	}
+
+	hello.supportedVersions = nil
+	for _, v := range spec.SupportedVersions {
+		if v == GREASEPlaceholder {
+			hello.supportedVersions = append(hello.supportedVersions, grease.version)
+			continue
+		}
+		for _, sv := range supportedVersions {
+			if v == sv {
+				hello.supportedVersions = append(hello.supportedVersions, v)
+				break
+			}
+		}
+	}
+	if !hello.offersVersion(supportedVersions...) {
+		return greaseValues{}, errors.New("tls: ClientHelloSpec offers no version enabled by the Config")
+	}
+
+	hello.supportedPoints = spec.SupportedPoints
+	hello.supportedSignatureAlgorithms = make([]SignatureScheme, 0, len(spec.SignatureAlgorithms))
+	for _, sigAlg := range spec.SignatureAlgorithms {
+		if sigAlg == SignatureScheme(GREASEPlaceholder) {
+			sigAlg = SignatureScheme(grease.signatureAlgorithm)
+		}
+		hello.supportedSignatureAlgorithms = append(hello.supportedSignatureAlgorithms, sigAlg)
+	}
+	if len(config.NextProtos) == 0 {
+		hello.alpnProtocols = spec.NextProtos
+	}
+
+	listed := make(map[uint16]bool, len(spec.Extensions))
+	for _, ext := range spec.Extensions {
+		listed[ext] = true
+	}
+	hello.ocspStapling = listed[extensionStatusRequest]
+	hello.scts = listed[extensionSCT]
+	hello.ticketSupported = listed[extensionSessionTicket] && !config.SessionTicketsDisabled
+	hello.extendedMasterSecret = listed[extensionExtendedMasterSecret]
+	if c.handshakes == 0 {
+		hello.secureRenegotiationSupported = listed[extensionRenegotiationInfo]
+	}
+	if listed[extensionPSKModes] && hello.offersVersion(VersionTLS13) {
+		hello.pskModes = []uint8{pskModeDHE}
+	}
+	if listed[extensionApplicationSettings] && len(hello.alpnProtocols) > 0 {
+		hello.applicationSettings = spec.ApplicationSettings
+	}
+	if listed[extensionCompressCertificate] {
+		hello.certCompressionAlgorithms = spec.CertCompressionAlgorithms
+	}
+	if listed[extensionDelegatedCredentials] {
+		hello.delegatedCredentials = spec.DelegatedCredentials
+	}
+	if listed[extensionRecordSizeLimit] {
+		hello.recordSizeLimit = spec.RecordSizeLimit
+	}
+	hello.padding = spec.Padding && listed[extensionPadding]
+
+	hello.extensionOrder = make([]uint16, 0, len(spec.Extensions))
+	greaseExtensions := 0
+	for _, ext := range spec.Extensions {
+		if ext == GREASEPlaceholder {
+			ext = grease.extensions[greaseExtensions%2]
+			greaseExtensions++
+		}
+		hello.extensionOrder = append(hello.extensionOrder, ext)
+	}
+	if spec.ShuffleExtensions {
+		if err := shuffleExtensions(hello.extensionOrder, config.rand()); err != nil {
+			return greaseValues{}, err
+		}
+	}
+
+	return grease, nil
+}
+
+// addGREASE adds GREASE values to a ClientHello built from the Config, the
+// way BoringSSL does: first in the cipher suite, supported_groups,
+// supported_versions, key_share and signature_algorithms lists, and as an
+// empty first and a one byte last extension.
+func addGREASE(hello *clientHelloMsg, rand io.Reader) error {
+	grease, err := newGREASEValues(rand)
+	if err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+
+	hello.cipherSuites = append([]uint16{grease.cipherSuite}, hello.cipherSuites...)
+	hello.supportedCurves = append([]CurveID{CurveID(grease.group)}, hello.supportedCurves...)
+	if len(hello.supportedSignatureAlgorithms) > 0 {
+		hello.supportedSignatureAlgorithms = append([]SignatureScheme{SignatureScheme(grease.signatureAlgorithm)},
+			hello.supportedSignatureAlgorithms...)
+	}
+	if hello.offersVersion(VersionTLS13) {
+		hello.supportedVersions = append([]uint16{grease.version}, hello.supportedVersions...)
+		hello.keyShares = append([]keyShare{{group: CurveID(grease.group), data: []byte{0}}}, hello.keyShares...)
+	}
+
+	hello.extensionOrder = make([]uint16, 0, len(defaultExtensionOrder)+2)
+	hello.extensionOrder = append(hello.extensionOrder, grease.extensions[0])
+	hello.extensionOrder = append(hello.extensionOrder, defaultExtensionOrder...)
+	hello.extensionOrder = append(hello.extensionOrder, grease.extensions[1])
+	return nil
+}
+
+// shuffleExtensions permutes order in place, leaving GREASE, padding and
+// pre_shared_key where they are.
+func shuffleExtensions(order []uint16, rand io.Reader) error {
+	var movable []int
+	for i, ext := range order {
+		if !isGREASE(ext) && ext != extensionPadding && ext != extensionPreSharedKey {
+			movable = append(movable, i)
+		}
+	}
+	var seed [8]byte
+	if _, err := io.ReadFull(rand, seed[:]); err != nil {
+		return errors.New("tls: short read from Rand: " + err.Error())
+	}
+	var s int64
+	for _, b := range seed {
+		s = s<<8 | int64(b)
+	}
+	r := mathrand.New(mathrand.NewSource(s))
+	r.Shuffle(len(movable), func(i, j int) {
+		order[movable[i]], order[movable[j]] = order[movable[j]], order[movable[i]]
+	})
+	return nil
+}
+
+// offersVersion reports whether the ClientHello offers any of versions in
+// supported_versions.
+func (m *clientHelloMsg) offersVersion(versions ...uint16) bool {
+	for _, v := range m.supportedVersions {
+		for _, want := range versions {
+			if v == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// makeClientHelloFromSpec finishes a ClientHello prepared by makeClientHello
+// according to spec, generating a key share for every implemented group in
+// spec.KeyShareCurves. GREASE groups get a single zero byte of key share
+// data, like Chrome sends.
+func (c *Conn) makeClientHelloFromSpec(hello *clientHelloMsg, spec *ClientHelloSpec, supportedVersions []uint16) (*clientHelloMsg, []ecdheParameters, error) {
+	grease, err := c.applyClientHelloSpec(hello, spec, supportedVersions)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hello.offersVersion(VersionTLS13) {
+		return hello, nil, nil
+	}
+
+	var params []ecdheParameters
+	for _, curveID := range spec.KeyShareCurves {
+		if curveID == CurveID(GREASEPlaceholder) {
+			hello.keyShares = append(hello.keyShares, keyShare{group: CurveID(grease.group), data: []byte{0}})
+			continue
+		}
+		if _, ok := curveForCurveID(curveID); curveID != X25519 && !ok {
+			continue
+		}
+		p, err := generateECDHEParameters(c.config.rand(), curveID)
+		if err != nil {
+			return nil, nil, err
+		}
+		hello.keyShares = append(hello.keyShares, keyShare{group: curveID, data: p.PublicKey()})
+		params = append(params, p)
+	}
+	if len(params) == 0 {
+		return nil, nil, errors.New("tls: ClientHelloSpec has no key share for an implemented group")
+	}
+	return hello, params, nil
+}
+
+// ChangeCipherSpecMode selects when a TLS 1.3 server sends the dummy
+// ChangeCipherSpec record of middlebox compatibility mode. See RFC 8446,
+// Appendix D.4.
+type ChangeCipherSpecMode int
+
+const (
+	// CCSAlways sends it right after the ServerHello or HelloRetryRequest,
+	// like this package does by default.
+	CCSAlways ChangeCipherSpecMode = iota
+	// CCSCompat sends it only if the client asked for compatibility mode
+	// with a non-empty legacy_session_id, like OpenSSL and BoringSSL.
+	CCSCompat
+	// CCSNever never sends it.
+	CCSNever
+)
+
+// ServerHelloSpec describes the shape of a server's handshake, so that it
+// looks like a common server stack rather than this package. Start from one
+// of the presets, such as NginxServerHelloSpec.
+type ServerHelloSpec struct {
+	// ServerHelloExtensions and EncryptedExtensions are the orders in which
+	// the extensions of those messages go on the wire. Extensions that are
+	// not listed follow in the default order.
+	ServerHelloExtensions []uint16
+	EncryptedExtensions   []uint16
+
+	// AcknowledgeServerName answers a client's server_name with an empty
+	// extension, in the ServerHello of a full TLS 1.2 handshake or in the
+	// EncryptedExtensions of TLS 1.3.
+	AcknowledgeServerName bool
+
+	// SessionTickets is the number of tickets sent after a TLS 1.3
+	// handshake. Zero means one.
+	SessionTickets int
+
+	// TicketLifetime is the lifetime advertised for session tickets. Zero
+	// means seven days for TLS 1.3 and no hint for TLS 1.2. It is capped
+	// at seven days.
+	TicketLifetime time.Duration
+
+	// TicketSize pads TLS 1.3 session tickets to at least this many bytes.
+	TicketSize int
+
+	// ChangeCipherSpec selects when the dummy ChangeCipherSpec is sent.
+	ChangeCipherSpec ChangeCipherSpecMode
+}
+
+// NginxServerHelloSpec returns a ServerHelloSpec approximating nginx on
+// OpenSSL 3 with its default session settings.
+func NginxServerHelloSpec() *ServerHelloSpec {
+	return &ServerHelloSpec{
+		ServerHelloExtensions: []uint16{
+			extensionRenegotiationInfo,
+			extensionServerName,
+			extensionSupportedPoints,
+			extensionSessionTicket,
+			extensionStatusRequest,
+			extensionALPN,
+			extensionSCT,
+			extensionSupportedVersions,
+			extensionKeyShare,
+			extensionPreSharedKey,
+		},
+		EncryptedExtensions:   []uint16{extensionServerName, extensionALPN},
+		AcknowledgeServerName: true,
+		SessionTickets:        2,
+		TicketLifetime:        5 * time.Minute,
+		TicketSize:            240,
+		ChangeCipherSpec:      CCSCompat,
+	}
+}
+
+// CloudflareServerHelloSpec returns a ServerHelloSpec approximating a
+// BoringSSL-based edge such as Cloudflare's.
+func CloudflareServerHelloSpec() *ServerHelloSpec {
+	return &ServerHelloSpec{
+		ServerHelloExtensions: []uint16{
+			extensionRenegotiationInfo,
+			extensionServerName,
+			extensionSessionTicket,
+			extensionStatusRequest,
+			extensionSCT,
+			extensionALPN,
+			extensionSupportedPoints,
+			extensionPreSharedKey,
+			extensionKeyShare,
+			extensionSupportedVersions,
+		},
+		EncryptedExtensions:   []uint16{extensionServerName, extensionALPN},
+		AcknowledgeServerName: true,
+		SessionTickets:        2,
+		TicketLifetime:        18 * time.Hour,
+		TicketSize:            192,
+		ChangeCipherSpec:      CCSCompat,
+	}
+}
+
+// ticketLifetime returns the lifetime advertised for session tickets of
+// version vers, in seconds.
+func (s *ServerHelloSpec) ticketLifetime(vers uint16) uint32 {
+	lifetime := maxSessionTicketLifetime
+	if vers < VersionTLS13 {
+		lifetime = 0
+	}
+	if s != nil && s.TicketLifetime > 0 && s.TicketLifetime < maxSessionTicketLifetime {
+		lifetime = s.TicketLifetime
+	}
+	return uint32(lifetime / time.Second)
+}
+
+// sessionTickets returns the number of tickets sent after a TLS 1.3
+// handshake.
+func (s *ServerHelloSpec) sessionTickets() int {
+	if s == nil || s.SessionTickets <= 0 {
+		return 1
+	}
+	return s.SessionTickets
+}
+
+// sendsDummyCCS reports whether a TLS 1.3 server answering hello sends the
+// dummy ChangeCipherSpec record.
+func (s *ServerHelloSpec) sendsDummyCCS(hello *clientHelloMsg) bool {
+	if s == nil {
+		return true
+	}
+	switch s.ChangeCipherSpec {
+	case CCSCompat:
+		return len(hello.sessionId) > 0
+	case CCSNever:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,609 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+func testCertificate(t *testing.T) Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// recordingConn keeps a copy of everything written to it.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+// firstHandshakeMessage returns the first handshake message in a stream of
+// unencrypted records.
+func firstHandshakeMessage(t *testing.T, stream []byte) []byte {
+	t.Helper()
+	var msg []byte
+	for len(stream) >= recordHeaderLen {
+		n := int(stream[3])<<8 | int(stream[4])
+		if stream[0] != byte(recordTypeHandshake) || len(stream) < recordHeaderLen+n {
+			break
+		}
+		msg = append(msg, stream[recordHeaderLen:recordHeaderLen+n]...)
+		stream = stream[recordHeaderLen+n:]
+		if len(msg) >= 4 && len(msg) >= 4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3])) {
+			return msg[:4+(int(msg[1])<<16|int(msg[2])<<8|int(msg[3]))]
+		}
+	}
+	t.Fatal("no complete handshake message in the client's first flight")
+	return nil
+}
+
+// extensionIDs returns the extension code points of a marshaled ClientHello
+// in wire order.
+func extensionIDs(t *testing.T, hello []byte) []uint16 {
+	t.Helper()
+	s := cryptobyte.String(hello)
+	var skip, extensions cryptobyte.String
+	if !s.Skip(4+2+32) || !s.ReadUint8LengthPrefixed(&skip) ||
+		!s.ReadUint16LengthPrefixed(&skip) || !s.ReadUint8LengthPrefixed(&skip) ||
+		!s.ReadUint16LengthPrefixed(&extensions) {
+		t.Fatal("malformed ClientHello")
+	}
+	var ids []uint16
+	for !extensions.Empty() {
+		var id uint16
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&skip) {
+			t.Fatal("malformed ClientHello extensions")
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestClientHelloSpecRoundTrip(t *testing.T) {
+	cert := testCertificate(t)
+	specs := map[string]func() *ClientHelloSpec{
+		"Chrome":  ChromeClientHelloSpec,
+		"Firefox": FirefoxClientHelloSpec,
+		"Safari":  SafariClientHelloSpec,
+	}
+	for name, newSpec := range specs {
+		for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+			spec := newSpec()
+			c, s := net.Pipe()
+			rc := &recordingConn{Conn: c}
+			client := Client(rc, &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientHelloSpec: spec})
+			server := Server(s, &Config{Certificates: []Certificate{cert}, MaxVersion: vers})
+
+			msg := []byte("hello through a browser fingerprint")
+			errc := make(chan error, 1)
+			go func() {
+				buf := make([]byte, len(msg))
+				if _, err := io.ReadFull(server, buf); err != nil {
+					errc <- err
+					return
+				}
+				_, err := server.Write(buf)
+				errc <- err
+			}()
+
+			if _, err := client.Write(msg); err != nil {
+				t.Fatalf("%s/%x: client write: %v", name, vers, err)
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(client, buf); err != nil {
+				t.Fatalf("%s/%x: client read: %v", name, vers, err)
+			}
+			if !bytes.Equal(buf, msg) {
+				t.Errorf("%s/%x: got %q, want %q", name, vers, buf, msg)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("%s/%x: server: %v", name, vers, err)
+			}
+			if got := client.ConnectionState().Version; got != vers {
+				t.Errorf("%s/%x: negotiated version %x", name, vers, got)
+			}
+			// Nobody reads the close_notify alerts off the pipe.
+			s.Close()
+			client.Close()
+			server.Close()
+
+			hello := firstHandshakeMessage(t, rc.written.Bytes())
+			var m clientHelloMsg
+			if !m.unmarshal(hello) {
+				t.Fatalf("%s: server-side parser rejected the ClientHello", name)
+			}
+			checkClientHelloShape(t, name, spec, &m, extensionIDs(t, hello))
+		}
+	}
+}
+
+// checkClientHelloShape checks a parsed ClientHello and its extension order
+// against the spec it was built from.
+func checkClientHelloShape(t *testing.T, name string, spec *ClientHelloSpec, m *clientHelloMsg, ids []uint16) {
+	t.Helper()
+	if len(m.cipherSuites) != len(spec.CipherSuites) {
+		t.Fatalf("%s: %d cipher suites, want %d", name, len(m.cipherSuites), len(spec.CipherSuites))
+	}
+	for i, suite := range spec.CipherSuites {
+		got := m.cipherSuites[i]
+		if suite == GREASEPlaceholder && !isGREASE(got) || suite != GREASEPlaceholder && got != suite {
+			t.Errorf("%s: cipher suite %d is %#04x, want %#04x", name, i, got, suite)
+		}
+	}
+	for i, curve := range spec.SupportedCurves {
+		got := m.supportedCurves[i]
+		if curve == CurveID(GREASEPlaceholder) && !isGREASE(uint16(got)) || curve != CurveID(GREASEPlaceholder) && got != curve {
+			t.Errorf("%s: group %d is %#04x, want %#04x", name, i, got, curve)
+		}
+	}
+
+	var want []uint16
+	for _, ext := range spec.Extensions {
+		// The padding extension is only sent when needed, and no session is
+		// resumed, so pre_shared_key is never sent.
+		if ext != extensionPadding && ext != extensionPreSharedKey {
+			want = append(want, ext)
+		}
+	}
+	var got []uint16
+	for _, ext := range ids {
+		if ext == extensionPadding {
+			continue
+		}
+		if isGREASE(ext) {
+			ext = GREASEPlaceholder
+		}
+		got = append(got, ext)
+	}
+	if spec.ShuffleExtensions {
+		sortUint16s(want)
+		sortUint16s(got)
+	}
+	if !equalUint16s(got, want) {
+		t.Errorf("%s: extensions %v, want %v", name, got, want)
+	}
+	if len(m.raw) > 0xff && len(m.raw) < 0x200 {
+		t.Errorf("%s: ClientHello of %d bytes was not padded", name, len(m.raw))
+	}
+}
+
+func sortUint16s(s []uint16) {
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+}
+
+func equalUint16s(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// handshakeRecorded completes a handshake and an echo between client and
+// server configs over loopback TCP, and returns the ClientHello, the first
+// message of the server and the client's view of the connection. Unlike a
+// pipe, TCP buffers the server's flight after a HelloRetryRequest.
+func handshakeRecorded(t *testing.T, clientConfig, serverConfig *Config) (clientHello, serverHello []byte, state ConnectionState) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		s, _ := ln.Accept()
+		accepted <- s
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	rc, rs := &recordingConn{Conn: c}, &recordingConn{Conn: s}
+	client, server := Client(rc, clientConfig), Server(rs, serverConfig)
+
+	msg := []byte("hello, GREASE")
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(msg))
+		if _, err := io.ReadFull(server, buf); err != nil {
+			errc <- err
+			return
+		}
+		_, err := server.Write(buf)
+		errc <- err
+	}()
+
+	if _, err := client.Write(msg); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(client, buf); err != nil {
+		t.Fatalf("client read: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server: %v", err)
+	}
+	state = client.ConnectionState()
+	client.Close()
+	server.Close()
+
+	return firstHandshakeMessage(t, rc.written.Bytes()), firstHandshakeMessage(t, rs.written.Bytes()), state
+}
+
+func TestGREASE(t *testing.T) {
+	cert := testCertificate(t)
+	for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+		clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true, GREASE: true}
+		serverConfig := &Config{Certificates: []Certificate{cert}, MaxVersion: vers}
+		hello, _, state := handshakeRecorded(t, clientConfig, serverConfig)
+		if state.Version != vers {
+			t.Errorf("%x: negotiated version %x", vers, state.Version)
+		}
+		if isGREASE(state.CipherSuite) {
+			t.Errorf("%x: negotiated GREASE cipher suite %#04x", vers, state.CipherSuite)
+		}
+
+		var m clientHelloMsg
+		if !m.unmarshal(hello) {
+			t.Fatalf("%x: server-side parser rejected the ClientHello", vers)
+		}
+		if !isGREASE(m.cipherSuites[0]) {
+			t.Errorf("%x: first cipher suite is %#04x", vers, m.cipherSuites[0])
+		}
+		if !isGREASE(uint16(m.supportedCurves[0])) {
+			t.Errorf("%x: first group is %#04x", vers, m.supportedCurves[0])
+		}
+		if !isGREASE(uint16(m.supportedSignatureAlgorithms[0])) {
+			t.Errorf("%x: first signature algorithm is %#04x", vers, m.supportedSignatureAlgorithms[0])
+		}
+		if !isGREASE(m.supportedVersions[0]) {
+			t.Errorf("%x: first version is %#04x", vers, m.supportedVersions[0])
+		}
+		if len(m.keyShares) != 2 || m.keyShares[0].group != m.supportedCurves[0] {
+			t.Errorf("%x: key shares %v do not start with the GREASE group", vers, m.keyShares)
+		}
+		ids := extensionIDs(t, hello)
+		if !isGREASE(ids[0]) || !isGREASE(ids[len(ids)-1]) || ids[0] == ids[len(ids)-1] {
+			t.Errorf("%x: extensions %v are not framed by two GREASE extensions", vers, ids)
+		}
+	}
+}
+
+func TestServerIgnoresGREASE(t *testing.T) {
+	cert := testCertificate(t)
+	spec := &ClientHelloSpec{
+		CipherSuites: []uint16{GREASEPlaceholder, TLS_AES_128_GCM_SHA256, GREASEPlaceholder,
+			TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		Extensions: []uint16{GREASEPlaceholder, extensionServerName, extensionSupportedCurves,
+			extensionSupportedPoints, extensionSignatureAlgorithms, extensionSupportedVersions,
+			extensionKeyShare, extensionPSKModes, GREASEPlaceholder},
+		SupportedCurves: []CurveID{CurveID(GREASEPlaceholder), X25519, CurveP256},
+		KeyShareCurves:  []CurveID{CurveID(GREASEPlaceholder), X25519},
+		SupportedPoints: []uint8{pointFormatUncompressed},
+		SignatureAlgorithms: []SignatureScheme{SignatureScheme(GREASEPlaceholder),
+			ECDSAWithP256AndSHA256, PSSWithSHA256},
+		SupportedVersions: []uint16{GREASEPlaceholder, VersionTLS13, VersionTLS12},
+	}
+
+	tests := []struct {
+		name      string
+		vers      uint16
+		curves    []CurveID
+		wantGroup CurveID
+		wantHRR   bool
+	}{
+		{"TLS12", VersionTLS12, nil, 0, false},
+		{"TLS13", VersionTLS13, nil, X25519, false},
+		// The GREASE key share must not satisfy the server, which has to ask
+		// for one of the real groups the client listed.
+		{"TLS13-HRR", VersionTLS13, []CurveID{CurveP256}, CurveP256, true},
+	}
+	for _, test := range tests {
+		clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientHelloSpec: spec}
+		serverConfig := &Config{Certificates: []Certificate{cert}, MaxVersion: test.vers, CurvePreferences: test.curves}
+		_, first, state := handshakeRecorded(t, clientConfig, serverConfig)
+		if state.Version != test.vers {
+			t.Errorf("%s: negotiated version %x", test.name, state.Version)
+		}
+
+		var m serverHelloMsg
+		if !m.unmarshal(first) {
+			t.Fatalf("%s: malformed ServerHello", test.name)
+		}
+		if isGREASE(m.cipherSuite) {
+			t.Errorf("%s: server selected GREASE cipher suite %#04x", test.name, m.cipherSuite)
+		}
+		if test.vers < VersionTLS13 {
+			continue
+		}
+		if gotHRR := bytes.Equal(m.random, helloRetryRequestRandom); gotHRR != test.wantHRR {
+			t.Errorf("%s: HelloRetryRequest sent: %v, want %v", test.name, gotHRR, test.wantHRR)
+		}
+		group := m.serverShare.group
+		if test.wantHRR {
+			group = m.selectedGroup
+		}
+		if group != test.wantGroup {
+			t.Errorf("%s: server selected group %#04x, want %#04x", test.name, group, test.wantGroup)
+		}
+	}
+}
+
+// serverHelloExtensionIDs returns the extension code points of a marshaled
+// ServerHello in wire order.
+func serverHelloExtensionIDs(t *testing.T, hello []byte) []uint16 {
+	t.Helper()
+	s := cryptobyte.String(hello)
+	var skip, extensions cryptobyte.String
+	if !s.Skip(4+2+32) || !s.ReadUint8LengthPrefixed(&skip) || !s.Skip(2+1) ||
+		!s.ReadUint16LengthPrefixed(&extensions) {
+		t.Fatal("malformed ServerHello")
+	}
+	var ids []uint16
+	for !extensions.Empty() {
+		var id uint16
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&skip) {
+			t.Fatal("malformed ServerHello extensions")
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// checkExtensionOrder fails the test unless ids follow order, which lists
+// every one of them.
+func checkExtensionOrder(t *testing.T, name string, ids, order []uint16) {
+	t.Helper()
+	rest := order
+	for _, id := range ids {
+		i := slices.Index(rest, id)
+		if i < 0 {
+			t.Errorf("%s: extensions %v do not follow %v", name, ids, order)
+			return
+		}
+		rest = rest[i+1:]
+	}
+}
+
+// sessionListCache keeps every session it is given.
+type sessionListCache struct {
+	sessions []*ClientSessionState
+}
+
+func (c *sessionListCache) Get(string) (*ClientSessionState, bool) {
+	if len(c.sessions) == 0 {
+		return nil, false
+	}
+	return c.sessions[len(c.sessions)-1], true
+}
+
+func (c *sessionListCache) Put(_ string, session *ClientSessionState) {
+	if session != nil {
+		c.sessions = append(c.sessions, session)
+	}
+}
+
+func TestServerHelloSpec(t *testing.T) {
+	cert := testCertificate(t)
+	for name, spec := range map[string]*ServerHelloSpec{
+		"nginx":      NginxServerHelloSpec(),
+		"cloudflare": CloudflareServerHelloSpec(),
+	} {
+		for _, vers := range []uint16{VersionTLS12, VersionTLS13} {
+			name := fmt.Sprintf("%s/%x", name, vers)
+			cache := new(sessionListCache)
+			clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache}
+			serverConfig := &Config{Certificates: []Certificate{cert}, MaxVersion: vers, ServerHelloSpec: spec}
+			_, hello, state := handshakeRecorded(t, clientConfig, serverConfig)
+			if state.Version != vers {
+				t.Fatalf("%s: negotiated version %x", name, state.Version)
+			}
+
+			ids := serverHelloExtensionIDs(t, hello)
+			checkExtensionOrder(t, name, ids, spec.ServerHelloExtensions)
+			if vers == VersionTLS12 && !slices.Contains(ids, extensionServerName) {
+				t.Errorf("%s: server_name not acknowledged in %v", name, ids)
+			}
+			if vers != VersionTLS13 {
+				continue
+			}
+
+			if len(cache.sessions) != spec.SessionTickets {
+				t.Fatalf("%s: received %d tickets, want %d", name, len(cache.sessions), spec.SessionTickets)
+			}
+			for _, session := range cache.sessions {
+				if lifetime := session.useBy.Sub(session.receivedAt).Round(time.Second); lifetime != spec.TicketLifetime {
+					t.Errorf("%s: ticket lifetime %v, want %v", name, lifetime, spec.TicketLifetime)
+				}
+				if len(session.sessionTicket) < spec.TicketSize {
+					t.Errorf("%s: ticket of %d bytes, want at least %d", name, len(session.sessionTicket), spec.TicketSize)
+				}
+			}
+			if bytes.Equal(cache.sessions[0].nonce, cache.sessions[1].nonce) {
+				t.Errorf("%s: tickets share the nonce %x", name, cache.sessions[0].nonce)
+			}
+
+			// Resume with the last ticket, whose PSK depends on its nonce.
+			if _, _, state := handshakeRecorded(t, clientConfig, serverConfig); !state.DidResume {
+				t.Errorf("%s: session not resumed", name)
+			}
+		}
+	}
+}
+
+func TestEncryptedExtensionsOrder(t *testing.T) {
+	m := &encryptedExtensionsMsg{
+		alpnProtocol:   "h2",
+		earlyData:      true,
+		serverNameAck:  true,
+		extensionOrder: []uint16{extensionEarlyData, extensionALPN},
+	}
+	s := cryptobyte.String(m.marshal())
+	var extensions, skip cryptobyte.String
+	if !s.Skip(4) || !s.ReadUint16LengthPrefixed(&extensions) {
+		t.Fatal("malformed EncryptedExtensions")
+	}
+	var ids []uint16
+	for !extensions.Empty() {
+		var id uint16
+		if !extensions.ReadUint16(&id) || !extensions.ReadUint16LengthPrefixed(&skip) {
+			t.Fatal("malformed EncryptedExtensions extensions")
+		}
+		ids = append(ids, id)
+	}
+	// The listed extensions come first, then the others in the default
+	// order.
+	if want := []uint16{extensionEarlyData, extensionALPN, extensionServerName}; !slices.Equal(ids, want) {
+		t.Errorf("extensions %v, want %v", ids, want)
+	}
+
+	var parsed encryptedExtensionsMsg
+	if !parsed.unmarshal(m.marshal()) || parsed.alpnProtocol != "h2" || !parsed.earlyData {
+		t.Errorf("client parsed %+v", parsed)
+	}
+}
+
+func TestServerChangeCipherSpec(t *testing.T) {
+	compat := &clientHelloMsg{sessionId: make([]byte, 32)}
+	plain := &clientHelloMsg{}
+	for _, tt := range []struct {
+		spec          *ServerHelloSpec
+		compat, plain bool
+	}{
+		{nil, true, true},
+		{&ServerHelloSpec{ChangeCipherSpec: CCSAlways}, true, true},
+		{&ServerHelloSpec{ChangeCipherSpec: CCSCompat}, true, false},
+		{&ServerHelloSpec{ChangeCipherSpec: CCSNever}, false, false},
+	} {
+		if got := tt.spec.sendsDummyCCS(compat); got != tt.compat {
+			t.Errorf("%+v: dummy ChangeCipherSpec for a compatibility mode client: %v, want %v", tt.spec, got, tt.compat)
+		}
+		if got := tt.spec.sendsDummyCCS(plain); got != tt.plain {
+			t.Errorf("%+v: dummy ChangeCipherSpec for another client: %v, want %v", tt.spec, got, tt.plain)
+		}
+	}
+}
+
+func TestServerHelloSpecTicketLifetime(t *testing.T) {
+	for _, tt := range []struct {
+		spec *ServerHelloSpec
+		vers uint16
+		want uint32
+	}{
+		{nil, VersionTLS13, uint32(maxSessionTicketLifetime / time.Second)},
+		{nil, VersionTLS12, 0},
+		{&ServerHelloSpec{TicketLifetime: time.Hour}, VersionTLS12, 3600},
+		{&ServerHelloSpec{TicketLifetime: time.Hour}, VersionTLS13, 3600},
+		{&ServerHelloSpec{TicketLifetime: 30 * 24 * time.Hour}, VersionTLS13, uint32(maxSessionTicketLifetime / time.Second)},
+	} {
+		if got := tt.spec.ticketLifetime(tt.vers); got != tt.want {
+			t.Errorf("%+v: lifetime of a %x ticket %d, want %d", tt.spec, tt.vers, got, tt.want)
+		}
+	}
+}
+
+func TestClientHelloPaddingTo(t *testing.T) {
+	for _, tt := range []struct {
+		n       int
+		lengths []int
+		want    int
+	}{
+		{300, []int{1024, 512, 256}, 512 - 300 - 4},
+		{300, []int{256}, 0},
+		// The extension header alone does not fit, nor an empty extension.
+		{508, []int{512}, 0},
+		{507, []int{512}, 1},
+		{507, []int{512, 600}, 1},
+		{300, []int{300 + 4 + 0x10000}, 0},
+		{300, nil, 0},
+	} {
+		if got := clientHelloPaddingTo(tt.n, tt.lengths); got != tt.want {
+			t.Errorf("clientHelloPaddingTo(%d, %v) = %d, want %d", tt.n, tt.lengths, got, tt.want)
+		}
+	}
+}
+
+func TestClientHelloLengths(t *testing.T) {
+	cert := testCertificate(t)
+	for _, tt := range []struct {
+		name    string
+		spec    *ClientHelloSpec
+		lengths []int
+		// want is the length of the ClientHello, or zero if it is not
+		// padded.
+		want int
+	}{
+		{"Fits", nil, []int{256, 1024, 700}, 700},
+		{"TooLong", nil, []int{100, 200}, 0},
+		{"OverSpec", ChromeClientHelloSpec(), []int{1024}, 1024},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConfig := &Config{
+				ServerName:         "example.com",
+				InsecureSkipVerify: true,
+				ClientHelloSpec:    tt.spec,
+				ClientHelloLengths: tt.lengths,
+				ClientSessionCache: NewLRUClientSessionCache(1),
+			}
+			serverConfig := &Config{Certificates: []Certificate{cert}}
+			for _, resume := range []bool{false, true} {
+				hello, _, state := handshakeRecorded(t, clientConfig, serverConfig)
+				if state.DidResume != resume {
+					t.Fatalf("resumed: %v, want %v", state.DidResume, resume)
+				}
+				var m clientHelloMsg
+				if !m.unmarshal(hello) {
+					t.Fatal("server-side parser rejected the ClientHello")
+				}
+				switch {
+				case tt.want == 0 && m.paddingLen != 0:
+					t.Errorf("resumed: %v: ClientHello of %d bytes padded by %d", resume, len(hello), m.paddingLen)
+				case tt.want != 0 && len(hello) != tt.want:
+					t.Errorf("resumed: %v: ClientHello of %d bytes, want %d", resume, len(hello), tt.want)
+				}
+			}
+		})
+	}
+}
@@ -34,7 +34,9 @@ type clientHandshakeState struct {
 	session      *ClientSessionState
 }
 
-func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
+// makeClientHello returns the ClientHello to send and, if it offers TLS 1.3,
+// the parameters of its key shares.
+func (c *Conn) makeClientHello() (*clientHelloMsg, []ecdheParameters, error) {
 	config := c.config
 	if len(config.ServerName) == 0 && !config.InsecureSkipVerify {
 		return nil, nil, errors.New("tls: either ServerName or InsecureSkipVerify must be specified in the tls.Config")
@@ -115,12 +117,25 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 	if _, err := io.ReadFull(config.rand(), hello.sessionId); err != nil {
 		return nil, nil, errors.New("tls: short read from Rand: " + err.Error())
 	}
+	// A Disguise client replaces it with a token proving knowledge of the
+	// shared key at the current time. The token is a MAC and looks just as
+	// random.
+	if keys := config.disguiseKeys(); len(keys) > 0 {
+		c.disguiseKey = keys[0]
+		copy(hello.sessionId, disguiseToken(c.disguiseKey, hello.random, config.time()))
+	}
 
 	if hello.vers >= VersionTLS12 {
 		hello.supportedSignatureAlgorithms = supportedSignatureAlgorithms
 	}
 
-	var params ecdheParameters
+	hello.paddingLengths = config.ClientHelloLengths
+
+	if spec := config.ClientHelloSpec; spec != nil {
+		return c.makeClientHelloFromSpec(hello, spec, supportedVersions)
+	}
+
+	var keyShareParams []ecdheParameters
 	if hello.supportedVersions[0] == VersionTLS13 {
 		if hasAESGCMHardwareSupport {
 			hello.cipherSuites = append(hello.cipherSuites, defaultCipherSuitesTLS13...)
@@ -132,14 +147,21 @@ func (c *Conn) makeClientHello() (*clientHelloMsg, ecdheParameters, error) {
 		if _, ok := curveForCurveID(curveID); curveID != X25519 && !ok {
 			return nil, nil, errors.New("tls: CurvePreferences includes unsupported curve")
 		}
-		params, err = generateECDHEParameters(config.rand(), curveID)
+		params, err := generateECDHEParameters(config.rand(), curveID)
 		if err != nil {
 			return nil, nil, err
 		}
 		hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
+		keyShareParams = []ecdheParameters{params}
 	}
 
-	return hello, params, nil
+	if config.GREASE {
+		if err := addGREASE(hello, config.rand()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return hello, keyShareParams, nil
 }
 
 func (c *Conn) clientHandshake(ctx context.Context) (err error) {
@@ -151,12 +173,19 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	// need to be reset.
 	c.didResume = false
 
-	hello, ecdheParams, err := c.makeClientHello()
+	hello, keyShareParams, err := c.makeClientHello()
 	if err != nil {
 		return err
 	}
 	c.serverName = hello.serverName
 
+	var ech *echClientContext
+	if c.config.EncryptedClientHelloConfigList != nil {
+		if ech, err = c.prepareECH(hello); err != nil {
+			return err
+		}
+	}
+
 	cacheKey, session, earlySecret, binderKey := c.loadSession(hello)
 	if cacheKey != "" && session != nil {
 		defer func() {
@@ -172,10 +201,33 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 		}()
 	}
 
-	if _, err := c.writeRecord(recordTypeHandshake, hello.marshal()); err != nil {
+	helloBytes := hello.marshal()
+	if ech != nil {
+		// The ClientHelloInner is what the handshake continues with if the
+		// server accepts it, but only the ClientHelloOuter is sent.
+		if err := ech.sealOuter(hello); err != nil {
+			return err
+		}
+		helloBytes = ech.outer.marshal()
+	}
+	if _, err := c.writeRecord(recordTypeHandshake, helloBytes); err != nil {
 		return err
 	}
 
+	var early *clientEarlyData
+	if hello.earlyData {
+		if early, err = c.sendEarlyData(hello, session, earlySecret); err != nil {
+			return err
+		}
+		if early.manager != nil {
+			defer func() {
+				if err != nil {
+					early.manager.Close()
+				}
+			}()
+		}
+	}
+
 	msg, err := c.readHandshake()
 	if err != nil {
 		return err
@@ -205,18 +257,36 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 
 	if c.vers == VersionTLS13 {
 		hs := &clientHandshakeStateTLS13{
-			c:           c,
-			ctx:         ctx,
-			serverHello: serverHello,
-			hello:       hello,
-			ecdheParams: ecdheParams,
-			session:     session,
-			earlySecret: earlySecret,
-			binderKey:   binderKey,
+			c:              c,
+			ctx:            ctx,
+			serverHello:    serverHello,
+			hello:          hello,
+			keyShareParams: keyShareParams,
+			session:        session,
+			earlySecret:    earlySecret,
+			binderKey:      binderKey,
+			echContext:     ech,
+			earlyData:      early,
 		}
 
 		// In TLS 1.3, session tickets are delivered after the handshake.
-		return hs.handshake()
+		if err := hs.handshake(); err != nil {
+			return err
+		}
+		c.sendLeftoverEarlyData(early)
+		return nil
+	}
+
+	if early != nil && early.manager != nil {
+		// Early data is never accepted by a TLS 1.2 server.
+		early.manager.Close()
+	}
+
+	if ech != nil {
+		// The ClientHelloInner only offers TLS 1.3, so the server negotiated
+		// an older version with the ClientHelloOuter.
+		hello, session = ech.outer, nil
+		c.echPublicName = ech.config.publicName
 	}
 
 	hs := &clientHandshakeState{
@@ -234,9 +304,12 @@ func (c *Conn) clientHandshake(ctx context.Context) (err error) {
 	// If we had a successful handshake and hs.session is different from
 	// the one already cached - cache a new one.
 	if cacheKey != "" && hs.session != nil && session != hs.session {
+		// The ticket arrived before Disguise was confirmed.
+		hs.session.disguise = c.disguiseSession()
 		c.config.ClientSessionCache.Put(cacheKey, hs.session)
 	}
 
+	c.sendLeftoverEarlyData(nil)
 	return nil
 }
 
@@ -248,7 +321,7 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 
 	hello.ticketSupported = true
 
-	if hello.supportedVersions[0] == VersionTLS13 {
+	if hello.offersVersion(VersionTLS13) {
 		// Require DHE on resumption as it guarantees forward secrecy against
 		// compromise of the session ticket key. See RFC 8446, Section 4.2.9.
 		hello.pskModes = []uint8{pskModeDHE}
@@ -334,6 +407,9 @@ func (c *Conn) loadSession(hello *clientHelloMsg) (cacheKey string,
 		return cacheKey, nil, nil, nil
 	}
 
+	// The early_data extension is covered by the binder.
+	hello.earlyData = c.offerEarlyData(session)
+
 	// Set the pre_shared_key extension. See RFC 8446, Section 4.2.11.1.
 	ticketAge := uint32(c.config.time().Sub(session.receivedAt) / time.Millisecond)
 	identity := pskIdentity{
@@ -385,6 +461,10 @@ func (hs *clientHandshakeState) handshake() error {
 	if err != nil {
 		return err
 	}
+	// The confirmation is authenticated by the Finished messages, like the
+	// rest of the server random, but is known early so that VerifyConnection
+	// sees it.
+	c.checkDisguiseConfirmation(hs.hello.random, hs.serverHello.random)
 
 	hs.finishedHash = newFinishedHash(c.vers, hs.suite)
 
@@ -402,6 +482,7 @@ func (hs *clientHandshakeState) handshake() error {
 	c.buffering = true
 	c.didResume = isResume
 	if isResume {
+		c.disguiseResumed = hs.session.disguise
 		if err := hs.establishKeys(); err != nil {
 			return err
 		}
@@ -450,6 +531,12 @@ func (hs *clientHandshakeState) handshake() error {
 	}
 
 	c.ekm = ekmFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.hello.random, hs.serverHello.random)
+	if c.echPublicName != "" {
+		return c.echRejectionError(nil)
+	}
+	if err := c.initDisguise(); err != nil {
+		return err
+	}
 	atomic.StoreUint32(&c.handshakeStatus, 1)
 
 	return nil
@@ -861,6 +948,9 @@ func (c *Conn) verifyServerCertificate(certificates [][]byte) error {
 			DNSName:       c.config.ServerName,
 			Intermediates: x509.NewCertPool(),
 		}
+		if c.echPublicName != "" {
+			opts.DNSName = c.echPublicName
+		}
 		for _, cert := range certs[1:] {
 			opts.Intermediates.AddCert(cert)
 		}
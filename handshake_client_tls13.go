@@ -21,12 +21,24 @@ type clientHandshakeStateTLS13 struct {
 	ctx         context.Context
 	serverHello *serverHelloMsg
 	hello       *clientHelloMsg
-	ecdheParams ecdheParameters
+	// keyShareParams holds the parameters of every key share sent, and
+	// ecdheParams the one the server selected.
+	keyShareParams []ecdheParameters
+	ecdheParams    ecdheParameters
 
 	session     *ClientSessionState
 	earlySecret []byte
 	binderKey   []byte
 
+	// echContext is set if the client offered an Encrypted Client Hello,
+	// with hs.hello the ClientHelloInner until the server rejects it, and
+	// echRetryConfigs is what a server rejecting it sent to retry with.
+	echContext      *echClientContext
+	echRetryConfigs []byte
+
+	// earlyData is set if the client sent 0-RTT data.
+	earlyData *clientEarlyData
+
 	certReq       *certificateRequestMsgTLS13
 	usingPSK      bool
 	sentDummyCCS  bool
@@ -36,11 +48,15 @@ type clientHandshakeStateTLS13 struct {
 	trafficSecret []byte // client_application_traffic_secret_0
 }
 
-// handshake requires hs.c, hs.hello, hs.serverHello, hs.ecdheParams, and,
-// optionally, hs.session, hs.earlySecret and hs.binderKey to be set.
+// handshake requires hs.c, hs.hello, hs.serverHello, hs.keyShareParams, and,
+// optionally, hs.session, hs.earlySecret, hs.binderKey and hs.earlyData to
+// be set.
 func (hs *clientHandshakeStateTLS13) handshake() error {
 	c := hs.c
 
+	// The dummy ChangeCipherSpec was sent before the early data.
+	hs.sentDummyCCS = hs.earlyData != nil
+
 	// The server must not select TLS 1.3 in a renegotiation. See RFC 8446,
 	// sections 4.1.2 and 4.1.3.
 	if c.handshakes > 0 {
@@ -49,7 +65,7 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	}
 
 	// Consistency check on the presence of a keyShare and its parameters.
-	if hs.ecdheParams == nil || len(hs.hello.keyShares) != 1 {
+	if len(hs.keyShareParams) == 0 || len(hs.hello.keyShares) < len(hs.keyShareParams) {
 		return c.sendAlert(alertInternalError)
 	}
 
@@ -57,6 +73,10 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		return err
 	}
 
+	if hs.echContext != nil {
+		hs.checkECHAcceptance()
+	}
+
 	hs.transcript = hs.suite.hash.New()
 	hs.transcript.Write(hs.hello.marshal())
 
@@ -75,6 +95,10 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if err := hs.processServerHello(); err != nil {
 		return err
 	}
+	// The confirmation is authenticated by the Finished messages, like the
+	// rest of the server random, but is known early so that VerifyConnection
+	// sees it.
+	c.checkDisguiseConfirmation(hs.hello.random, hs.serverHello.random)
 	if err := hs.sendDummyChangeCipherSpec(); err != nil {
 		return err
 	}
@@ -90,6 +114,9 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 	if err := hs.readServerFinished(); err != nil {
 		return err
 	}
+	if err := hs.sendEndOfEarlyData(); err != nil {
+		return err
+	}
 	if err := hs.sendClientCertificate(); err != nil {
 		return err
 	}
@@ -100,6 +127,15 @@ func (hs *clientHandshakeStateTLS13) handshake() error {
 		return err
 	}
 
+	if c.echPublicName != "" {
+		return c.echRejectionError(hs.echRetryConfigs)
+	}
+	if err := hs.finishEarlyData(); err != nil {
+		return err
+	}
+	if err := c.initDisguise(); err != nil {
+		return err
+	}
 	atomic.StoreUint32(&c.handshakeStatus, 1)
 
 	return nil
@@ -214,11 +250,11 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 				break
 			}
 		}
-		if !curveOK {
+		if !curveOK || isGREASE(uint16(curveID)) {
 			c.sendAlert(alertIllegalParameter)
 			return errors.New("tls: server selected unsupported group")
 		}
-		if hs.ecdheParams.CurveID() == curveID {
+		if hs.keyShareFor(curveID) != nil {
 			c.sendAlert(alertIllegalParameter)
 			return errors.New("tls: server sent an unnecessary HelloRetryRequest key_share")
 		}
@@ -231,10 +267,13 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 			c.sendAlert(alertInternalError)
 			return err
 		}
-		hs.ecdheParams = params
+		hs.keyShareParams = []ecdheParameters{params}
 		hs.hello.keyShares = []keyShare{{group: curveID, data: params.PublicKey()}}
 	}
 
+	// Early data is rejected by a HelloRetryRequest, and not offered again.
+	// See RFC 8446, Section 4.2.10.
+	hs.hello.earlyData = false
 	hs.hello.raw = nil
 	if len(hs.hello.pskIdentities) > 0 {
 		pskSuite := cipherSuiteTLS13ByID(hs.session.cipherSuite)
@@ -261,7 +300,14 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 	}
 
 	hs.transcript.Write(hs.hello.marshal())
-	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
+	helloBytes := hs.hello.marshal()
+	if c.echAccepted {
+		if err := hs.echContext.sealOuter(hs.hello); err != nil {
+			return err
+		}
+		helloBytes = hs.echContext.outer.marshal()
+	}
+	if _, err := c.writeRecord(recordTypeHandshake, helloBytes); err != nil {
 		return err
 	}
 
@@ -281,6 +327,21 @@ func (hs *clientHandshakeStateTLS13) processHelloRetryRequest() error {
 		return err
 	}
 
+	if c.echAccepted {
+		return hs.checkECHConfirmation()
+	}
+
+	return nil
+}
+
+// keyShareFor returns the parameters of the key share sent for curveID, or
+// nil if none was sent.
+func (hs *clientHandshakeStateTLS13) keyShareFor(curveID CurveID) ecdheParameters {
+	for _, params := range hs.keyShareParams {
+		if params.CurveID() == curveID {
+			return params
+		}
+	}
 	return nil
 }
 
@@ -306,7 +367,7 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server did not send a key share")
 	}
-	if hs.serverHello.serverShare.group != hs.ecdheParams.CurveID() {
+	if hs.ecdheParams = hs.keyShareFor(hs.serverHello.serverShare.group); hs.ecdheParams == nil {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: server selected unsupported group")
 	}
@@ -334,6 +395,7 @@ func (hs *clientHandshakeStateTLS13) processServerHello() error {
 
 	hs.usingPSK = true
 	c.didResume = true
+	c.disguiseResumed = hs.session.disguise
 	c.peerCertificates = hs.session.serverCertificates
 	c.verifiedChains = hs.session.verifiedChains
 	c.ocspResponse = hs.session.ocspResponse
@@ -401,6 +463,25 @@ func (hs *clientHandshakeStateTLS13) readServerParameters() error {
 		return err
 	}
 	c.clientProtocol = encryptedExtensions.alpnProtocol
+	if c.echPublicName != "" {
+		hs.echRetryConfigs = encryptedExtensions.echRetryConfigs
+	}
+
+	if encryptedExtensions.earlyData {
+		if !hs.hello.earlyData {
+			c.sendAlert(alertUnsupportedExtension)
+			return errors.New("tls: server accepted early data that was not offered")
+		}
+		// The server must have resumed the session of the early data, and
+		// kept its cipher suite and application protocol.
+		session := hs.earlyData.session
+		if !hs.usingPSK || hs.serverHello.selectedIdentity != 0 ||
+			c.cipherSuite != session.cipherSuite || c.clientProtocol != session.alpn {
+			c.sendAlert(alertIllegalParameter)
+			return errors.New("tls: server accepted early data for a different session")
+		}
+		c.earlyDataAccepted = true
+	}
 
 	return nil
 }
@@ -547,14 +628,20 @@ func (hs *clientHandshakeStateTLS13) sendClientCertificate() error {
 		return nil
 	}
 
-	cert, err := c.getClientCertificate(&CertificateRequestInfo{
-		AcceptableCAs:    hs.certReq.certificateAuthorities,
-		SignatureSchemes: hs.certReq.supportedSignatureAlgorithms,
-		Version:          c.vers,
-		ctx:              hs.ctx,
-	})
-	if err != nil {
-		return err
+	// A client whose Encrypted Client Hello was rejected only knows the
+	// server by its public name, and does not authenticate to it.
+	cert := new(Certificate)
+	var err error
+	if c.echPublicName == "" {
+		cert, err = c.getClientCertificate(&CertificateRequestInfo{
+			AcceptableCAs:    hs.certReq.certificateAuthorities,
+			SignatureSchemes: hs.certReq.supportedSignatureAlgorithms,
+			Version:          c.vers,
+			ctx:              hs.ctx,
+		})
+		if err != nil {
+			return err
+		}
 	}
 
 	certMsg := new(certificateMsgTLS13)
@@ -671,8 +758,11 @@ func (c *Conn) handleNewSessionTicket(msg *newSessionTicketMsgTLS13) error {
 		nonce:              msg.nonce,
 		useBy:              c.config.time().Add(lifetime),
 		ageAdd:             msg.ageAdd,
+		maxEarlyData:       msg.maxEarlyData,
+		alpn:               c.clientProtocol,
 		ocspResponse:       c.ocspResponse,
 		scts:               c.scts,
+		disguise:           c.disguiseSession(),
 	}
 
 	cacheKey := clientSessionCacheKey(c.conn.RemoteAddr(), c.config)
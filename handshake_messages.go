@@ -92,6 +92,49 @@ type clientHelloMsg struct {
 	pskModes                         []uint8
 	pskIdentities                    []pskIdentity
 	pskBinders                       [][]byte
+	extendedMasterSecret             bool
+	certCompressionAlgorithms        []CertCompressionAlgorithm
+	recordSizeLimit                  uint16
+	delegatedCredentials             []SignatureScheme
+	applicationSettings              []string
+	encryptedClientHello             []byte
+
+	// extensionOrder, if set, is the order in which the extensions that
+	// are set go on the wire. It may contain GREASE values, which are sent
+	// as empty extensions. padding says whether to pad the message like
+	// BoringSSL does, and paddingLengths, which takes precedence, lists
+	// lengths to pad it to. paddingLen is computed by marshal, or parsed by
+	// unmarshal.
+	extensionOrder []uint16
+	padding        bool
+	paddingLengths []int
+	paddingLen     int
+}
+
+// defaultExtensionOrder is the order in which clientHelloMsg.marshal emits
+// the extensions that are set but not listed in extensionOrder.
+var defaultExtensionOrder = []uint16{
+	extensionServerName,
+	extensionStatusRequest,
+	extensionSupportedCurves,
+	extensionSupportedPoints,
+	extensionSessionTicket,
+	extensionSignatureAlgorithms,
+	extensionSignatureAlgorithmsCert,
+	extensionRenegotiationInfo,
+	extensionALPN,
+	extensionSCT,
+	extensionSupportedVersions,
+	extensionCookie,
+	extensionKeyShare,
+	extensionEarlyData,
+	extensionPSKModes,
+	extensionExtendedMasterSecret,
+	extensionCompressCertificate,
+	extensionRecordSizeLimit,
+	extensionDelegatedCredentials,
+	extensionApplicationSettings,
+	extensionEncryptedClientHello,
 }
 
 func (m *clientHelloMsg) marshal() []byte {
@@ -99,6 +142,23 @@ func (m *clientHelloMsg) marshal() []byte {
 		return m.raw
 	}
 
+	m.paddingLen = 0
+	m.raw = m.marshalMsg()
+	var n int
+	switch {
+	case len(m.paddingLengths) > 0:
+		n = clientHelloPaddingTo(len(m.raw), m.paddingLengths)
+	case m.padding:
+		n = clientHelloPaddingLen(len(m.raw))
+	}
+	if n > 0 {
+		m.paddingLen = n
+		m.raw = m.marshalMsg()
+	}
+	return m.raw
+}
+
+func (m *clientHelloMsg) marshalMsg() []byte {
 	var b cryptobyte.Builder
 	b.AddUint8(typeClientHello)
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
@@ -121,183 +181,302 @@ func (m *clientHelloMsg) marshal() []byte {
 		bWithoutExtensions := *b
 
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-			if len(m.serverName) > 0 {
-				// RFC 6066, Section 3
-				b.AddUint16(extensionServerName)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			// Extensions listed in extensionOrder come first, in that order,
+			// followed by any other extension that is set. GREASE extensions
+			// after the first carry a single zero byte, like BoringSSL's.
+			listed := make(map[uint16]bool, len(m.extensionOrder))
+			grease := 0
+			for _, ext := range m.extensionOrder {
+				switch {
+				case ext == extensionPadding || ext == extensionPreSharedKey:
+					continue
+				case isGREASE(ext):
+					b.AddUint16(ext)
 					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddUint8(0) // name_type = host_name
-						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-							b.AddBytes([]byte(m.serverName))
-						})
+						if grease > 0 {
+							b.AddUint8(0)
+						}
 					})
-				})
+					grease++
+				default:
+					m.marshalExtension(b, ext)
+					listed[ext] = true
+				}
 			}
-			if m.ocspStapling {
-				// RFC 4366, Section 3.6
-				b.AddUint16(extensionStatusRequest)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8(1)  // status_type = ocsp
-					b.AddUint16(0) // empty responder_id_list
-					b.AddUint16(0) // empty request_extensions
-				})
+			for _, ext := range defaultExtensionOrder {
+				if !listed[ext] {
+					m.marshalExtension(b, ext)
+				}
 			}
-			if len(m.supportedCurves) > 0 {
-				// RFC 4492, sections 5.1.1 and RFC 8446, Section 4.2.7
-				b.AddUint16(extensionSupportedCurves)
+			m.marshalExtension(b, extensionPadding)
+			// pre_shared_key must be the last extension.
+			m.marshalExtension(b, extensionPreSharedKey)
+
+			extensionsPresent = len(b.BytesOrPanic()) > 2
+		})
+
+		if !extensionsPresent {
+			*b = bWithoutExtensions
+		}
+	})
+
+	return b.BytesOrPanic()
+}
+
+// marshalExtension appends extension ext to b, if it is set in m.
+func (m *clientHelloMsg) marshalExtension(b *cryptobyte.Builder, ext uint16) {
+	switch ext {
+	case extensionServerName:
+		if len(m.serverName) > 0 {
+			// RFC 6066, Section 3
+			b.AddUint16(extensionServerName)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8(0) // name_type = host_name
 					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, curve := range m.supportedCurves {
-							b.AddUint16(uint16(curve))
-						}
+						b.AddBytes([]byte(m.serverName))
 					})
 				})
-			}
-			if len(m.supportedPoints) > 0 {
-				// RFC 4492, Section 5.1.2
-				b.AddUint16(extensionSupportedPoints)
+			})
+		}
+	case extensionStatusRequest:
+		if m.ocspStapling {
+			// RFC 4366, Section 3.6
+			b.AddUint16(extensionStatusRequest)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(1)  // status_type = ocsp
+				b.AddUint16(0) // empty responder_id_list
+				b.AddUint16(0) // empty request_extensions
+			})
+		}
+	case extensionSupportedCurves:
+		if len(m.supportedCurves) > 0 {
+			// RFC 4492, sections 5.1.1 and RFC 8446, Section 4.2.7
+			b.AddUint16(extensionSupportedCurves)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.supportedPoints)
-					})
+					for _, curve := range m.supportedCurves {
+						b.AddUint16(uint16(curve))
+					}
 				})
-			}
-			if m.ticketSupported {
-				// RFC 5077, Section 3.2
-				b.AddUint16(extensionSessionTicket)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddBytes(m.sessionTicket)
+			})
+		}
+	case extensionSupportedPoints:
+		if len(m.supportedPoints) > 0 {
+			// RFC 4492, Section 5.1.2
+			b.AddUint16(extensionSupportedPoints)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.supportedPoints)
 				})
-			}
-			if len(m.supportedSignatureAlgorithms) > 0 {
-				// RFC 5246, Section 7.4.1.4.1
-				b.AddUint16(extensionSignatureAlgorithms)
+			})
+		}
+	case extensionSessionTicket:
+		if m.ticketSupported {
+			// RFC 5077, Section 3.2
+			b.AddUint16(extensionSessionTicket)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.sessionTicket)
+			})
+		}
+	case extensionSignatureAlgorithms:
+		if len(m.supportedSignatureAlgorithms) > 0 {
+			// RFC 5246, Section 7.4.1.4.1
+			b.AddUint16(extensionSignatureAlgorithms)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, sigAlgo := range m.supportedSignatureAlgorithms {
-							b.AddUint16(uint16(sigAlgo))
-						}
-					})
+					for _, sigAlgo := range m.supportedSignatureAlgorithms {
+						b.AddUint16(uint16(sigAlgo))
+					}
 				})
-			}
-			if len(m.supportedSignatureAlgorithmsCert) > 0 {
-				// RFC 8446, Section 4.2.3
-				b.AddUint16(extensionSignatureAlgorithmsCert)
+			})
+		}
+	case extensionSignatureAlgorithmsCert:
+		if len(m.supportedSignatureAlgorithmsCert) > 0 {
+			// RFC 8446, Section 4.2.3
+			b.AddUint16(extensionSignatureAlgorithmsCert)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, sigAlgo := range m.supportedSignatureAlgorithmsCert {
-							b.AddUint16(uint16(sigAlgo))
-						}
-					})
+					for _, sigAlgo := range m.supportedSignatureAlgorithmsCert {
+						b.AddUint16(uint16(sigAlgo))
+					}
 				})
-			}
-			if m.secureRenegotiationSupported {
-				// RFC 5746, Section 3.2
-				b.AddUint16(extensionRenegotiationInfo)
+			})
+		}
+	case extensionRenegotiationInfo:
+		if m.secureRenegotiationSupported {
+			// RFC 5746, Section 3.2
+			b.AddUint16(extensionRenegotiationInfo)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.secureRenegotiation)
+				})
+			})
+		}
+	case extensionALPN:
+		if len(m.alpnProtocols) > 0 {
+			// RFC 7301, Section 3.1
+			b.AddUint16(extensionALPN)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.secureRenegotiation)
-					})
+					for _, proto := range m.alpnProtocols {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes([]byte(proto))
+						})
+					}
 				})
-			}
-			if len(m.alpnProtocols) > 0 {
-				// RFC 7301, Section 3.1
-				b.AddUint16(extensionALPN)
+			})
+		}
+	case extensionSCT:
+		if m.scts {
+			// RFC 6962, Section 3.3.1
+			b.AddUint16(extensionSCT)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionSupportedVersions:
+		if len(m.supportedVersions) > 0 {
+			// RFC 8446, Section 4.2.1
+			b.AddUint16(extensionSupportedVersions)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, vers := range m.supportedVersions {
+						b.AddUint16(vers)
+					}
+				})
+			})
+		}
+	case extensionCookie:
+		if len(m.cookie) > 0 {
+			// RFC 8446, Section 4.2.2
+			b.AddUint16(extensionCookie)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, proto := range m.alpnProtocols {
-							b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-								b.AddBytes([]byte(proto))
-							})
-						}
-					})
+					b.AddBytes(m.cookie)
 				})
-			}
-			if m.scts {
-				// RFC 6962, Section 3.3.1
-				b.AddUint16(extensionSCT)
-				b.AddUint16(0) // empty extension_data
-			}
-			if len(m.supportedVersions) > 0 {
-				// RFC 8446, Section 4.2.1
-				b.AddUint16(extensionSupportedVersions)
+			})
+		}
+	case extensionKeyShare:
+		if len(m.keyShares) > 0 {
+			// RFC 8446, Section 4.2.8
+			b.AddUint16(extensionKeyShare)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, vers := range m.supportedVersions {
-							b.AddUint16(vers)
-						}
-					})
+					for _, ks := range m.keyShares {
+						b.AddUint16(uint16(ks.group))
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes(ks.data)
+						})
+					}
 				})
-			}
-			if len(m.cookie) > 0 {
-				// RFC 8446, Section 4.2.2
-				b.AddUint16(extensionCookie)
+			})
+		}
+	case extensionEarlyData:
+		if m.earlyData {
+			// RFC 8446, Section 4.2.10
+			b.AddUint16(extensionEarlyData)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionPSKModes:
+		if len(m.pskModes) > 0 {
+			// RFC 8446, Section 4.2.9
+			b.AddUint16(extensionPSKModes)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.pskModes)
+				})
+			})
+		}
+	case extensionPreSharedKey:
+		if len(m.pskIdentities) > 0 {
+			// RFC 8446, Section 4.2.11
+			b.AddUint16(extensionPreSharedKey)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.cookie)
-					})
+					for _, psk := range m.pskIdentities {
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes(psk.label)
+						})
+						b.AddUint32(psk.obfuscatedTicketAge)
+					}
 				})
-			}
-			if len(m.keyShares) > 0 {
-				// RFC 8446, Section 4.2.8
-				b.AddUint16(extensionKeyShare)
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, ks := range m.keyShares {
-							b.AddUint16(uint16(ks.group))
-							b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-								b.AddBytes(ks.data)
-							})
-						}
-					})
+					for _, binder := range m.pskBinders {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes(binder)
+						})
+					}
 				})
-			}
-			if m.earlyData {
-				// RFC 8446, Section 4.2.10
-				b.AddUint16(extensionEarlyData)
-				b.AddUint16(0) // empty extension_data
-			}
-			if len(m.pskModes) > 0 {
-				// RFC 8446, Section 4.2.9
-				b.AddUint16(extensionPSKModes)
+			})
+		}
+	case extensionExtendedMasterSecret:
+		if m.extendedMasterSecret {
+			// RFC 7627, Section 5.1
+			b.AddUint16(extensionExtendedMasterSecret)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionCompressCertificate:
+		if len(m.certCompressionAlgorithms) > 0 {
+			// RFC 8879, Section 3
+			b.AddUint16(extensionCompressCertificate)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					for _, alg := range m.certCompressionAlgorithms {
+						b.AddUint16(uint16(alg))
+					}
+				})
+			})
+		}
+	case extensionRecordSizeLimit:
+		if m.recordSizeLimit > 0 {
+			// RFC 8449, Section 4
+			b.AddUint16(extensionRecordSizeLimit)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(m.recordSizeLimit)
+			})
+		}
+	case extensionDelegatedCredentials:
+		if len(m.delegatedCredentials) > 0 {
+			// RFC 9345, Section 4.1.1
+			b.AddUint16(extensionDelegatedCredentials)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.pskModes)
-					})
+					for _, sigAlgo := range m.delegatedCredentials {
+						b.AddUint16(uint16(sigAlgo))
+					}
 				})
-			}
-			if len(m.pskIdentities) > 0 { // pre_shared_key must be the last extension
-				// RFC 8446, Section 4.2.11
-				b.AddUint16(extensionPreSharedKey)
+			})
+		}
+	case extensionApplicationSettings:
+		if len(m.applicationSettings) > 0 {
+			// draft-vvv-tls-alps-01, Section 3
+			b.AddUint16(extensionApplicationSettings)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, psk := range m.pskIdentities {
-							b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-								b.AddBytes(psk.label)
-							})
-							b.AddUint32(psk.obfuscatedTicketAge)
-						}
-					})
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, binder := range m.pskBinders {
-							b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-								b.AddBytes(binder)
-							})
-						}
-					})
+					for _, proto := range m.applicationSettings {
+						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes([]byte(proto))
+						})
+					}
 				})
-			}
-
-			extensionsPresent = len(b.BytesOrPanic()) > 2
-		})
-
-		if !extensionsPresent {
-			*b = bWithoutExtensions
+			})
 		}
-	})
-
-	m.raw = b.BytesOrPanic()
-	return m.raw
+	case extensionEncryptedClientHello:
+		if len(m.encryptedClientHello) > 0 {
+			// draft-ietf-tls-esni-18, Section 5
+			b.AddUint16(extensionEncryptedClientHello)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.encryptedClientHello)
+			})
+		}
+	case extensionPadding:
+		if m.paddingLen > 0 {
+			// RFC 7685, Section 3
+			b.AddUint16(extensionPadding)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(make([]byte, m.paddingLen))
+			})
+		}
+	}
 }
 
 // marshalWithoutBinders returns the ClientHello through the
@@ -575,6 +754,18 @@ func (m *clientHelloMsg) unmarshal(data []byte) bool {
 				}
 				m.pskBinders = append(m.pskBinders, binder)
 			}
+		case extensionPadding:
+			// RFC 7685, Section 3. The server ignores the contents, which
+			// the client fills with zeroes.
+			m.paddingLen = len(extData)
+			extData.Skip(len(extData))
+		case extensionEncryptedClientHello:
+			// draft-ietf-tls-esni-18, Section 5. It is parsed by the ECH
+			// code, which needs it along with the raw message.
+			if !extData.ReadBytes(&m.encryptedClientHello, len(extData)) ||
+				len(m.encryptedClientHello) == 0 {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -610,6 +801,33 @@ type serverHelloMsg struct {
 	// HelloRetryRequest extensions
 	cookie        []byte
 	selectedGroup CurveID
+	// echConfirmation is the Encrypted Client Hello acceptance signal of a
+	// HelloRetryRequest. See draft-ietf-tls-esni-18, Section 7.2.1.
+	echConfirmation []byte
+
+	// serverNameAck is set by a server that acknowledges the client's
+	// server_name with an empty extension. extensionOrder, if set, is the
+	// order in which the extensions that are set go on the wire.
+	serverNameAck  bool
+	extensionOrder []uint16
+}
+
+// defaultServerHelloExtensionOrder is the order in which
+// serverHelloMsg.marshal emits the extensions that are set but not listed
+// in extensionOrder.
+var defaultServerHelloExtensionOrder = []uint16{
+	extensionServerName,
+	extensionStatusRequest,
+	extensionSessionTicket,
+	extensionRenegotiationInfo,
+	extensionALPN,
+	extensionSCT,
+	extensionSupportedVersions,
+	extensionKeyShare,
+	extensionPreSharedKey,
+	extensionCookie,
+	extensionSupportedPoints,
+	extensionEncryptedClientHello,
 }
 
 func (m *serverHelloMsg) marshal() []byte {
@@ -633,99 +851,139 @@ func (m *serverHelloMsg) marshal() []byte {
 		bWithoutExtensions := *b
 
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-			if m.ocspStapling {
-				b.AddUint16(extensionStatusRequest)
-				b.AddUint16(0) // empty extension_data
+			listed := make(map[uint16]bool, len(m.extensionOrder))
+			for _, ext := range m.extensionOrder {
+				if !listed[ext] {
+					m.marshalExtension(b, ext)
+					listed[ext] = true
+				}
 			}
-			if m.ticketSupported {
-				b.AddUint16(extensionSessionTicket)
-				b.AddUint16(0) // empty extension_data
+			for _, ext := range defaultServerHelloExtensionOrder {
+				if !listed[ext] {
+					m.marshalExtension(b, ext)
+				}
 			}
-			if m.secureRenegotiationSupported {
-				b.AddUint16(extensionRenegotiationInfo)
+
+			extensionsPresent = len(b.BytesOrPanic()) > 2
+		})
+
+		if !extensionsPresent {
+			*b = bWithoutExtensions
+		}
+	})
+
+	m.raw = b.BytesOrPanic()
+	return m.raw
+}
+
+// marshalExtension appends extension ext to b, if it is set in m.
+func (m *serverHelloMsg) marshalExtension(b *cryptobyte.Builder, ext uint16) {
+	switch ext {
+	case extensionServerName:
+		if m.serverNameAck {
+			// RFC 6066, Section 3
+			b.AddUint16(extensionServerName)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionStatusRequest:
+		if m.ocspStapling {
+			b.AddUint16(extensionStatusRequest)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionSessionTicket:
+		if m.ticketSupported {
+			b.AddUint16(extensionSessionTicket)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionRenegotiationInfo:
+		if m.secureRenegotiationSupported {
+			b.AddUint16(extensionRenegotiationInfo)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.secureRenegotiation)
+				})
+			})
+		}
+	case extensionALPN:
+		if len(m.alpnProtocol) > 0 {
+			b.AddUint16(extensionALPN)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.secureRenegotiation)
+						b.AddBytes([]byte(m.alpnProtocol))
 					})
 				})
-			}
-			if len(m.alpnProtocol) > 0 {
-				b.AddUint16(extensionALPN)
+			})
+		}
+	case extensionSCT:
+		if len(m.scts) > 0 {
+			b.AddUint16(extensionSCT)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-							b.AddBytes([]byte(m.alpnProtocol))
+					for _, sct := range m.scts {
+						b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+							b.AddBytes(sct)
 						})
-					})
-				})
-			}
-			if len(m.scts) > 0 {
-				b.AddUint16(extensionSCT)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						for _, sct := range m.scts {
-							b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-								b.AddBytes(sct)
-							})
-						}
-					})
-				})
-			}
-			if m.supportedVersion != 0 {
-				b.AddUint16(extensionSupportedVersions)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(m.supportedVersion)
-				})
-			}
-			if m.serverShare.group != 0 {
-				b.AddUint16(extensionKeyShare)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(uint16(m.serverShare.group))
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.serverShare.data)
-					})
-				})
-			}
-			if m.selectedIdentityPresent {
-				b.AddUint16(extensionPreSharedKey)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(m.selectedIdentity)
+					}
 				})
-			}
-
-			if len(m.cookie) > 0 {
-				b.AddUint16(extensionCookie)
+			})
+		}
+	case extensionSupportedVersions:
+		if m.supportedVersion != 0 {
+			b.AddUint16(extensionSupportedVersions)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(m.supportedVersion)
+			})
+		}
+	case extensionKeyShare:
+		if m.serverShare.group != 0 {
+			b.AddUint16(extensionKeyShare)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(uint16(m.serverShare.group))
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.cookie)
-					})
+					b.AddBytes(m.serverShare.data)
 				})
-			}
-			if m.selectedGroup != 0 {
-				b.AddUint16(extensionKeyShare)
+			})
+		}
+		if m.selectedGroup != 0 {
+			b.AddUint16(extensionKeyShare)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(uint16(m.selectedGroup))
+			})
+		}
+	case extensionPreSharedKey:
+		if m.selectedIdentityPresent {
+			b.AddUint16(extensionPreSharedKey)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16(m.selectedIdentity)
+			})
+		}
+	case extensionCookie:
+		if len(m.cookie) > 0 {
+			b.AddUint16(extensionCookie)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
 				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16(uint16(m.selectedGroup))
+					b.AddBytes(m.cookie)
 				})
-			}
-			if len(m.supportedPoints) > 0 {
-				b.AddUint16(extensionSupportedPoints)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddBytes(m.supportedPoints)
-					})
+			})
+		}
+	case extensionSupportedPoints:
+		if len(m.supportedPoints) > 0 {
+			b.AddUint16(extensionSupportedPoints)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddBytes(m.supportedPoints)
 				})
-			}
-
-			extensionsPresent = len(b.BytesOrPanic()) > 2
-		})
-
-		if !extensionsPresent {
-			*b = bWithoutExtensions
+			})
 		}
-	})
-
-	m.raw = b.BytesOrPanic()
-	return m.raw
+	case extensionEncryptedClientHello:
+		if len(m.echConfirmation) > 0 {
+			b.AddUint16(extensionEncryptedClientHello)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.echConfirmation)
+			})
+		}
+	}
 }
 
 func (m *serverHelloMsg) unmarshal(data []byte) bool {
@@ -825,6 +1083,10 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 				len(m.supportedPoints) == 0 {
 				return false
 			}
+		case extensionEncryptedClientHello:
+			if !extData.ReadBytes(&m.echConfirmation, echConfirmationLen) {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -841,6 +1103,25 @@ func (m *serverHelloMsg) unmarshal(data []byte) bool {
 type encryptedExtensionsMsg struct {
 	raw          []byte
 	alpnProtocol string
+	// echRetryConfigs is the ECHConfigList a server that rejected the
+	// Encrypted Client Hello sends for the client to retry with.
+	echRetryConfigs []byte
+	// earlyData is set by a server that accepted the client's 0-RTT data.
+	earlyData bool
+
+	// serverNameAck and extensionOrder are as in serverHelloMsg.
+	serverNameAck  bool
+	extensionOrder []uint16
+}
+
+// defaultEncryptedExtensionsOrder is the order in which
+// encryptedExtensionsMsg.marshal emits the extensions that are set but not
+// listed in extensionOrder.
+var defaultEncryptedExtensionsOrder = []uint16{
+	extensionServerName,
+	extensionALPN,
+	extensionEarlyData,
+	extensionEncryptedClientHello,
 }
 
 func (m *encryptedExtensionsMsg) marshal() []byte {
@@ -852,15 +1133,17 @@ func (m *encryptedExtensionsMsg) marshal() []byte {
 	b.AddUint8(typeEncryptedExtensions)
 	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-			if len(m.alpnProtocol) > 0 {
-				b.AddUint16(extensionALPN)
-				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
-						b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
-							b.AddBytes([]byte(m.alpnProtocol))
-						})
-					})
-				})
+			listed := make(map[uint16]bool, len(m.extensionOrder))
+			for _, ext := range m.extensionOrder {
+				if !listed[ext] {
+					m.marshalExtension(b, ext)
+					listed[ext] = true
+				}
+			}
+			for _, ext := range defaultEncryptedExtensionsOrder {
+				if !listed[ext] {
+					m.marshalExtension(b, ext)
+				}
 			}
 		})
 	})
@@ -869,6 +1152,40 @@ func (m *encryptedExtensionsMsg) marshal() []byte {
 	return m.raw
 }
 
+// marshalExtension appends extension ext to b, if it is set in m.
+func (m *encryptedExtensionsMsg) marshalExtension(b *cryptobyte.Builder, ext uint16) {
+	switch ext {
+	case extensionServerName:
+		if m.serverNameAck {
+			b.AddUint16(extensionServerName)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionALPN:
+		if len(m.alpnProtocol) > 0 {
+			b.AddUint16(extensionALPN)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+					b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+						b.AddBytes([]byte(m.alpnProtocol))
+					})
+				})
+			})
+		}
+	case extensionEarlyData:
+		if m.earlyData {
+			b.AddUint16(extensionEarlyData)
+			b.AddUint16(0) // empty extension_data
+		}
+	case extensionEncryptedClientHello:
+		if len(m.echRetryConfigs) > 0 {
+			b.AddUint16(extensionEncryptedClientHello)
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddBytes(m.echRetryConfigs)
+			})
+		}
+	}
+}
+
 func (m *encryptedExtensionsMsg) unmarshal(data []byte) bool {
 	*m = encryptedExtensionsMsg{raw: data}
 	s := cryptobyte.String(data)
@@ -899,6 +1216,13 @@ func (m *encryptedExtensionsMsg) unmarshal(data []byte) bool {
 				return false
 			}
 			m.alpnProtocol = string(proto)
+		case extensionEarlyData:
+			// RFC 8446, Section 4.2.10
+			m.earlyData = true
+		case extensionEncryptedClientHello:
+			if !extData.ReadBytes(&m.echRetryConfigs, len(extData)) {
+				return false
+			}
 		default:
 			// Ignore unknown extensions.
 			continue
@@ -1748,8 +2072,9 @@ func (m *certificateVerifyMsg) unmarshal(data []byte) bool {
 }
 
 type newSessionTicketMsg struct {
-	raw    []byte
-	ticket []byte
+	raw          []byte
+	lifetimeHint uint32
+	ticket       []byte
 }
 
 func (m *newSessionTicketMsg) marshal() (x []byte) {
@@ -1765,6 +2090,10 @@ func (m *newSessionTicketMsg) marshal() (x []byte) {
 	x[1] = uint8(length >> 16)
 	x[2] = uint8(length >> 8)
 	x[3] = uint8(length)
+	x[4] = uint8(m.lifetimeHint >> 24)
+	x[5] = uint8(m.lifetimeHint >> 16)
+	x[6] = uint8(m.lifetimeHint >> 8)
+	x[7] = uint8(m.lifetimeHint)
 	x[8] = uint8(ticketLen >> 8)
 	x[9] = uint8(ticketLen)
 	copy(x[10:], m.ticket)
@@ -1786,6 +2115,7 @@ func (m *newSessionTicketMsg) unmarshal(data []byte) bool {
 		return false
 	}
 
+	m.lifetimeHint = uint32(data[4])<<24 | uint32(data[5])<<16 | uint32(data[6])<<8 | uint32(data[7])
 	ticketLen := int(data[8])<<8 + int(data[9])
 	if len(data)-10 != ticketLen {
 		return false
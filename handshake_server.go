@@ -40,7 +40,12 @@ type serverHandshakeState struct {
 
 // serverHandshake performs a TLS handshake as a server.
 func (c *Conn) serverHandshake(ctx context.Context) error {
-	clientHello, err := c.readClientHello(ctx)
+	// Keep the raw first flight, so that a client without a valid Disguise
+	// token can be replayed to the decoy as if it had connected there.
+	c.recordingHello = true
+	clientHello, echContext, err := c.readClientHello(ctx)
+	c.recordingHello = false
+	c.helloBytes = nil
 	if err != nil {
 		return err
 	}
@@ -50,16 +55,23 @@ func (c *Conn) serverHandshake(ctx context.Context) error {
 			c:           c,
 			ctx:         ctx,
 			clientHello: clientHello,
+			echContext:  echContext,
 		}
-		return hs.handshake()
+		err = hs.handshake()
+	} else {
+		hs := serverHandshakeState{
+			c:           c,
+			ctx:         ctx,
+			clientHello: clientHello,
+		}
+		err = hs.handshake()
 	}
 
-	hs := serverHandshakeState{
-		c:           c,
-		ctx:         ctx,
-		clientHello: clientHello,
+	if err == nil && c.decoy != nil {
+		err = c.serveDecoyTLS()
+		atomic.StoreUint32(&c.handshakeStatus, 0)
 	}
-	return hs.handshake()
+	return err
 }
 
 func (hs *serverHandshakeState) handshake() error {
@@ -74,6 +86,7 @@ func (hs *serverHandshakeState) handshake() error {
 	if hs.checkForResumption() {
 		// The client has included a session ticket and so we do an abbreviated handshake.
 		c.didResume = true
+		c.disguiseResumed = hs.sessionState.disguise
 		if err := hs.doResumeHandshake(); err != nil {
 			return err
 		}
@@ -122,21 +135,31 @@ func (hs *serverHandshakeState) handshake() error {
 	}
 
 	c.ekm = ekmFromMasterSecret(c.vers, hs.suite, hs.masterSecret, hs.clientHello.random, hs.hello.random)
+	if err := c.initDisguise(); err != nil {
+		return err
+	}
 	atomic.StoreUint32(&c.handshakeStatus, 1)
 
 	return nil
 }
 
-// readClientHello reads a ClientHello message and selects the protocol version.
-func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
+// readClientHello reads a ClientHello message and selects the protocol
+// version. If the client offered an Encrypted Client Hello, it also returns
+// its context, and the ClientHelloInner if it could be decrypted.
+func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, *echServerContext, error) {
 	msg, err := c.readHandshake()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	clientHello, ok := msg.(*clientHelloMsg)
 	if !ok {
 		c.sendAlert(alertUnexpectedMessage)
-		return nil, unexpectedMessageError(clientHello, msg)
+		return nil, nil, unexpectedMessageError(clientHello, msg)
+	}
+
+	clientHello, echContext, err := c.processECHClientHello(clientHello)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	var configForClient *Config
@@ -145,13 +168,28 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 		chi := clientHelloInfo(ctx, c, clientHello)
 		if configForClient, err = c.config.GetConfigForClient(chi); err != nil {
 			c.sendAlert(alertInternalError)
-			return nil, err
+			return nil, nil, err
 		} else if configForClient != nil {
 			c.config = configForClient
 		}
 	}
 	c.ticketKeys = originalConfig.ticketKeys(configForClient)
 
+	// Disguise is activated only for clients that prove knowledge of one of
+	// the keys. The others are handed to the decoy, if there is one, before
+	// any Disguise state exists, so that they see an ordinary website.
+	if !c.authorizeDisguise(clientHello) && c.config.DisguiseDecoy != nil {
+		if c.config.DisguiseDecoyMode == DecoyForwardTCP {
+			c.disguiseLogger().Info("disguise decoy forward", "remote", c.conn.RemoteAddr(), "mode", "tcp")
+			return nil, nil, c.serveDecoyTCP(ctx)
+		}
+		c.disguiseLogger().Info("disguise decoy forward", "remote", c.conn.RemoteAddr(), "mode", "tls")
+		if c.decoy, err = c.config.DisguiseDecoy(ctx); err != nil {
+			c.sendAlert(alertInternalError)
+			return nil, nil, err
+		}
+	}
+
 	clientVersions := clientHello.supportedVersions
 	if len(clientHello.supportedVersions) == 0 {
 		clientVersions = supportedVersionsFromMax(clientHello.vers)
@@ -159,13 +197,13 @@ func (c *Conn) readClientHello(ctx context.Context) (*clientHelloMsg, error) {
 	c.vers, ok = c.config.mutualVersion(roleServer, clientVersions)
 	if !ok {
 		c.sendAlert(alertProtocolVersion)
-		return nil, fmt.Errorf("tls: client offered only unsupported versions: %x", clientVersions)
+		return nil, nil, fmt.Errorf("tls: client offered only unsupported versions: %x", clientVersions)
 	}
 	c.haveVers = true
 	c.in.version = c.vers
 	c.out.version = c.vers
 
-	return clientHello, nil
+	return clientHello, echContext, nil
 }
 
 func (hs *serverHandshakeState) processClientHello() error {
@@ -173,6 +211,9 @@ func (hs *serverHandshakeState) processClientHello() error {
 
 	hs.hello = new(serverHelloMsg)
 	hs.hello.vers = c.vers
+	if spec := c.config.ServerHelloSpec; spec != nil {
+		hs.hello.extensionOrder = spec.ServerHelloExtensions
+	}
 
 	foundCompression := false
 	// We only support null compression, so check that the client offered it.
@@ -205,6 +246,9 @@ func (hs *serverHandshakeState) processClientHello() error {
 		c.sendAlert(alertInternalError)
 		return err
 	}
+	if c.disguiseVersion != 0 {
+		confirmDisguise(c.disguiseKey, hs.clientHello.random, hs.hello.random)
+	}
 
 	if len(hs.clientHello.secureRenegotiation) != 0 {
 		c.sendAlert(alertHandshakeFailure)
@@ -496,6 +540,9 @@ func (hs *serverHandshakeState) doFullHandshake() error {
 
 	hs.hello.ticketSupported = hs.clientHello.ticketSupported && !c.config.SessionTicketsDisabled
 	hs.hello.cipherSuite = hs.suite.id
+	if spec := c.config.ServerHelloSpec; spec != nil {
+		hs.hello.serverNameAck = spec.AcknowledgeServerName && hs.clientHello.serverName != ""
+	}
 
 	hs.finishedHash = newFinishedHash(hs.c.vers, hs.suite)
 	if c.config.ClientAuth == NoClientCert {
@@ -746,6 +793,7 @@ func (hs *serverHandshakeState) sendSessionTicket() error {
 
 	c := hs.c
 	m := new(newSessionTicketMsg)
+	m.lifetimeHint = c.config.ServerHelloSpec.ticketLifetime(c.vers)
 
 	createdAt := uint64(c.config.time().Unix())
 	if hs.sessionState != nil {
@@ -764,6 +812,7 @@ func (hs *serverHandshakeState) sendSessionTicket() error {
 		createdAt:    createdAt,
 		masterSecret: hs.masterSecret,
 		certificates: certsFromClient,
+		disguise:     c.disguiseSession(),
 	}
 	var err error
 	m.ticket, err = c.encryptTicket(state.marshal())
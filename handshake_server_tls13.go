@@ -27,6 +27,7 @@ type serverHandshakeStateTLS13 struct {
 	c               *Conn
 	ctx             context.Context
 	clientHello     *clientHelloMsg
+	echContext      *echServerContext
 	hello           *serverHelloMsg
 	sentDummyCCS    bool
 	usingPSK        bool
@@ -40,6 +41,14 @@ type serverHandshakeStateTLS13 struct {
 	trafficSecret   []byte // client_application_traffic_secret_0
 	transcript      hash.Hash
 	clientFinished  []byte
+
+	// earlyData is set if the server accepted the client's 0-RTT data,
+	// of which it reads at most earlyDataLimit bytes.
+	earlyData      bool
+	earlyDataLimit uint32
+	// clientHandshakeSecret is client_handshake_traffic_secret, which
+	// protects the client's second flight after its early data.
+	clientHandshakeSecret []byte
 }
 
 func (hs *serverHandshakeStateTLS13) handshake() error {
@@ -74,10 +83,17 @@ func (hs *serverHandshakeStateTLS13) handshake() error {
 	if err := hs.readClientCertificate(); err != nil {
 		return err
 	}
-	if err := hs.readClientFinished(); err != nil {
+	if hs.earlyData {
+		// The client's second flight follows its early data, which Read
+		// returns first. See readEndOfEarlyData.
+		c.earlyHandshake = hs
+	} else if err := hs.readClientFinished(); err != nil {
 		return err
 	}
 
+	if err := c.initDisguise(); err != nil {
+		return err
+	}
 	atomic.StoreUint32(&c.handshakeStatus, 1)
 
 	return nil
@@ -92,6 +108,9 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 	// supported_versions instead. See RFC 8446, sections 4.1.3 and 4.2.1.
 	hs.hello.vers = VersionTLS12
 	hs.hello.supportedVersion = c.vers
+	if spec := c.config.ServerHelloSpec; spec != nil {
+		hs.hello.extensionOrder = spec.ServerHelloExtensions
+	}
 
 	if len(hs.clientHello.supportedVersions) == 0 {
 		c.sendAlert(alertIllegalParameter)
@@ -130,6 +149,14 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 		c.sendAlert(alertInternalError)
 		return err
 	}
+	if c.echAccepted {
+		// The end of the random is overwritten with the ECH confirmation,
+		// which is computed over a ServerHello where it is zero.
+		copy(hs.hello.random[32-echConfirmationLen:], make([]byte, echConfirmationLen))
+	}
+	if c.disguiseVersion != 0 {
+		confirmDisguise(c.disguiseKey, hs.clientHello.random, hs.hello.random)
+	}
 
 	if len(hs.clientHello.secureRenegotiation) != 0 {
 		c.sendAlert(alertHandshakeFailure)
@@ -137,14 +164,9 @@ func (hs *serverHandshakeStateTLS13) processClientHello() error {
 	}
 
 	if hs.clientHello.earlyData {
-		// See RFC 8446, Section 4.2.10 for the complicated behavior required
-		// here. The scenario is that a different server at our address offered
-		// to accept early data in the past, which we can't handle. For now, all
-		// 0-RTT enabled session tickets need to expire before a Go server can
-		// replace a server or join a pool. That's the same requirement that
-		// applies to mixing or replacing with any TLS 1.2 server.
-		c.sendAlert(alertUnsupportedExtension)
-		return errors.New("tls: client sent unexpected early data")
+		// Until checkForResumption accepts it, the early data is skipped
+		// as if it was rejected. See RFC 8446, Section 4.2.10.
+		c.skipEarlyData = c.config.earlyDataSkip()
 	}
 
 	hs.hello.sessionId = hs.clientHello.sessionId
@@ -267,9 +289,8 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 			continue
 		}
 
-		// We don't check the obfuscated ticket age because it's affected by
-		// clock skew and it's only a freshness signal useful for shrinking the
-		// window for replay attacks, which don't affect us as we don't do 0-RTT.
+		// The obfuscated ticket age is only checked by acceptEarlyData, as
+		// it's affected by clock skew and only matters for 0-RTT replays.
 
 		pskSuite := cipherSuiteTLS13ByID(sessionState.cipherSuite)
 		if pskSuite == nil || pskSuite.hash != hs.suite.hash {
@@ -289,7 +310,7 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 		}
 
 		psk := hs.suite.expandLabel(sessionState.resumptionSecret, "resumption",
-			nil, hs.suite.hash.Size())
+			sessionState.nonce, hs.suite.hash.Size())
 		hs.earlySecret = hs.suite.extract(psk, nil)
 		binderKey := hs.suite.deriveSecret(hs.earlySecret, resumptionBinderLabel, nil)
 		// Clone the transcript in case a HelloRetryRequest was recorded.
@@ -306,6 +327,7 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 		}
 
 		c.didResume = true
+		c.disguiseResumed = sessionState.disguise
 		if err := c.processCertsFromClient(sessionState.certificate); err != nil {
 			return err
 		}
@@ -313,6 +335,10 @@ func (hs *serverHandshakeStateTLS13) checkForResumption() error {
 		hs.hello.selectedIdentityPresent = true
 		hs.hello.selectedIdentity = uint16(i)
 		hs.usingPSK = true
+		// Early data is protected with the first PSK. See RFC 8446,
+		// Section 4.2.10.
+		hs.earlyData = i == 0 && hs.acceptEarlyData(sessionState, identity)
+		hs.earlyDataLimit = sessionState.maxEarlyData
 		return nil
 	}
 
@@ -384,7 +410,7 @@ func (hs *serverHandshakeStateTLS13) pickCertificate() error {
 // sendDummyChangeCipherSpec sends a ChangeCipherSpec record for compatibility
 // with middleboxes that didn't implement TLS correctly. See RFC 8446, Appendix D.4.
 func (hs *serverHandshakeStateTLS13) sendDummyChangeCipherSpec() error {
-	if hs.sentDummyCCS {
+	if hs.sentDummyCCS || !hs.c.config.ServerHelloSpec.sendsDummyCCS(hs.clientHello) {
 		return nil
 	}
 	hs.sentDummyCCS = true
@@ -412,6 +438,15 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		compressionMethod: hs.hello.compressionMethod,
 		supportedVersion:  hs.hello.supportedVersion,
 		selectedGroup:     selectedGroup,
+		extensionOrder:    hs.hello.extensionOrder,
+	}
+	if c.echAccepted {
+		helloRetryRequest.echConfirmation = make([]byte, echConfirmationLen)
+		transcript := cloneHash(hs.transcript, hs.suite.hash)
+		transcript.Write(helloRetryRequest.marshal())
+		helloRetryRequest.echConfirmation = echConfirmation(hs.suite, hs.clientHello.random,
+			echHRRAcceptConfirmationLabel, transcript)
+		helloRetryRequest.raw = nil
 	}
 
 	hs.transcript.Write(helloRetryRequest.marshal())
@@ -434,6 +469,12 @@ func (hs *serverHandshakeStateTLS13) doHelloRetryRequest(selectedGroup CurveID)
 		return unexpectedMessageError(clientHello, msg)
 	}
 
+	if c.echAccepted {
+		if clientHello, err = hs.echContext.openRetry(c, clientHello); err != nil {
+			return err
+		}
+	}
+
 	if len(clientHello.keyShares) != 1 || clientHello.keyShares[0].group != selectedGroup {
 		c.sendAlert(alertIllegalParameter)
 		return errors.New("tls: client sent invalid key share in second ClientHello")
@@ -515,6 +556,26 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	c := hs.c
 
 	hs.transcript.Write(hs.clientHello.marshal())
+	if hs.earlyData {
+		earlyTrafficSecret := hs.suite.deriveSecret(hs.earlySecret,
+			clientEarlyTrafficLabel, hs.transcript)
+		c.in.setTrafficSecret(hs.suite, earlyTrafficSecret)
+		if err := c.config.writeKeyLog(keyLogLabelClientEarly, hs.clientHello.random, earlyTrafficSecret); err != nil {
+			c.sendAlert(alertInternalError)
+			return err
+		}
+		c.earlyEKM = hs.suite.earlyExportKeyingMaterial(hs.earlySecret, hs.transcript)
+		c.skipEarlyData = 0
+		c.earlyDataLeft = hs.earlyDataLimit
+		c.earlyDataAccepted = true
+	}
+	if c.echAccepted {
+		transcript := cloneHash(hs.transcript, hs.suite.hash)
+		transcript.Write(hs.hello.marshal())
+		copy(hs.hello.random[32-echConfirmationLen:], echConfirmation(hs.suite, hs.clientHello.random,
+			echAcceptConfirmationLabel, transcript))
+		hs.hello.raw = nil
+	}
 	hs.transcript.Write(hs.hello.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, hs.hello.marshal()); err != nil {
 		return err
@@ -531,9 +592,12 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 	hs.handshakeSecret = hs.suite.extract(hs.sharedKey,
 		hs.suite.deriveSecret(earlySecret, "derived", nil))
 
-	clientSecret := hs.suite.deriveSecret(hs.handshakeSecret,
+	hs.clientHandshakeSecret = hs.suite.deriveSecret(hs.handshakeSecret,
 		clientHandshakeTrafficLabel, hs.transcript)
-	c.in.setTrafficSecret(hs.suite, clientSecret)
+	if !hs.earlyData {
+		c.in.setTrafficSecret(hs.suite, hs.clientHandshakeSecret)
+	}
+	clientSecret := hs.clientHandshakeSecret
 	serverSecret := hs.suite.deriveSecret(hs.handshakeSecret,
 		serverHandshakeTrafficLabel, hs.transcript)
 	c.out.setTrafficSecret(hs.suite, serverSecret)
@@ -557,7 +621,15 @@ func (hs *serverHandshakeStateTLS13) sendServerParameters() error {
 		return err
 	}
 	encryptedExtensions.alpnProtocol = selectedProto
+	encryptedExtensions.earlyData = hs.earlyData
 	c.clientProtocol = selectedProto
+	if spec := c.config.ServerHelloSpec; spec != nil {
+		encryptedExtensions.serverNameAck = spec.AcknowledgeServerName && hs.clientHello.serverName != ""
+		encryptedExtensions.extensionOrder = spec.EncryptedExtensions
+	}
+	if hs.echContext != nil && !c.echAccepted {
+		encryptedExtensions.echRetryConfigs = echRetryConfigList(c.config.EncryptedClientHelloKeys)
+	}
 
 	hs.transcript.Write(encryptedExtensions.marshal())
 	if _, err := c.writeRecord(recordTypeHandshake, encryptedExtensions.marshal()); err != nil {
@@ -677,6 +749,11 @@ func (hs *serverHandshakeStateTLS13) sendServerFinished() error {
 
 	c.ekm = hs.suite.exportKeyingMaterial(hs.masterSecret, hs.transcript)
 
+	// The client sends EndOfEarlyData before its Finished, which covers it.
+	if hs.earlyData {
+		hs.transcript.Write(new(endOfEarlyDataMsg).marshal())
+	}
+
 	// If we did not request client certificates, at this point we can
 	// precompute the client finished and roll the transcript forward to send
 	// session tickets in our first flight.
@@ -706,7 +783,7 @@ func (hs *serverHandshakeStateTLS13) shouldSendSessionTickets() bool {
 func (hs *serverHandshakeStateTLS13) sendSessionTickets() error {
 	c := hs.c
 
-	hs.clientFinished = hs.suite.finishedHash(c.in.trafficSecret, hs.transcript)
+	hs.clientFinished = hs.suite.finishedHash(hs.clientHandshakeSecret, hs.transcript)
 	finishedMsg := &finishedMsg{
 		verifyData: hs.clientFinished,
 	}
@@ -716,50 +793,75 @@ func (hs *serverHandshakeStateTLS13) sendSessionTickets() error {
 		return nil
 	}
 
-	resumptionSecret := hs.suite.deriveSecret(hs.masterSecret,
+	// The secret is kept for the tickets SendSessionTicket sends later.
+	c.resumptionSecret = hs.suite.deriveSecret(hs.masterSecret,
 		resumptionLabel, hs.transcript)
 
+	c.out.Lock()
+	defer c.out.Unlock()
+	for i := 0; i < c.config.ServerHelloSpec.sessionTickets(); i++ {
+		if err := c.sendSessionTicketLocked(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendSessionTicketLocked sends a TLS 1.3 NewSessionTicket carrying the
+// Disguise state of the connection at this point. c.out must be locked.
+func (c *Conn) sendSessionTicketLocked() error {
 	m := new(newSessionTicketMsgTLS13)
 
+	// ticket_nonce must be unique per connection. It is left empty when
+	// sending a single ticket, as this package always did.
+	spec := c.config.ServerHelloSpec
+	if c.ticketsSent > 0 || spec != nil {
+		m.nonce = make([]byte, 8)
+		binary.BigEndian.PutUint64(m.nonce, c.ticketsSent)
+	}
+	c.ticketsSent++
+
+	// ticket_age_add is a random 32-bit value. See RFC 8446, section 4.6.1
+	// It is stored in the ticket to check the age of 0-RTT tickets.
+	ageAdd := make([]byte, 4)
+	if _, err := c.config.rand().Read(ageAdd); err != nil {
+		return err
+	}
+	m.ageAdd = binary.LittleEndian.Uint32(ageAdd)
+	m.maxEarlyData = c.config.MaxEarlyData
+
 	var certsFromClient [][]byte
 	for _, cert := range c.peerCertificates {
 		certsFromClient = append(certsFromClient, cert.Raw)
 	}
 	state := sessionStateTLS13{
-		cipherSuite:      hs.suite.id,
+		cipherSuite:      c.cipherSuite,
 		createdAt:        uint64(c.config.time().Unix()),
-		resumptionSecret: resumptionSecret,
+		resumptionSecret: c.resumptionSecret,
 		certificate: Certificate{
 			Certificate:                 certsFromClient,
 			OCSPStaple:                  c.ocspResponse,
 			SignedCertificateTimestamps: c.scts,
 		},
+		nonce:        m.nonce,
+		disguise:     c.disguiseSession(),
+		ageAdd:       m.ageAdd,
+		maxEarlyData: m.maxEarlyData,
+		alpn:         c.clientProtocol,
+	}
+	if spec != nil {
+		state.padTo(spec.TicketSize)
 	}
 	var err error
 	m.label, err = c.encryptTicket(state.marshal())
 	if err != nil {
 		return err
 	}
-	m.lifetime = uint32(maxSessionTicketLifetime / time.Second)
+	m.lifetime = spec.ticketLifetime(c.vers)
 
-	// ticket_age_add is a random 32-bit value. See RFC 8446, section 4.6.1
-	// The value is not stored anywhere; we never need to check the ticket age
-	// because 0-RTT is not supported.
-	ageAdd := make([]byte, 4)
-	_, err = hs.c.config.rand().Read(ageAdd)
-	if err != nil {
-		return err
-	}
-	m.ageAdd = binary.LittleEndian.Uint32(ageAdd)
-
-	// ticket_nonce, which must be unique per connection, is always left at
-	// zero because we only ever send one ticket per connection.
-
-	if _, err := c.writeRecord(recordTypeHandshake, m.marshal()); err != nil {
-		return err
-	}
-
-	return nil
+	_, err = c.writeRecordLocked(recordTypeHandshake, m.marshal())
+	return err
 }
 
 func (hs *serverHandshakeStateTLS13) readClientCertificate() error {
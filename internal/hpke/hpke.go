@@ -0,0 +1,242 @@
+// Package hpke implements the base mode of Hybrid Public Key Encryption
+// (RFC 9180) with DHKEM(X25519, HKDF-SHA256), which is what Encrypted Client
+// Hello needs.
+package hpke
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Algorithm identifiers, from RFC 9180, Section 7.
+const (
+	DHKEM_X25519_HKDF_SHA256 uint16 = 0x0020
+
+	KDF_HKDF_SHA256 uint16 = 0x0001
+
+	AEAD_AES_128_GCM      uint16 = 0x0001
+	AEAD_AES_256_GCM      uint16 = 0x0002
+	AEAD_ChaCha20Poly1305 uint16 = 0x0003
+)
+
+// SupportedKEM, SupportedKDF and SupportedAEAD report whether an algorithm
+// is implemented.
+func SupportedKEM(id uint16) bool { return id == DHKEM_X25519_HKDF_SHA256 }
+
+func SupportedKDF(id uint16) bool { return id == KDF_HKDF_SHA256 }
+
+func SupportedAEAD(id uint16) bool { return aeadKeyLen(id) > 0 }
+
+func aeadKeyLen(id uint16) int {
+	switch id {
+	case AEAD_AES_128_GCM:
+		return 16
+	case AEAD_AES_256_GCM, AEAD_ChaCha20Poly1305:
+		return 32
+	}
+	return 0
+}
+
+func newAEAD(id uint16, key []byte) (cipher.AEAD, error) {
+	if id == AEAD_ChaCha20Poly1305 {
+		return chacha20poly1305.New(key)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// x25519KeyLen is Nsk, Npk and Nenc of DHKEM(X25519, HKDF-SHA256), and
+// secretLen its Nsecret.
+const (
+	x25519KeyLen = 32
+	secretLen    = 32
+)
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	labeledIKM = append(labeledIKM, "HPKE-v1"...)
+	labeledIKM = append(labeledIKM, suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := make([]byte, 2, 2+7+len(suiteID)+len(label)+len(info))
+	binary.BigEndian.PutUint16(labeledInfo, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out); err != nil {
+		panic("hpke: LabeledExpand invocation failed unexpectedly")
+	}
+	return out
+}
+
+var kemSuiteID = []byte{'K', 'E', 'M', 0x00, 0x20}
+
+// sharedSecret implements ExtractAndExpand of RFC 9180, Section 4.1.
+func sharedSecret(dh, enc, publicKey []byte) []byte {
+	kemContext := append(append([]byte{}, enc...), publicKey...)
+	eaePRK := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, eaePRK, "shared_secret", kemContext, secretLen)
+}
+
+// GenerateKey returns a new DHKEM(X25519, HKDF-SHA256) key pair.
+func GenerateKey(rand io.Reader) (privateKey, publicKey []byte, err error) {
+	privateKey = make([]byte, x25519KeyLen)
+	if _, err := io.ReadFull(rand, privateKey); err != nil {
+		return nil, nil, err
+	}
+	publicKey, err = curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return privateKey, publicKey, nil
+}
+
+// context is the encryption context of RFC 9180, Section 5.2, shared by
+// senders and recipients.
+type context struct {
+	aead      cipher.AEAD
+	baseNonce []byte
+	seq       uint64
+}
+
+func newContext(kemID, kdfID, aeadID uint16, shared, info []byte) (*context, error) {
+	if !SupportedKEM(kemID) || !SupportedKDF(kdfID) || !SupportedAEAD(aeadID) {
+		return nil, errors.New("hpke: unsupported algorithm")
+	}
+	suiteID := make([]byte, 0, 10)
+	suiteID = append(suiteID, "HPKE"...)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, kemID)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, kdfID)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, aeadID)
+
+	// Only the base mode is implemented, so the PSK and its ID are empty.
+	pskIDHash := labeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(suiteID, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{0x00}, pskIDHash...), infoHash...)
+	secret := labeledExtract(suiteID, shared, "secret", nil)
+
+	key := labeledExpand(suiteID, secret, "key", keyScheduleContext, aeadKeyLen(aeadID))
+	aead, err := newAEAD(aeadID, key)
+	if err != nil {
+		return nil, err
+	}
+	baseNonce := labeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, aead.NonceSize())
+	return &context{aead: aead, baseNonce: baseNonce}, nil
+}
+
+// Overhead returns the difference between the length of a ciphertext and
+// that of its plaintext.
+func (c *context) Overhead() int {
+	return c.aead.Overhead()
+}
+
+// nonce returns the nonce for the current sequence number, which the
+// caller advances once the message is processed.
+func (c *context) nonce() ([]byte, error) {
+	if c.seq == ^uint64(0) {
+		return nil, errors.New("hpke: message limit reached")
+	}
+	nonce := make([]byte, len(c.baseNonce))
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.seq)
+	for i := range nonce {
+		nonce[i] ^= c.baseNonce[i]
+	}
+	return nonce, nil
+}
+
+// Sender is the encryption context of the sender of messages.
+type Sender struct {
+	*context
+}
+
+// SetupSender generates an encapsulated key for the recipient's public key
+// and returns it together with the context to encrypt messages with.
+func SetupSender(kemID, kdfID, aeadID uint16, publicKey, info []byte, rand io.Reader) (enc []byte, s *Sender, err error) {
+	if !SupportedKEM(kemID) {
+		return nil, nil, errors.New("hpke: unsupported KEM")
+	}
+	ephemeral, enc, err := GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(ephemeral, publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := newContext(kemID, kdfID, aeadID, sharedSecret(dh, enc, publicKey), info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, &Sender{c}, nil
+}
+
+// Seal encrypts plaintext and authenticates it together with aad.
+func (s *Sender) Seal(aad, plaintext []byte) ([]byte, error) {
+	nonce, err := s.nonce()
+	if err != nil {
+		return nil, err
+	}
+	s.seq++
+	return s.aead.Seal(nil, nonce, plaintext, aad), nil
+}
+
+// Recipient is the decryption context of the recipient of messages.
+type Recipient struct {
+	*context
+}
+
+// SetupRecipient decapsulates enc with the recipient's private key and
+// returns the context to decrypt messages with.
+func SetupRecipient(kemID, kdfID, aeadID uint16, privateKey, info, enc []byte) (*Recipient, error) {
+	if !SupportedKEM(kemID) {
+		return nil, errors.New("hpke: unsupported KEM")
+	}
+	if len(enc) != x25519KeyLen {
+		return nil, errors.New("hpke: invalid encapsulated key")
+	}
+	dh, err := curve25519.X25519(privateKey, enc)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newContext(kemID, kdfID, aeadID, sharedSecret(dh, enc, publicKey), info)
+	if err != nil {
+		return nil, err
+	}
+	return &Recipient{c}, nil
+}
+
+// Open decrypts ciphertext and checks that it was sealed with aad. The
+// sequence number only advances on success.
+func (r *Recipient) Open(aad, ciphertext []byte) ([]byte, error) {
+	nonce, err := r.nonce()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := r.aead.Open(nil, nonce, ciphertext, aad)
+	if err != nil {
+		return nil, err
+	}
+	r.seq++
+	return plaintext, nil
+}
@@ -0,0 +1,59 @@
+package hpke
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// TestVector checks the first base mode vector of RFC 9180, Appendix A.1.1.
+func TestVector(t *testing.T) {
+	info := mustDecodeHex(t, "4f6465206f6e2061204772656369616e2055726e")
+	skE := mustDecodeHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736")
+	pkR := mustDecodeHex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	skR := mustDecodeHex(t, "4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	wantEnc := mustDecodeHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	aad := mustDecodeHex(t, "436f756e742d30")
+	plaintext := mustDecodeHex(t, "4265617574792069732074727574682c20747275746820626561757479")
+	wantCiphertext := mustDecodeHex(t, "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+
+	// The ephemeral key is read from rand.
+	enc, sender, err := SetupSender(DHKEM_X25519_HKDF_SHA256, KDF_HKDF_SHA256, AEAD_AES_128_GCM, pkR, info, bytes.NewReader(skE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc, wantEnc) {
+		t.Errorf("enc = %x, want %x", enc, wantEnc)
+	}
+	ciphertext, err := sender.Seal(aad, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ciphertext, wantCiphertext) {
+		t.Errorf("ciphertext = %x, want %x", ciphertext, wantCiphertext)
+	}
+
+	recipient, err := SetupRecipient(DHKEM_X25519_HKDF_SHA256, KDF_HKDF_SHA256, AEAD_AES_128_GCM, skR, info, enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recipient.Open(aad[:1], ciphertext); err == nil {
+		t.Error("Open succeeded with the wrong aad")
+	}
+	got, err := recipient.Open(aad, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("plaintext = %q, want %q", got, plaintext)
+	}
+}
@@ -22,10 +22,12 @@ import (
 
 const (
 	resumptionBinderLabel         = "res binder"
+	clientEarlyTrafficLabel       = "c e traffic"
 	clientHandshakeTrafficLabel   = "c hs traffic"
 	serverHandshakeTrafficLabel   = "s hs traffic"
 	clientApplicationTrafficLabel = "c ap traffic"
 	serverApplicationTrafficLabel = "s ap traffic"
+	earlyExporterLabel            = "e exp master"
 	exporterLabel                 = "exp master"
 	resumptionLabel               = "res master"
 	trafficUpdateLabel            = "traffic upd"
@@ -92,7 +94,16 @@ func (c *cipherSuiteTLS13) finishedHash(baseKey []byte, transcript hash.Hash) []
 // exportKeyingMaterial implements RFC5705 exporters for TLS 1.3 according to
 // RFC 8446, Section 7.5.
 func (c *cipherSuiteTLS13) exportKeyingMaterial(masterSecret []byte, transcript hash.Hash) func(string, []byte, int) ([]byte, error) {
-	expMasterSecret := c.deriveSecret(masterSecret, exporterLabel, transcript)
+	return c.exporter(c.deriveSecret(masterSecret, exporterLabel, transcript))
+}
+
+// earlyExportKeyingMaterial is the early exporter of RFC 8446, Section 7.5,
+// for a transcript holding the ClientHello.
+func (c *cipherSuiteTLS13) earlyExportKeyingMaterial(earlySecret []byte, transcript hash.Hash) func(string, []byte, int) ([]byte, error) {
+	return c.exporter(c.deriveSecret(earlySecret, earlyExporterLabel, transcript))
+}
+
+func (c *cipherSuiteTLS13) exporter(expMasterSecret []byte) func(string, []byte, int) ([]byte, error) {
 	return func(label string, context []byte, length int) ([]byte, error) {
 		secret := c.deriveSecret(expMasterSecret, label, nil)
 		h := c.hash.New()
@@ -14,6 +14,7 @@ import (
 	"errors"
 	"io"
 
+	"github.com/uDisguise/disguise/disguise"
 	"golang.org/x/crypto/cryptobyte"
 )
 
@@ -26,6 +27,9 @@ type sessionState struct {
 	masterSecret []byte // opaque master_secret<1..2^16-1>;
 	// struct { opaque certificate<1..2^24-1> } Certificate;
 	certificates [][]byte // Certificate certificate_list<0..2^24-1>;
+	// uint8 disguise_version; opaque disguise_state<0..2^16-1>;
+	// both only present if Disguise was active.
+	disguise disguiseSession
 
 	// usedOldKey is true if the ticket from which this session came from
 	// was encrypted with an older key and thus should be refreshed.
@@ -47,6 +51,9 @@ func (m *sessionState) marshal() []byte {
 			})
 		}
 	})
+	if m.disguise.version != 0 {
+		m.disguise.marshal(&b)
+	}
 	return b.BytesOrPanic()
 }
 
@@ -71,31 +78,78 @@ func (m *sessionState) unmarshal(data []byte) bool {
 		}
 		m.certificates = append(m.certificates, cert)
 	}
+	if !s.Empty() && !m.disguise.unmarshal(&s) {
+		return false
+	}
 	return s.Empty()
 }
 
 // sessionStateTLS13 is the content of a TLS 1.3 session ticket. Its first
 // version (revision = 0) doesn't carry any of the information needed for 0-RTT
-// validation and the nonce is always empty.
+// validation and the nonce is always empty. The second (revision = 1) adds
+// the ticket nonce, for servers that send several tickets per connection,
+// and padding, for servers that shape their ticket sizes. The third
+// (revision = 2) adds the Disguise state of the connection. The fourth
+// (revision = 3) adds what 0-RTT validation needs, and is only used for
+// tickets that allow early data.
 type sessionStateTLS13 struct {
 	// uint8 version  = 0x0304;
-	// uint8 revision = 0;
+	// uint8 revision = 0, 1, 2 or 3;
 	cipherSuite      uint16
 	createdAt        uint64
 	resumptionSecret []byte      // opaque resumption_master_secret<1..2^8-1>;
 	certificate      Certificate // CertificateEntry certificate_list<0..2^24-1>;
+	nonce            []byte      // opaque ticket_nonce<0..255>; revision 1 and later
+	padding          int         // opaque padding<0..2^16-1>; revision 1 and later
+	// uint8 disguise_version; opaque disguise_state<0..2^16-1>; revision 2
+	// and later, with a non-zero version in revision 2
+	disguise     disguiseSession
+	ageAdd       uint32 // uint32 ticket_age_add; revision 3 only
+	maxEarlyData uint32 // uint32 max_early_data_size; revision 3 only
+	alpn         string // opaque alpn<0..255>; revision 3 only
+}
+
+func (m *sessionStateTLS13) revision() uint8 {
+	switch {
+	case m.maxEarlyData > 0:
+		return 3
+	case m.disguise.version != 0:
+		return 2
+	case len(m.nonce) > 0 || m.padding > 0:
+		return 1
+	}
+	return 0
 }
 
 func (m *sessionStateTLS13) marshal() []byte {
+	revision := m.revision()
 	var b cryptobyte.Builder
 	b.AddUint16(VersionTLS13)
-	b.AddUint8(0) // revision
+	b.AddUint8(revision)
 	b.AddUint16(m.cipherSuite)
 	addUint64(&b, m.createdAt)
 	b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
 		b.AddBytes(m.resumptionSecret)
 	})
 	marshalCertificate(&b, m.certificate)
+	if revision >= 1 {
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(m.nonce)
+		})
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(make([]byte, m.padding))
+		})
+	}
+	if revision >= 2 {
+		m.disguise.marshal(&b)
+	}
+	if revision == 3 {
+		b.AddUint32(m.ageAdd)
+		b.AddUint32(m.maxEarlyData)
+		b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes([]byte(m.alpn))
+		})
+	}
 	return b.BytesOrPanic()
 }
 
@@ -104,16 +158,58 @@ func (m *sessionStateTLS13) unmarshal(data []byte) bool {
 	s := cryptobyte.String(data)
 	var version uint16
 	var revision uint8
-	return s.ReadUint16(&version) &&
-		version == VersionTLS13 &&
-		s.ReadUint8(&revision) &&
-		revision == 0 &&
-		s.ReadUint16(&m.cipherSuite) &&
-		readUint64(&s, &m.createdAt) &&
-		readUint8LengthPrefixed(&s, &m.resumptionSecret) &&
-		len(m.resumptionSecret) != 0 &&
-		unmarshalCertificate(&s, &m.certificate) &&
-		s.Empty()
+	if !s.ReadUint16(&version) ||
+		version != VersionTLS13 ||
+		!s.ReadUint8(&revision) ||
+		revision > 3 ||
+		!s.ReadUint16(&m.cipherSuite) ||
+		!readUint64(&s, &m.createdAt) ||
+		!readUint8LengthPrefixed(&s, &m.resumptionSecret) ||
+		len(m.resumptionSecret) == 0 ||
+		!unmarshalCertificate(&s, &m.certificate) {
+		return false
+	}
+	if revision >= 1 {
+		var padding cryptobyte.String
+		if !readUint8LengthPrefixed(&s, &m.nonce) ||
+			!s.ReadUint16LengthPrefixed(&padding) {
+			return false
+		}
+		m.padding = len(padding)
+	}
+	if revision >= 2 && (!m.disguise.unmarshal(&s) || revision == 2 && m.disguise.version == 0) {
+		return false
+	}
+	if revision == 3 {
+		var alpn []byte
+		if !s.ReadUint32(&m.ageAdd) ||
+			!s.ReadUint32(&m.maxEarlyData) ||
+			m.maxEarlyData == 0 ||
+			!readUint8LengthPrefixed(&s, &alpn) {
+			return false
+		}
+		m.alpn = string(alpn)
+	}
+	return s.Empty()
+}
+
+// padTo pads m so that the ticket encrypting it is at least size bytes long.
+func (m *sessionStateTLS13) padTo(size int) {
+	need := size - (ticketKeyNameLen + aes.BlockSize + sha256.Size) - len(m.marshal())
+	if need <= 0 {
+		return
+	}
+	if m.revision() == 0 {
+		// Switching to revision 1 adds the two length prefixes.
+		need -= 3
+	}
+	if need < 1 {
+		need = 1
+	}
+	if need > 0xffff {
+		need = 0xffff
+	}
+	m.padding += need
 }
 
 func (c *Conn) encryptTicket(state []byte) ([]byte, error) {
@@ -183,3 +279,62 @@ func (c *Conn) decryptTicket(encrypted []byte) (plaintext []byte, usedOldKey boo
 
 	return plaintext, keyIndex > 0
 }
+
+// disguiseSession is the Disguise state a session carries: the version the
+// connection negotiated, and the encoded disguise.State of its persona, so
+// that resuming the session continues it.
+type disguiseSession struct {
+	version uint8
+	state   []byte
+}
+
+func (d *disguiseSession) marshal(b *cryptobyte.Builder) {
+	b.AddUint8(d.version)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddBytes(d.state)
+	})
+}
+
+func (d *disguiseSession) unmarshal(s *cryptobyte.String) bool {
+	return s.ReadUint8(&d.version) && readUint16LengthPrefixed(s, &d.state)
+}
+
+// disguiseSession returns the Disguise state to store in a session: the
+// persona of the Manager, or before it exists, the one of the session the
+// connection resumed.
+func (c *Conn) disguiseSession() disguiseSession {
+	if c.disguiseVersion == 0 {
+		return disguiseSession{}
+	}
+	if c.disguiseManager == nil {
+		if c.disguiseResumed.version == c.disguiseVersion {
+			return c.disguiseResumed
+		}
+		return disguiseSession{version: c.disguiseVersion}
+	}
+	state, err := c.disguiseManager.State().MarshalBinary()
+	if err != nil {
+		return disguiseSession{version: c.disguiseVersion}
+	}
+	return disguiseSession{version: c.disguiseVersion, state: state}
+}
+
+// restoreDisguise continues the persona of the session the connection
+// resumed, if the same Disguise version was negotiated again.
+func (c *Conn) restoreDisguise() {
+	if c.didResume && c.disguiseResumed.version == c.disguiseVersion {
+		c.disguiseResumed.restore(c.disguiseManager)
+	}
+}
+
+// restore continues in m the persona saved in d, if it carries one.
+func (d *disguiseSession) restore(m *disguise.Manager) {
+	if len(d.state) == 0 {
+		return
+	}
+	var state disguise.State
+	if err := state.UnmarshalBinary(d.state); err != nil {
+		return
+	}
+	m.Restore(state)
+}
@@ -0,0 +1,167 @@
+//go:build go1.25
+
+package tls
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+	"testing/synctest"
+
+	"github.com/uDisguise/disguise/disguise"
+	"github.com/uDisguise/disguise/disguise/profile"
+	"github.com/uDisguise/disguise/disguise/simnet"
+)
+
+func TestSessionStateTLS13Revisions(t *testing.T) {
+	base := func() sessionStateTLS13 {
+		return sessionStateTLS13{
+			cipherSuite:      TLS_AES_128_GCM_SHA256,
+			createdAt:        1700000000,
+			resumptionSecret: bytes.Repeat([]byte{1}, 32),
+		}
+	}
+	disguised := disguiseSession{version: disguise.Version, state: []byte("state")}
+	for _, tt := range []struct {
+		name     string
+		revision uint8
+		update   func(*sessionStateTLS13)
+	}{
+		{"Plain", 0, func(*sessionStateTLS13) {}},
+		{"Nonce", 1, func(s *sessionStateTLS13) { s.nonce = []byte{0, 1} }},
+		{"Padding", 1, func(s *sessionStateTLS13) { s.padding = 100 }},
+		{"Disguise", 2, func(s *sessionStateTLS13) { s.disguise = disguised }},
+		{"DisguiseVersionOnly", 2, func(s *sessionStateTLS13) { s.disguise = disguiseSession{version: disguise.Version} }},
+		{"EarlyData", 3, func(s *sessionStateTLS13) { s.maxEarlyData = 1 << 14; s.ageAdd = 7; s.alpn = "h2" }},
+		{"EarlyDataDisguise", 3, func(s *sessionStateTLS13) { s.maxEarlyData = 1 << 14; s.disguise = disguised }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := base()
+			tt.update(&s)
+			b := s.marshal()
+			if b[2] != tt.revision {
+				t.Errorf("revision %d, want %d", b[2], tt.revision)
+			}
+			var got sessionStateTLS13
+			if !got.unmarshal(b) {
+				t.Fatal("unmarshal failed")
+			}
+			if !bytes.Equal(got.marshal(), b) {
+				t.Errorf("unmarshal = %+v, want %+v", got, s)
+			}
+			if got.disguise.version != s.disguise.version || !bytes.Equal(got.disguise.state, s.disguise.state) {
+				t.Errorf("Disguise state %+v, want %+v", got.disguise, s.disguise)
+			}
+			for n := range len(b) {
+				if new(sessionStateTLS13).unmarshal(b[:n]) {
+					t.Fatalf("unmarshal accepted %d of %d bytes", n, len(b))
+				}
+			}
+		})
+	}
+
+	// Revision 2 exists to carry Disguise state, so it cannot go without.
+	s := base()
+	s.disguise = disguiseSession{version: disguise.Version}
+	b := s.marshal()
+	b[len(b)-3] = 0
+	if new(sessionStateTLS13).unmarshal(b) {
+		t.Error("unmarshal accepted a revision 2 state without a Disguise version")
+	}
+}
+
+func TestSessionStateDisguise(t *testing.T) {
+	for _, d := range []disguiseSession{{}, {version: disguise.Version, state: []byte("state")}} {
+		s := sessionState{
+			vers:         VersionTLS12,
+			cipherSuite:  TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			createdAt:    1700000000,
+			masterSecret: bytes.Repeat([]byte{1}, 48),
+			disguise:     d,
+		}
+		var got sessionState
+		if !got.unmarshal(s.marshal()) {
+			t.Fatalf("unmarshal of %+v failed", d)
+		}
+		if got.disguise.version != d.version || !bytes.Equal(got.disguise.state, d.state) {
+			t.Errorf("Disguise state %+v, want %+v", got.disguise, d)
+		}
+	}
+}
+
+// TestDisguiseSessionTicket checks that a ticket sent once a connection has
+// learned a persona carries it, on both sides, to the connection resuming
+// the session.
+func TestDisguiseSessionTicket(t *testing.T) {
+	state := func(typ profile.TrafficType, load float64) disguise.State {
+		counts := disguise.NewHMMClassifier().Counts()
+		counts.Emission[typ][1] += 10
+		return disguise.State{
+			Profile: profile.Dynamic,
+			Weights: map[profile.TrafficType]float64{
+				profile.WebBrowsing:    0,
+				profile.VideoStreaming: 0,
+				profile.FileDownload:   0,
+				typ:                    1,
+			},
+			Load:       load,
+			Classifier: counts,
+		}
+	}
+	clientState, serverState := state(profile.VideoStreaming, 0.25), state(profile.FileDownload, 0.5)
+
+	cache := new(sessionListCache)
+	clientConfig := &Config{ServerName: "example.com", InsecureSkipVerify: true, ClientSessionCache: cache}
+	serverConfig := &Config{Certificates: []Certificate{testCertificate(t)}}
+
+	// connect runs f on a connected client and server.
+	connect := func(f func(t *testing.T, client, server *Conn)) {
+		synctest.Test(t, func(t *testing.T) {
+			a, b := simnet.Pipe(simnet.Link{}, simnet.Link{})
+			client, server := Client(a, clientConfig), Server(b, serverConfig)
+			handshake := make(chan error, 1)
+			go func() { handshake <- server.Handshake() }()
+			if err := client.Handshake(); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-handshake; err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			defer client.Close()
+			f(t, client, server)
+		})
+	}
+
+	connect(func(t *testing.T, client, server *Conn) {
+		client.disguiseManager.Restore(clientState)
+		server.disguiseManager.Restore(serverState)
+		if err := client.SendSessionTicket(); err == nil {
+			t.Error("SendSessionTicket succeeded on a client")
+		}
+		if err := server.SendSessionTicket(); err != nil {
+			t.Fatal(err)
+		}
+		go server.Write([]byte{0})
+		// Reading past the ticket stores it.
+		if _, err := io.ReadFull(client, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(cache.sessions); n != 2 {
+			t.Fatalf("client stored %d sessions, want 2", n)
+		}
+	})
+
+	connect(func(t *testing.T, client, server *Conn) {
+		if !client.ConnectionState().DidResume {
+			t.Fatal("session not resumed")
+		}
+		if got := client.disguiseManager.State(); !reflect.DeepEqual(got, clientState) {
+			t.Errorf("client resumed %+v, want %+v", got, clientState)
+		}
+		if got := server.disguiseManager.State(); !reflect.DeepEqual(got, serverState) {
+			t.Errorf("server resumed %+v, want %+v", got, serverState)
+		}
+	})
+}